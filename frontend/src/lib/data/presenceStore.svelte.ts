@@ -6,6 +6,8 @@ type PresenceEntry = {
   row: number;
   col: string;
   isLocked: boolean;
+  // Connection dropped; the hub holds their locks while they reconnect
+  isAway: boolean;
 };
 
 type PendingCellEntry = {
@@ -89,6 +89,8 @@ export interface ChangeLogTable {
     action: ColumnType<'update' | 'insert', 'update' | 'insert' | undefined, never>;
     modified_at: ColumnType<Date, string | undefined, never>;
     modified_by: string;
+    // Realtime hub instance that wrote the row; NULL for everything else
+    origin: ColumnType<string | null, never, never>;
 }
 
 export interface NetworkDetailsTable {
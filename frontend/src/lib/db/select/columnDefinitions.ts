@@ -29,7 +29,7 @@ export const WARRANTY_COLUMNS = [
 
 // Change history columns — DATE_FORMAT so MySQL returns string, not JS Date
 export const HISTORY_COLUMNS = [
-  sql<string>`DATE_FORMAT(ai.modified, '%Y-%m-%d %H:%i:%s')`.as('modified'),
+  sql<string>`DATE_FORMAT(ai.modified, '%Y-%m-%d %H:%i:%s.%f')`.as('modified'),
   'ai.modified_by',
   sql<string>`DATE_FORMAT(ai.created, '%Y-%m-%d %H:%i:%s')`.as('created'),
   'ai.created_by',
@@ -15,7 +15,7 @@ export async function getDefaultAssets() {
             'ai.comment',
             sql<string>`DATE_FORMAT(ai.under_warranty_until, '%Y-%m-%d')`.as('under_warranty_until'),
             'ai.warranty_details',
-            sql<string>`DATE_FORMAT(ai.modified, '%Y-%m-%d %H:%i:%s')`.as('modified'),
+            sql<string>`DATE_FORMAT(ai.modified, '%Y-%m-%d %H:%i:%s.%f')`.as('modified'),
             'ai.modified_by',
             sql<string>`DATE_FORMAT(ai.created, '%Y-%m-%d %H:%i:%s')`.as('created'),
             'ai.created_by'
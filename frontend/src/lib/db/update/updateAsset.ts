@@ -33,7 +33,7 @@ const galaxyExtensionMap: Record<string, { table: string; idColumn: string }> =
 
 export async function updateAsset(id: number, key: string, value: any, username: string, trx?: Transaction<Database>) {
     const qb = trx ?? db;
-    // asset_inventory.modified has DEFAULT current_timestamp() ON UPDATE current_timestamp(),
+    // asset_inventory.modified has DEFAULT current_timestamp(6) ON UPDATE current_timestamp(6),
     // so the DB sets it automatically on every UPDATE. No explicit value needed.
 
     switch (key) {
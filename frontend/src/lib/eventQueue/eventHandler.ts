@@ -4,7 +4,7 @@
 import { toastState } from '$lib/toast/toastState.svelte';
 import { assetStore } from '$lib/data/assetStore.svelte';
 import { queryStore } from '$lib/data/queryStore.svelte';
-import { realtime } from '$lib/utils/realtimeManager.svelte';
+import { realtime, type RealtimeRequestError } from '$lib/utils/realtimeManager.svelte';
 import { presenceStore } from '$lib/data/presenceStore.svelte';
 import { urlStore } from '$lib/data/urlStore.svelte';
 import { sortStore, columnWidthStore } from '$lib/data/uiStore.svelte';
@@ -118,6 +118,10 @@ export async function processEvent(
       handleWsExistingUsers(event.payload);
       break;
 
+    case 'WS_VIEWPORT_STATE':
+      handleWsViewportState(event.payload);
+      break;
+
     case 'WS_USER_POSITION_UPDATE':
       handleWsUserPositionUpdate(event.payload);
       break;
@@ -126,6 +130,11 @@ export async function processEvent(
       handleWsUserLeft(event.payload);
       break;
 
+    case 'WS_USER_AWAY':
+    case 'WS_USER_RETURNED':
+      handleWsUserAway(event.payload, event.type === 'WS_USER_AWAY');
+      break;
+
     case 'WS_CELL_LOCKED':
       handleWsCellLocked(event.payload);
       break;
@@ -134,6 +143,16 @@ export async function processEvent(
       handleWsCellUnlocked(event.payload);
       break;
 
+    case 'WS_CELL_LOCK_EXPIRED':
+      handleWsCellLockExpired();
+      break;
+
+    case 'WS_CELL_LOCK_REVOKED':
+    case 'WS_ROW_LOCK_REVOKED':
+    case 'WS_PENDING_REVOKED':
+      handleWsLockRevoked(event.type, event.payload);
+      break;
+
     case 'WS_PENDING_BROADCAST':
       handleWsPendingBroadcast(event.payload);
       break;
@@ -146,10 +165,35 @@ export async function processEvent(
       handleWsCommitBroadcast(event.payload);
       break;
 
+    case 'WS_COMMIT_CONFLICT':
+      handleWsCommitConflict(event.payload);
+      break;
+
+    case 'WS_ROWS_CHANGED':
+      handleWsRowsChanged(event.payload);
+      break;
+
     case 'WS_CLIENT_STATE_RECONCILED':
       handleWsClientStateReconciled(event.payload);
       break;
 
+    case 'WS_ERROR':
+      handleWsError(event.payload);
+      break;
+
+    case 'WS_SERVER_SHUTDOWN':
+      toastState.addToast('Server is restarting. Reconnecting shortly…', 'info');
+      break;
+
+    case 'WS_SESSION_EXPIRED':
+      toastState.addToast('Your session has ended. Please log in again.', 'error');
+      setTimeout(() => window.location.assign('/login'), 2000);
+      break;
+
+    case 'WS_RESYNC_REQUIRED':
+      await handleWsResyncRequired(event.payload);
+      break;
+
     // ─── Outbound WS events ───────────────────────────────────────────────
     case 'POSITION_UPDATE':
       handlePositionUpdate(event.payload);
@@ -275,21 +319,44 @@ async function handleCommitUpdate(
   }
   if (!changes || changes.length === 0) return;
 
-  const apiChanges = changes.map((c: any) => ({
-    rowId: c.row,
-    columnId: c.col,
-    newValue: c.value,
-    oldValue: c.original,
-  }));
-
-  const res = await apiPost('/api/update', apiChanges);
-  if (!res.success) {
-    if (res.status === 409) {
-      toastState.addToast(res.data?.error || 'Duplicate value - this value already exists.', 'warning');
-    } else {
-      toastState.addToast(res.data?.error || 'Failed to commit changes.', 'error');
+  // Over the socket the hub writes the changes itself and broadcasts only
+  // what the database accepted. Without a socket, save through the API.
+  if (realtime.isConnected()) {
+    try {
+      await realtime.request('COMMIT', {
+        changes: changes.map((c: any) => ({
+          assetId: c.row,
+          key: c.col,
+          value: c.value == null ? null : String(c.value),
+          // Required: lets the hub refuse the write if someone changed the row meanwhile
+          baseModified: assetStore.baseAssets.find((a: any) => a.id === c.row)?.modified ?? undefined,
+        })),
+      });
+    } catch (err) {
+      const e = err as RealtimeRequestError;
+      // WS_COMMIT_CONFLICT already told the user what changed
+      if (e.code === 'COMMIT_CONFLICT') return;
+      const level = e.code === 'DUPLICATE' || e.code === 'INVALID_VALUE' ? 'warning' : 'error';
+      toastState.addToast(e.message || 'Failed to commit changes.', level);
+      return;
+    }
+  } else {
+    const apiChanges = changes.map((c: any) => ({
+      rowId: c.row,
+      columnId: c.col,
+      newValue: c.value,
+      oldValue: c.original,
+    }));
+
+    const res = await apiPost('/api/update', apiChanges);
+    if (!res.success) {
+      if (res.status === 409) {
+        toastState.addToast(res.data?.error || 'Duplicate value - this value already exists.', 'warning');
+      } else {
+        toastState.addToast(res.data?.error || 'Failed to commit changes.', 'error');
+      }
+      return;
     }
-    return;
   }
 
   // Apply committed values to the live assets
@@ -316,7 +383,6 @@ async function handleCommitUpdate(
   }
 
   pendingStore.edits = [];
-  realtime.sendCommitBroadcast(changes.map((c: any) => ({ assetId: c.row, key: c.col, value: c.value })));
   toastState.addToast('Changes saved successfully.', 'success');
 }
 
@@ -523,6 +589,7 @@ function handleWsExistingUsers(
       row: lock ? Number(lock.assetId) : user.assetId ?? user.row ?? -1,
       col: lock ? lock.key : keys[user.col] ?? '',
       isLocked: !!lock,
+      isAway: !!user.away,
     });
   }
   presenceStore.users = entries;
@@ -556,6 +623,55 @@ function handleWsExistingUsers(
   }
 }
 
+// Assets that scrolled into view: their locks and pending cells replace
+// what we had, since the hub did not tell us about them while hidden
+function handleWsViewportState(
+  payload: Record<string, any>,
+): void {
+  const shown = new Set((payload.assetIds || []).map(Number));
+  const lockedCells = payload.lockedCells || {};
+  const keys = Object.keys(assetStore.displayedAssets[0] ?? {});
+
+  const locksByUser = new Map<string, { assetId: number; key: string }>();
+  for (const [lockKey, lock] of Object.entries(lockedCells) as [string, any][]) {
+    const [assetId, key] = lockKey.split(':');
+    locksByUser.set(String(lock.userId), { assetId: Number(assetId), key });
+  }
+
+  for (const [, user] of Object.entries(payload.users || {}) as [string, any][]) {
+    const existing = presenceStore.users.find((u: any) => u.id === Number(user.userId));
+    if (!existing) continue;
+    const lock = locksByUser.get(String(user.userId));
+    if (lock) {
+      existing.row = lock.assetId;
+      existing.col = lock.key;
+      existing.isLocked = true;
+    } else {
+      existing.row = user.assetId ?? user.row ?? -1;
+      existing.col = keys[user.col] ?? '';
+      if (shown.has(Number(existing.row))) existing.isLocked = false;
+    }
+  }
+  for (const user of presenceStore.users) {
+    if (user.isLocked && shown.has(Number(user.row)) && !locksByUser.has(String(user.id))) {
+      user.isLocked = false;
+    }
+  }
+
+  const pending = presenceStore.pendingCells.filter((p) => !shown.has(p.assetId));
+  for (const [, cellInfo] of Object.entries(payload.pendingCells || {}) as [string, any][]) {
+    pending.push({
+      userId: Number(cellInfo.userId),
+      assetId: Number(cellInfo.assetId),
+      key: cellInfo.key,
+      firstname: cellInfo.firstname || '',
+      lastname: cellInfo.lastname || '',
+      color: cellInfo.color || '#6b7280',
+    });
+  }
+  presenceStore.pendingCells = pending;
+}
+
 function handleWsUserPositionUpdate(
   payload: Record<string, any>,
 ): void {
@@ -569,6 +685,7 @@ function handleWsUserPositionUpdate(
     existing.row = assetId;
     existing.col = colKey;
     existing.isLocked = false;
+    existing.isAway = false;
     existing.firstname = payload.firstname || existing.firstname;
     existing.lastname = payload.lastname || existing.lastname;
     existing.color = payload.color || existing.color;
@@ -581,6 +698,7 @@ function handleWsUserPositionUpdate(
       row: assetId,
       col: colKey,
       isLocked: false,
+      isAway: false,
     });
   }
 }
@@ -592,6 +710,15 @@ function handleWsUserLeft(
   presenceStore.users = presenceStore.users.filter((u: any) => u.id !== userId);
 }
 
+function handleWsUserAway(
+  payload: Record<string, any>,
+  away: boolean,
+): void {
+  const userId = Number(payload.clientId);
+  const user = presenceStore.users.find((u: any) => u.id === userId);
+  if (user) user.isAway = away;
+}
+
 function handleWsCellLocked(
   payload: Record<string, any>,
 ): void {
@@ -619,6 +746,19 @@ function handleWsCellUnlocked(
   if (user) user.isLocked = false;
 }
 
+function handleWsCellLockExpired(): void {
+  toastState.addToast('Your edit lock expired. Other users can now edit this cell.', 'warning');
+}
+
+function handleWsLockRevoked(type: string, payload: Record<string, any>): void {
+  const by = payload.by ? `${payload.by.firstname} ${payload.by.lastname}` : 'An admin';
+  const what =
+    type === 'WS_CELL_LOCK_REVOKED' ? 'your edit lock'
+    : type === 'WS_ROW_LOCK_REVOKED' ? 'your row lock'
+    : 'your pending edits';
+  toastState.addToast(`${by} released ${what}.`, 'warning');
+}
+
 function handleWsPendingBroadcast(
   payload: Record<string, any>,
 ): void {
@@ -669,8 +809,8 @@ function handleWsCommitBroadcast(
   const changes = payload.changes || [];
 
   const user = presenceStore.users.find(u => u.id === userId);
-  const displayName = user ? `${user.lastname}, ${user.firstname}` : '';
-  const now = new Date().toLocaleString('ja-JP', { year: 'numeric', month: '2-digit', day: '2-digit', hour: '2-digit', minute: '2-digit', second: '2-digit' }).replace(/\//g, '-');
+  const displayName = payload.modifiedBy || (user ? `${user.lastname}, ${user.firstname}` : '');
+  const now = payload.modified || new Date().toLocaleString('ja-JP', { year: 'numeric', month: '2-digit', day: '2-digit', hour: '2-digit', minute: '2-digit', second: '2-digit' }).replace(/\//g, '-');
 
   // Apply each committed change to local assetStore + auditStore
   for (const change of changes) {
@@ -704,6 +844,71 @@ function handleWsCommitBroadcast(
   );
 }
 
+// A commit was refused because its rows changed after we loaded them. Show
+// the current values; the user's edits stay pending so they can re-commit
+// on top of the new data.
+function handleWsCommitConflict(payload: Record<string, any>): void {
+  const conflicts: any[] = payload.conflicts || [];
+  for (const conflict of conflicts) {
+    const assetId = Number(conflict.assetId);
+    for (const arr of [assetStore.baseAssets, assetStore.displayedAssets]) {
+      const asset = arr.find((a: any) => a.id === assetId);
+      if (asset) {
+        asset[conflict.key] = conflict.value;
+        asset.modified = conflict.modified;
+        asset.modified_by = conflict.modifiedBy;
+      }
+    }
+  }
+
+  const first = conflicts[0];
+  if (!first) return;
+  const who = first.modifiedBy || 'another user';
+  const more = conflicts.length > 1 ? ` (and ${conflicts.length - 1} more)` : '';
+  toastState.addToast(
+    `Not saved: ${who} changed asset ${first.assetId} at ${first.modified}${more}. Review and commit again.`,
+    'warning',
+  );
+}
+
+// Rows changed in the database by any writer, read from the binlog. Values
+// already use grid keys; only keys a loaded row has are applied. Inserted
+// rows show up on the next query.
+function handleWsRowsChanged(payload: Record<string, any>): void {
+  const changes: any[] = payload.changes || [];
+  for (const change of changes) {
+    const assetId = Number(change.assetId);
+    const values: Record<string, string | null> = change.values || {};
+
+    if (change.table === 'current_audit') {
+      for (const arr of [auditStore.baseAssignments, auditStore.displayedAssignments]) {
+        const audit = arr.find(a => a.asset_id === assetId);
+        if (!audit) continue;
+        for (const [key, value] of Object.entries(values)) {
+          if (key in audit) (audit as any)[key] = value;
+        }
+      }
+      continue;
+    }
+
+    if (change.action === 'delete') {
+      if (change.table === 'asset_inventory') {
+        assetStore.baseAssets = assetStore.baseAssets.filter((a: any) => a.id !== assetId);
+        assetStore.displayedAssets = assetStore.displayedAssets.filter((a: any) => a.id !== assetId);
+      }
+      continue;
+    }
+
+    for (const arr of [assetStore.baseAssets, assetStore.displayedAssets]) {
+      const asset = arr.find((a: any) => a.id === assetId);
+      if (!asset) continue;
+      for (const [key, value] of Object.entries(values)) {
+        if (key in asset) asset[key] = value;
+      }
+    }
+  }
+}
+
 function handleWsClientStateReconciled(
   payload: Record<string, any>,
 ): void {
@@ -733,6 +938,43 @@ function handleWsClientStateReconciled(
 // Apply an auditor assignment update to baseAssignments and displayedAssignments.
 // Builds new arrays once (map + spread for matched ids), preserves displayedAssignments order,
 // and produces exactly two reactive writes regardless of selection size.
+function handleWsError(payload: Record<string, any>): void {
+  console.warn(`[Realtime] ${payload.type} rejected: ${payload.code}`, payload);
+  if (payload.code === 'FORBIDDEN') {
+    toastState.addToast(payload.message || 'You do not have permission to do that.', 'error');
+  } else if (payload.code === 'RATE_LIMITED') {
+    toastState.addToast(payload.message || 'Too many changes at once, slow down.', 'warning');
+  }
+}
+
+// The hub could not replay everything missed while disconnected; reload the
+// grid so no committed change is lost. Locks and presence come back with the
+// EXISTING_USERS snapshot that follows.
+async function handleWsResyncRequired(payload: Record<string, any>): Promise<void> {
+  console.warn(`[Realtime] Resync required for room ${payload.room}`);
+  if (payload.room !== 'grid') {
+    toastState.addToast('Missed live updates while offline. Refresh to see the latest data.', 'warning');
+    return;
+  }
+
+  const params = new URLSearchParams();
+  params.set('view', queryStore.view || 'default');
+  for (const s of queryStore.hiddenStatuses) params.append('hidden_status', s);
+  const res = await apiFetch('/api/view_change', params);
+  if (!res.success) {
+    toastState.addToast('Missed live updates while offline. Refresh to see the latest data.', 'warning');
+    return;
+  }
+
+  assetStore.baseAssets = res.data.assets;
+  if (queryStore.q || queryStore.filters.length > 0) {
+    await handleQuery({ view: queryStore.view, q: queryStore.q, filters: queryStore.filters });
+  } else {
+    assetStore.displayedAssets = res.data.assets;
+  }
+  toastState.addToast('Reconnected. Data reloaded to catch up on missed changes.', 'info');
+}
+
 function applyAuditAssignmentUpdate(assetIds: number[], userId: number, auditorName: string | null) {
   const idSet = new Set(assetIds);
   const newBase = auditStore.baseAssignments.map(a =>
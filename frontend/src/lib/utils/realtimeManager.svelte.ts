@@ -1,12 +1,32 @@
 import { PUBLIC_WS_URL, PUBLIC_WS_PROTOCOL } from '$env/static/public';
 import { connectionStore } from '$lib/data/connectionStore.svelte';
 import { enqueue } from '$lib/eventQueue/eventQueue';
+import type { ClientEnvelope, ClientMessages, ClientMessageType, ClientState, ErrorReply } from '$lib/utils/realtimeProtocol';
 
 const INSTANCE_KEY = Symbol.for('APP_REALTIME_MANAGER');
 const MAX_QUEUE_SIZE = 50;
 // Stop retrying after this many consecutive failures. The next user action
 // (focus / visibility / click / keypress) wakes the connection and resets.
 const MAX_RECONNECT_ATTEMPTS = 5;
+// Cell locks are leased server-side (30s). Renew well inside that window
+// while an edit is open so a live editor never loses its lock.
+const LOCK_HEARTBEAT_MS = 10000;
+// A request() with no ACK/ERROR after this long is treated as lost.
+const REQUEST_TIMEOUT_MS = 10000;
+
+/** Rejection of a request(): the hub's ERROR reply, or a local failure (TIMEOUT / DISCONNECTED). */
+export class RealtimeRequestError extends Error {
+    constructor(public readonly code: string, message: string, public readonly field?: string) {
+        super(message);
+        this.name = 'RealtimeRequestError';
+    }
+}
+
+type PendingRequest = {
+    resolve: () => void;
+    reject: (err: RealtimeRequestError) => void;
+    timer: ReturnType<typeof setTimeout>;
+};
 
 function createRealtimeManager() {
     // --- GHOST KILLER ---
@@ -18,19 +38,40 @@ function createRealtimeManager() {
     // --- PLUMBING ---
     let socket: WebSocket | null = null;
     let reconnectTimer: ReturnType<typeof setTimeout> | null = null;
+    let lockHeartbeatTimer: ReturnType<typeof setInterval> | null = null;
     let attempts = 0;
     let shouldReconnect = true;
     let gaveUp = false;
     let session: { id: string; color?: string } | null = null;
     let currentRoom: string = '';
-    let localStateProvider: (() => { position: any; lock: any; pending: any[] }) | null = null;
+    // Every subscribed room, currentRoom first
+    let currentRooms: string[] = [];
+    // Asset ids last sent in VIEWPORT; resent after a reconnect
+    let currentViewport: number[] | null = null;
+    let localStateProvider: (() => ClientState) | null = null;
+    // Highest broadcast seq received in each room; those of the subscribed
+    // rooms are sent as resume_from so the hub can replay what was missed
+    // while the socket was down
+    const lastSeqs = new Map<string, number>();
+    // Hub instance lastSeqs came from; seqs only mean something there
+    let lastInstance = '';
+    // Set by SERVER_SHUTDOWN: the delay before the first reconnect attempt
+    let restartDelay: number | null = null;
+    // Bumped by every connect() and disconnect(); a ticket that arrives for
+    // an older attempt is dropped
+    let connectAttempt = 0;
+    let ticketPending = false;
 
     // Message Queue for offline actions
     let messageQueue: string[] = [];
 
+    // Requests waiting for an ACK / ERROR, keyed by requestId
+    const pendingRequests = new Map<string, PendingRequest>();
+    let nextRequestId = 1;
+
     // --- ACTIONS ---
 
-    function setLocalStateProvider(fn: () => { position: any; lock: any; pending: any[] }) {
+    function setLocalStateProvider(fn: () => ClientState) {
         localStateProvider = fn;
     }
 
@@ -45,12 +86,31 @@ function createRealtimeManager() {
 
     function sendEditStart(assetId: number, key: string) {
         send('CELL_EDIT_START', { assetId, key });
+        startLockHeartbeat();
     }
 
     function sendEditEnd() {
+        stopLockHeartbeat();
         send('CELL_EDIT_END', {});
     }
 
+    function startLockHeartbeat() {
+        stopLockHeartbeat();
+        lockHeartbeatTimer = setInterval(() => {
+            // Only renew over a live socket — queued heartbeats are useless
+            if (socket?.readyState === WebSocket.OPEN) {
+                socket.send(JSON.stringify({ type: 'CELL_LOCK_HEARTBEAT', payload: {} }));
+            }
+        }, LOCK_HEARTBEAT_MS);
+    }
+
+    function stopLockHeartbeat() {
+        if (lockHeartbeatTimer) {
+            clearInterval(lockHeartbeatTimer);
+            lockHeartbeatTimer = null;
+        }
+    }
+
     function sendCellPending(assetId: number, key: string, value: string) {
         send('CELL_PENDING', { assetId, key, value });
     }
@@ -63,22 +123,35 @@ function createRealtimeManager() {
         send('PENDING_CLEAR_ALL', {});
     }
 
-    function sendCommitBroadcast(changes: { assetId: number; key: string; value: string }[]) {
-        send('COMMIT_BROADCAST', { changes });
-    }
-
-    function sendSubscribe(room: string) {
-        currentRoom = room;
-        send('SUBSCRIBE', { room });
+    // Pass several rooms to be in all of them, e.g. ['grid', 'grid:location:3'];
+    // the first is where messages act unless they name another room
+    function sendSubscribe(room: string | string[]) {
+        if (Array.isArray(room)) {
+            currentRoom = room[0] ?? '';
+            currentRooms = [...room];
+            send('SUBSCRIBE', { rooms: room });
+        } else {
+            currentRoom = room;
+            currentRooms = [room];
+            send('SUBSCRIBE', { room });
+        }
     }
 
     function sendUnsubscribe() {
         if (currentRoom) {
             send('UNSUBSCRIBE', {});
             currentRoom = '';
+            currentRooms = [];
         }
     }
 
+    // Only hear about cell locks, pending edits and cursors on these assets;
+    // null hears about every asset again
+    function sendViewport(assetIds: number[] | null) {
+        currentViewport = assetIds;
+        send('VIEWPORT', assetIds ? { assetIds } : {});
+    }
+
     function sendAuditAssign(assetIds: number[], userId: number, auditorName: string) {
         send('AUDIT_ASSIGN', { assetIds, userId, auditorName });
     }
@@ -103,10 +176,49 @@ function createRealtimeManager() {
         send('ROW_UNLOCK', { assetId });
     }
 
-    function send(type: string, payload: any) {
+    /**
+     * Send a message and wait for the hub to confirm it. Resolves on ACK,
+     * rejects with a RealtimeRequestError on ERROR so callers can roll back
+     * optimistic UI.
+     */
+    function request<K extends ClientMessageType>(type: K, payload: ClientMessages[K]): Promise<void> {
+        if (!shouldReconnect) {
+            return Promise.reject(new RealtimeRequestError('DISCONNECTED', 'Not connected'));
+        }
+
+        const requestId = String(nextRequestId++);
+        return new Promise<void>((resolve, reject) => {
+            const timer = setTimeout(() => {
+                pendingRequests.delete(requestId);
+                reject(new RealtimeRequestError('TIMEOUT', `${type} was not acknowledged`));
+            }, REQUEST_TIMEOUT_MS);
+            pendingRequests.set(requestId, { resolve, reject, timer });
+            send(type, payload, requestId);
+        });
+    }
+
+    function settleRequest(requestId: string, err?: RealtimeRequestError): boolean {
+        const pending = pendingRequests.get(requestId);
+        if (!pending) return false;
+        pendingRequests.delete(requestId);
+        clearTimeout(pending.timer);
+        if (err) pending.reject(err);
+        else pending.resolve();
+        return true;
+    }
+
+    function rejectAllRequests(code: string, message: string) {
+        for (const requestId of [...pendingRequests.keys()]) {
+            settleRequest(requestId, new RealtimeRequestError(code, message));
+        }
+    }
+
+    function send<K extends ClientMessageType>(type: K, payload: ClientMessages[K], requestId?: string) {
         if (!shouldReconnect) return;
 
-        const msg = JSON.stringify({ type, payload });
+        const envelope: ClientEnvelope<K> = { type, payload };
+        if (requestId) envelope.requestId = requestId;
+        const msg = JSON.stringify(envelope);
 
         if (socket?.readyState === WebSocket.OPEN) {
             socket.send(msg);
@@ -154,19 +266,63 @@ function createRealtimeManager() {
             socket = null;
         }
 
+        // A different session starts a fresh stream
+        if (session?.id !== sessionId) lastSeqs.clear();
+
         // If we are already connected/connecting to the correct session, just return
         if (socket &&
             (socket.readyState === WebSocket.OPEN || socket.readyState === WebSocket.CONNECTING) &&
             session?.id === sessionId) {
             return;
         }
+        if (ticketPending && session?.id === sessionId) return;
 
         session = { id: sessionId, color };
         shouldReconnect = true;
 
+        // The session id stays out of the socket URL: trade it for a
+        // single-use ticket first
+        const attempt = ++connectAttempt;
+        ticketPending = true;
+        fetchTicket(sessionId)
+            .then((ticket) => {
+                if (attempt !== connectAttempt) return;
+                ticketPending = false;
+                openSocket(ticket, color);
+            })
+            .catch((err) => {
+                if (attempt !== connectAttempt) return;
+                ticketPending = false;
+                console.error('[Realtime] Could not get a connection ticket', err);
+                connectionStore.status = 'disconnected';
+                if (shouldReconnect) scheduleReconnect();
+            });
+    }
+
+    async function fetchTicket(sessionId: string): Promise<string> {
+        const httpProtocol = PUBLIC_WS_PROTOCOL === 'wss' ? 'https' : 'http';
+        const res = await fetch(`${httpProtocol}://${PUBLIC_WS_URL}/api/ws/ticket`, {
+            method: 'POST',
+            credentials: 'include',
+            headers: { Authorization: `Bearer ${sessionId}` }
+        });
+        if (!res.ok) throw new Error(`ticket request failed with ${res.status}`);
+        const { ticket } = await res.json();
+        return ticket;
+    }
+
+    function openSocket(ticket: string, color?: string) {
         const url = new URL(`${PUBLIC_WS_PROTOCOL}://${PUBLIC_WS_URL}/api/ws`);
-        url.searchParams.set('session_id', sessionId);
+        url.searchParams.set('ticket', ticket);
         if (color) url.searchParams.set('color', color);
+        // Rooms left out of resume_from are resynced
+        const resumeFrom = currentRooms
+            .filter((room) => lastSeqs.has(room))
+            .map((room) => `${room}:${lastSeqs.get(room)}`);
+        if (resumeFrom.length > 0) {
+            url.searchParams.set('resume_from', resumeFrom.join(','));
+            url.searchParams.set('resume_instance', lastInstance);
+        }
 
         const ws = new WebSocket(url.toString());
         socket = ws;
@@ -185,6 +341,14 @@ function createRealtimeManager() {
                 }));
             }
 
+            // A new connection hears about every asset until told otherwise
+            if (currentViewport) {
+                ws.send(JSON.stringify({
+                    type: 'VIEWPORT',
+                    payload: { assetIds: currentViewport }
+                }));
+            }
+
             // 3. FLUSH QUEUE
             if (messageQueue.length > 0) {
                 while (messageQueue.length > 0 && ws.readyState === WebSocket.OPEN) {
@@ -210,7 +374,20 @@ function createRealtimeManager() {
         ws.onmessage = (e) => {
             if (socket !== ws) return;
             try {
-                const { type, payload } = JSON.parse(e.data);
+                const { type, seq, rooms, payload } = JSON.parse(e.data);
+                // Another instance numbers its stream afresh
+                if (type === 'WELCOME' && payload.instance !== lastInstance) {
+                    lastInstance = payload.instance;
+                    lastSeqs.clear();
+                }
+                // A broadcast without rooms belongs to every room's stream
+                if (seq) {
+                    for (const room of currentRooms) {
+                        if ((!rooms || rooms.includes(room)) && seq > (lastSeqs.get(room) ?? 0)) {
+                            lastSeqs.set(room, seq);
+                        }
+                    }
+                }
                 handleMessage(type, payload);
             } catch (err) {
                 console.error('[Realtime] Parse error', err);
@@ -228,7 +405,11 @@ function createRealtimeManager() {
         connectionStore.status = 'reconnecting';
         if (reconnectTimer) return; // Don't schedule multiple timers
 
-        const delay = Math.min(1000 * 2 ** attempts++, 10000); // Cap at 10s
+        let delay = Math.min(1000 * 2 ** attempts++, 10000); // Cap at 10s
+        if (restartDelay !== null) {
+            delay = restartDelay;
+            restartDelay = null;
+        }
         reconnectTimer = setTimeout(() => {
             reconnectTimer = null;
             if (session) connect(session.id, session.color);
@@ -259,7 +440,12 @@ function createRealtimeManager() {
         }
 
         shouldReconnect = false; // Stop intentional reconnects
+        connectAttempt++;
+        ticketPending = false;
         currentRoom = '';
+        currentRooms = [];
+        lastSeqs.clear();
+        stopLockHeartbeat();
 
         if (reconnectTimer) {
             clearTimeout(reconnectTimer);
@@ -268,6 +454,7 @@ function createRealtimeManager() {
 
         // Clear queue immediately
         messageQueue = [];
+        rejectAllRequests('DISCONNECTED', 'Connection closed');
 
         // Teardown Socket
         cleanupSocket();
@@ -289,6 +476,27 @@ function createRealtimeManager() {
     }
 
     function handleMessage(type: string, payload: any) {
+        if (type === 'ACK') {
+            settleRequest(payload.requestId);
+            return;
+        }
+        if (type === 'ERROR' && payload.requestId) {
+            const reply = payload as ErrorReply;
+            // The caller of request() handles its own failure
+            if (settleRequest(reply.requestId!, new RealtimeRequestError(reply.code, reply.message, reply.field))) return;
+        }
+        if (type === 'CELL_LOCK_EXPIRED' || type === 'CELL_LOCK_REVOKED') stopLockHeartbeat();
+        if (type === 'SERVER_SHUTDOWN') {
+            // Spread reconnects so a restart is not met by every tab at once
+            const hint = payload.reconnectAfterMs || 3000;
+            restartDelay = hint + Math.random() * hint;
+            attempts = 0;
+        }
+        if (type === 'SESSION_EXPIRED') {
+            // The hub closes the socket next; reconnecting would be refused
+            shouldReconnect = false;
+            stopLockHeartbeat();
+        }
         enqueue({ type: 'WS_' + type, payload });
     }
 
@@ -315,6 +523,7 @@ function createRealtimeManager() {
         isConnected,
         connect,
         disconnect,
+        request,
         sendPositionUpdate,
         sendDeselect,
         sendEditStart,
@@ -322,9 +531,9 @@ function createRealtimeManager() {
         sendCellPending,
         sendCellPendingClear,
         sendPendingClearAll,
-        sendCommitBroadcast,
         sendSubscribe,
         sendUnsubscribe,
+        sendViewport,
         sendAuditAssign,
         sendAuditComplete,
         sendAuditStart,
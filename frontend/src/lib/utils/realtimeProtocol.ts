@@ -0,0 +1,327 @@
+// Code generated by ws/cmd/protogen from ws/internal/protocol. DO NOT EDIT.
+
+/** Asset and user ids: numbers from the grid, strings from the hub's map keys. */
+export type ID = number | string;
+
+/** Messages the client may send to the hub. */
+export interface ClientMessages {
+    ADMIN_CLEAR_PENDING_FOR_USER: UserRef;
+    ADMIN_FORCE_UNLOCK_CELL: CellRef;
+    ADMIN_FORCE_UNLOCK_ROW: RowRef;
+    AUDIT_ASSIGN: AuditAssign;
+    AUDIT_CLOSE: Empty;
+    AUDIT_COMPLETE: AuditComplete;
+    AUDIT_START: Empty;
+    CELL_EDIT_END: Empty;
+    CELL_EDIT_START: CellRef;
+    CELL_LOCK_HEARTBEAT: Empty;
+    CELL_PENDING: CellValue;
+    CELL_PENDING_CLEAR: CellRef;
+    CLIENT_STATE: ClientState;
+    COMMIT: Commit;
+    PENDING_CLEAR_ALL: Empty;
+    PING: Empty;
+    ROW_LOCK: RowRef;
+    ROW_UNLOCK: RowRef;
+    SUBSCRIBE: Subscribe;
+    UNSUBSCRIBE: Unsubscribe;
+    USER_DESELECTED: Empty;
+    USER_POSITION_UPDATE: PositionUpdate;
+    VIEWPORT: Viewport;
+}
+
+/** Messages the hub sends to clients. */
+export interface ServerMessages {
+    ACK: Ack;
+    AUDIT_ASSIGN_BROADCAST: AuditAssign;
+    AUDIT_CLOSE_BROADCAST: Empty;
+    AUDIT_COMPLETE_BROADCAST: AuditComplete;
+    AUDIT_START_BROADCAST: Empty;
+    CELL_LOCKED: CellLocked;
+    CELL_LOCK_EXPIRED: CellRef;
+    CELL_LOCK_REVOKED: CellLockRevoked;
+    CELL_UNLOCKED: CellRef;
+    CLIENT_STATE_RECONCILED: ClientStateReconciled;
+    COMMIT_BROADCAST: CommittedChanges;
+    COMMIT_CONFLICT: CommitConflict;
+    ERROR: ErrorReply;
+    EXISTING_USERS: ExistingUsers;
+    PENDING_BROADCAST: PendingCell;
+    PENDING_CLEAR_BROADCAST: PendingClear;
+    PENDING_REVOKED: PendingRevoked;
+    RESYNC_REQUIRED: ResyncRequired;
+    ROWS_CHANGED: RowsChanged;
+    ROW_LOCKED: RowLocked;
+    ROW_LOCK_REJECTED: RowLockRejected;
+    ROW_LOCK_REVOKED: RowLockRevoked;
+    ROW_UNLOCKED: RowRef;
+    SERVER_SHUTDOWN: ServerShutdown;
+    SESSION_EXPIRED: Empty;
+    USER_AWAY: UserAway;
+    USER_LEFT: UserLeft;
+    USER_POSITION_UPDATE: UserPosition;
+    USER_RETURNED: UserAway;
+    VIEWPORT_STATE: ViewportState;
+    WELCOME: Welcome;
+}
+
+export interface UserRef {
+    userId: ID;
+}
+
+export interface CellRef {
+    assetId: ID;
+    key: string;
+}
+
+export interface RowRef {
+    assetId: ID;
+}
+
+export interface AuditAssign {
+    assetIds: number[];
+    userId: number;
+    auditorName: string;
+}
+
+export type Empty = Record<string, never>;
+
+export interface AuditComplete {
+    assetId: number;
+    completedCount: number;
+}
+
+export interface CellValue {
+    assetId: ID;
+    key: string;
+    value: string;
+}
+
+export interface ClientState {
+    position?: PositionUpdate | null;
+    lock?: CellRef | null;
+    pending?: CellValue[];
+    rowLock?: RowRef | null;
+}
+
+export interface Commit {
+    changes: CommitChange[];
+}
+
+export interface Subscribe {
+    room?: string;
+    rooms?: string[];
+}
+
+export interface Unsubscribe {
+    room?: string;
+}
+
+export interface PositionUpdate {
+    row: number;
+    col: number;
+    assetId?: ID;
+}
+
+export interface Viewport {
+    assetIds?: ID[];
+}
+
+export interface Ack {
+    requestId: string;
+    type: string;
+}
+
+export interface CellLocked extends Holder {
+    assetId: ID;
+    key: string;
+}
+
+export interface CellLockRevoked {
+    assetId: ID;
+    key: string;
+    by: Actor;
+}
+
+export interface ClientStateReconciled {
+    conflicts: Conflict[];
+}
+
+export interface CommittedChanges {
+    userId: string;
+    modifiedBy: string;
+    modified: string;
+    changes: CommitChange[];
+}
+
+export interface CommitConflict {
+    requestId?: string;
+    conflicts: CellConflict[];
+}
+
+export interface ErrorReply {
+    requestId?: string;
+    type: string;
+    code: string;
+    field?: string;
+    message: string;
+}
+
+export interface ExistingUsers {
+    room: string;
+    users: Record<string, PresentUser>;
+    lockedCells: Record<string, Holder>;
+    pendingCells: Record<string, PendingCell>;
+    rowLocks: Record<string, Holder>;
+}
+
+export interface PendingCell extends Holder {
+    assetId: ID;
+    key: string;
+}
+
+export interface PendingClear {
+    assetId?: ID;
+    key?: string;
+    userId?: string;
+    cells?: CellRef[];
+}
+
+export interface PendingRevoked {
+    cells: CellRef[];
+    by: Actor;
+}
+
+export interface ResyncRequired {
+    room: string;
+}
+
+export interface RowsChanged {
+    changes: RowChange[];
+}
+
+export interface RowLocked extends Holder {
+    assetId: ID;
+}
+
+export interface RowLockRejected {
+    assetId: ID;
+    reason: string;
+    firstname: string;
+    lastname: string;
+}
+
+export interface RowLockRevoked {
+    assetId: ID;
+    by: Actor;
+}
+
+export interface ServerShutdown {
+    reconnectAfterMs: number;
+}
+
+export interface UserAway {
+    clientId: string;
+}
+
+export interface UserLeft {
+    clientId: string;
+}
+
+export interface UserPosition {
+    row: number;
+    col: number;
+    assetId?: ID;
+    clientId: string;
+    userId: number;
+    username: string;
+    firstname: string;
+    lastname: string;
+    color: string;
+}
+
+export interface ViewportState {
+    assetIds: ID[];
+    users: Record<string, PresentUser>;
+    lockedCells: Record<string, Holder>;
+    pendingCells: Record<string, PendingCell>;
+}
+
+export interface Welcome {
+    clientId: string;
+    userId: number;
+    username: string;
+    firstname: string;
+    lastname: string;
+    role: number;
+    color: string;
+    instance: string;
+}
+
+export interface CommitChange {
+    assetId: ID;
+    key: string;
+    value: string | null;
+    baseModified?: string;
+}
+
+export interface Holder {
+    userId: string;
+    firstname: string;
+    lastname: string;
+    color: string;
+}
+
+export interface Actor {
+    userId: string;
+    firstname: string;
+    lastname: string;
+}
+
+export interface Conflict {
+    type: string;
+    assetId: ID;
+    key?: string;
+    heldBy?: string;
+    firstname?: string;
+    lastname?: string;
+}
+
+export interface CellConflict {
+    assetId: ID;
+    key: string;
+    value: string | null;
+    modified: string;
+    modifiedBy: string;
+    changedKey?: string;
+}
+
+export interface PresentUser {
+    row: number;
+    col: number;
+    assetId?: ID;
+    userId: number;
+    username: string;
+    firstname: string;
+    lastname: string;
+    color: string;
+    away?: boolean;
+}
+
+export interface RowChange {
+    table: string;
+    action: string;
+    assetId: ID;
+    values?: Record<string, string | null>;
+}
+
+export type ClientMessageType = keyof ClientMessages;
+export type ServerMessageType = keyof ServerMessages;
+
+/** Wire shape of a client message; set requestId to get an ACK or ERROR back, room to act in a room other than the first subscribed. */
+export interface ClientEnvelope<K extends ClientMessageType = ClientMessageType> {
+    type: K;
+    requestId?: string;
+    room?: string;
+    payload: ClientMessages[K];
+}
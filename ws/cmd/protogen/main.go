@@ -0,0 +1,150 @@
+// Command protogen writes TypeScript definitions for the /api/ws protocol so
+// the Svelte realtimeManager stays in sync with internal/protocol.
+//
+// Run it through `go generate ./...` from the ws directory.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"asset-ws/internal/protocol"
+)
+
+var idType = reflect.TypeOf(protocol.ID(""))
+
+type generator struct {
+	buf     bytes.Buffer
+	emitted map[reflect.Type]bool
+	queue   []reflect.Type
+}
+
+func main() {
+	out := flag.String("out", "", "output .ts file (stdout when empty)")
+	flag.Parse()
+
+	g := &generator{emitted: make(map[reflect.Type]bool)}
+
+	inbound := make(map[string]reflect.Type, len(protocol.Inbound))
+	for msgType, newPayload := range protocol.Inbound {
+		inbound[msgType] = reflect.TypeOf(newPayload()).Elem()
+	}
+	outbound := make(map[string]reflect.Type, len(protocol.Outbound))
+	for msgType, payload := range protocol.Outbound {
+		outbound[msgType] = reflect.TypeOf(payload)
+	}
+
+	g.buf.WriteString("// Code generated by ws/cmd/protogen from ws/internal/protocol. DO NOT EDIT.\n\n")
+	g.buf.WriteString("/** Asset and user ids: numbers from the grid, strings from the hub's map keys. */\n")
+	g.buf.WriteString("export type ID = number | string;\n")
+
+	g.writeMessageMap("ClientMessages", "Messages the client may send to the hub.", inbound)
+	g.writeMessageMap("ServerMessages", "Messages the hub sends to clients.", outbound)
+
+	for len(g.queue) > 0 {
+		t := g.queue[0]
+		g.queue = g.queue[1:]
+		g.writeStruct(t)
+	}
+
+	g.buf.WriteString("\nexport type ClientMessageType = keyof ClientMessages;\n")
+	g.buf.WriteString("export type ServerMessageType = keyof ServerMessages;\n")
+
+	g.buf.WriteString("\n/** Wire shape of a client message; set requestId to get an ACK or ERROR back, room to act in a room other than the first subscribed. */\n")
+	g.buf.WriteString("export interface ClientEnvelope<K extends ClientMessageType = ClientMessageType> {\n")
+	g.buf.WriteString("    type: K;\n    requestId?: string;\n    room?: string;\n    payload: ClientMessages[K];\n}\n")
+
+	if *out == "" {
+		os.Stdout.Write(g.buf.Bytes())
+		return
+	}
+	if err := os.WriteFile(*out, g.buf.Bytes(), 0o644); err != nil {
+		log.Fatalf("protogen: %v", err)
+	}
+}
+
+func (g *generator) writeMessageMap(name, doc string, messages map[string]reflect.Type) {
+	types := make([]string, 0, len(messages))
+	for msgType := range messages {
+		types = append(types, msgType)
+	}
+	sort.Strings(types)
+
+	fmt.Fprintf(&g.buf, "\n/** %s */\nexport interface %s {\n", doc, name)
+	for _, msgType := range types {
+		fmt.Fprintf(&g.buf, "    %s: %s;\n", msgType, g.tsType(messages[msgType]))
+	}
+	g.buf.WriteString("}\n")
+}
+
+func (g *generator) writeStruct(t reflect.Type) {
+	if t.NumField() == 0 {
+		fmt.Fprintf(&g.buf, "\nexport type %s = Record<string, never>;\n", t.Name())
+		return
+	}
+
+	var extends []string
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			extends = append(extends, g.tsType(f.Type))
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" || !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		optional := ""
+		if strings.Contains(opts, "omitempty") {
+			optional = "?"
+		}
+		fields = append(fields, fmt.Sprintf("    %s%s: %s;", name, optional, g.tsType(f.Type)))
+	}
+
+	header := "export interface " + t.Name()
+	if len(extends) > 0 {
+		header += " extends " + strings.Join(extends, ", ")
+	}
+	fmt.Fprintf(&g.buf, "\n%s {\n%s\n}\n", header, strings.Join(fields, "\n"))
+}
+
+func (g *generator) tsType(t reflect.Type) string {
+	if t == idType {
+		return "ID"
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.tsType(t.Elem()) + " | null"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return g.tsType(t.Elem()) + "[]"
+	case reflect.Map:
+		return fmt.Sprintf("Record<%s, %s>", g.tsType(t.Key()), g.tsType(t.Elem()))
+	case reflect.Struct:
+		if !g.emitted[t] {
+			g.emitted[t] = true
+			g.queue = append(g.queue, t)
+		}
+		return t.Name()
+	default:
+		return "unknown"
+	}
+}
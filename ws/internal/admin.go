@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"log"
+
+	"asset-ws/internal/protocol"
+)
+
+// Admin handlers are only reached by Admin and above; readPump enforces
+// messageRoles before dispatch.
+
+// adminActor describes the admin who released a lock, so the evicted client
+// can tell the user who took it away.
+func (c *Client) adminActor() protocol.Actor {
+	return protocol.Actor{
+		UserID:    c.userID,
+		Firstname: c.userInfo.Firstname,
+		Lastname:  c.userInfo.Lastname,
+	}
+}
+
+func (c *Client) handleAdminForceUnlockCell(p *protocol.CellRef) error {
+	lockKey := protocol.CellKey(p.AssetID, p.Key)
+
+	if c.hub.revokeCellLock(*p, c.adminActor()) {
+		log.Printf("[Admin] %s force-released cell %s", c.userInfo.Username, lockKey)
+		return nil
+	}
+
+	// Held by a client of another instance; that instance revokes it
+	claim := c.hub.remoteClaim(LockCell, lockKey)
+	if claim == nil {
+		return protocol.Rejectf(protocol.CodeNotFound, "Cell %s is not locked", lockKey)
+	}
+	if err := c.hub.locks.Release(LockCell, claim.Owner, lockKey); err != nil {
+		return err
+	}
+	c.hub.publishControl(controlForceUnlockCell, forceUnlockCell{Owner: claim.Owner, Cell: *p, By: c.adminActor()})
+	log.Printf("[Admin] %s force-released cell %s held on %s", c.userInfo.Username, lockKey, claim.Instance)
+	return nil
+}
+
+// revokeCellLock releases a cell lock held by a client of this instance,
+// tells its room and the owner. It reports whether a lock was held here.
+func (h *Hub) revokeCellLock(cell protocol.CellRef, by protocol.Actor) bool {
+	lockKey := protocol.CellKey(cell.AssetID, cell.Key)
+
+	info := h.cellLocks.ForceUnlock(lockKey)
+	if info == nil {
+		return false
+	}
+	owner := info.Client
+	h.release(LockCell, owner, lockKey)
+
+	log.Printf("[Admin] Cell %s held by %s (%s %s) revoked by %s %s", lockKey, owner.userInfo.Username, owner.userInfo.Firstname, owner.userInfo.Lastname, by.Firstname, by.Lastname)
+
+	h.BroadcastInView(info.Room, []string{info.AssetID}, protocol.TypeCellUnlocked, cell, nil)
+
+	owner.sendMessage(protocol.TypeCellLockRevoked, protocol.CellLockRevoked{
+		AssetID: cell.AssetID,
+		Key:     cell.Key,
+		By:      by,
+	})
+	return true
+}
+
+func (c *Client) handleAdminForceUnlockRow(p *protocol.RowRef) error {
+	assetId := p.AssetID.String()
+
+	if c.hub.revokeRowLock(*p, c.adminActor()) {
+		log.Printf("[Admin] %s force-released row %s", c.userInfo.Username, assetId)
+		return nil
+	}
+
+	claim := c.hub.remoteClaim(LockRow, assetId)
+	if claim == nil {
+		return protocol.Rejectf(protocol.CodeNotFound, "Row %s is not locked", assetId)
+	}
+	if err := c.hub.locks.Release(LockRow, claim.Owner, assetId); err != nil {
+		return err
+	}
+	c.hub.publishControl(controlForceUnlockRow, forceUnlockRow{Owner: claim.Owner, Row: *p, By: c.adminActor()})
+	log.Printf("[Admin] %s force-released row %s held on %s", c.userInfo.Username, assetId, claim.Instance)
+	return nil
+}
+
+// revokeRowLock releases a row lock held by a client of this instance and
+// tells everyone. It reports whether a lock was held here.
+func (h *Hub) revokeRowLock(row protocol.RowRef, by protocol.Actor) bool {
+	assetId := row.AssetID.String()
+
+	info := h.rowLocks.ForceUnlock(assetId)
+	if info == nil {
+		return false
+	}
+	owner := info.Client
+	h.release(LockRow, owner, assetId)
+
+	log.Printf("[Admin] Row %s held by %s (%s %s) revoked by %s %s", assetId, owner.userInfo.Username, owner.userInfo.Firstname, owner.userInfo.Lastname, by.Firstname, by.Lastname)
+
+	h.BroadcastToAllRooms(protocol.TypeRowUnlocked, row, nil)
+
+	owner.sendMessage(protocol.TypeRowLockRevoked, protocol.RowLockRevoked{
+		AssetID: row.AssetID,
+		By:      by,
+	})
+	return true
+}
+
+func (c *Client) handleAdminClearPendingForUser(p *protocol.UserRef) error {
+	userID := p.UserID.String()
+
+	remote := 0
+	for _, claim := range c.hub.remoteClaims(LockPending) {
+		if claim.Holder.UserID == userID {
+			remote++
+		}
+	}
+
+	cleared := c.hub.revokePending(userID, c.adminActor())
+	if cleared == 0 && remote == 0 {
+		return protocol.Rejectf(protocol.CodeNotFound, "User %s has no pending cells", p.UserID)
+	}
+	if remote > 0 {
+		c.hub.publishControl(controlClearPending, clearPending{UserID: userID, By: c.adminActor()})
+	}
+	log.Printf("[Admin] %s cleared pending cells of user %s (%d here, %d on other instances)", c.userInfo.Username, userID, cleared, remote)
+	return nil
+}
+
+// revokePending drops a user's pending cells on this instance, tells the
+// rooms they were made in and each connection. It returns how many were
+// dropped.
+func (h *Hub) revokePending(userID string, by protocol.Actor) int {
+	cleared := 0
+	for owner, removed := range h.pendingCells.RemoveAllForUser(userID) {
+		cells := make([]protocol.CellRef, 0, len(removed))
+		cellKeys := make([]string, 0, len(removed))
+		byRoom := make(map[string][]protocol.CellRef)
+		for _, info := range removed {
+			cell := protocol.CellRef{AssetID: protocol.ID(info.AssetID), Key: info.Key}
+			cells = append(cells, cell)
+			cellKeys = append(cellKeys, protocol.CellKey(cell.AssetID, cell.Key))
+			byRoom[info.Room] = append(byRoom[info.Room], cell)
+		}
+		h.release(LockPending, owner, cellKeys...)
+		cleared += len(cells)
+
+		log.Printf("[Admin] %d pending cells held by %s (%s %s) revoked by %s %s", len(cells), owner.userInfo.Username, owner.userInfo.Firstname, owner.userInfo.Lastname, by.Firstname, by.Lastname)
+
+		for room, roomCells := range byRoom {
+			h.BroadcastInView(room, cellAssets(roomCells), protocol.TypePendingClearBroadcast, protocol.PendingClear{
+				UserID: owner.userID,
+				Cells:  roomCells,
+			}, nil)
+		}
+
+		owner.sendMessage(protocol.TypePendingRevoked, protocol.PendingRevoked{
+			Cells: cells,
+			By:    by,
+		})
+	}
+	return cleared
+}
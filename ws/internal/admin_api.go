@@ -0,0 +1,267 @@
+package internal
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// adminClient describes one connection in admin API responses
+type adminClient struct {
+	UserID    string    `json:"userId"`
+	Username  string    `json:"username"`
+	Firstname string    `json:"firstname"`
+	Lastname  string    `json:"lastname"`
+	Role      int       `json:"role"`
+	Color     string    `json:"color"`
+	Room      string    `json:"room"`
+	Rooms     []string  `json:"rooms"`
+	Away      bool      `json:"away"`
+	LastPong  time.Time `json:"lastPong"`
+	// Messages waiting in the connection's send buffer
+	Queued int `json:"queued"`
+	// Whether permessage-deflate is on, and what the connection sent so far
+	// before and after compression
+	Compressed bool  `json:"compressed"`
+	BytesSent  int64 `json:"bytesSent"`
+	BytesWire  int64 `json:"bytesWire"`
+	BytesSaved int64 `json:"bytesSaved"`
+	// Wire format, json or msgpack
+	Format string `json:"format"`
+}
+
+type adminRoom struct {
+	Room    string        `json:"room"`
+	Clients []adminClient `json:"clients"`
+}
+
+type adminCellLock struct {
+	AssetID   string      `json:"assetId"`
+	Key       string      `json:"key"`
+	ExpiresAt time.Time   `json:"expiresAt"`
+	Holder    adminClient `json:"holder"`
+}
+
+type adminRowLock struct {
+	AssetID string      `json:"assetId"`
+	Holder  adminClient `json:"holder"`
+}
+
+type adminPendingCell struct {
+	AssetID string      `json:"assetId"`
+	Key     string      `json:"key"`
+	Value   string      `json:"value"`
+	Holder  adminClient `json:"holder"`
+}
+
+// AdminHandler serves JSON snapshots of the hub under /api/ws/admin/, plus
+// an on-demand session recheck. Callers authenticate with their session,
+// sent as a Bearer token or the sessionId cookie, and must hold an admin
+// role.
+func (h *Hub) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/ws/admin/clients", h.handleAdminClients)
+	mux.HandleFunc("GET /api/ws/admin/rooms", h.handleAdminRooms)
+	mux.HandleFunc("GET /api/ws/admin/locks", h.handleAdminLocks)
+	mux.HandleFunc("GET /api/ws/admin/row-locks", h.handleAdminRowLocks)
+	mux.HandleFunc("GET /api/ws/admin/pending", h.handleAdminPending)
+	mux.HandleFunc("POST /api/ws/admin/sessions/revalidate", h.handleAdminRevalidate)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionID := requestSessionID(r)
+		if sessionID == "" {
+			writeJSONError(w, http.StatusUnauthorized, "Missing session")
+			return
+		}
+		userInfo, err := h.ValidateSession(sessionID)
+		if err != nil {
+			writeJSONError(w, http.StatusUnauthorized, "Invalid session")
+			return
+		}
+		if userInfo.Role < RoleAuditAdmin || userInfo.Role > RoleAdmin {
+			log.Printf("[Admin] %s (role %d) denied %s", userInfo.Username, userInfo.Role, r.URL.Path)
+			writeJSONError(w, http.StatusForbidden, "Admin role required")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write JSON response: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// adminView describes a client
+func (h *Hub) adminView(client *Client, parked map[*Client]bool) adminClient {
+	client.mu.Lock()
+	lastPong := client.lastPong
+	client.mu.Unlock()
+
+	rooms := client.roomList()
+	var room string
+	if len(rooms) > 0 {
+		room = rooms[0]
+	}
+	return adminClient{
+		UserID:     client.userID,
+		Username:   client.userInfo.Username,
+		Firstname:  client.userInfo.Firstname,
+		Lastname:   client.userInfo.Lastname,
+		Role:       client.userInfo.Role,
+		Color:      client.userInfo.Color,
+		Room:       room,
+		Rooms:      append([]string{}, rooms...),
+		Away:       parked[client],
+		LastPong:   lastPong,
+		Queued:     len(client.send),
+		Compressed: client.compressed,
+		BytesSent:  client.stats.payload.Load(),
+		BytesWire:  client.stats.wire.Load(),
+		BytesSaved: client.stats.saved(),
+		Format:     client.format(),
+	}
+}
+
+// adminViews describes every client the hub knows, connected or parked
+func (h *Hub) adminViews() map[*Client]adminClient {
+	parked := h.parkedClients()
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	views := make(map[*Client]adminClient, len(h.clients)+len(parked))
+	for client := range h.clients {
+		views[client] = h.adminView(client, parked)
+	}
+	for client := range parked {
+		views[client] = h.adminView(client, parked)
+	}
+	return views
+}
+
+// holderView describes a lock holder, falling back to what the client
+// carries if it left between the snapshots
+func (h *Hub) holderView(client *Client, views map[*Client]adminClient) adminClient {
+	if view, ok := views[client]; ok {
+		return view
+	}
+	return adminClient{
+		UserID:    client.userID,
+		Username:  client.userInfo.Username,
+		Firstname: client.userInfo.Firstname,
+		Lastname:  client.userInfo.Lastname,
+		Role:      client.userInfo.Role,
+		Color:     client.userInfo.Color,
+	}
+}
+
+func (h *Hub) handleAdminClients(w http.ResponseWriter, r *http.Request) {
+	views := h.adminViews()
+	clients := make([]adminClient, 0, len(views))
+	for _, view := range views {
+		clients = append(clients, view)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Username < clients[j].Username })
+	writeJSON(w, clients)
+}
+
+func (h *Hub) handleAdminRooms(w http.ResponseWriter, r *http.Request) {
+	parked := h.parkedClients()
+
+	members := make(map[string][]*Client)
+	for _, r := range h.roomActors(nil) {
+		members[r.name] = r.clients()
+	}
+	names := append([]string{}, roomNames...)
+	for name, clients := range members {
+		if !isRootRoom(name) && len(clients) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	rooms := make([]adminRoom, 0, len(names))
+	for _, name := range names {
+		room := adminRoom{Room: name, Clients: []adminClient{}}
+		for _, client := range members[name] {
+			room.Clients = append(room.Clients, h.adminView(client, parked))
+		}
+		sort.Slice(room.Clients, func(i, j int) bool { return room.Clients[i].Username < room.Clients[j].Username })
+		rooms = append(rooms, room)
+	}
+
+	writeJSON(w, rooms)
+}
+
+func (h *Hub) handleAdminLocks(w http.ResponseWriter, r *http.Request) {
+	views := h.adminViews()
+	locks := make([]adminCellLock, 0)
+	for _, lock := range h.cellLocks.GetAll() {
+		locks = append(locks, adminCellLock{
+			AssetID:   lock.AssetID,
+			Key:       lock.Key,
+			ExpiresAt: lock.ExpiresAt,
+			Holder:    h.holderView(lock.Client, views),
+		})
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		if locks[i].AssetID != locks[j].AssetID {
+			return locks[i].AssetID < locks[j].AssetID
+		}
+		return locks[i].Key < locks[j].Key
+	})
+	writeJSON(w, locks)
+}
+
+func (h *Hub) handleAdminRowLocks(w http.ResponseWriter, r *http.Request) {
+	views := h.adminViews()
+	locks := make([]adminRowLock, 0)
+	for _, lock := range h.rowLocks.GetAll() {
+		locks = append(locks, adminRowLock{
+			AssetID: lock.AssetID,
+			Holder:  h.holderView(lock.Client, views),
+		})
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].AssetID < locks[j].AssetID })
+	writeJSON(w, locks)
+}
+
+func (h *Hub) handleAdminPending(w http.ResponseWriter, r *http.Request) {
+	views := h.adminViews()
+	cells := make([]adminPendingCell, 0)
+	for _, cell := range h.pendingCells.GetAll() {
+		cells = append(cells, adminPendingCell{
+			AssetID: cell.AssetID,
+			Key:     cell.Key,
+			Value:   cell.Value,
+			Holder:  h.holderView(cell.Client, views),
+		})
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].AssetID != cells[j].AssetID {
+			return cells[i].AssetID < cells[j].AssetID
+		}
+		return cells[i].Key < cells[j].Key
+	})
+	writeJSON(w, cells)
+}
+
+// handleAdminRevalidate rechecks every session now, for use right after
+// users are deleted or their sessions revoked. The other instances recheck
+// too; the count is this instance's.
+func (h *Hub) handleAdminRevalidate(w http.ResponseWriter, r *http.Request) {
+	h.publishControl(controlRevalidate, struct{}{})
+	writeJSON(w, map[string]int{"ended": h.RevalidateSessions()})
+}
@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	"asset-ws/internal/protocol"
+)
+
+// backplaneOutboxSize is how many envelopes may wait to be published before
+// broadcasts start dropping them for other instances
+const backplaneOutboxSize = 1024
+
+// Envelope kinds
+const (
+	envelopeBroadcast = "broadcast"
+	envelopeControl   = "control"
+)
+
+// Control envelopes ask another instance to act on state only it holds
+const (
+	controlForceUnlockCell = "force_unlock_cell"
+	controlForceUnlockRow  = "force_unlock_row"
+	controlClearPending    = "clear_pending"
+	controlRevalidate      = "revalidate_sessions"
+)
+
+// Envelope carries a room broadcast or a control request between instances
+type Envelope struct {
+	Origin string `json:"origin"`
+	Kind   string `json:"kind"`
+	// Rooms a broadcast goes to; empty means every room
+	Rooms []string `json:"rooms,omitempty"`
+	// Assets a broadcast is about; see BroadcastInView
+	Assets  []string        `json:"assets,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Backplane relays envelopes between the hubs of a cluster. Every hub
+// publishes its room broadcasts and receives everyone else's.
+type Backplane interface {
+	// Publish hands an envelope to every other instance
+	Publish(env Envelope) error
+	// Run delivers envelopes published by other instances until shutdown
+	// is closed
+	Run(instance string, shutdown <-chan struct{}, deliver func(Envelope))
+}
+
+// forceUnlockCell asks the instance whose client holds a cell lock to revoke it
+type forceUnlockCell struct {
+	Owner string           `json:"owner"`
+	Cell  protocol.CellRef `json:"cell"`
+	By    protocol.Actor   `json:"by"`
+}
+
+// forceUnlockRow asks the instance whose client holds a row lock to revoke it
+type forceUnlockRow struct {
+	Owner string          `json:"owner"`
+	Row   protocol.RowRef `json:"row"`
+	By    protocol.Actor  `json:"by"`
+}
+
+// clearPending asks every instance to drop a user's pending cells
+type clearPending struct {
+	UserID string         `json:"userId"`
+	By     protocol.Actor `json:"by"`
+}
+
+// MemoryBackplane connects hubs running in the same process. It is what
+// tests use to run a cluster without a database.
+type MemoryBackplane struct {
+	subscribers map[string]chan Envelope
+	mutex       sync.Mutex
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{subscribers: make(map[string]chan Envelope)}
+}
+
+func (b *MemoryBackplane) Publish(env Envelope) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for instance, ch := range b.subscribers {
+		if instance == env.Origin {
+			continue
+		}
+		select {
+		case ch <- env:
+		default:
+			log.Printf("[Backplane] %s is not keeping up, dropping %s", instance, env.Type)
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBackplane) Run(instance string, shutdown <-chan struct{}, deliver func(Envelope)) {
+	ch := make(chan Envelope, backplaneOutboxSize)
+	b.mutex.Lock()
+	b.subscribers[instance] = ch
+	b.mutex.Unlock()
+
+	defer func() {
+		b.mutex.Lock()
+		delete(b.subscribers, instance)
+		b.mutex.Unlock()
+	}()
+
+	for {
+		select {
+		case env := <-ch:
+			deliver(env)
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// publish queues a broadcast for the other instances. The hub's own clients
+// have already been sent it.
+func (h *Hub) publish(msgType string, data interface{}, rooms, assets []string) {
+	if h.backplane == nil {
+		return
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("JSON Marshal error: %v", err)
+		return
+	}
+	h.enqueue(Envelope{Origin: h.instanceID, Kind: envelopeBroadcast, Rooms: rooms, Assets: assets, Type: msgType, Payload: payload})
+}
+
+// publishControl queues a control request for the other instances
+func (h *Hub) publishControl(control string, data interface{}) {
+	if h.backplane == nil {
+		return
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("JSON Marshal error: %v", err)
+		return
+	}
+	h.enqueue(Envelope{Origin: h.instanceID, Kind: envelopeControl, Type: control, Payload: payload})
+}
+
+// enqueue hands an envelope to the publisher goroutine without blocking
+// the broadcast that produced it
+func (h *Hub) enqueue(env Envelope) {
+	select {
+	case h.outbox <- env:
+	default:
+		log.Printf("[Backplane] Outbox full, dropping %s", env.Type)
+	}
+}
+
+// runPublisher publishes queued envelopes in order until shutdown, then
+// flushes what is left so the last unlocks of a drain reach the cluster
+func (h *Hub) runPublisher() {
+	for {
+		select {
+		case env := <-h.outbox:
+			h.publishEnvelope(env)
+		case <-h.shutdown:
+			for {
+				select {
+				case env := <-h.outbox:
+					h.publishEnvelope(env)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (h *Hub) publishEnvelope(env Envelope) {
+	if err := h.backplane.Publish(env); err != nil {
+		log.Printf("[Backplane] Failed to publish %s: %v", env.Type, err)
+	}
+}
+
+// receive applies an envelope from another instance. Broadcasts go to the
+// local rooms under a local seq, so resume works per instance.
+func (h *Hub) receive(env Envelope) {
+	if env.Origin == h.instanceID {
+		return
+	}
+	if env.Kind == envelopeControl {
+		h.receiveControl(env)
+		return
+	}
+
+	if len(env.Rooms) == 0 {
+		h.broadcastToAllRoomsLocal(env.Type, env.Payload, nil)
+		return
+	}
+	h.broadcastToRoomsLocal(env.Rooms, env.Assets, env.Type, env.Payload, nil)
+}
+
+func (h *Hub) receiveControl(env Envelope) {
+	var err error
+	switch env.Type {
+	case controlForceUnlockCell:
+		var req forceUnlockCell
+		if err = json.Unmarshal(env.Payload, &req); err == nil && h.ownsClaim(req.Owner) {
+			h.revokeCellLock(req.Cell, req.By)
+		}
+	case controlForceUnlockRow:
+		var req forceUnlockRow
+		if err = json.Unmarshal(env.Payload, &req); err == nil && h.ownsClaim(req.Owner) {
+			h.revokeRowLock(req.Row, req.By)
+		}
+	case controlClearPending:
+		var req clearPending
+		if err = json.Unmarshal(env.Payload, &req); err == nil {
+			h.revokePending(req.UserID, req.By)
+		}
+	case controlRevalidate:
+		// One query per session; keep it off the delivery loop
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			h.RevalidateSessions()
+		}()
+	default:
+		log.Printf("[Backplane] Ignoring unknown control %q from %s", env.Type, env.Origin)
+	}
+	if err != nil {
+		log.Printf("[Backplane] Bad %s control from %s: %v", env.Type, env.Origin, err)
+	}
+}
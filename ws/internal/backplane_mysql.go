@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// backplanePoll is how often the MySQL backplane looks for new envelopes
+	backplanePoll = 100 * time.Millisecond
+	// backplaneBatch caps how many envelopes one poll reads
+	backplaneBatch = 500
+	// backplaneGapWait is how long a skipped id is watched for. Ids are
+	// handed out before the insert commits, so a later id can show up first.
+	backplaneGapWait = 2 * time.Second
+	// backplaneRetention is how long delivered envelopes stay in the table
+	backplaneRetention  = 5 * time.Minute
+	backplanePruneEvery = time.Minute
+)
+
+// MySQLBackplane relays envelopes through the ws_backplane table. Every
+// instance inserts what it publishes and polls for rows from the others.
+type MySQLBackplane struct {
+	db *sql.DB
+}
+
+// NewMySQLBackplane creates the ws_backplane table if it is missing
+func NewMySQLBackplane(db *sql.DB) (*MySQLBackplane, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS ws_backplane (
+			id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			origin VARCHAR(64) NOT NULL,
+			envelope MEDIUMTEXT NOT NULL,
+			created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+			KEY idx_ws_backplane_created (created_at)
+		)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("create ws_backplane: %w", err)
+	}
+	return &MySQLBackplane{db: db}, nil
+}
+
+func (b *MySQLBackplane) Publish(env Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec("INSERT INTO ws_backplane (origin, envelope) VALUES (?, ?)", env.Origin, data)
+	return err
+}
+
+// Run polls from the current end of the table; envelopes published before
+// the instance started are of no use to it.
+func (b *MySQLBackplane) Run(instance string, shutdown <-chan struct{}, deliver func(Envelope)) {
+	var cursor int64
+	for {
+		err := b.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM ws_backplane").Scan(&cursor)
+		if err == nil {
+			break
+		}
+		log.Printf("[Backplane] Failed to read starting position: %v", err)
+		select {
+		case <-time.After(5 * time.Second):
+		case <-shutdown:
+			return
+		}
+	}
+	log.Printf("[Backplane] Following ws_backplane from id %d as %s", cursor, instance)
+
+	p := &backplanePoller{db: b.db, instance: instance, cursor: cursor, gaps: make(map[int64]time.Time)}
+
+	ticker := time.NewTicker(backplanePoll)
+	defer ticker.Stop()
+	lastPrune := time.Now()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.poll(deliver); err != nil {
+				log.Printf("[Backplane] Poll failed: %v", err)
+			}
+			if time.Since(lastPrune) >= backplanePruneEvery {
+				lastPrune = time.Now()
+				b.prune()
+			}
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// prune drops envelopes every instance has long since read
+func (b *MySQLBackplane) prune() {
+	res, err := b.db.Exec("DELETE FROM ws_backplane WHERE created_at < NOW(6) - INTERVAL ? SECOND", int(backplaneRetention.Seconds()))
+	if err != nil {
+		log.Printf("[Backplane] Prune failed: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("[Backplane] Pruned %d old envelopes", n)
+	}
+}
+
+// backplanePoller tails ws_backplane by id for one instance
+type backplanePoller struct {
+	db       *sql.DB
+	instance string
+	cursor   int64
+	// Ids skipped over, watched until their deadline in case they commit late
+	gaps map[int64]time.Time
+}
+
+func (p *backplanePoller) poll(deliver func(Envelope)) error {
+	query := "SELECT id, origin, envelope FROM ws_backplane WHERE id > ?"
+	args := []interface{}{p.cursor}
+	if len(p.gaps) > 0 {
+		placeholders := make([]string, 0, len(p.gaps))
+		for id := range p.gaps {
+			placeholders = append(placeholders, "?")
+			args = append(args, id)
+		}
+		query += " OR id IN (" + strings.Join(placeholders, ",") + ")"
+	}
+	query += " ORDER BY id LIMIT ?"
+	args = append(args, backplaneBatch)
+
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	for rows.Next() {
+		var id int64
+		var origin, data string
+		if err := rows.Scan(&id, &origin, &data); err != nil {
+			return err
+		}
+
+		if id > p.cursor {
+			// A jump wider than a batch is not a handful of slow inserts
+			if id-p.cursor <= backplaneBatch {
+				for missing := p.cursor + 1; missing < id; missing++ {
+					p.gaps[missing] = now.Add(backplaneGapWait)
+				}
+			}
+			p.cursor = id
+		} else {
+			delete(p.gaps, id)
+		}
+
+		if origin == p.instance {
+			continue
+		}
+		var env Envelope
+		if err := json.Unmarshal([]byte(data), &env); err != nil {
+			log.Printf("[Backplane] Skipping unreadable envelope %d: %v", id, err)
+			continue
+		}
+		deliver(env)
+	}
+
+	for id, deadline := range p.gaps {
+		if now.After(deadline) {
+			delete(p.gaps, id)
+		}
+	}
+	return rows.Err()
+}
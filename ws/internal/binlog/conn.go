@@ -0,0 +1,339 @@
+package binlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Client capability flags sent in the handshake response
+const (
+	clientLongPassword   = 0x00000001
+	clientLongFlag       = 0x00000004
+	clientProtocol41     = 0x00000200
+	clientTransactions   = 0x00002000
+	clientSecureConn     = 0x00008000
+	clientPluginAuth     = 0x00080000
+	clientCapabilities   = clientLongPassword | clientLongFlag | clientProtocol41 | clientTransactions | clientSecureConn | clientPluginAuth
+	maxPacketSize        = 1<<24 - 1
+	utf8mb4GeneralCI     = 45
+	nativePasswordPlugin = "mysql_native_password"
+)
+
+// Command bytes
+const (
+	comQuery      = 0x03
+	comBinlogDump = 0x12
+)
+
+// Packet headers
+const (
+	packetOK  = 0x00
+	packetEOF = 0xfe
+	packetErr = 0xff
+)
+
+// dialTimeout bounds connecting and authenticating to the primary
+const dialTimeout = 10 * time.Second
+
+// conn is a bare MySQL protocol connection. It only knows enough of the
+// protocol to log in with mysql_native_password, run simple statements and
+// read a binlog dump.
+type conn struct {
+	netConn net.Conn
+	reader  *bufio.Reader
+	seq     byte
+}
+
+// ServerError is an ERR packet sent by the server
+type ServerError struct {
+	Code    uint16
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error %d: %s", e.Code, e.Message)
+}
+
+func dial(addr, user, password string) (*conn, error) {
+	netConn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{netConn: netConn, reader: bufio.NewReaderSize(netConn, 64*1024)}
+
+	netConn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := c.handshake(user, password); err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("handshake: %w", err)
+	}
+	netConn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func (c *conn) Close() error {
+	return c.netConn.Close()
+}
+
+// readPacket reads one logical packet, joining payloads split across
+// maximum-size packets
+func (c *conn) readPacket() ([]byte, error) {
+	var payload []byte
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return nil, err
+		}
+		length := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+		c.seq = header[3] + 1
+
+		chunk := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, chunk); err != nil {
+			return nil, err
+		}
+		if payload == nil {
+			payload = chunk
+		} else {
+			payload = append(payload, chunk...)
+		}
+		if length < maxPacketSize {
+			return payload, nil
+		}
+	}
+}
+
+func (c *conn) writePacket(payload []byte) error {
+	for {
+		length := len(payload)
+		if length > maxPacketSize {
+			length = maxPacketSize
+		}
+		packet := make([]byte, 4+length)
+		packet[0] = byte(length)
+		packet[1] = byte(length >> 8)
+		packet[2] = byte(length >> 16)
+		packet[3] = c.seq
+		copy(packet[4:], payload[:length])
+		c.seq++
+
+		if _, err := c.netConn.Write(packet); err != nil {
+			return err
+		}
+		payload = payload[length:]
+		if length < maxPacketSize {
+			return nil
+		}
+	}
+}
+
+// writeCommand starts a new command, which resets the sequence id
+func (c *conn) writeCommand(command byte, body []byte) error {
+	c.seq = 0
+	return c.writePacket(append([]byte{command}, body...))
+}
+
+func parseError(packet []byte) error {
+	if len(packet) < 3 {
+		return errors.New("malformed error packet")
+	}
+	e := &ServerError{Code: binary.LittleEndian.Uint16(packet[1:3])}
+	message := packet[3:]
+	// Skip the '#' marker and five character SQL state
+	if len(message) > 6 && message[0] == '#' {
+		message = message[6:]
+	}
+	e.Message = string(message)
+	return e
+}
+
+// handshake answers the server greeting and completes authentication
+func (c *conn) handshake(user, password string) error {
+	greeting, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if len(greeting) > 0 && greeting[0] == packetErr {
+		return parseError(greeting)
+	}
+	if len(greeting) < 1 || greeting[0] != 10 {
+		return errors.New("unsupported protocol version")
+	}
+
+	// Protocol version, then the NUL-terminated server version
+	pos := 1
+	end := bytes.IndexByte(greeting[pos:], 0)
+	if end < 0 {
+		return errors.New("malformed greeting")
+	}
+	pos += end + 1
+
+	// Connection id, first 8 scramble bytes and a filler byte
+	if len(greeting) < pos+4+8+1+2 {
+		return errors.New("malformed greeting")
+	}
+	pos += 4
+	scramble := append([]byte{}, greeting[pos:pos+8]...)
+	pos += 9
+	capabilities := uint32(binary.LittleEndian.Uint16(greeting[pos : pos+2]))
+	pos += 2
+
+	if len(greeting) >= pos+16 {
+		// Character set and status flags, then the upper capability bits
+		pos += 3
+		capabilities |= uint32(binary.LittleEndian.Uint16(greeting[pos:pos+2])) << 16
+		pos += 2
+		scrambleLen := int(greeting[pos])
+		pos += 11
+
+		if capabilities&clientSecureConn != 0 {
+			n := scrambleLen - 8
+			if n < 13 {
+				n = 13
+			}
+			if len(greeting) < pos+n {
+				return errors.New("malformed greeting")
+			}
+			// The second part is NUL-terminated
+			scramble = append(scramble, bytes.TrimRight(greeting[pos:pos+n], "\x00")...)
+		}
+	}
+	if capabilities&clientProtocol41 == 0 {
+		return errors.New("server does not support protocol 4.1")
+	}
+
+	// Answer with a native password response even if the server defaults to
+	// another plugin; it replies with an auth switch we handle below
+	response := new(bytes.Buffer)
+	flags := clientCapabilities & (capabilities | clientLongPassword)
+	binary.Write(response, binary.LittleEndian, uint32(flags))
+	binary.Write(response, binary.LittleEndian, uint32(maxPacketSize))
+	response.WriteByte(utf8mb4GeneralCI)
+	response.Write(make([]byte, 23))
+	response.WriteString(user)
+	response.WriteByte(0)
+
+	auth := scrambleNativePassword(scramble, password)
+	response.WriteByte(byte(len(auth)))
+	response.Write(auth)
+	if flags&clientPluginAuth != 0 {
+		response.WriteString(nativePasswordPlugin)
+		response.WriteByte(0)
+	}
+
+	if err := c.writePacket(response.Bytes()); err != nil {
+		return err
+	}
+
+	for {
+		packet, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		if len(packet) == 0 {
+			return errors.New("empty authentication reply")
+		}
+
+		switch packet[0] {
+		case packetOK:
+			return nil
+		case packetErr:
+			return parseError(packet)
+		case packetEOF:
+			// Auth switch request: plugin name, then that plugin's scramble
+			body := packet[1:]
+			end := bytes.IndexByte(body, 0)
+			if end < 0 {
+				return errors.New("malformed auth switch request")
+			}
+			if name := string(body[:end]); name != nativePasswordPlugin {
+				return fmt.Errorf("unsupported authentication plugin %q, the replication user needs mysql_native_password", name)
+			}
+			scramble = bytes.TrimRight(body[end+1:], "\x00")
+			if err := c.writePacket(scrambleNativePassword(scramble, password)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected authentication reply 0x%02x", packet[0])
+		}
+	}
+}
+
+// scrambleNativePassword computes SHA1(password) XOR
+// SHA1(scramble + SHA1(SHA1(password)))
+func scrambleNativePassword(scramble []byte, password string) []byte {
+	if password == "" {
+		return []byte{}
+	}
+
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+
+	h := sha1.New()
+	h.Write(scramble)
+	h.Write(stage2[:])
+	result := h.Sum(nil)
+
+	for i := range result {
+		result[i] ^= stage1[i]
+	}
+	return result
+}
+
+// exec runs a statement that returns no rows
+func (c *conn) exec(query string) error {
+	if err := c.writeCommand(comQuery, []byte(query)); err != nil {
+		return err
+	}
+	packet, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if len(packet) == 0 {
+		return errors.New("empty query reply")
+	}
+	switch packet[0] {
+	case packetOK:
+		return nil
+	case packetErr:
+		return parseError(packet)
+	default:
+		return fmt.Errorf("%q returned a result set", query)
+	}
+}
+
+// startDump asks the server to stream the binlog from file and position
+func (c *conn) startDump(serverID uint32, file string, position uint32) error {
+	body := make([]byte, 10, 10+len(file))
+	binary.LittleEndian.PutUint32(body[0:4], position)
+	binary.LittleEndian.PutUint16(body[4:6], 0)
+	binary.LittleEndian.PutUint32(body[6:10], serverID)
+	body = append(body, file...)
+	return c.writeCommand(comBinlogDump, body)
+}
+
+// readEvent returns the next binlog event from a dump
+func (c *conn) readEvent() ([]byte, error) {
+	packet, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if len(packet) == 0 {
+		return nil, errors.New("empty binlog packet")
+	}
+	switch packet[0] {
+	case packetOK:
+		return packet[1:], nil
+	case packetErr:
+		return nil, parseError(packet)
+	case packetEOF:
+		return nil, io.EOF
+	default:
+		return nil, fmt.Errorf("unexpected binlog packet 0x%02x", packet[0])
+	}
+}
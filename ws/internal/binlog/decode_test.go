@@ -0,0 +1,292 @@
+package binlog
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unhex decodes event bytes written as hex, ignoring spaces
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatalf("bad hex %q: %v", s, err)
+	}
+	return b
+}
+
+func TestDecodeValue(t *testing.T) {
+	tests := []struct {
+		name       string
+		columnType byte
+		meta       uint16
+		data       string
+		want       string
+	}{
+		{"TINYINT", typeTiny, 0, "ff", "-1"},
+		{"SMALLINT", typeShort, 0, "2c01", "300"},
+		{"MEDIUMINT", typeInt24, 0, "feffff", "-2"},
+		{"INT", typeLong, 0, "40e20100", "123456"},
+		{"INT negative", typeLong, 0, "f9ffffff", "-7"},
+		{"BIGINT", typeLongLong, 0, "0000000000010000", "1099511627776"},
+		{"FLOAT", typeFloat, 4, "0000c03f", "1.5"},
+		{"DOUBLE", typeDouble, 8, "00000000000002c0", "-2.25"},
+		{"DECIMAL(10,2)", typeNewDecimal, 10<<8 | 2, "800004d238", "1234.56"},
+		{"DECIMAL(10,2) negative", typeNewDecimal, 10<<8 | 2, "7ffffb2dc7", "-1234.56"},
+		{"DECIMAL(20,10)", typeNewDecimal, 20<<8 | 10, "810dfb38d200bc614e09", "1234567890.0123456789"},
+		{"YEAR", typeYear, 0, "7c", "2024"},
+		{"YEAR zero", typeYear, 0, "00", "0000"},
+		{"DATE", typeDate, 0, "6fd00f", "2024-03-15"},
+		{"TIME old", typeTime, 0, "40e201", "12:34:56"},
+		{"TIME old negative", typeTime, 0, "c01dfe", "-12:34:56"},
+		{"DATETIME old", typeDatetime, 0, "4232cb9068120000", "2024-03-15 13:45:30"},
+		{"DATETIME(0)", typeDatetime2, 0, "99b2dedb5e", "2024-03-15 13:45:30"},
+		{"DATETIME(3)", typeDatetime2, 3, "99b2dedb5e04ce", "2024-03-15 13:45:30.123"},
+		{"DATETIME(6)", typeDatetime2, 6, "9963ff7efb00002a", "1999-12-31 23:59:59.000042"},
+		{"TIME(0) negative", typeTime2, 0, "7fef7d", "-01:02:03"},
+		{"TIME(0) max", typeTime2, 0, "b46efb", "838:59:59"},
+		{"TIMESTAMP old", typeTimestamp, 0, "00f15365", time.Unix(1700000000, 0).Format(time.DateTime)},
+		{"TIMESTAMP(0)", typeTimestamp2, 0, "6553f100", time.Unix(1700000000, 0).Format(time.DateTime)},
+		{"TIMESTAMP(2)", typeTimestamp2, 2, "6553f100 07", time.Unix(1700000000, 0).Format(time.DateTime) + ".07"},
+		{"VARCHAR(50)", typeVarchar, 200, "05 68656c6c6f", "hello"},
+		{"VARCHAR(300)", typeVarchar, 1200, "0500 68656c6c6f", "hello"},
+		{"VARCHAR empty", typeVarchar, 200, "00", ""},
+		{"CHAR(10)", typeString, 0xfe<<8 | 40, "03 616263", "abc"},
+		{"CHAR(100) utf8mb4", typeString, 0xee90, "0300 616263", "abc"},
+		{"ENUM", typeString, 0xf7<<8 | 1, "02", "2"},
+		{"SET", typeString, 0xf8<<8 | 1, "05", "5"},
+		{"TEXT", typeBlob, 2, "0300 616263", "abc"},
+		{"TINYBLOB", typeBlob, 1, "02 ffee", "\xff\xee"},
+		{"LONGTEXT", typeBlob, 4, "03000000 7b7d0a", "{}\n"},
+		{"BIT(3)", typeBit, 3, "05", "5"},
+		{"BIT(10)", typeBit, 1<<8 | 2, "0201", "513"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &reader{data: unhex(t, tt.data)}
+			got, err := decodeValue(r, tt.columnType, tt.meta)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if r.remaining() != 0 {
+				t.Errorf("%d bytes left over", r.remaining())
+			}
+		})
+	}
+}
+
+func TestDecodeValueErrors(t *testing.T) {
+	if _, err := decodeValue(&reader{data: unhex(t, "40e2")}, typeLong, 0); !errors.Is(err, errShort) {
+		t.Errorf("truncated INT: got %v, want errShort", err)
+	}
+	if _, err := decodeValue(&reader{data: unhex(t, "05 6162")}, typeVarchar, 200); !errors.Is(err, errShort) {
+		t.Errorf("truncated VARCHAR: got %v, want errShort", err)
+	}
+	if _, err := decodeValue(&reader{data: unhex(t, "00")}, typeDecimal, 0); err == nil {
+		t.Error("old DECIMAL decoded, want unsupported")
+	}
+}
+
+func TestFormatUnsigned(t *testing.T) {
+	tests := []struct {
+		text       string
+		columnType byte
+		want       string
+	}{
+		{"-1", typeTiny, "255"},
+		{"-1", typeShort, "65535"},
+		{"-2", typeInt24, "16777214"},
+		{"-1", typeLong, "4294967295"},
+		{"-1", typeLongLong, "18446744073709551615"},
+		{"42", typeLong, "42"},
+		{"-1.5", typeDouble, "-1.5"},
+	}
+	for _, tt := range tests {
+		if got := formatUnsigned(tt.text, tt.columnType); got != tt.want {
+			t.Errorf("formatUnsigned(%q, %d) = %q, want %q", tt.text, tt.columnType, got, tt.want)
+		}
+	}
+}
+
+func TestMemberNames(t *testing.T) {
+	tests := []struct {
+		columnType string
+		text       string
+		want       string
+	}{
+		{"enum('new','used','it''s broken')", "2", "used"},
+		{"enum('new','used','it''s broken')", "3", "it's broken"},
+		{"enum('new','used')", "0", ""},
+		{"set('a','b','c')", "5", "a,c"},
+		{"set('a','b','c')", "0", ""},
+	}
+	for _, tt := range tests {
+		members := parseMembers(tt.columnType)
+		got := memberNames(tt.text, members, strings.HasPrefix(tt.columnType, "set"))
+		if got != tt.want {
+			t.Errorf("%s value %s: got %q, want %q", tt.columnType, tt.text, got, tt.want)
+		}
+	}
+}
+
+// The table map and rows events below describe
+//
+//	CREATE TABLE grid.assets (
+//		id INT NOT NULL,
+//		name VARCHAR(50),
+//		price DECIMAL(10,2),
+//		status ENUM('new','used') NOT NULL,
+//		modified DATETIME NOT NULL
+//	) CHARSET utf8mb4
+const (
+	assetsTableMap = "2a0000000000 0100" + // table id 42, flags
+		"04 67726964 00" + // schema "grid"
+		"06 617373657473 00" + // table "assets"
+		"05 030ff6fe12" + // INT, VARCHAR, NEWDECIMAL, STRING, DATETIME2
+		"07 c800 0a02 f701 00" + // metadata
+		"06" // name and price are nullable
+
+	// UPDATE grid.assets SET name = 'new', price = 1234.56, status = 'used'
+	// WHERE id = 7, from name 'old' and a NULL price
+	assetsUpdateV2 = "2a0000000000 0100 0200" + // table id, flags, no extra data
+		"05 1f 1f" + // every column before and after
+		"04 07000000 03 6f6c64 01 99b2dedb5e" +
+		"00 07000000 03 6e6577 800004d238 02 99b2dedb5e"
+
+	// DELETE FROM grid.assets WHERE id = 7 with binlog_row_image=MINIMAL
+	assetsDeleteMinimalV1 = "2a0000000000 0100" +
+		"05 01" + // only the primary key
+		"00 07000000"
+)
+
+func TestParseTableMap(t *testing.T) {
+	tm, err := parseTableMap(unhex(t, assetsTableMap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &tableMap{
+		ID:       42,
+		Schema:   "grid",
+		Table:    "assets",
+		Types:    []byte{typeLong, typeVarchar, typeNewDecimal, typeString, typeDatetime2},
+		Meta:     []uint16{0, 200, 10<<8 | 2, 0xf701, 0},
+		Nullable: []bool{false, true, true, false, false},
+	}
+	if !reflect.DeepEqual(tm, want) {
+		t.Fatalf("got %+v, want %+v", tm, want)
+	}
+
+	if _, err := parseTableMap(unhex(t, assetsTableMap[:40])); err == nil {
+		t.Error("truncated table map parsed")
+	}
+}
+
+func TestParseRowsEvent(t *testing.T) {
+	tm, err := parseTableMap(unhex(t, assetsTableMap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := map[uint64]*tableMap{tm.ID: tm}
+
+	tests := []struct {
+		name      string
+		eventType byte
+		body      string
+		want      [][]Value
+	}{
+		{"update v2", updateRowsEventV2, assetsUpdateV2, [][]Value{
+			{{Text: "7"}, {Text: "old"}, {Null: true}, {Text: "1"}, {Text: "2024-03-15 13:45:30"}},
+			{{Text: "7"}, {Text: "new"}, {Text: "1234.56"}, {Text: "2"}, {Text: "2024-03-15 13:45:30"}},
+		}},
+		{"minimal delete v1", deleteRowsEventV1, assetsDeleteMinimalV1, [][]Value{
+			{{Text: "7"}, {Missing: true}, {Missing: true}, {Missing: true}, {Missing: true}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action, v2, ok := rowsEventVersion(tt.eventType)
+			if !ok {
+				t.Fatalf("event type %d is not a rows event", tt.eventType)
+			}
+			body := unhex(t, tt.body)
+			if id := rowsEventTableID(body); id != 42 {
+				t.Fatalf("table id %d, want 42", id)
+			}
+			ev, got, err := parseRowsEvent(body, v2, action, tables)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tm {
+				t.Errorf("resolved table %+v", got)
+			}
+			if !reflect.DeepEqual(ev.Rows, tt.want) {
+				t.Errorf("rows %+v, want %+v", ev.Rows, tt.want)
+			}
+		})
+	}
+
+	// Rows of a table whose map has not been seen cannot be decoded
+	if _, _, err := parseRowsEvent(unhex(t, assetsUpdateV2), true, ActionUpdate, nil); err == nil {
+		t.Error("rows event for an unknown table parsed")
+	}
+}
+
+func TestRowValues(t *testing.T) {
+	tm := &tableMap{Types: []byte{typeTiny, typeString, typeString, typeVarchar}}
+	columns := []column{
+		{Name: "age", Unsigned: true},
+		{Name: "status", Members: []string{"new", "used"}},
+		{Name: "tags", Members: []string{"a", "b", "c"}, Set: true},
+		{Name: "name"},
+	}
+	values := rowValues(tm, columns, []Value{{Text: "-56"}, {Text: "2"}, {Text: "6"}, {Null: true}})
+
+	if got := *values["age"]; got != "200" {
+		t.Errorf("age %q, want 200", got)
+	}
+	if got := *values["status"]; got != "used" {
+		t.Errorf("status %q, want used", got)
+	}
+	if got := *values["tags"]; got != "b,c" {
+		t.Errorf("tags %q, want b,c", got)
+	}
+	if name, ok := values["name"]; !ok || name != nil {
+		t.Errorf("name %v, want NULL", name)
+	}
+}
+
+func TestParseHeaderAndSmallEvents(t *testing.T) {
+	// A rotate event as the primary sends it when the dump starts
+	header, err := parseHeader(unhex(t, "00000000 04 01000000 2c000000 00000000 2000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != (eventHeader{Type: rotateEvent, ServerID: 1, Size: 44, Flags: 0x20}) {
+		t.Errorf("header %+v", header)
+	}
+	if _, err := parseHeader(unhex(t, "0000")); err == nil {
+		t.Error("short header parsed")
+	}
+
+	file, position, err := parseRotate(unhex(t, "0400000000000000 6d7973716c2d62696e2e303030303032"))
+	if err != nil || file != "mysql-bin.000002" || position != 4 {
+		t.Errorf("rotate to %s:%d (%v)", file, position, err)
+	}
+
+	// thread id, exec time, schema length, error code, two bytes of status
+	// variables, schema "grid" and the statement
+	query, err := parseQuery(unhex(t, "05000000 00000000 04 0000 0200 0000 67726964 00 424547494e"))
+	if err != nil || query != "BEGIN" {
+		t.Errorf("query %q (%v)", query, err)
+	}
+	if _, err := parseQuery(unhex(t, "05000000 00000000 04 0000 ff00")); err == nil {
+		t.Error("query event with missing status variables parsed")
+	}
+}
@@ -0,0 +1,241 @@
+package binlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Binlog event types this reader handles. Everything else is skipped.
+const (
+	queryEvent             = 2
+	rotateEvent            = 4
+	formatDescriptionEvent = 15
+	xidEvent               = 16
+	tableMapEvent          = 19
+	writeRowsEventV1       = 23
+	updateRowsEventV1      = 24
+	deleteRowsEventV1      = 25
+	writeRowsEventV2       = 30
+	updateRowsEventV2      = 31
+	deleteRowsEventV2      = 32
+
+	// MariaDB writes these instead when log_bin_compress is on
+	writeRowsCompressedEventV1  = 166
+	deleteRowsCompressedEventV2 = 171
+)
+
+// eventHeaderSize is the v4 event header: timestamp, type, server id, event
+// size, next position and flags
+const eventHeaderSize = 19
+
+type eventHeader struct {
+	Type     byte
+	ServerID uint32
+	Size     uint32
+	LogPos   uint32
+	Flags    uint16
+}
+
+func parseHeader(data []byte) (eventHeader, error) {
+	if len(data) < eventHeaderSize {
+		return eventHeader{}, errors.New("short event header")
+	}
+	return eventHeader{
+		Type:     data[4],
+		ServerID: binary.LittleEndian.Uint32(data[5:9]),
+		Size:     binary.LittleEndian.Uint32(data[9:13]),
+		LogPos:   binary.LittleEndian.Uint32(data[13:17]),
+		Flags:    binary.LittleEndian.Uint16(data[17:19]),
+	}, nil
+}
+
+// tableMap describes a table as the binlog references it in row events
+type tableMap struct {
+	ID       uint64
+	Schema   string
+	Table    string
+	Types    []byte
+	Meta     []uint16
+	Nullable []bool
+}
+
+// parseRotate returns the next binlog file name and position
+func parseRotate(body []byte) (string, uint32, error) {
+	if len(body) < 8 {
+		return "", 0, errors.New("short rotate event")
+	}
+	return string(body[8:]), uint32(binary.LittleEndian.Uint64(body[0:8])), nil
+}
+
+// parseQuery returns the statement text of a query event
+func parseQuery(body []byte) (string, error) {
+	// thread id, exec time, schema length, error code, status vars length
+	if len(body) < 13 {
+		return "", errors.New("short query event")
+	}
+	schemaLen := int(body[8])
+	statusLen := int(binary.LittleEndian.Uint16(body[11:13]))
+	start := 13 + statusLen + schemaLen + 1
+	if start > len(body) {
+		return "", errors.New("short query event")
+	}
+	return string(body[start:]), nil
+}
+
+func parseTableMap(body []byte) (*tableMap, error) {
+	r := &reader{data: body}
+	tm := &tableMap{ID: r.uint48()}
+	r.skip(2)
+
+	tm.Schema = string(r.bytes(int(r.uint8())))
+	r.skip(1)
+	tm.Table = string(r.bytes(int(r.uint8())))
+	r.skip(1)
+
+	count := int(r.lenenc())
+	tm.Types = r.bytes(count)
+	meta := &reader{data: r.bytes(int(r.lenenc()))}
+	nulls := r.bytes((count + 7) / 8)
+	if r.err != nil {
+		return nil, fmt.Errorf("table map: %w", r.err)
+	}
+
+	tm.Meta = make([]uint16, count)
+	tm.Nullable = make([]bool, count)
+	for i, t := range tm.Types {
+		switch t {
+		case typeFloat, typeDouble, typeBlob, typeGeometry, typeJSON,
+			typeTimestamp2, typeDatetime2, typeTime2:
+			tm.Meta[i] = uint16(meta.uint8())
+		case typeVarchar, typeVarString, typeBit:
+			tm.Meta[i] = meta.uint16()
+		case typeNewDecimal, typeString, typeEnum, typeSet:
+			// Big-endian: precision then scale, or real type then length
+			tm.Meta[i] = uint16(meta.uint8())<<8 | uint16(meta.uint8())
+		}
+		tm.Nullable[i] = nulls[i/8]&(1<<(i%8)) != 0
+	}
+	if meta.err != nil {
+		return nil, fmt.Errorf("table map metadata: %w", meta.err)
+	}
+	return tm, nil
+}
+
+// rowsEvent is a decoded WRITE, UPDATE or DELETE rows event. Rows hold full
+// images; an update has its before and after images in consecutive pairs.
+type rowsEvent struct {
+	TableID uint64
+	Flags   uint16
+	Rows    [][]Value
+}
+
+func rowsEventVersion(eventType byte) (action Action, v2 bool, ok bool) {
+	switch eventType {
+	case writeRowsEventV1:
+		return ActionInsert, false, true
+	case updateRowsEventV1:
+		return ActionUpdate, false, true
+	case deleteRowsEventV1:
+		return ActionDelete, false, true
+	case writeRowsEventV2:
+		return ActionInsert, true, true
+	case updateRowsEventV2:
+		return ActionUpdate, true, true
+	case deleteRowsEventV2:
+		return ActionDelete, true, true
+	}
+	return "", false, false
+}
+
+// rowsEventTableID reads just the table id so events for tables nobody
+// watches are skipped without decoding them
+func rowsEventTableID(body []byte) uint64 {
+	r := &reader{data: body}
+	return r.uint48()
+}
+
+func parseRowsEvent(body []byte, v2 bool, action Action, tables map[uint64]*tableMap) (*rowsEvent, *tableMap, error) {
+	r := &reader{data: body}
+	ev := &rowsEvent{TableID: r.uint48(), Flags: r.uint16()}
+	if v2 {
+		// The extra data length counts its own two bytes
+		extra := int(r.uint16())
+		if extra > 2 {
+			r.skip(extra - 2)
+		}
+	}
+
+	tm, ok := tables[ev.TableID]
+	if !ok {
+		return nil, nil, fmt.Errorf("rows event for unknown table id %d", ev.TableID)
+	}
+
+	count := int(r.lenenc())
+	if count != len(tm.Types) {
+		return nil, nil, fmt.Errorf("%s.%s: rows event has %d columns, table map has %d", tm.Schema, tm.Table, count, len(tm.Types))
+	}
+	present := r.bytes((count + 7) / 8)
+	presentAfter := present
+	if action == ActionUpdate {
+		presentAfter = r.bytes((count + 7) / 8)
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+
+	for r.remaining() > 0 {
+		row, err := parseRowImage(r, tm, present)
+		if err != nil {
+			return nil, nil, err
+		}
+		ev.Rows = append(ev.Rows, row)
+
+		if action == ActionUpdate {
+			after, err := parseRowImage(r, tm, presentAfter)
+			if err != nil {
+				return nil, nil, err
+			}
+			ev.Rows = append(ev.Rows, after)
+		}
+	}
+	return ev, tm, nil
+}
+
+// parseRowImage reads one row image. Columns missing from the image (with
+// binlog_row_image=MINIMAL) are left as Missing values.
+func parseRowImage(r *reader, tm *tableMap, present []byte) ([]Value, error) {
+	count := len(tm.Types)
+	included := 0
+	for i := 0; i < count; i++ {
+		if present[i/8]&(1<<(i%8)) != 0 {
+			included++
+		}
+	}
+	nulls := r.bytes((included + 7) / 8)
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	row := make([]Value, count)
+	n := 0
+	for i := 0; i < count; i++ {
+		if present[i/8]&(1<<(i%8)) == 0 {
+			row[i] = Value{Missing: true}
+			continue
+		}
+		isNull := nulls[n/8]&(1<<(n%8)) != 0
+		n++
+		if isNull {
+			row[i] = Value{Null: true}
+			continue
+		}
+
+		text, err := decodeValue(r, tm.Types[i], tm.Meta[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s column %d: %w", tm.Schema, tm.Table, i, err)
+		}
+		row[i] = Value{Text: text}
+	}
+	return row, r.err
+}
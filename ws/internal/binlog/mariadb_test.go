@@ -0,0 +1,142 @@
+//go:build mariadb
+
+package binlog
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Runs against a real server with
+//
+//	WS_TEST_MARIADB_DSN='root:secret@tcp(127.0.0.1:3306)/test' go test -tags mariadb ./internal/binlog/
+//
+// The server needs log_bin and binlog_format=ROW, and the user the
+// REPLICATION SLAVE grant.
+
+const testTable = "binlog_stream_test"
+
+func TestStreamAgainstMariaDB(t *testing.T) {
+	dsn := os.Getenv("WS_TEST_MARIADB_DSN")
+	if dsn == "" {
+		t.Skip("WS_TEST_MARIADB_DSN is not set")
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	exec := func(query string, args ...any) {
+		t.Helper()
+		if _, err := db.Exec(query, args...); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	exec("DROP TABLE IF EXISTS " + testTable)
+	exec(`CREATE TABLE ` + testTable + ` (
+		id INT UNSIGNED NOT NULL PRIMARY KEY,
+		name VARCHAR(50) NULL,
+		price DECIMAL(10,2) NULL,
+		status ENUM('new','used') NOT NULL,
+		tags SET('a','b','c') NOT NULL,
+		flags BIT(3) NOT NULL,
+		qty TINYINT UNSIGNED NOT NULL,
+		born DATE NULL,
+		modified DATETIME(3) NOT NULL,
+		note TEXT NULL
+	) CHARSET utf8mb4`)
+	defer db.Exec("DROP TABLE IF EXISTS " + testTable)
+
+	stream := NewStream(Config{
+		Addr:     cfg.Addr,
+		User:     cfg.User,
+		Password: cfg.Passwd,
+		ServerID: 4242,
+		Schema:   cfg.DBName,
+		Tables:   []string{testTable},
+	}, db)
+	// Start from here, so the statements below are in the stream even if
+	// they run before it connects
+	if err := stream.readMasterStatus(); err != nil {
+		t.Fatal(err)
+	}
+
+	exec("INSERT INTO " + testTable + " VALUES (7, 'drill', 1234.56, 'used', 'a,c', b'101', 200, '2024-03-15', '2024-03-15 13:45:30.123', NULL)")
+	exec("UPDATE " + testTable + " SET name = NULL, price = -0.5, qty = 255 WHERE id = 7")
+	exec("DELETE FROM " + testTable + " WHERE id = 7")
+
+	shutdown := make(chan struct{})
+	batches := make(chan []RowChange, 3)
+	stopped := make(chan struct{})
+	go func() {
+		stream.Run(shutdown, func(rows []RowChange) { batches <- rows })
+		close(stopped)
+	}()
+	defer func() {
+		close(shutdown)
+		<-stopped
+	}()
+
+	next := func(action Action) RowChange {
+		t.Helper()
+		select {
+		case rows := <-batches:
+			if len(rows) != 1 || rows[0].Table != testTable || rows[0].Action != action {
+				t.Fatalf("got %+v, want one %s", rows, action)
+			}
+			return rows[0]
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no %s from the binlog", action)
+		}
+		return RowChange{}
+	}
+	expect := func(what string, values map[string]*string, want map[string]string, null ...string) {
+		t.Helper()
+		for name, text := range want {
+			if v, ok := values[name]; !ok || v == nil || *v != text {
+				t.Errorf("%s %s = %v, want %q", what, name, v, text)
+			}
+		}
+		for _, name := range null {
+			if v, ok := values[name]; !ok || v != nil {
+				t.Errorf("%s %s = %v, want NULL", what, name, v)
+			}
+		}
+	}
+
+	inserted := map[string]string{
+		"id":       "7",
+		"name":     "drill",
+		"price":    "1234.56",
+		"status":   "used",
+		"tags":     "a,c",
+		"flags":    "5",
+		"qty":      "200",
+		"born":     "2024-03-15",
+		"modified": "2024-03-15 13:45:30.123",
+	}
+	insert := next(ActionInsert)
+	if len(insert.Before) != 0 {
+		t.Errorf("insert has a before image %v", insert.Before)
+	}
+	expect("insert", insert.After, inserted, "note")
+
+	update := next(ActionUpdate)
+	expect("update before", update.Before, inserted, "note")
+	expect("update after", update.After, map[string]string{"id": "7", "price": "-0.50", "qty": "255"}, "name", "note")
+
+	deleted := next(ActionDelete)
+	if len(deleted.After) != 0 {
+		t.Errorf("delete has an after image %v", deleted.After)
+	}
+	expect("delete", deleted.Before, map[string]string{"id": "7", "qty": "255"})
+}
@@ -0,0 +1,456 @@
+// Package binlog follows a MariaDB primary's binary log as a replication
+// client and hands committed row changes for a set of watched tables to a
+// callback, one call per transaction.
+//
+// The server needs row-based logging and a user that may replicate:
+//
+//	[mysqld]
+//	log_bin          = mysql-bin
+//	binlog_format    = ROW
+//	binlog_row_image = FULL
+//	server_id        = 1
+//
+//	GRANT REPLICATION SLAVE, REPLICATION CLIENT ON *.* TO 'asset_ws'@'%';
+//
+// For a local MariaDB container the same settings can be passed as flags:
+// docker run -e MARIADB_ROOT_PASSWORD=... mariadb:11 --log-bin --binlog-format=ROW --server-id=1
+package binlog
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Action is the kind of row change
+type Action string
+
+const (
+	ActionInsert Action = "insert"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+)
+
+// retryDelay is how long Run waits before reconnecting after an error
+const retryDelay = 5 * time.Second
+
+// maxTransactionRows flushes very large transactions (bulk imports) in parts
+// rather than holding every row until the commit
+const maxTransactionRows = 1000
+
+// Config holds the replication connection settings
+type Config struct {
+	// Addr is the primary's host:port
+	Addr     string
+	User     string
+	Password string
+	// ServerID identifies this client to the primary and must not clash
+	// with any real replica
+	ServerID uint32
+	// Schema is the database holding the watched tables
+	Schema string
+	// Tables lists the tables whose rows are reported
+	Tables []string
+}
+
+// RowChange is one changed row of a watched table. Before is empty for
+// inserts and After is empty for deletes. Values are nil for SQL NULL.
+type RowChange struct {
+	Table  string
+	Action Action
+	Before map[string]*string
+	After  map[string]*string
+}
+
+// column is what the stream knows about a table column from
+// information_schema; the binlog itself only carries types
+type column struct {
+	Name     string
+	Unsigned bool
+	// Members of an ENUM or SET, in declaration order
+	Members []string
+	Set     bool
+}
+
+// Stream follows the binlog. It is not safe for concurrent use.
+type Stream struct {
+	config  Config
+	db      *sql.DB
+	watched map[string]bool
+
+	// Position of the last transaction handed to the callback; reconnects
+	// resume from here
+	file     string
+	position uint32
+
+	checksum bool
+	tables   map[uint64]*tableMap
+	columns  map[string][]column
+	pending  []RowChange
+}
+
+// NewStream creates a stream for config. db is a regular connection to the
+// same server, used for the starting position and column names.
+func NewStream(config Config, db *sql.DB) *Stream {
+	watched := make(map[string]bool, len(config.Tables))
+	for _, table := range config.Tables {
+		watched[table] = true
+	}
+	return &Stream{
+		config:  config,
+		db:      db,
+		watched: watched,
+		columns: make(map[string][]column),
+	}
+}
+
+// Run follows the binlog from its current end until shutdown is closed,
+// calling handle with the watched rows of each committed transaction.
+// Connection errors are logged and retried.
+func (s *Stream) Run(shutdown <-chan struct{}, handle func([]RowChange)) {
+	for {
+		err := s.follow(shutdown, handle)
+		select {
+		case <-shutdown:
+			return
+		default:
+		}
+		log.Printf("[Binlog] Replication stopped, retrying in %s: %v", retryDelay, err)
+
+		select {
+		case <-shutdown:
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// follow runs one replication connection until it fails
+func (s *Stream) follow(shutdown <-chan struct{}, handle func([]RowChange)) error {
+	if s.file == "" {
+		if err := s.readMasterStatus(); err != nil {
+			return fmt.Errorf("reading binlog position: %w", err)
+		}
+	}
+
+	var checksum string
+	if err := s.db.QueryRow("SELECT @@global.binlog_checksum").Scan(&checksum); err != nil {
+		return fmt.Errorf("reading binlog_checksum: %w", err)
+	}
+	s.checksum = !strings.EqualFold(checksum, "NONE")
+
+	c, err := dial(s.config.Addr, s.config.User, s.config.Password)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Closing the connection is the only way to interrupt a blocking read
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-shutdown:
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	// Tell the server we understand its checksums and MariaDB's own events
+	if err := c.exec("SET @master_binlog_checksum = @@global.binlog_checksum"); err != nil {
+		return err
+	}
+	if err := c.exec("SET @mariadb_slave_capability = 4"); err != nil {
+		return err
+	}
+	if err := c.startDump(s.config.ServerID, s.file, s.position); err != nil {
+		return err
+	}
+	log.Printf("[Binlog] Following %s from %s:%d", s.config.Addr, s.file, s.position)
+
+	s.tables = make(map[uint64]*tableMap)
+	s.pending = nil
+	file := s.file
+
+	for {
+		data, err := c.readEvent()
+		if err == io.EOF {
+			return fmt.Errorf("server ended the dump")
+		}
+		if err != nil {
+			return err
+		}
+
+		header, err := parseHeader(data)
+		if err != nil {
+			return err
+		}
+		body := data[eventHeaderSize:]
+		// The format description event always carries its checksum
+		// algorithm byte; the CRC32 itself trails every event
+		if s.checksum && len(body) >= 4 {
+			body = body[:len(body)-4]
+		}
+
+		switch header.Type {
+		case rotateEvent:
+			next, _, err := parseRotate(body)
+			if err != nil {
+				return err
+			}
+			file = next
+
+		case tableMapEvent:
+			tm, err := parseTableMap(body)
+			if err != nil {
+				return err
+			}
+			s.tables[tm.ID] = tm
+
+		case queryEvent:
+			query, err := parseQuery(body)
+			if err != nil {
+				return err
+			}
+			switch strings.ToUpper(strings.TrimSpace(query)) {
+			case "BEGIN":
+			case "COMMIT":
+				s.commit(file, header.LogPos, handle)
+			default:
+				// DDL may have changed column names or order
+				s.columns = make(map[string][]column)
+				s.commit(file, header.LogPos, handle)
+			}
+
+		case xidEvent:
+			s.commit(file, header.LogPos, handle)
+
+		case writeRowsEventV1, updateRowsEventV1, deleteRowsEventV1,
+			writeRowsEventV2, updateRowsEventV2, deleteRowsEventV2:
+			if err := s.handleRows(header, body); err != nil {
+				// A row we cannot decode is dropped rather than stalling the feed
+				log.Printf("[Binlog] Skipping rows event at %s:%d: %v", file, header.LogPos, err)
+			}
+			if len(s.pending) >= maxTransactionRows {
+				s.flush(handle)
+			}
+
+		default:
+			if header.Type >= writeRowsCompressedEventV1 && header.Type <= deleteRowsCompressedEventV2 {
+				log.Printf("[Binlog] Compressed row events are not supported, disable log_bin_compress")
+			}
+		}
+	}
+}
+
+// readMasterStatus starts the stream at the end of the current binlog
+func (s *Stream) readMasterStatus() error {
+	rows, err := s.db.Query("SHOW MASTER STATUS")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("binary logging is not enabled on the server")
+	}
+
+	values := make([]sql.RawBytes, len(names))
+	targets := make([]any, len(names))
+	for i := range values {
+		targets[i] = &values[i]
+	}
+	if err := rows.Scan(targets...); err != nil {
+		return err
+	}
+	if len(values) < 2 {
+		return fmt.Errorf("unexpected SHOW MASTER STATUS result")
+	}
+
+	position, err := strconv.ParseUint(string(values[1]), 10, 32)
+	if err != nil {
+		return err
+	}
+	s.file = string(values[0])
+	s.position = uint32(position)
+	return nil
+}
+
+// handleRows decodes a rows event for a watched table into pending changes
+func (s *Stream) handleRows(header eventHeader, body []byte) error {
+	action, v2, _ := rowsEventVersion(header.Type)
+
+	tm, ok := s.tables[rowsEventTableID(body)]
+	if !ok || tm.Schema != s.config.Schema || !s.watched[tm.Table] {
+		return nil
+	}
+
+	ev, tm, err := parseRowsEvent(body, v2, action, s.tables)
+	if err != nil {
+		return err
+	}
+	columns, err := s.tableColumns(tm)
+	if err != nil {
+		return err
+	}
+
+	if action == ActionUpdate {
+		for i := 0; i+1 < len(ev.Rows); i += 2 {
+			s.pending = append(s.pending, RowChange{
+				Table:  tm.Table,
+				Action: action,
+				Before: rowValues(tm, columns, ev.Rows[i]),
+				After:  rowValues(tm, columns, ev.Rows[i+1]),
+			})
+		}
+		return nil
+	}
+
+	for _, row := range ev.Rows {
+		change := RowChange{Table: tm.Table, Action: action}
+		if action == ActionInsert {
+			change.After = rowValues(tm, columns, row)
+		} else {
+			change.Before = rowValues(tm, columns, row)
+		}
+		s.pending = append(s.pending, change)
+	}
+	return nil
+}
+
+// tableColumns returns a table's columns in ordinal order, reloading them
+// when the binlog shows a different column count than the cache
+func (s *Stream) tableColumns(tm *tableMap) ([]column, error) {
+	key := tm.Schema + "." + tm.Table
+	if columns, ok := s.columns[key]; ok && len(columns) == len(tm.Types) {
+		return columns, nil
+	}
+
+	rows, err := s.db.Query(`
+		SELECT COLUMN_NAME, COLUMN_TYPE
+		FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?
+		ORDER BY ORDINAL_POSITION
+	`, tm.Schema, tm.Table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []column
+	for rows.Next() {
+		var name, columnType string
+		if err := rows.Scan(&name, &columnType); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column{
+			Name:     name,
+			Unsigned: strings.Contains(columnType, "unsigned"),
+			Members:  parseMembers(columnType),
+			Set:      strings.HasPrefix(columnType, "set"),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(columns) != len(tm.Types) {
+		return nil, fmt.Errorf("%s has %d columns, binlog row has %d", key, len(columns), len(tm.Types))
+	}
+
+	s.columns[key] = columns
+	return columns, nil
+}
+
+// parseMembers returns the members of an enum('a','b') or set('a','b')
+// column type
+func parseMembers(columnType string) []string {
+	open := strings.IndexByte(columnType, '(')
+	if open < 0 || !(strings.HasPrefix(columnType, "enum") || strings.HasPrefix(columnType, "set")) {
+		return nil
+	}
+	list := strings.TrimSuffix(columnType[open+1:], ")")
+
+	var members []string
+	for _, quoted := range strings.Split(list, "','") {
+		members = append(members, strings.ReplaceAll(strings.Trim(quoted, "'"), "''", "'"))
+	}
+	return members
+}
+
+// rowValues names a row image's columns, leaving out columns the image
+// does not include
+func rowValues(tm *tableMap, columns []column, row []Value) map[string]*string {
+	values := make(map[string]*string, len(row))
+	for i, value := range row {
+		if value.Missing {
+			continue
+		}
+		if value.Null {
+			values[columns[i].Name] = nil
+			continue
+		}
+
+		text := value.Text
+		col := columns[i]
+		switch {
+		case col.Unsigned:
+			text = formatUnsigned(text, tm.Types[i])
+		case col.Members != nil:
+			text = memberNames(text, col.Members, col.Set)
+		}
+		values[col.Name] = &text
+	}
+	return values
+}
+
+// memberNames turns an ENUM index or SET bitmask into member names
+func memberNames(text string, members []string, set bool) string {
+	v, err := strconv.ParseUint(text, 10, 64)
+	if err != nil {
+		return text
+	}
+	if !set {
+		if v == 0 || int(v) > len(members) {
+			return ""
+		}
+		return members[v-1]
+	}
+
+	var names []string
+	for i, member := range members {
+		if v&(1<<i) != 0 {
+			names = append(names, member)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// commit hands the finished transaction's rows to the callback and records
+// where to resume
+func (s *Stream) commit(file string, position uint32, handle func([]RowChange)) {
+	s.flush(handle)
+	if position > 0 {
+		s.file = file
+		s.position = position
+	}
+}
+
+func (s *Stream) flush(handle func([]RowChange)) {
+	if len(s.pending) == 0 {
+		return
+	}
+	rows := s.pending
+	s.pending = nil
+	handle(rows)
+}
@@ -0,0 +1,349 @@
+package binlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Column types as they appear in table map events
+const (
+	typeDecimal    = 0
+	typeTiny       = 1
+	typeShort      = 2
+	typeLong       = 3
+	typeFloat      = 4
+	typeDouble     = 5
+	typeNull       = 6
+	typeTimestamp  = 7
+	typeLongLong   = 8
+	typeInt24      = 9
+	typeDate       = 10
+	typeTime       = 11
+	typeDatetime   = 12
+	typeYear       = 13
+	typeVarchar    = 15
+	typeBit        = 16
+	typeTimestamp2 = 17
+	typeDatetime2  = 18
+	typeTime2      = 19
+	typeJSON       = 245
+	typeNewDecimal = 246
+	typeEnum       = 247
+	typeSet        = 248
+	typeBlob       = 252
+	typeVarString  = 253
+	typeString     = 254
+	typeGeometry   = 255
+)
+
+var errShort = errors.New("event truncated")
+
+// Value is one column of a row image, formatted the way the SQL layer
+// prints it. Integers are signed; Stream reinterprets unsigned columns.
+type Value struct {
+	Text    string
+	Null    bool
+	Missing bool
+}
+
+// reader walks an event body. The first read past the end sets err and
+// every later read returns zero values.
+type reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *reader) remaining() int {
+	return len(r.data) - r.pos
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || r.pos+n > len(r.data) {
+		r.err = errShort
+		return make([]byte, max(n, 0))
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *reader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *reader) uint8() uint8 {
+	return r.bytes(1)[0]
+}
+
+func (r *reader) uint16() uint16 {
+	return binary.LittleEndian.Uint16(r.bytes(2))
+}
+
+func (r *reader) uint24() uint32 {
+	b := r.bytes(3)
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func (r *reader) uint32() uint32 {
+	return binary.LittleEndian.Uint32(r.bytes(4))
+}
+
+func (r *reader) uint48() uint64 {
+	b := r.bytes(6)
+	return uint64(binary.LittleEndian.Uint32(b[0:4])) | uint64(binary.LittleEndian.Uint16(b[4:6]))<<32
+}
+
+func (r *reader) uint64() uint64 {
+	return binary.LittleEndian.Uint64(r.bytes(8))
+}
+
+// uintN reads an n-byte little-endian unsigned integer
+func (r *reader) uintN(n int) uint64 {
+	var v uint64
+	for i, b := range r.bytes(n) {
+		v |= uint64(b) << (8 * i)
+	}
+	return v
+}
+
+// bigEndian reads an n-byte big-endian unsigned integer
+func (r *reader) bigEndian(n int) uint64 {
+	var v uint64
+	for _, b := range r.bytes(n) {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// lenenc reads a length-encoded integer
+func (r *reader) lenenc() uint64 {
+	first := r.uint8()
+	switch {
+	case first < 0xfb:
+		return uint64(first)
+	case first == 0xfc:
+		return uint64(r.uint16())
+	case first == 0xfd:
+		return uint64(r.uint24())
+	case first == 0xfe:
+		return r.uint64()
+	}
+	return 0
+}
+
+// decodeValue reads one non-NULL column value and formats it
+func decodeValue(r *reader, columnType byte, meta uint16) (string, error) {
+	// CHAR, ENUM and SET all arrive as STRING with the real type in the
+	// metadata. Long CHAR columns fold two length bits into the type byte.
+	if columnType == typeString && meta >= 256 {
+		realType := byte(meta >> 8)
+		if realType&0x30 != 0x30 {
+			meta = uint16(byte(meta)) | uint16((realType&0x30)^0x30)<<4
+			realType |= 0x30
+		} else {
+			meta = meta & 0xff
+		}
+		columnType = realType
+	}
+
+	var text string
+	switch columnType {
+	case typeTiny:
+		text = strconv.FormatInt(int64(int8(r.uint8())), 10)
+	case typeShort:
+		text = strconv.FormatInt(int64(int16(r.uint16())), 10)
+	case typeInt24:
+		v := int32(r.uint24()<<8) >> 8
+		text = strconv.FormatInt(int64(v), 10)
+	case typeLong:
+		text = strconv.FormatInt(int64(int32(r.uint32())), 10)
+	case typeLongLong:
+		text = strconv.FormatInt(int64(r.uint64()), 10)
+	case typeFloat:
+		text = strconv.FormatFloat(float64(math.Float32frombits(r.uint32())), 'g', -1, 32)
+	case typeDouble:
+		text = strconv.FormatFloat(math.Float64frombits(r.uint64()), 'g', -1, 64)
+	case typeNewDecimal:
+		text = decodeDecimal(r, int(meta>>8), int(meta&0xff))
+	case typeYear:
+		v := int(r.uint8())
+		if v > 0 {
+			v += 1900
+		}
+		text = fmt.Sprintf("%04d", v)
+	case typeDate:
+		v := r.uint24()
+		text = fmt.Sprintf("%04d-%02d-%02d", v>>9, (v>>5)&15, v&31)
+	case typeTime:
+		v := int32(r.uint24()<<8) >> 8
+		sign := ""
+		if v < 0 {
+			sign, v = "-", -v
+		}
+		text = fmt.Sprintf("%s%02d:%02d:%02d", sign, v/10000, v/100%100, v%100)
+	case typeDatetime:
+		v := r.uint64()
+		date, clock := v/1000000, v%1000000
+		text = fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", date/10000, date/100%100, date%100, clock/10000, clock/100%100, clock%100)
+	case typeTimestamp:
+		text = time.Unix(int64(r.uint32()), 0).Format(time.DateTime)
+	case typeTimestamp2:
+		seconds := int64(r.bigEndian(4))
+		text = time.Unix(seconds, 0).Format(time.DateTime) + decodeFraction(r, int(meta))
+	case typeDatetime2:
+		text = decodeDatetime2(r, int(meta))
+	case typeTime2:
+		text = decodeTime2(r, int(meta))
+	case typeVarchar, typeVarString, typeString:
+		// Columns longer than 255 bytes use a two byte length prefix
+		var n int
+		if meta > 255 {
+			n = int(r.uint16())
+		} else {
+			n = int(r.uint8())
+		}
+		text = string(r.bytes(n))
+	case typeEnum, typeSet:
+		// The index or bitmask; Stream maps it onto the member names
+		text = strconv.FormatUint(r.uintN(int(meta&0xff)), 10)
+	case typeBlob, typeGeometry, typeJSON:
+		n := int(r.uintN(int(meta)))
+		text = string(r.bytes(n))
+	case typeBit:
+		bits, whole := int(meta&0xff), int(meta>>8)
+		n := whole
+		if bits > 0 {
+			n++
+		}
+		text = strconv.FormatUint(r.bigEndian(n), 10)
+	default:
+		return "", fmt.Errorf("unsupported column type %d", columnType)
+	}
+
+	if r.err != nil {
+		return "", r.err
+	}
+	return text, nil
+}
+
+// decodeFraction reads the fractional seconds stored after TIMESTAMP2,
+// DATETIME2 and TIME2 values
+func decodeFraction(r *reader, fsp int) string {
+	if fsp <= 0 {
+		return ""
+	}
+	v := r.bigEndian((fsp + 1) / 2)
+	// Odd precisions are stored with one extra digit
+	if fsp%2 == 1 {
+		v /= 10
+	}
+	return fmt.Sprintf(".%0*d", fsp, v)
+}
+
+func decodeDatetime2(r *reader, fsp int) string {
+	packed := int64(r.bigEndian(5)) - 0x8000000000
+	if packed < 0 {
+		packed = -packed
+	}
+	ymd := packed >> 17
+	ym := ymd >> 5
+	hms := packed % (1 << 17)
+
+	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d%s",
+		ym/13, ym%13, ymd%(1<<5),
+		hms>>12, (hms>>6)%(1<<6), hms%(1<<6),
+		decodeFraction(r, fsp))
+}
+
+func decodeTime2(r *reader, fsp int) string {
+	packed := int64(r.bigEndian(3)) - 0x800000
+	sign := ""
+	if packed < 0 {
+		sign, packed = "-", -packed
+	}
+	return fmt.Sprintf("%s%02d:%02d:%02d%s", sign,
+		(packed>>12)%(1<<10), (packed>>6)%(1<<6), packed%(1<<6),
+		decodeFraction(r, fsp))
+}
+
+// digitsToBytes is how many bytes a NEWDECIMAL group of n digits takes
+var digitsToBytes = [10]int{0, 1, 1, 2, 2, 3, 3, 4, 4, 4}
+
+// decodeDecimal reads a NEWDECIMAL: integer and fraction digits packed nine
+// to four bytes, big-endian, with the sign in the top bit and negative
+// numbers stored inverted
+func decodeDecimal(r *reader, precision, scale int) string {
+	intDigits := precision - scale
+	size := intDigits/9*4 + digitsToBytes[intDigits%9] + scale/9*4 + digitsToBytes[scale%9]
+
+	data := append([]byte(nil), r.bytes(size)...)
+	if r.err != nil || size == 0 {
+		return ""
+	}
+
+	negative := data[0]&0x80 == 0
+	data[0] ^= 0x80
+	if negative {
+		for i := range data {
+			data[i] = ^data[i]
+		}
+	}
+	d := &reader{data: data}
+
+	var b strings.Builder
+	if negative {
+		b.WriteByte('-')
+	}
+
+	intPart := ""
+	if lead := intDigits % 9; lead > 0 {
+		intPart = strconv.FormatUint(d.bigEndian(digitsToBytes[lead]), 10)
+	}
+	for i := 0; i < intDigits/9; i++ {
+		group := d.bigEndian(4)
+		if intPart == "" {
+			intPart = strconv.FormatUint(group, 10)
+		} else {
+			intPart += fmt.Sprintf("%09d", group)
+		}
+	}
+	intPart = strings.TrimLeft(intPart, "0")
+	if intPart == "" {
+		intPart = "0"
+	}
+	b.WriteString(intPart)
+
+	if scale > 0 {
+		b.WriteByte('.')
+		for i := 0; i < scale/9; i++ {
+			fmt.Fprintf(&b, "%09d", d.bigEndian(4))
+		}
+		if trail := scale % 9; trail > 0 {
+			fmt.Fprintf(&b, "%0*d", trail, d.bigEndian(digitsToBytes[trail]))
+		}
+	}
+	return b.String()
+}
+
+// formatUnsigned reinterprets a signed integer rendered by decodeValue as
+// the unsigned value of a column with the given type
+func formatUnsigned(text string, columnType byte) string {
+	v, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || v >= 0 {
+		return text
+	}
+	bits := map[byte]uint{typeTiny: 8, typeShort: 16, typeInt24: 24, typeLong: 32, typeLongLong: 64}[columnType]
+	if bits == 0 {
+		return text
+	}
+	if bits == 64 {
+		return strconv.FormatUint(uint64(v), 10)
+	}
+	return strconv.FormatUint(uint64(v)&(1<<bits-1), 10)
+}
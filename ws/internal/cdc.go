@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"log"
+	"sort"
+
+	"asset-ws/internal/binlog"
+	"asset-ws/internal/protocol"
+)
+
+// binlogAssetColumns is the column of each watched table holding the asset id
+var binlogAssetColumns = map[string]string{
+	"asset_inventory":       "id",
+	"asset_network_details": "asset_id",
+	"asset_ped_details":     "asset_id",
+	"asset_galaxy_details":  "asset_id",
+	"current_audit":         "asset_id",
+}
+
+// binlogGridKeys maps a stored column back to the grid keys it feeds, per
+// table. Tables missing here (current_audit) pass their columns through.
+var binlogGridKeys = func() map[string]map[string][]string {
+	keys := map[string]map[string][]string{
+		"asset_inventory": {
+			"modified":    {"modified"},
+			"modified_by": {"modified_by"},
+		},
+	}
+	for key, col := range assetColumns {
+		if keys[col.Table] == nil {
+			keys[col.Table] = make(map[string][]string)
+		}
+		keys[col.Table][col.Column] = append(keys[col.Table][col.Column], key)
+	}
+	return keys
+}()
+
+// BinlogTables lists the tables a binlog feed for the hub has to watch
+func BinlogTables() []string {
+	tables := make([]string, 0, len(binlogAssetColumns))
+	for table := range binlogAssetColumns {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// runRowFeed follows the row feed until shutdown and broadcasts every
+// transaction touching the asset tables as ROWS_CHANGED. Unlike the
+// change_log watcher it sees every writer, including bulk imports that skip
+// change_log, and the hub's own commits, which clients apply idempotently.
+func (h *Hub) runRowFeed() {
+	h.config.RowFeed.Run(h.shutdown, h.broadcastRowChanges)
+}
+
+// broadcastRowChanges converts one transaction's rows to grid keys and
+// sends them to every room
+func (h *Hub) broadcastRowChanges(rows []binlog.RowChange) {
+	names := make(lookupNames)
+	changes := make([]protocol.RowChange, 0, len(rows))
+
+	for _, row := range rows {
+		image := row.After
+		if row.Action == binlog.ActionDelete {
+			image = row.Before
+		}
+		assetID := image[binlogAssetColumns[row.Table]]
+		if assetID == nil {
+			continue
+		}
+
+		change := protocol.RowChange{
+			Table:   row.Table,
+			Action:  string(row.Action),
+			AssetID: protocol.ID(*assetID),
+		}
+		if row.Action != binlog.ActionDelete {
+			change.Values = h.gridValues(row, names)
+			// An update that only touched columns no grid shows
+			if row.Action == binlog.ActionUpdate && len(change.Values) == 0 {
+				continue
+			}
+		}
+		changes = append(changes, change)
+	}
+
+	if len(changes) == 0 {
+		return
+	}
+	// Every instance follows the binlog itself, so this stays local
+	h.broadcastToAllRoomsLocal(protocol.TypeRowsChanged, protocol.RowsChanged{Changes: changes}, nil)
+	log.Printf("[Binlog] Broadcast %d row changes", len(changes))
+}
+
+// gridValues returns the changed columns of a row under their grid keys,
+// resolving lookup ids to the names the grid shows
+func (h *Hub) gridValues(row binlog.RowChange, names lookupNames) map[string]*string {
+	keyColumn := binlogAssetColumns[row.Table]
+	gridKeys, mapped := binlogGridKeys[row.Table]
+
+	values := make(map[string]*string)
+	for column, value := range row.After {
+		if column == keyColumn {
+			continue
+		}
+		if row.Action == binlog.ActionUpdate {
+			if before, ok := row.Before[column]; ok && sameValue(before, value) {
+				continue
+			}
+		}
+
+		if !mapped {
+			values[column] = value
+			continue
+		}
+		for _, key := range gridKeys[column] {
+			spec, ok := assetColumns[key]
+			if !ok || spec.LookupTable == "" {
+				values[key] = value
+				continue
+			}
+			values[key] = h.lookupValue(key, spec, value, names)
+		}
+	}
+	return values
+}
+
+// lookupNames caches lookup table names by table and id for one batch
+type lookupNames map[string]map[string]*string
+
+// lookupValue resolves a lookup id to its name, or to the environment label
+// for the environment key
+func (h *Hub) lookupValue(key string, spec assetColumn, id *string, names lookupNames) *string {
+	if id == nil {
+		return nil
+	}
+
+	if names[spec.LookupTable] == nil {
+		names[spec.LookupTable] = make(map[string]*string)
+	}
+	name, cached := names[spec.LookupTable][*id]
+	if !cached {
+		var err error
+		if name, err = h.store.LookupName(spec.LookupTable, spec.LookupName, *id); err != nil {
+			log.Printf("[Binlog] Failed to resolve %s id %s: %v", spec.LookupTable, *id, err)
+		}
+		names[spec.LookupTable][*id] = name
+	}
+
+	if key != "environment" {
+		return name
+	}
+	environment := ""
+	if name != nil {
+		for label, status := range environmentStatuses {
+			if status == *name {
+				environment = label
+			}
+		}
+	}
+	return &environment
+}
+
+func sameValue(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
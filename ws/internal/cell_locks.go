@@ -1,17 +1,24 @@
 package internal
 
 import (
-	"encoding/json"
-	"fmt"
 	"log"
 	"strings"
 	"sync"
+	"time"
+
+	"asset-ws/internal/protocol"
 )
 
+// cellLockLease is how long a cell lock survives without a CELL_LOCK_HEARTBEAT
+// from its owner. Clients heartbeat well inside this window while editing.
+const cellLockLease = 30 * time.Second
+
 type CellLockInfo struct {
-	Client  *Client
-	AssetID string
-	Key     string
+	Client    *Client
+	AssetID   string
+	Key       string
+	Room      string // Room the lock was taken in
+	ExpiresAt time.Time
 }
 
 type CellLockManager struct {
@@ -29,7 +36,7 @@ func NewCellLockManager() *CellLockManager {
 	}
 }
 
-func (clm *CellLockManager) Lock(lockKey string, client *Client, assetID, key string) bool {
+func (clm *CellLockManager) Lock(lockKey string, client *Client, assetID, key, room string) bool {
 	clm.mutex.Lock()
 	defer clm.mutex.Unlock()
 
@@ -39,9 +46,11 @@ func (clm *CellLockManager) Lock(lockKey string, client *Client, assetID, key st
 	}
 
 	clm.locks[lockKey] = &CellLockInfo{
-		Client:  client,
-		AssetID: assetID,
-		Key:     key,
+		Client:    client,
+		AssetID:   assetID,
+		Key:       key,
+		Room:      room,
+		ExpiresAt: time.Now().Add(cellLockLease),
 	}
 
 	if _, ok := clm.userLocks[client]; !ok {
@@ -52,8 +61,98 @@ func (clm *CellLockManager) Lock(lockKey string, client *Client, assetID, key st
 	return true
 }
 
-// RemoveAllForClient removes all locks for a client and returns the lock keys that were removed
-func (clm *CellLockManager) RemoveAllForClient(client *Client) []string {
+// Renew extends the lease on every lock held by a client and returns how many were renewed
+func (clm *CellLockManager) Renew(client *Client) int {
+	clm.mutex.Lock()
+	defer clm.mutex.Unlock()
+
+	lockKeys, ok := clm.userLocks[client]
+	if !ok {
+		return 0
+	}
+
+	expiresAt := time.Now().Add(cellLockLease)
+	for lockKey := range lockKeys {
+		if info, ok := clm.locks[lockKey]; ok {
+			info.ExpiresAt = expiresAt
+		}
+	}
+	return len(lockKeys)
+}
+
+// Transfer hands every lock held by one client to another and renews their
+// lease; used when a reconnecting client adopts its parked state
+func (clm *CellLockManager) Transfer(from, to *Client) int {
+	clm.mutex.Lock()
+	defer clm.mutex.Unlock()
+
+	lockKeys, ok := clm.userLocks[from]
+	if !ok {
+		return 0
+	}
+
+	expiresAt := time.Now().Add(cellLockLease)
+	for lockKey := range lockKeys {
+		if info, ok := clm.locks[lockKey]; ok {
+			info.Client = to
+			info.ExpiresAt = expiresAt
+		}
+	}
+	delete(clm.userLocks, from)
+	if clm.userLocks[to] == nil {
+		clm.userLocks[to] = make(map[string]bool)
+	}
+	for lockKey := range lockKeys {
+		clm.userLocks[to][lockKey] = true
+	}
+	return len(lockKeys)
+}
+
+// ExpireStale removes every lock whose lease ran out before now and returns them
+func (clm *CellLockManager) ExpireStale(now time.Time) []*CellLockInfo {
+	clm.mutex.Lock()
+	defer clm.mutex.Unlock()
+
+	var expired []*CellLockInfo
+	for lockKey, info := range clm.locks {
+		if now.Before(info.ExpiresAt) {
+			continue
+		}
+		delete(clm.locks, lockKey)
+		if userSet, ok := clm.userLocks[info.Client]; ok {
+			delete(userSet, lockKey)
+			if len(userSet) == 0 {
+				delete(clm.userLocks, info.Client)
+			}
+		}
+		expired = append(expired, info)
+	}
+	return expired
+}
+
+// ForceUnlock removes a lock regardless of its owner and returns the removed lock, or nil
+func (clm *CellLockManager) ForceUnlock(lockKey string) *CellLockInfo {
+	clm.mutex.Lock()
+	defer clm.mutex.Unlock()
+
+	info, ok := clm.locks[lockKey]
+	if !ok {
+		return nil
+	}
+
+	delete(clm.locks, lockKey)
+	if userSet, ok := clm.userLocks[info.Client]; ok {
+		delete(userSet, lockKey)
+		if len(userSet) == 0 {
+			delete(clm.userLocks, info.Client)
+		}
+	}
+	return info
+}
+
+// RemoveAllForClient removes all locks for a client and returns the lock
+// keys that were removed, grouped by the room they were taken in
+func (clm *CellLockManager) RemoveAllForClient(client *Client) map[string][]string {
 	clm.mutex.Lock()
 	defer clm.mutex.Unlock()
 
@@ -62,29 +161,72 @@ func (clm *CellLockManager) RemoveAllForClient(client *Client) []string {
 		return nil
 	}
 
-	removed := make([]string, 0, len(lockKeys))
+	removed := make(map[string][]string)
 	for lockKey := range lockKeys {
+		if info, ok := clm.locks[lockKey]; ok {
+			removed[info.Room] = append(removed[info.Room], lockKey)
+		}
 		delete(clm.locks, lockKey)
-		removed = append(removed, lockKey)
 	}
 	delete(clm.userLocks, client)
 	return removed
 }
 
+// RemoveRoomForClient removes the locks a client took in one room and
+// returns their keys
+func (clm *CellLockManager) RemoveRoomForClient(client *Client, room string) []string {
+	clm.mutex.Lock()
+	defer clm.mutex.Unlock()
+
+	var removed []string
+	for lockKey := range clm.userLocks[client] {
+		if info, ok := clm.locks[lockKey]; ok && info.Room == room {
+			delete(clm.locks, lockKey)
+			delete(clm.userLocks[client], lockKey)
+			removed = append(removed, lockKey)
+		}
+	}
+	if len(clm.userLocks[client]) == 0 {
+		delete(clm.userLocks, client)
+	}
+	return removed
+}
+
+// AssignRoom moves the locks a client took outside any room into room
+func (clm *CellLockManager) AssignRoom(client *Client, room string) {
+	clm.mutex.Lock()
+	defer clm.mutex.Unlock()
+
+	for lockKey := range clm.userLocks[client] {
+		if info, ok := clm.locks[lockKey]; ok && info.Room == "" {
+			info.Room = room
+		}
+	}
+}
+
 // GetLock returns a single lock by key
 func (clm *CellLockManager) GetLock(lockKey string) *CellLockInfo {
 	clm.mutex.RLock()
 	defer clm.mutex.RUnlock()
 	if info, ok := clm.locks[lockKey]; ok {
 		return &CellLockInfo{
-			Client:  info.Client,
-			AssetID: info.AssetID,
-			Key:     info.Key,
+			Client:    info.Client,
+			AssetID:   info.AssetID,
+			Key:       info.Key,
+			Room:      info.Room,
+			ExpiresAt: info.ExpiresAt,
 		}
 	}
 	return nil
 }
 
+// Count returns how many cells are locked
+func (clm *CellLockManager) Count() int {
+	clm.mutex.RLock()
+	defer clm.mutex.RUnlock()
+	return len(clm.locks)
+}
+
 // GetAll returns a snapshot of all current locks
 func (clm *CellLockManager) GetAll() map[string]*CellLockInfo {
 	clm.mutex.RLock()
@@ -93,121 +235,127 @@ func (clm *CellLockManager) GetAll() map[string]*CellLockInfo {
 	snapshot := make(map[string]*CellLockInfo, len(clm.locks))
 	for k, v := range clm.locks {
 		snapshot[k] = &CellLockInfo{
-			Client:  v.Client,
-			AssetID: v.AssetID,
-			Key:     v.Key,
+			Client:    v.Client,
+			AssetID:   v.AssetID,
+			Key:       v.Key,
+			Room:      v.Room,
+			ExpiresAt: v.ExpiresAt,
 		}
 	}
 	return snapshot
 }
 
-func (c *Client) handleCellEditStart(payload interface{}) {
-	payloadMap, ok := payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-
-	assetIdRaw, ok1 := payloadMap["assetId"]
-	keyStr, ok2 := payloadMap["key"].(string)
-	if !ok1 || !ok2 || keyStr == "" {
-		return
-	}
-
-	assetId := fmt.Sprintf("%v", assetIdRaw)
-	lockKey := assetId + ":" + keyStr
+func (c *Client) handleCellEditStart(p *protocol.CellRef, room string) error {
+	assetId := p.AssetID.String()
+	lockKey := protocol.CellKey(p.AssetID, p.Key)
 
 	// Check if row is locked by an auditor
 	if blocked, blocker := c.hub.rowLocks.IsRowLocked(assetId, c); blocked {
-		rejectPayload := map[string]interface{}{
-			"assetId":   assetId,
-			"key":       keyStr,
-			"userId":    blocker.Client.userID,
-			"firstname": blocker.Client.userInfo.Firstname,
-			"lastname":  blocker.Client.userInfo.Lastname,
-			"color":     blocker.Client.userInfo.Color,
-		}
-		msg := Message{Type: "CELL_LOCKED", Payload: rejectPayload}
-		jsonMsg, err := json.Marshal(msg)
-		if err == nil {
-			select {
-			case c.send <- jsonMsg:
-			default:
-			}
-		}
-		return
+		c.sendMessage(protocol.TypeCellLocked, protocol.CellLocked{
+			AssetID: p.AssetID,
+			Key:     p.Key,
+			Holder:  blocker.Client.holder(),
+		})
+		return protocol.Rejectf(protocol.CodeRowLocked, "Row is locked by %s %s", blocker.Client.userInfo.Firstname, blocker.Client.userInfo.Lastname)
+	}
+	if claim := c.hub.remoteClaim(LockRow, assetId); claim != nil {
+		c.sendMessage(protocol.TypeCellLocked, protocol.CellLocked{
+			AssetID: p.AssetID,
+			Key:     p.Key,
+			Holder:  claim.Holder,
+		})
+		return protocol.Rejectf(protocol.CodeRowLocked, "Row is locked by %s %s", claim.Holder.Firstname, claim.Holder.Lastname)
 	}
 
 	// Check if cell is pending by another user
 	if blocked, blocker := c.hub.pendingCells.IsBlockedByOther(lockKey, c); blocked {
-		rejectPayload := map[string]interface{}{
-			"assetId":   assetId,
-			"key":       keyStr,
-			"userId":    blocker.Client.userID,
-			"firstname": blocker.Client.userInfo.Firstname,
-			"lastname":  blocker.Client.userInfo.Lastname,
-			"color":     blocker.Client.userInfo.Color,
-		}
-		msg := Message{Type: "CELL_LOCKED", Payload: rejectPayload}
-		jsonMsg, err := json.Marshal(msg)
-		if err == nil {
-			select {
-			case c.send <- jsonMsg:
-			default:
-			}
-		}
-		return
+		c.sendMessage(protocol.TypeCellLocked, protocol.CellLocked{
+			AssetID: p.AssetID,
+			Key:     p.Key,
+			Holder:  blocker.Client.holder(),
+		})
+		return protocol.Rejectf(protocol.CodeCellPending, "Cell has unsaved changes by %s %s", blocker.Client.userInfo.Firstname, blocker.Client.userInfo.Lastname)
+	}
+	if claim := c.hub.remoteClaim(LockPending, lockKey); claim != nil {
+		c.sendMessage(protocol.TypeCellLocked, protocol.CellLocked{
+			AssetID: p.AssetID,
+			Key:     p.Key,
+			Holder:  claim.Holder,
+		})
+		return protocol.Rejectf(protocol.CodeCellPending, "Cell has unsaved changes by %s %s", claim.Holder.Firstname, claim.Holder.Lastname)
 	}
 
-	locked := c.hub.cellLocks.Lock(lockKey, c, assetId, keyStr)
+	locked := c.hub.cellLocks.Lock(lockKey, c, assetId, p.Key, room)
 
+	// Granted here; another instance may still hold it
 	if locked {
-		log.Printf("[CellLock] %s (%s %s) locked cell %s", c.userInfo.Username, c.userInfo.Firstname, c.userInfo.Lastname, lockKey)
-		broadcastPayload := map[string]interface{}{
-			"assetId":   assetIdRaw,
-			"key":       keyStr,
-			"userId":    c.userID,
-			"firstname": c.userInfo.Firstname,
-			"lastname":  c.userInfo.Lastname,
-			"color":     c.userInfo.Color,
-		}
-		c.hub.BroadcastToRoom(c.room,"CELL_LOCKED", broadcastPayload, c)
-	} else {
-		existing := c.hub.cellLocks.GetLock(lockKey)
-		if existing != nil {
-			log.Printf("[CellLock] %s rejected for cell %s (held by %s %s)", c.userInfo.Username, lockKey, existing.Client.userInfo.Firstname, existing.Client.userInfo.Lastname)
-			rejectPayload := map[string]interface{}{
-				"assetId":   existing.AssetID,
-				"key":       existing.Key,
-				"userId":    existing.Client.userID,
-				"firstname": existing.Client.userInfo.Firstname,
-				"lastname":  existing.Client.userInfo.Lastname,
-				"color":     existing.Client.userInfo.Color,
-			}
-			msg := Message{Type: "CELL_LOCKED", Payload: rejectPayload}
-			jsonMsg, err := json.Marshal(msg)
-			if err == nil {
-				select {
-				case c.send <- jsonMsg:
-				default:
-					log.Printf("[CellLock] Failed to send rejection to %s (buffer full)", c.userInfo.Username)
-				}
-			}
+		if other := c.claim(LockCell, lockKey, "", room); other != nil {
+			c.hub.cellLocks.ForceUnlock(lockKey)
+			log.Printf("[CellLock] %s rejected for cell %s (held by %s %s on %s)", c.userInfo.Username, lockKey, other.Holder.Firstname, other.Holder.Lastname, other.Instance)
+			c.sendMessage(protocol.TypeCellLocked, protocol.CellLocked{
+				AssetID: p.AssetID,
+				Key:     p.Key,
+				Holder:  other.Holder,
+			})
+			return protocol.Rejectf(protocol.CodeCellLocked, "Cell is being edited by %s %s", other.Holder.Firstname, other.Holder.Lastname)
 		}
+		log.Printf("[CellLock] %s (%s %s) locked cell %s", c.userInfo.Username, c.userInfo.Firstname, c.userInfo.Lastname, lockKey)
+		c.hub.BroadcastInView(room, []string{assetId}, protocol.TypeCellLocked, protocol.CellLocked{
+			AssetID: p.AssetID,
+			Key:     p.Key,
+			Holder:  c.holder(),
+		}, c)
+		return nil
+	}
+
+	existing := c.hub.cellLocks.GetLock(lockKey)
+	if existing == nil {
+		// Released between Lock and GetLock; the client may simply retry
+		return protocol.Rejectf(protocol.CodeCellLocked, "Cell is being edited by another user")
 	}
+	log.Printf("[CellLock] %s rejected for cell %s (held by %s %s)", c.userInfo.Username, lockKey, existing.Client.userInfo.Firstname, existing.Client.userInfo.Lastname)
+	c.sendMessage(protocol.TypeCellLocked, protocol.CellLocked{
+		AssetID: protocol.ID(existing.AssetID),
+		Key:     existing.Key,
+		Holder:  existing.Client.holder(),
+	})
+	return protocol.Rejectf(protocol.CodeCellLocked, "Cell is being edited by %s %s", existing.Client.userInfo.Firstname, existing.Client.userInfo.Lastname)
 }
 
-func (c *Client) handleCellEditEnd(payload interface{}) {
+func (c *Client) handleCellEditEnd() {
 	// Release all locks for this user (only one cell can be edited at a time)
-	removedLocks := c.hub.cellLocks.RemoveAllForClient(c)
-	for _, lockKey := range removedLocks {
-		parts := strings.SplitN(lockKey, ":", 2)
-		if len(parts) == 2 {
-			log.Printf("[CellLock] %s unlocked cell %s", c.userInfo.Username, lockKey)
-			broadcastPayload := map[string]interface{}{
-				"assetId": parts[0],
-				"key":     parts[1],
+	for room, removedLocks := range c.hub.cellLocks.RemoveAllForClient(c) {
+		c.hub.release(LockCell, c, removedLocks...)
+		for _, lockKey := range removedLocks {
+			if cell, ok := splitCellKey(lockKey); ok {
+				log.Printf("[CellLock] %s unlocked cell %s", c.userInfo.Username, lockKey)
+				c.hub.BroadcastInView(room, []string{cell.AssetID.String()}, protocol.TypeCellUnlocked, cell, c)
 			}
-			c.hub.BroadcastToRoom(c.room,"CELL_UNLOCKED", broadcastPayload, c)
 		}
 	}
 }
+
+func (c *Client) handleCellLockHeartbeat() {
+	// Keep the lease alive on whatever cell this client is editing
+	c.hub.cellLocks.Renew(c)
+}
+
+// splitCellKey turns an "assetId:key" map key back into a cell reference
+func splitCellKey(cellKey string) (protocol.CellRef, bool) {
+	parts := strings.SplitN(cellKey, ":", 2)
+	if len(parts) != 2 {
+		return protocol.CellRef{}, false
+	}
+	return protocol.CellRef{AssetID: protocol.ID(parts[0]), Key: parts[1]}, true
+}
+
+// splitCellKeys converts a list of removed cell keys for a broadcast payload
+func splitCellKeys(cellKeys []string) []protocol.CellRef {
+	cells := make([]protocol.CellRef, 0, len(cellKeys))
+	for _, cellKey := range cellKeys {
+		if cell, ok := splitCellKey(cellKey); ok {
+			cells = append(cells, cell)
+		}
+	}
+	return cells
+}
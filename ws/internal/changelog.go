@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"asset-ws/internal/protocol"
+)
+
+const (
+	// changeLogBatch caps how many change_log rows one poll reads
+	changeLogBatch = 500
+	// changeLogGapWait is how long a skipped id is watched for. Ids are
+	// handed out before the insert commits, so a later id can show up first.
+	changeLogGapWait = 30 * time.Second
+)
+
+// ChangeLogWatcher tails change_log by id and broadcasts rows written by
+// anything other than the hubs (the SvelteKit API, bulk SQL fixes, other
+// tools) as COMMIT_BROADCAST, so every write path reaches connected grids.
+// Rows a hub wrote carry its instance as origin; it broadcast them itself.
+type ChangeLogWatcher struct {
+	hub    *Hub
+	store  AssetStore
+	cursor int64
+	// Ids skipped over, watched until their deadline in case they commit late
+	gaps map[int64]time.Time
+}
+
+func NewChangeLogWatcher(hub *Hub, store AssetStore) *ChangeLogWatcher {
+	return &ChangeLogWatcher{
+		hub:   hub,
+		store: store,
+		gaps:  make(map[int64]time.Time),
+	}
+}
+
+// Run polls until shutdown is closed. It starts from the current end of
+// change_log; history before startup is what the page load already showed.
+func (w *ChangeLogWatcher) Run(interval time.Duration, shutdown <-chan struct{}) {
+	cursor, err := w.store.ChangeLogHead()
+	if err != nil {
+		log.Printf("[ChangeLog] Failed to read starting position, watcher disabled: %v", err)
+		return
+	}
+	w.cursor = cursor
+	log.Printf("[ChangeLog] Watching change_log from id %d every %s", w.cursor, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Keep reading while full batches come back
+			for {
+				n, err := w.poll()
+				if err != nil {
+					log.Printf("[ChangeLog] Poll failed: %v", err)
+					break
+				}
+				if n < changeLogBatch {
+					break
+				}
+			}
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// poll reads the next batch after the cursor, plus the skipped ids that
+// committed since, and broadcasts it. It returns how many rows it read.
+func (w *ChangeLogWatcher) poll() (int, error) {
+	gaps := make([]int64, 0, len(w.gaps))
+	for id := range w.gaps {
+		gaps = append(gaps, id)
+	}
+	batch, err := w.store.ChangeLogAfter(w.cursor, gaps, changeLogBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	for _, row := range batch {
+		if row.ID > w.cursor {
+			// A jump wider than a batch is not a handful of slow inserts
+			if row.ID-w.cursor <= changeLogBatch {
+				for missing := w.cursor + 1; missing < row.ID; missing++ {
+					w.gaps[missing] = now.Add(changeLogGapWait)
+				}
+			}
+			w.cursor = row.ID
+		} else {
+			delete(w.gaps, row.ID)
+		}
+	}
+	for id, deadline := range w.gaps {
+		if now.After(deadline) {
+			log.Printf("[ChangeLog] Gave up waiting for change_log id %d", id)
+			delete(w.gaps, id)
+		}
+	}
+
+	w.broadcast(w.external(batch))
+	return len(batch), nil
+}
+
+// external drops the rows written by a hub of the cluster
+func (w *ChangeLogWatcher) external(batch []ChangeLogRow) []ChangeLogRow {
+	var external []ChangeLogRow
+	for _, row := range batch {
+		if row.Origin == "" {
+			external = append(external, row)
+		}
+	}
+	return external
+}
+
+// broadcast sends runs of updates by the same user at the same time as one
+// COMMIT_BROADCAST each. Inserts are skipped: a new row is not a cell edit
+// and grids pick it up on their next load.
+func (w *ChangeLogWatcher) broadcast(batch []ChangeLogRow) {
+	var current *protocol.CommittedChanges
+	flush := func() {
+		if current != nil && len(current.Changes) > 0 {
+			// Every instance runs its own watcher, so this stays local
+			w.hub.broadcastToAllRoomsLocal(protocol.TypeCommitBroadcast, *current, nil)
+			log.Printf("[ChangeLog] Broadcast %d external changes by %s", len(current.Changes), current.ModifiedBy)
+		}
+		current = nil
+	}
+
+	for _, row := range batch {
+		if row.Action != "update" {
+			continue
+		}
+		if current == nil || current.ModifiedBy != row.ModifiedBy || current.Modified != row.ModifiedAt {
+			flush()
+			current = &protocol.CommittedChanges{
+				ModifiedBy: row.ModifiedBy,
+				Modified:   row.ModifiedAt,
+			}
+		}
+
+		change := protocol.CommitChange{
+			AssetID: protocol.ID(strconv.FormatInt(row.AssetID, 10)),
+			Key:     row.Column,
+			Value:   row.NewValue,
+		}
+		current.Changes = append(current.Changes, change)
+	}
+	flush()
+}
@@ -1,12 +1,14 @@
 package internal
 
 import (
-	"encoding/json"
 	"log"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"asset-ws/internal/protocol"
+
 	"github.com/gorilla/websocket"
 	"golang.org/x/time/rate"
 )
@@ -22,14 +24,45 @@ const (
 type Client struct {
 	hub       *Hub
 	conn      *websocket.Conn
-	send      chan []byte
+	send      chan *outbound
 	done      chan struct{} // Lifecycle signal — closed on unregister
-	userID    string    // Shared ID (e.g., "101")
+	drain     chan struct{} // Closed to flush send, then close; see closeWith
+	userID    string        // Shared ID (e.g., "101")
+	sessionID string
 	userInfo  *UserInfo
-	room      string    // Current room subscription ("grid", "audit", or "")
+	// Subscribed rooms, the first being where messages act by default.
+	// Replaced as a whole, never modified; see roomList.
+	rooms     atomic.Pointer[[]string]
+	roomLabel atomic.Value // Kind of the first room, for metrics
 	lastPong  time.Time
 	mu        sync.Mutex
 	limiter   *rate.Limiter
+	drainOnce sync.Once
+	// Close frame flushAndClose ends with; set once, before drain closes
+	closeFrame []byte
+	// Set when the session was found invalid, so the client is not parked
+	revoked atomic.Bool
+	// Set once its USER_LEFT is sequenced; snapshots leave out what it still
+	// holds from then on
+	left atomic.Bool
+	// Assets the client has rendered (VIEWPORT); nil while it sees everything
+	viewport atomic.Pointer[map[string]bool]
+	// Whether permessage-deflate was negotiated, and what was written
+	compressed bool
+	stats      *wireStats
+	// Whether the client negotiated protocol.MsgpackSubprotocol
+	binary bool
+
+	// What did not fit in send under SlowClientCoalesce: the latest cursor
+	// of each user (guarded by mu) and whether anything else was dropped.
+	// backlog wakes writePump to deal with them once send drains.
+	coalesced map[string]*outbound
+	resync    atomic.Bool
+	backlog   chan struct{}
+
+	// Where the client left its rooms before reconnecting (?resume_from);
+	// consumed by the first SUBSCRIBE. Only touched by readPump.
+	resume *resumePoint
 }
 
 func (c *Client) readPump() {
@@ -52,7 +85,7 @@ func (c *Client) readPump() {
 	c.mu.Unlock()
 
 	for {
-		_, message, err := c.conn.ReadMessage()
+		frameType, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WS unexpected close for user %s: %v", c.userInfo.Username, err)
@@ -60,189 +93,264 @@ func (c *Client) readPump() {
 			break
 		}
 
-		var msg Message
-		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Printf("Could not decode message from user %s: %v", c.userInfo.Username, err)
+		decode := protocol.Decode
+		if frameType == websocket.BinaryMessage {
+			decode = protocol.DecodeMsgpack
+		}
+		req, err := decode(message)
+		if err != nil {
+			c.hub.metrics.messagesIn.WithLabelValues(invalidMessageType).Inc()
+			log.Printf("Rejected message from user %s: %v", c.userInfo.Username, err)
+			// Malformed messages count against the rate limit too
+			if c.limiter.Allow() {
+				c.reply(req, err)
+			}
 			continue
 		}
 
+		c.hub.metrics.messagesIn.WithLabelValues(req.Type).Inc()
+
 		if !c.limiter.Allow() {
-			log.Printf("Rate limit exceeded for user %s, dropping message type %s", c.userInfo.Username, msg.Type)
+			c.hub.metrics.rateLimited.Inc()
+			log.Printf("Rate limit exceeded for user %s, dropping message type %s", c.userInfo.Username, req.Type)
+			c.reply(req, protocol.Rejectf(protocol.CodeRateLimited, "Too many messages, slow down"))
 			continue
 		}
 
-		switch msg.Type {
-		case "USER_POSITION_UPDATE":
-			c.handlePositionUpdate(msg.Payload)
-		case "USER_DESELECTED":
-			c.handleDeselect()
-		case "CELL_EDIT_START":
-			c.handleCellEditStart(msg.Payload)
-		case "CELL_EDIT_END":
-			c.handleCellEditEnd(msg.Payload)
-		case "CELL_PENDING":
-			c.handleCellPending(msg.Payload)
-		case "CELL_PENDING_CLEAR":
-			c.handleCellPendingClear(msg.Payload)
-		case "PENDING_CLEAR_ALL":
-			c.handlePendingClearAll()
-		case "COMMIT_BROADCAST":
-			c.handleCommitBroadcast(msg.Payload)
-		case "CLIENT_STATE":
-			c.handleClientState(msg.Payload)
-		case "SUBSCRIBE":
-			c.handleSubscribe(msg.Payload)
-		case "UNSUBSCRIBE":
-			c.handleUnsubscribe()
-		case "AUDIT_ASSIGN":
-			c.hub.BroadcastToRoom(c.room, "AUDIT_ASSIGN_BROADCAST", msg.Payload, c)
-		case "AUDIT_COMPLETE":
-			c.hub.BroadcastToRoom(c.room, "AUDIT_COMPLETE_BROADCAST", msg.Payload, c)
-		case "AUDIT_START":
-			c.hub.BroadcastToRoom(c.room, "AUDIT_START_BROADCAST", msg.Payload, c)
-		case "AUDIT_CLOSE":
-			c.hub.BroadcastToRoom(c.room, "AUDIT_CLOSE_BROADCAST", msg.Payload, c)
-		case "ROW_LOCK":
-			c.handleRowLock(msg.Payload)
-		case "ROW_UNLOCK":
-			c.handleRowUnlock(msg.Payload)
-		case "PING":
-			// Client is checking if we're alive, we auto-respond with pong
+		if !canSend(c.userInfo.Role, req.Type) {
+			log.Printf("[Auth] %s (role %d) is not allowed to send %s", c.userInfo.Username, c.userInfo.Role, req.Type)
+			c.reply(req, protocol.Rejectf(protocol.CodeForbidden, "You do not have permission to do that"))
+			continue
 		}
+
+		c.reply(req, c.dispatch(req))
 	}
 }
 
-func (c *Client) handleSubscribe(payload interface{}) {
-	payloadMap, ok := payload.(map[string]interface{})
-	if !ok {
-		return
+// dispatch routes a decoded message to its handler. A non-nil error is sent
+// back to the client as an ERROR message.
+func (c *Client) dispatch(req protocol.Request) error {
+	payload := req.Payload
+	room, err := c.requestRoom(req)
+	if err != nil {
+		return err
 	}
 
-	room, ok := payloadMap["room"].(string)
-	if !ok || room == "" {
-		return
+	switch req.Type {
+	case protocol.TypeUserPositionUpdate:
+		c.handlePositionUpdate(payload.(*protocol.PositionUpdate), room)
+	case protocol.TypeUserDeselected:
+		c.handleDeselect()
+	case protocol.TypeCellEditStart:
+		return c.handleCellEditStart(payload.(*protocol.CellRef), room)
+	case protocol.TypeCellEditEnd:
+		c.handleCellEditEnd()
+	case protocol.TypeCellLockHeartbeat:
+		c.handleCellLockHeartbeat()
+	case protocol.TypeCellPending:
+		return c.handleCellPending(payload.(*protocol.CellValue), room)
+	case protocol.TypeCellPendingClear:
+		return c.handleCellPendingClear(payload.(*protocol.CellRef))
+	case protocol.TypePendingClearAll:
+		c.handlePendingClearAll()
+	case protocol.TypeCommit:
+		return c.handleCommit(req, payload.(*protocol.Commit))
+	case protocol.TypeClientState:
+		c.handleClientState(payload.(*protocol.ClientState), room)
+	case protocol.TypeSubscribe:
+		return c.handleSubscribe(payload.(*protocol.Subscribe))
+	case protocol.TypeUnsubscribe:
+		return c.handleUnsubscribe(payload.(*protocol.Unsubscribe))
+	case protocol.TypeViewport:
+		c.handleViewport(payload.(*protocol.Viewport))
+	case protocol.TypeAuditAssign:
+		c.hub.BroadcastToRoom(room, protocol.TypeAuditAssignBroadcast, payload, c)
+	case protocol.TypeAuditComplete:
+		c.hub.BroadcastToRoom(room, protocol.TypeAuditCompleteBroadcast, payload, c)
+	case protocol.TypeAuditStart:
+		c.hub.BroadcastToRoom(room, protocol.TypeAuditStartBroadcast, payload, c)
+	case protocol.TypeAuditClose:
+		c.hub.BroadcastToRoom(room, protocol.TypeAuditCloseBroadcast, payload, c)
+	case protocol.TypeRowLock:
+		return c.handleRowLock(payload.(*protocol.RowRef), room)
+	case protocol.TypeRowUnlock:
+		return c.handleRowUnlock(payload.(*protocol.RowRef))
+	case protocol.TypeAdminForceUnlockCell:
+		return c.handleAdminForceUnlockCell(payload.(*protocol.CellRef))
+	case protocol.TypeAdminForceUnlockRow:
+		return c.handleAdminForceUnlockRow(payload.(*protocol.RowRef))
+	case protocol.TypeAdminClearPendingForUser:
+		return c.handleAdminClearPendingForUser(payload.(*protocol.UserRef))
+	case protocol.TypePing:
+		// Client is checking if we're alive, we auto-respond with pong
 	}
+	return nil
+}
 
-	validRooms := map[string]bool{"grid": true, "audit": true}
-	if !validRooms[room] {
-		log.Printf("[Room] %s attempted to join invalid room '%s'", c.userInfo.Username, room)
+// requestRoom is the room a message acts in: the one it names, which the
+// client must be in, or else the client's first room
+func (c *Client) requestRoom(req protocol.Request) (string, error) {
+	rooms := c.roomList()
+	if req.Room == "" {
+		if len(rooms) == 0 {
+			return "", nil
+		}
+		return rooms[0], nil
+	}
+	for _, room := range rooms {
+		if room == req.Room {
+			return room, nil
+		}
+	}
+	return "", protocol.Rejectf(protocol.CodeNotSubscribed, "You are not in room '%s'", req.Room)
+}
+
+// reply answers a request: ERROR whenever it failed, ACK when it succeeded
+// and the client asked for confirmation with a requestId
+func (c *Client) reply(req protocol.Request, err error) {
+	if err != nil {
+		c.sendMessage(protocol.TypeError, protocol.NewErrorReply(req, err))
 		return
 	}
+	if req.RequestID != "" {
+		c.sendMessage(protocol.TypeAck, protocol.Ack{RequestID: req.RequestID, Type: req.Type})
+	}
+}
 
-	// Phase 1: Remove from old room under write lock, collect old room name
-	var oldRoom string
-	c.hub.mutex.Lock()
-	if c.room != "" && c.room != room {
-		oldRoom = c.room
-		if roomClients, ok := c.hub.rooms[c.room]; ok {
-			delete(roomClients, c)
-			if len(roomClients) == 0 {
-				delete(c.hub.rooms, c.room)
-			}
-		}
-		c.room = ""
-		log.Printf("[Room] %s (%s %s) left room '%s'", c.userInfo.Username, c.userInfo.Firstname, c.userInfo.Lastname, oldRoom)
+// sendMessage queues a message for this client only, dropping it if the buffer is full
+func (c *Client) sendMessage(msgType string, payload interface{}) {
+	if !c.hub.deliver(c, newOutbound(protocol.Message{Type: msgType, Payload: payload})) {
+		log.Printf("Failed to send %s to %s (buffer full)", msgType, c.userInfo.Username)
 	}
-	c.hub.mutex.Unlock()
-
-	// Phase 2: Cleanup + broadcast to old room (no hub mutex held)
-	if oldRoom != "" {
-		c.hub.presence.Remove(c)
-
-		removedLocks := c.hub.cellLocks.RemoveAllForClient(c)
-		for _, lockKey := range removedLocks {
-			parts := strings.SplitN(lockKey, ":", 2)
-			if len(parts) == 2 {
-				c.hub.BroadcastToRoom(oldRoom, "CELL_UNLOCKED", map[string]interface{}{
-					"assetId": parts[0],
-					"key":     parts[1],
-				}, nil)
-			}
-		}
+}
 
-		removedPending := c.hub.pendingCells.RemoveAllForClient(c)
-		if len(removedPending) > 0 {
-			cells := make([]map[string]interface{}, 0, len(removedPending))
-			for _, cellKey := range removedPending {
-				parts := strings.SplitN(cellKey, ":", 2)
-				if len(parts) == 2 {
-					cells = append(cells, map[string]interface{}{"assetId": parts[0], "key": parts[1]})
-				}
-			}
-			c.hub.BroadcastToRoom(oldRoom, "PENDING_CLEAR_BROADCAST", map[string]interface{}{"cells": cells}, nil)
+// holder describes this client as the owner of a lock or pending cell
+func (c *Client) holder() protocol.Holder {
+	return protocol.Holder{
+		UserID:    c.userID,
+		Firstname: c.userInfo.Firstname,
+		Lastname:  c.userInfo.Lastname,
+		Color:     c.userInfo.Color,
+	}
+}
+
+// handleSubscribe moves the client into exactly the requested rooms,
+// leaving the ones it was in but are not listed
+func (c *Client) handleSubscribe(p *protocol.Subscribe) error {
+	rooms := p.RoomList()
+
+	for _, room := range rooms {
+		if err := c.hub.checkRoom(room); err != nil {
+			log.Printf("[Room] %s attempted to join invalid room '%s'", c.userInfo.Username, room)
+			return err
 		}
+	}
+	keep := make(map[string]bool, len(rooms))
+	for _, room := range rooms {
+		keep[room] = true
+	}
 
-		removedRowLocks := c.hub.rowLocks.RemoveAllForClient(c)
-		for _, assetId := range removedRowLocks {
-			c.hub.BroadcastToAllRooms("ROW_UNLOCKED", map[string]interface{}{"assetId": assetId}, nil)
+	// Leave unlisted rooms and release what was acquired there
+	var left []string
+	for _, room := range c.roomList() {
+		if !keep[room] {
+			left = append(left, room)
 		}
+	}
+	c.setRooms(rooms)
+	for _, room := range left {
+		c.hub.leaveRoom(c, room)
+		c.releaseRoomState(room)
+	}
 
-		c.hub.BroadcastToRoom(oldRoom, "USER_LEFT", map[string]interface{}{"clientId": c.userID}, nil)
+	// CLIENT_STATE is reconciled before the first SUBSCRIBE after a
+	// reconnect; what it restored belongs to the first room
+	c.hub.presence.AssignRoom(c, rooms[0])
+	c.hub.cellLocks.AssignRoom(c, rooms[0])
+	c.hub.pendingCells.AssignRoom(c, rooms[0])
+	c.hub.rowLocks.AssignRoom(c, rooms[0])
+
+	// Join the rooms, replay missed events on the first join after a
+	// reconnect, then send each room's existing state
+	resume := c.resume
+	c.resume = nil
+	c.hub.joinRooms(c, rooms, resume)
+
+	log.Printf("[Room] %s (%s %s) joined room '%s'", c.userInfo.Username, c.userInfo.Firstname, c.userInfo.Lastname, strings.Join(rooms, "', '"))
+	return nil
+}
+
+// handleUnsubscribe leaves the named room, or every room
+func (c *Client) handleUnsubscribe(p *protocol.Unsubscribe) error {
+	var left, remaining []string
+	for _, room := range c.roomList() {
+		if p.Room == "" || room == p.Room {
+			left = append(left, room)
+		} else {
+			remaining = append(remaining, room)
+		}
+	}
+	if p.Room != "" && len(left) == 0 {
+		return protocol.Rejectf(protocol.CodeNotSubscribed, "You are not in room '%s'", p.Room)
 	}
 
-	// Phase 3: Add to new room under write lock
-	c.hub.mutex.Lock()
-	if _, ok := c.hub.rooms[room]; !ok {
-		c.hub.rooms[room] = make(map[*Client]bool)
+	c.setRooms(remaining)
+	for _, room := range left {
+		c.hub.leaveRoom(c, room)
+		c.releaseRoomState(room)
 	}
-	c.hub.rooms[room][c] = true
-	c.room = room
-	c.hub.mutex.Unlock()
+	return nil
+}
 
-	log.Printf("[Room] %s (%s %s) joined room '%s'", c.userInfo.Username, c.userInfo.Firstname, c.userInfo.Lastname, room)
+// roomList returns the client's rooms. The slice must not be modified.
+func (c *Client) roomList() []string {
+	if rooms := c.rooms.Load(); rooms != nil {
+		return *rooms
+	}
+	return nil
+}
 
-	// Send existing state now that the client is in a room
-	c.hub.sendExistingUsers(c)
+// setRooms records the client's rooms. Only the client's readPump calls it.
+func (c *Client) setRooms(rooms []string) {
+	c.rooms.Store(&rooms)
+	if len(rooms) > 0 {
+		c.roomLabel.Store(roomKind(rooms[0]))
+	} else {
+		c.roomLabel.Store("")
+	}
 }
 
-func (c *Client) handleUnsubscribe() {
-	var oldRoom string
-	c.hub.mutex.Lock()
-	if c.room != "" {
-		oldRoom = c.room
-		if roomClients, ok := c.hub.rooms[c.room]; ok {
-			delete(roomClients, c)
-			if len(roomClients) == 0 {
-				delete(c.hub.rooms, c.room)
-			}
+// releaseRoomState drops the presence, locks and pending cells this client
+// acquired in oldRoom after it left it, and tells the remaining members
+func (c *Client) releaseRoomState(oldRoom string) {
+	cursorGone := c.hub.presence.RemoveInRoom(c, oldRoom)
+
+	removedLocks := c.hub.cellLocks.RemoveRoomForClient(c, oldRoom)
+	c.hub.release(LockCell, c, removedLocks...)
+	for _, lockKey := range removedLocks {
+		if cell, ok := splitCellKey(lockKey); ok {
+			c.hub.BroadcastInView(oldRoom, []string{cell.AssetID.String()}, protocol.TypeCellUnlocked, cell, nil)
 		}
-		c.room = ""
-		log.Printf("[Room] %s (%s %s) left room '%s'", c.userInfo.Username, c.userInfo.Firstname, c.userInfo.Lastname, oldRoom)
 	}
-	c.hub.mutex.Unlock()
-
-	if oldRoom != "" {
-		c.hub.presence.Remove(c)
-
-		removedLocks := c.hub.cellLocks.RemoveAllForClient(c)
-		for _, lockKey := range removedLocks {
-			parts := strings.SplitN(lockKey, ":", 2)
-			if len(parts) == 2 {
-				c.hub.BroadcastToRoom(oldRoom, "CELL_UNLOCKED", map[string]interface{}{
-					"assetId": parts[0],
-					"key":     parts[1],
-				}, nil)
-			}
-		}
 
-		removedPending := c.hub.pendingCells.RemoveAllForClient(c)
-		if len(removedPending) > 0 {
-			cells := make([]map[string]interface{}, 0, len(removedPending))
-			for _, cellKey := range removedPending {
-				parts := strings.SplitN(cellKey, ":", 2)
-				if len(parts) == 2 {
-					cells = append(cells, map[string]interface{}{"assetId": parts[0], "key": parts[1]})
-				}
-			}
-			c.hub.BroadcastToRoom(oldRoom, "PENDING_CLEAR_BROADCAST", map[string]interface{}{"cells": cells}, nil)
-		}
+	removedPending := c.hub.pendingCells.RemoveRoomForClient(c, oldRoom)
+	c.hub.release(LockPending, c, removedPending...)
+	if len(removedPending) > 0 {
+		cells := splitCellKeys(removedPending)
+		c.hub.BroadcastInView(oldRoom, cellAssets(cells), protocol.TypePendingClearBroadcast, protocol.PendingClear{
+			Cells: cells,
+		}, nil)
+	}
 
-		removedRowLocks := c.hub.rowLocks.RemoveAllForClient(c)
-		for _, assetId := range removedRowLocks {
-			c.hub.BroadcastToAllRooms("ROW_UNLOCKED", map[string]interface{}{"assetId": assetId}, nil)
-		}
+	removedRowLocks := c.hub.rowLocks.RemoveRoomForClient(c, oldRoom)
+	c.hub.release(LockRow, c, removedRowLocks...)
+	for _, assetId := range removedRowLocks {
+		c.hub.BroadcastToAllRooms(protocol.TypeRowUnlocked, protocol.RowRef{AssetID: protocol.ID(assetId)}, nil)
+	}
 
-		c.hub.BroadcastToRoom(oldRoom, "USER_LEFT", map[string]interface{}{"clientId": c.userID}, nil)
+	// A cursor shown in another of its rooms stays
+	if cursorGone {
+		c.hub.BroadcastToRoom(oldRoom, protocol.TypeUserLeft, protocol.UserLeft{ClientID: c.userID}, nil)
 	}
 }
 
@@ -257,13 +365,24 @@ func (c *Client) writePump() {
 		select {
 		case <-c.done:
 			return
+		case <-c.drain:
+			c.flushAndClose()
+			return
 		case message, ok := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				return
 			}
 
-			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			if err := c.write(message); err != nil {
+				return
+			}
+			if len(c.send) == 0 && !c.catchUp() {
+				return
+			}
+
+		case <-c.backlog:
+			if len(c.send) == 0 && !c.catchUp() {
 				return
 			}
 
@@ -275,3 +394,41 @@ func (c *Client) writePump() {
 		}
 	}
 }
+
+// flushAndClose writes whatever is still queued for the client and ends the
+// connection with the close frame given to closeWith
+func (c *Client) flushAndClose() {
+	for {
+		select {
+		case message, ok := <-c.send:
+			if !ok {
+				return
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.write(message); err != nil {
+				return
+			}
+		default:
+			c.conn.WriteControl(websocket.CloseMessage, c.closeFrame, time.Now().Add(writeWait))
+			return
+		}
+	}
+}
+
+// startDrain tells writePump to flush and close because the server is
+// restarting. Safe to call more than once.
+func (c *Client) startDrain() {
+	c.closeWith(websocket.CloseServiceRestart, "Server restarting")
+}
+
+// closeWith tells writePump to flush and close with the given close code.
+// Only the first call counts; it reports whether this was it.
+func (c *Client) closeWith(code int, text string) bool {
+	first := false
+	c.drainOnce.Do(func() {
+		c.closeFrame = websocket.FormatCloseMessage(code, text)
+		close(c.drain)
+		first = true
+	})
+	return first
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	"asset-ws/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// Clients speak JSON in text frames unless they negotiate
+// protocol.MsgpackSubprotocol, which switches both directions to MessagePack
+// in binary frames. Messages are queued as typed values and encoded the
+// first time a client of each format writes them, so a broadcast costs one
+// encoding per format in use however many clients it reaches, and rooms of
+// JSON clients never pay for MessagePack.
+
+// outbound is a message queued for one or more clients
+type outbound struct {
+	msg protocol.Message
+	// Sent to many clients: each encoding is also framed once
+	shared bool
+	json   encoding
+	packed encoding
+}
+
+// encoding is one wire format of an outbound message, made on first use
+type encoding struct {
+	once     sync.Once
+	data     []byte
+	prepared *websocket.PreparedMessage
+	err      error
+}
+
+// newOutbound wraps a message for one client
+func newOutbound(msg protocol.Message) *outbound {
+	return &outbound{msg: msg}
+}
+
+// newBroadcast wraps a message that is about to go to many clients
+func newBroadcast(msg protocol.Message) *outbound {
+	return &outbound{msg: msg, shared: true}
+}
+
+// encoded returns the message in the format of a JSON or binary client
+func (m *outbound) encoded(binary bool) *encoding {
+	e, frameType := &m.json, websocket.TextMessage
+	if binary {
+		e, frameType = &m.packed, websocket.BinaryMessage
+	}
+	e.once.Do(func() {
+		if binary {
+			e.data, e.err = protocol.MarshalMsgpack(m.msg)
+		} else {
+			e.data, e.err = json.Marshal(m.msg)
+		}
+		if e.err == nil && m.shared {
+			e.prepared, e.err = websocket.NewPreparedMessage(frameType, e.data)
+		}
+	})
+	return e
+}
+
+// format names the client's wire format
+func (c *Client) format() string {
+	if c.binary {
+		return "msgpack"
+	}
+	return "json"
+}
+
+// write sends one queued message on the connection in the client's format,
+// compressed if it is large enough. Only writePump calls it. A message that
+// cannot be encoded is logged and skipped.
+func (c *Client) write(message *outbound) error {
+	e := message.encoded(c.binary)
+	if e.err != nil {
+		log.Printf("Failed to encode %s for %s: %v", message.msg.Type, c.userInfo.Username, e.err)
+		return nil
+	}
+	if c.compressed {
+		c.conn.EnableWriteCompression(len(e.data) >= c.hub.config.CompressionMinSize)
+	}
+
+	wireBefore := c.stats.wire.Load()
+	var err error
+	switch {
+	case e.prepared != nil:
+		err = c.conn.WritePreparedMessage(e.prepared)
+	case c.binary:
+		err = c.conn.WriteMessage(websocket.BinaryMessage, e.data)
+	default:
+		err = c.conn.WriteMessage(websocket.TextMessage, e.data)
+	}
+	c.stats.payload.Add(int64(len(e.data)))
+	c.hub.metrics.messageBytes.Add(float64(len(e.data)))
+	c.hub.metrics.wireBytes.Add(float64(c.stats.wire.Load() - wireBefore))
+	return err
+}
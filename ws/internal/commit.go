@@ -0,0 +1,425 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"asset-ws/internal/protocol"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// commitTimeout bounds a COMMIT transaction; the sender's readPump waits on it
+const commitTimeout = 10 * time.Second
+
+// assetColumn describes how a grid column is stored. It mirrors the column
+// mapping in the SvelteKit updateAsset helper so both write paths agree.
+type assetColumn struct {
+	// Table and Column are where the value is written
+	Table  string
+	Column string
+	// Lookup tables store a name; the asset row references its id
+	LookupTable string
+	LookupName  string
+	// Read selects the current grid value, with ai = asset_inventory and
+	// d = the extension table
+	Read   string
+	MaxLen int
+	Unique bool
+}
+
+func inventoryColumn(name string, maxLen int) assetColumn {
+	return assetColumn{Table: "asset_inventory", Column: name, Read: "ai." + name, MaxLen: maxLen}
+}
+
+func lookupColumn(column, lookupTable, lookupName string) assetColumn {
+	return assetColumn{
+		Table:       "asset_inventory",
+		Column:      column,
+		LookupTable: lookupTable,
+		LookupName:  lookupName,
+		Read:        fmt.Sprintf("(SELECT l.%s FROM %s l WHERE l.id = ai.%s)", lookupName, lookupTable, column),
+	}
+}
+
+func extensionColumn(table, name string) assetColumn {
+	return assetColumn{Table: table, Column: name, Read: "d." + name}
+}
+
+// assetColumns lists every column a COMMIT may change, keyed by grid key
+var assetColumns = map[string]assetColumn{
+	"bu_estate":            inventoryColumn("bu_estate", 20),
+	"shelf_cabinet_table":  inventoryColumn("shelf_cabinet_table", 30),
+	"node":                 inventoryColumn("node", 30),
+	"asset_type":           inventoryColumn("asset_type", 20),
+	"asset_set_type":       inventoryColumn("asset_set_type", 40),
+	"manufacturer":         inventoryColumn("manufacturer", 40),
+	"model":                inventoryColumn("model", 40),
+	"wbd_tag":              {Table: "asset_inventory", Column: "wbd_tag", Read: "ai.wbd_tag", MaxLen: 10, Unique: true},
+	"serial_number":        {Table: "asset_inventory", Column: "serial_number", Read: "ai.serial_number", MaxLen: 30, Unique: true},
+	"comment":              inventoryColumn("comment", 200),
+	"under_warranty_until": {Table: "asset_inventory", Column: "under_warranty_until", Read: "DATE_FORMAT(ai.under_warranty_until, '%Y-%m-%d')"},
+	"warranty_details":     inventoryColumn("warranty_details", 180),
+
+	"status":      lookupColumn("status_id", "asset_status", "status_name"),
+	"condition":   lookupColumn("condition_id", "asset_condition", "condition_name"),
+	"location":    lookupColumn("location_id", "asset_locations", "location_name"),
+	"department":  lookupColumn("department_id", "asset_departments", "department_name"),
+	"application": lookupColumn("application_id", "asset_applications", "application_name"),
+	"environment": {
+		Table:       "asset_inventory",
+		Column:      "status_id",
+		LookupTable: "asset_status",
+		LookupName:  "status_name",
+		Read:        "(SELECT CASE s.status_name WHEN 'In use - Prod' THEN 'PROD' WHEN 'In use - Stage/UAT' THEN 'STAGE' WHEN 'In use - Dev' THEN 'DEV' ELSE '' END FROM asset_status s WHERE s.id = ai.status_id)",
+	},
+
+	"hardware_ped_emv":                 extensionColumn("asset_ped_details", "hardware_ped_emv"),
+	"appm_ped_emv":                     extensionColumn("asset_ped_details", "appm_ped_emv"),
+	"vfop_ped_emv":                     extensionColumn("asset_ped_details", "vfop_ped_emv"),
+	"vfsred_ped_emv":                   extensionColumn("asset_ped_details", "vfsred_ped_emv"),
+	"vault_ped_emv":                    extensionColumn("asset_ped_details", "vault_ped_emv"),
+	"physical_security_method_ped_emv": extensionColumn("asset_ped_details", "physical_security_method_ped_emv"),
+
+	"ip_address":  extensionColumn("asset_network_details", "ip_address"),
+	"mac_address": extensionColumn("asset_network_details", "mac_address"),
+
+	"node_type":      extensionColumn("asset_galaxy_details", "node_type"),
+	"node_number":    extensionColumn("asset_galaxy_details", "node_number"),
+	"hostname":       extensionColumn("asset_galaxy_details", "hostname"),
+	"node_link":      extensionColumn("asset_galaxy_details", "node_link"),
+	"license_number": extensionColumn("asset_galaxy_details", "license_number"),
+	"galaxy_module":  extensionColumn("asset_galaxy_details", "galaxy_module"),
+}
+
+// environmentStatuses maps the Galaxy environment column onto asset statuses
+var environmentStatuses = map[string]string{
+	"PROD":  "In use - Prod",
+	"STAGE": "In use - Stage/UAT",
+	"DEV":   "In use - Dev",
+}
+
+// CommittedChange is one change as the database accepted it
+type CommittedChange struct {
+	protocol.CommitChange
+	OldValue *string
+}
+
+// CommitResult is a successful commit and the modified time it stamped on
+// every asset it touched
+type CommitResult struct {
+	Changes  []CommittedChange
+	Modified string
+}
+
+// CommitConflictError rejects a commit whose rows changed since the client
+// last saw them
+type CommitConflictError struct {
+	Conflicts []protocol.CellConflict
+}
+
+func (e *CommitConflictError) Error() string {
+	return fmt.Sprintf("%d cells changed since they were loaded", len(e.Conflicts))
+}
+
+// CommitAssetChanges checks a batch of cell changes and hands it to the
+// store. Either every change is written or none is.
+func (h *Hub) CommitAssetChanges(changes []protocol.CommitChange, modifiedBy string) (*CommitResult, error) {
+	for i, change := range changes {
+		if err := checkCommitChange(change); err != nil {
+			return nil, fmt.Errorf("change %d: %w", i, err)
+		}
+	}
+	return h.store.CommitAssetChanges(changes, modifiedBy, h.instanceID)
+}
+
+// CommitAssetChanges applies a batch of cell changes in one transaction and
+// logs each to change_log with the value it replaced and origin. Nothing is
+// written unless every asset row is still at the BaseModified of its
+// changes.
+func (s *SQLAssetStore) CommitAssetChanges(changes []protocol.CommitChange, modifiedBy, origin string) (*CommitResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), commitTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin commit: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Check every row before writing any, so all conflicts come back at once
+	conflicts, err := findCommitConflicts(ctx, tx, changes)
+	if err != nil {
+		return nil, err
+	}
+	if len(conflicts) > 0 {
+		return nil, &CommitConflictError{Conflicts: conflicts}
+	}
+
+	// One timestamp for the whole commit, in the format the grid loads
+	var modified string
+	if err := tx.QueryRowContext(ctx, "SELECT DATE_FORMAT(NOW(6), '%Y-%m-%d %H:%i:%s.%f')").Scan(&modified); err != nil {
+		return nil, fmt.Errorf("read commit time: %w", err)
+	}
+
+	result := &CommitResult{Changes: make([]CommittedChange, 0, len(changes)), Modified: modified}
+	for _, change := range changes {
+		oldValue, err := applyAssetChange(ctx, tx, change, modifiedBy, modified)
+		if err != nil {
+			return nil, err
+		}
+
+		// The commit is broadcast by handleCommit; origin keeps the change_log
+		// watchers from repeating it
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO change_log (asset_id, column_name, old_value, new_value, action, modified_by, origin)
+			VALUES (?, ?, ?, ?, 'update', ?, ?)
+		`, change.AssetID.String(), change.Key, oldValue, change.Value, modifiedBy, origin)
+		if err != nil {
+			return nil, fmt.Errorf("log change to %s:%s: %w", change.AssetID, change.Key, err)
+		}
+
+		change.BaseModified = ""
+		result.Changes = append(result.Changes, CommittedChange{CommitChange: change, OldValue: oldValue})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	return result, nil
+}
+
+// findCommitConflicts locks each asset row the commit changes and reports
+// the cells whose row has moved on, with the current value and what moved
+// it. modified has microsecond resolution, so commits in the same second
+// are told apart.
+func findCommitConflicts(ctx context.Context, tx *sql.Tx, changes []protocol.CommitChange) ([]protocol.CellConflict, error) {
+	type rowState struct {
+		modified   string
+		modifiedBy string
+	}
+	rows := make(map[string]*rowState)
+
+	var conflicts []protocol.CellConflict
+	for _, change := range changes {
+		assetID := change.AssetID.String()
+
+		row, seen := rows[assetID]
+		if !seen {
+			row = &rowState{}
+			var modifiedBy sql.NullString
+			err := tx.QueryRowContext(ctx, `
+				SELECT DATE_FORMAT(modified, '%Y-%m-%d %H:%i:%s.%f'), modified_by
+				FROM asset_inventory WHERE id = ? FOR UPDATE
+			`, assetID).Scan(&row.modified, &modifiedBy)
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, protocol.Rejectf(protocol.CodeNotFound, "Asset %s does not exist", assetID)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("read modified for %s: %w", assetID, err)
+			}
+			row.modifiedBy = modifiedBy.String
+			rows[assetID] = row
+		}
+
+		if row.modified == change.BaseModified {
+			continue
+		}
+
+		col := assetColumns[change.Key]
+		readQuery := fmt.Sprintf("SELECT %s FROM asset_inventory ai WHERE ai.id = ?", col.Read)
+		if col.Table != "asset_inventory" {
+			readQuery = fmt.Sprintf("SELECT %s FROM asset_inventory ai LEFT JOIN %s d ON d.asset_id = ai.id WHERE ai.id = ?", col.Read, col.Table)
+		}
+		var current sql.NullString
+		if err := tx.QueryRowContext(ctx, readQuery, assetID).Scan(&current); err != nil {
+			return nil, fmt.Errorf("read %s:%s: %w", assetID, change.Key, err)
+		}
+
+		// This cell's own change_log row since the base if there is one,
+		// else the newest of the others. change_log.modified_at has whole
+		// seconds, so the base is cut to its second.
+		var changedKey string
+		err := tx.QueryRowContext(ctx, `
+			SELECT column_name FROM change_log
+			WHERE asset_id = ? AND modified_at >= ?
+			ORDER BY column_name = ? DESC, id DESC LIMIT 1
+		`, assetID, baseSecond(change.BaseModified), change.Key).Scan(&changedKey)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("read change_log for %s: %w", assetID, err)
+		}
+
+		conflict := protocol.CellConflict{
+			AssetID:    change.AssetID,
+			Key:        change.Key,
+			Modified:   row.modified,
+			ModifiedBy: row.modifiedBy,
+			ChangedKey: changedKey,
+		}
+		if current.Valid {
+			conflict.Value = &current.String
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts, nil
+}
+
+// baseSecond cuts a modified time to whole seconds
+func baseSecond(modified string) string {
+	if len(modified) > len("2006-01-02 15:04:05") {
+		return modified[:len("2006-01-02 15:04:05")]
+	}
+	return modified
+}
+
+// checkCommitChange rejects changes the database would refuse or mangle
+func checkCommitChange(change protocol.CommitChange) error {
+	col, ok := assetColumns[change.Key]
+	if !ok {
+		return &protocol.ValidationError{Type: protocol.TypeCommit, Field: "changes.key", Reason: fmt.Sprintf("'%s' is not an editable column", change.Key)}
+	}
+	if change.Value != nil && col.MaxLen > 0 && len([]rune(*change.Value)) > col.MaxLen {
+		return protocol.Rejectf(protocol.CodeInvalidValue, "%s exceeds max length of %d characters", change.Key, col.MaxLen)
+	}
+	if change.Key == "environment" && change.Value != nil {
+		if _, ok := environmentStatuses[*change.Value]; !ok {
+			return protocol.Rejectf(protocol.CodeInvalidValue, "environment must be PROD, STAGE or DEV")
+		}
+	}
+	return nil
+}
+
+// applyAssetChange writes one change and returns the value it replaced
+func applyAssetChange(ctx context.Context, tx *sql.Tx, change protocol.CommitChange, modifiedBy, modified string) (*string, error) {
+	col := assetColumns[change.Key]
+	assetID := change.AssetID.String()
+
+	// Lock the asset row (and its extension row, if any) while we read the old value
+	readQuery := fmt.Sprintf("SELECT %s FROM asset_inventory ai WHERE ai.id = ? FOR UPDATE", col.Read)
+	if col.Table != "asset_inventory" {
+		readQuery = fmt.Sprintf("SELECT %s FROM asset_inventory ai LEFT JOIN %s d ON d.asset_id = ai.id WHERE ai.id = ? FOR UPDATE", col.Read, col.Table)
+	}
+	var oldValue sql.NullString
+	if err := tx.QueryRowContext(ctx, readQuery, assetID).Scan(&oldValue); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, protocol.Rejectf(protocol.CodeNotFound, "Asset %s does not exist", assetID)
+		}
+		return nil, fmt.Errorf("read %s:%s: %w", assetID, change.Key, err)
+	}
+
+	value, err := storedValue(ctx, tx, change, col)
+	if err != nil {
+		return nil, err
+	}
+
+	if col.Unique && change.Value != nil && *change.Value != "" {
+		var otherID int64
+		err := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT id FROM asset_inventory WHERE %s = ? AND id != ? LIMIT 1", col.Column), *change.Value, assetID).Scan(&otherID)
+		if err == nil {
+			return nil, protocol.Rejectf(protocol.CodeDuplicate, "%s \"%s\" already exists", change.Key, *change.Value)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("check unique %s: %w", change.Key, err)
+		}
+	}
+
+	if col.Table == "asset_inventory" {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("UPDATE asset_inventory SET %s = ?, modified_by = ?, modified = ? WHERE id = ?", col.Column), value, modifiedBy, modified, assetID)
+	} else {
+		// Extension rows are created on first write
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT IGNORE INTO %s (asset_id) VALUES (?)", col.Table), assetID); err == nil {
+			_, err = tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET %s = ? WHERE asset_id = ?", col.Table, col.Column), value, assetID)
+		}
+		if err == nil {
+			// Set modified explicitly: ON UPDATE does not fire when modified_by is unchanged
+			_, err = tx.ExecContext(ctx, "UPDATE asset_inventory SET modified_by = ?, modified = ? WHERE id = ?", modifiedBy, modified, assetID)
+		}
+	}
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+			return nil, protocol.Rejectf(protocol.CodeDuplicate, "Duplicate value - this value already exists")
+		}
+		return nil, fmt.Errorf("write %s:%s: %w", assetID, change.Key, err)
+	}
+
+	if !oldValue.Valid {
+		return nil, nil
+	}
+	return &oldValue.String, nil
+}
+
+// storedValue converts a grid value into what is written to the column:
+// lookup names become ids, and blanks become NULL where a string makes no sense
+func storedValue(ctx context.Context, tx *sql.Tx, change protocol.CommitChange, col assetColumn) (interface{}, error) {
+	if change.Value == nil || (*change.Value == "" && (col.LookupTable != "" || change.Key == "under_warranty_until")) {
+		return nil, nil
+	}
+	value := *change.Value
+
+	if col.LookupTable == "" {
+		return value, nil
+	}
+
+	name := value
+	if change.Key == "environment" {
+		name = environmentStatuses[value]
+	}
+	var id int64
+	err := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT id FROM %s WHERE %s = ?", col.LookupTable, col.LookupName), name).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, protocol.Rejectf(protocol.CodeInvalidValue, "Unknown %s '%s'", change.Key, value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("look up %s '%s': %w", change.Key, value, err)
+	}
+	return id, nil
+}
+
+func (c *Client) handleCommit(req protocol.Request, p *protocol.Commit) error {
+	modifiedBy := c.userInfo.Lastname + ", " + c.userInfo.Firstname
+
+	result, err := c.hub.CommitAssetChanges(p.Changes, modifiedBy)
+	if err != nil {
+		var conflict *CommitConflictError
+		if errors.As(err, &conflict) {
+			log.Printf("[Commit] %s commit rejected: %v", c.userInfo.Username, err)
+			c.sendMessage(protocol.TypeCommitConflict, protocol.CommitConflict{
+				RequestID: req.RequestID,
+				Conflicts: conflict.Conflicts,
+			})
+			return protocol.Rejectf(protocol.CodeCommitConflict, "Someone else changed these assets since you loaded them")
+		}
+		log.Printf("[Commit] %s commit of %d changes failed: %v", c.userInfo.Username, len(p.Changes), err)
+		return err
+	}
+
+	// Broadcast exactly what was written
+	changes := make([]protocol.CommitChange, len(result.Changes))
+	for i, change := range result.Changes {
+		changes[i] = change.CommitChange
+	}
+
+	// The commit supersedes the user's unsaved edits
+	released := 0
+	for _, removedCells := range c.hub.pendingCells.RemoveAllForClient(c) {
+		c.hub.release(LockPending, c, removedCells...)
+		released += len(removedCells)
+	}
+
+	// The sender gets it too: it carries the new modified time the next
+	// commit of these rows must be based on
+	c.hub.BroadcastToAllRooms(protocol.TypeCommitBroadcast, protocol.CommittedChanges{
+		UserID:     c.userID,
+		ModifiedBy: modifiedBy,
+		Modified:   result.Modified,
+		Changes:    changes,
+	}, nil)
+
+	log.Printf("[Commit] %s committed %d changes (released %d pending cells)", c.userInfo.Username, len(changes), released)
+	return nil
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Clients that offer permessage-deflate get messages of at least
+// CompressionMinSize bytes compressed at CompressionLevel; small ones are
+// not worth the CPU. Every connection counts the bytes of the messages
+// written to it and the bytes that reached the socket, so the admin API and
+// metrics show what compression saves.
+
+// wireStats counts what a connection wrote
+type wireStats struct {
+	payload atomic.Int64 // Message bytes before compression and framing
+	wire    atomic.Int64 // Bytes written to the socket
+}
+
+// saved is how many bytes compression kept off the network. Frame headers
+// and pings make it a slight underestimate.
+func (s *wireStats) saved() int64 {
+	return max(s.payload.Load()-s.wire.Load(), 0)
+}
+
+// offersDeflate reports whether an upgrade request asks for permessage-deflate
+func offersDeflate(r *http.Request) bool {
+	for _, ext := range r.Header.Values("Sec-Websocket-Extensions") {
+		if strings.Contains(strings.ToLower(ext), "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// countingWriter hands the upgrader a connection that counts its writes
+type countingWriter struct {
+	http.ResponseWriter
+	stats *wireStats
+}
+
+func (w countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countingConn{Conn: conn, stats: w.stats}, brw, nil
+}
+
+type countingConn struct {
+	net.Conn
+	stats *wireStats
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.stats.wire.Add(int64(n))
+	return n, err
+}
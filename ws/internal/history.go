@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// roomHistorySize is how many sequenced events each room keeps for replay
+const roomHistorySize = 1024
+
+type historyEntry struct {
+	Seq     uint64
+	Type    string
+	Message *outbound
+}
+
+// roomRing is a fixed-size ring of one room's most recent events
+type roomRing struct {
+	entries []historyEntry
+	next    int
+	// floor is the highest seq this room can no longer replay
+	floor uint64
+}
+
+// EventHistory stamps room broadcasts with a hub-wide sequence number and
+// keeps the latest events of every room so reconnecting clients can catch up.
+// A room's ring starts when it is first joined or broadcast to; a resume
+// from before that asks for a resync.
+type EventHistory struct {
+	rooms map[string]*roomRing
+	// The counter starts at the hub's start time in microseconds, so any seq
+	// handed out by a previous process is lower than everything this one
+	// retains and resuming from it asks for a resync instead of a bad replay.
+	start  uint64
+	latest uint64
+	mu     sync.Mutex
+}
+
+// NewEventHistory starts the history with rings for rooms, which can be
+// resumed from any seq this hub issued
+func NewEventHistory(rooms ...string) *EventHistory {
+	start := uint64(time.Now().UnixMicro())
+	eh := &EventHistory{
+		rooms:  make(map[string]*roomRing),
+		start:  start,
+		latest: start,
+	}
+	for _, room := range rooms {
+		eh.rooms[room] = &roomRing{floor: start}
+	}
+	return eh
+}
+
+// Start starts a room's ring if it has none yet and calls start with the
+// seq the room's stream is at: that of its newest event, or the floor of an
+// empty ring. Nothing is stamped until start returns, so a room it sets up
+// misses no broadcast.
+func (eh *EventHistory) Start(room string, start func(seq uint64)) {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+
+	ring, ok := eh.rooms[room]
+	if !ok {
+		ring = &roomRing{floor: eh.latest}
+		eh.rooms[room] = ring
+	}
+	if len(ring.entries) == 0 {
+		start(ring.floor)
+		return
+	}
+	start(ring.entries[(ring.next+len(ring.entries)-1)%len(ring.entries)].Seq)
+}
+
+// Stamp takes the next sequence number, has queue build and queue the
+// message for it, and stores the message in the rings of rooms, or of every
+// room when rooms is nil. Nothing else is stamped until queue returns, so
+// messages are queued in seq order.
+func (eh *EventHistory) Stamp(rooms []string, queue func(seq uint64) *outbound) {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+
+	eh.latest++
+	seq := eh.latest
+	message := queue(seq)
+
+	if rooms == nil {
+		for _, ring := range eh.rooms {
+			ring.record(seq, message.msg.Type, message)
+		}
+		return
+	}
+	for _, room := range rooms {
+		ring, ok := eh.rooms[room]
+		if !ok {
+			ring = &roomRing{floor: seq - 1}
+			eh.rooms[room] = ring
+		}
+		ring.record(seq, message.msg.Type, message)
+	}
+}
+
+// Retain drops the ring of every room not in the set keep returns and
+// returns how many it dropped. keep runs under the history lock, so no room
+// starts on a ring that is about to go.
+func (eh *EventHistory) Retain(keep func() map[string]bool) int {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+
+	kept := keep()
+	dropped := 0
+	for room := range eh.rooms {
+		if !kept[room] {
+			delete(eh.rooms, room)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+func (ring *roomRing) record(seq uint64, msgType string, message *outbound) {
+	if len(ring.entries) < roomHistorySize {
+		ring.entries = append(ring.entries, historyEntry{Seq: seq, Type: msgType, Message: message})
+		return
+	}
+	ring.floor = ring.entries[ring.next].Seq
+	ring.entries[ring.next] = historyEntry{Seq: seq, Type: msgType, Message: message}
+	ring.next = (ring.next + 1) % roomHistorySize
+}
+
+// Since returns a room's events after seq in order. ok is false when some
+// of them are no longer retained (or seq was never issued by this hub), in
+// which case the client has to resync from scratch.
+func (eh *EventHistory) Since(room string, seq uint64) (entries []historyEntry, ok bool) {
+	eh.mu.Lock()
+	defer eh.mu.Unlock()
+
+	if seq > eh.latest {
+		return nil, false
+	}
+
+	ring, exists := eh.rooms[room]
+	if !exists {
+		return nil, seq == eh.latest
+	}
+	if seq < ring.floor {
+		return nil, false
+	}
+
+	for i := 0; i < len(ring.entries); i++ {
+		entry := ring.entries[(ring.next+i)%len(ring.entries)]
+		if entry.Seq > seq {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, true
+}
+
+// resumePoint is where a reconnecting client left each room (?resume_from)
+type resumePoint struct {
+	// Seq for rooms not listed in rooms
+	all   uint64
+	rooms map[string]uint64
+}
+
+// parseResumePoint reads resume_from: either one seq for every room, or a
+// comma-separated list of room:seq, where rooms left out resume from 0 and
+// so resync
+func parseResumePoint(raw string) (*resumePoint, error) {
+	if seq, err := strconv.ParseUint(raw, 10, 64); err == nil {
+		return &resumePoint{all: seq}, nil
+	}
+	p := &resumePoint{rooms: make(map[string]uint64)}
+	for _, item := range strings.Split(raw, ",") {
+		// Room names contain colons; the seq follows the last one
+		i := strings.LastIndex(item, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid room seq %q", item)
+		}
+		seq, err := strconv.ParseUint(item[i+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid room seq %q", item)
+		}
+		p.rooms[item[:i]] = seq
+	}
+	return p, nil
+}
+
+// from is the last seq the client saw in room
+func (p *resumePoint) from(room string) uint64 {
+	if seq, ok := p.rooms[room]; ok {
+		return seq
+	}
+	return p.all
+}
@@ -1,49 +1,94 @@
 package internal
 
 import (
-	"database/sql"
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"asset-ws/internal/protocol"
+
 	"github.com/gorilla/websocket"
 	"golang.org/x/time/rate"
 )
 
 // Lock ordering: each manager (presence, cellLocks, pendingCells, rowLocks)
 // uses its own independent mutex. No code path holds two manager locks
-// simultaneously. Hub.mutex protects client/room maps only.
+// simultaneously. Hub.mutex protects the client, parked and room actor maps
+// only; room membership belongs to each room's actor (see roomActor).
+// Room broadcasts are stamped under the EventHistory mutex, which may take
+// Hub.mutex to find or start the rooms, never the other way around. They are
+// queued on the actors without waiting for them. A room actor only takes
+// Hub.mutex to retire itself, and nobody holding Hub.mutex waits for a room.
 
 const (
-	healthCheckInterval = 30 * time.Second
+	healthCheckInterval   = 30 * time.Second
+	cellLockSweepInterval = 5 * time.Second
 
 	hubChannelBuffer = 100
+
+	// shutdownReconnectHint is how long clients are told to wait before
+	// reconnecting after SERVER_SHUTDOWN, roughly a restart's length
+	shutdownReconnectHint = 3 * time.Second
+	// shutdownPollInterval is how often Shutdown checks whether every
+	// client has disconnected
+	shutdownPollInterval = 50 * time.Millisecond
 )
 
-type Message struct {
-	Type    string      `json:"type"`
-	Payload interface{} `json:"payload"`
+// HubConfig holds the hub's tunables, read from the environment in main
+type HubConfig struct {
+	AllowedOrigins []string
+	// ReconnectGrace is how long a dropped client's locks and pending cells
+	// wait for the same session to reconnect. Zero releases them at once.
+	ReconnectGrace time.Duration
+	// ChangeLogPoll is how often change_log is polled for writes made outside
+	// the hub. Zero disables the watcher.
+	ChangeLogPoll time.Duration
+	// RowFeed, when set, broadcasts row changes from change data capture
+	RowFeed RowFeed
+	// InstanceID names this process among the instances sharing Backplane
+	// and Locks. It must be unique in the cluster.
+	InstanceID string
+	// Backplane relays room broadcasts to the other instances. Nil runs
+	// the hub on its own.
+	Backplane Backplane
+	// Locks arbitrates cell, row and pending state between instances.
+	// Nil uses an in-process store.
+	Locks LockStore
+	// SessionRevalidate is how often every client's session is checked
+	// again, so logged out and expired users are disconnected. Zero only
+	// rechecks on demand.
+	SessionRevalidate time.Duration
+	// Tickets holds the upgrade tickets ServeTicket issues. Nil keeps them
+	// in process, which only works if upgrades reach the issuing instance.
+	Tickets TicketStore
+	// AllowQuerySession accepts ?session_id= on upgrades, for clients that
+	// predate tickets. The id then shows up in proxy logs and history.
+	AllowQuerySession bool
+	// SlowClients is what happens to a client whose send buffer is full.
+	// Empty means SlowClientCoalesce.
+	SlowClients SlowClientPolicy
+	// CompressionLevel negotiates permessage-deflate and compresses at this
+	// flate level, 1 (fastest) to 9 (smallest). Zero never compresses.
+	CompressionLevel int
+	// CompressionMinSize is the smallest message, in bytes, that is sent
+	// compressed
+	CompressionMinSize int
 }
 
 // BroadcastData wraps the message and the sender to allow echo suppression
 type BroadcastData struct {
-	Message []byte
+	Message protocol.Message
 	Sender  *Client // Can be nil for system messages
-}
-
-// UserInfo holds authenticated user data
-type UserInfo struct {
-	UserID    int64
-	Username  string
-	Firstname string
-	Lastname  string
-	Color     string
+	Type    string
+	Queued  time.Time
 }
 
 type Hub struct {
@@ -54,267 +99,276 @@ type Hub struct {
 	// This allows us to track all open tabs for a specific user
 	userClients map[string]map[*Client]bool
 
-	// Room subscriptions: room name -> set of clients
-	rooms map[string]map[*Client]bool
-
-	broadcast       chan BroadcastData
-	register        chan *Client
-	unregister      chan *Client
-	mutex           sync.RWMutex
-	presence        *UserPresence
-	cellLocks       *CellLockManager
-	pendingCells    *PendingCellManager
-	rowLocks        *RowLockManager
-	shutdown        chan struct{}
-	wg              sync.WaitGroup
-	db              *sql.DB
-	allowedOrigins  []string
-}
-
-func NewHub(db *sql.DB, allowedOrigins []string) *Hub {
-	return &Hub{
-		broadcast:      make(chan BroadcastData, hubChannelBuffer),
-		register:       make(chan *Client, hubChannelBuffer),
-		unregister:     make(chan *Client, hubChannelBuffer),
-		clients:        make(map[*Client]bool),
-		userClients:    make(map[string]map[*Client]bool),
-		rooms:          make(map[string]map[*Client]bool),
-		presence:       NewUserPresence(),
-		cellLocks:      NewCellLockManager(),
-		pendingCells:   NewPendingCellManager(),
-		rowLocks:       NewRowLockManager(),
-		shutdown:       make(chan struct{}),
-		db:             db,
-		allowedOrigins: allowedOrigins,
+	// Room name -> the actor owning its members
+	rooms map[string]*roomActor
+
+	broadcast    chan BroadcastData
+	register     chan *Client
+	unregister   chan *Client
+	mutex        sync.RWMutex
+	presence     *UserPresence
+	cellLocks    *CellLockManager
+	pendingCells *PendingCellManager
+	rowLocks     *RowLockManager
+	history      *EventHistory
+	changeLog    *ChangeLogWatcher
+	metrics      *hubMetrics
+	shutdown     chan struct{}
+	wg           sync.WaitGroup
+	sessions     SessionValidator
+	store        AssetStore
+	config       HubConfig
+
+	// Cluster membership; see HubConfig
+	instanceID string
+	backplane  Backplane
+	locks      LockStore
+	outbox     chan Envelope
+
+	tickets TicketStore
+
+	// Disconnected clients inside their reconnect grace window, by parkKey
+	parked map[string][]*parkedClient
+
+	// Set once Shutdown starts; new upgrades are refused
+	draining     atomic.Bool
+	shutdownOnce sync.Once
+}
+
+// NewHub creates a hub that authenticates clients with sessions and reads
+// and writes assets through store
+func NewHub(sessions SessionValidator, store AssetStore, config HubConfig) *Hub {
+	h := &Hub{
+		broadcast:    make(chan BroadcastData, hubChannelBuffer),
+		register:     make(chan *Client, hubChannelBuffer),
+		unregister:   make(chan *Client, hubChannelBuffer),
+		clients:      make(map[*Client]bool),
+		userClients:  make(map[string]map[*Client]bool),
+		rooms:        make(map[string]*roomActor),
+		presence:     NewUserPresence(),
+		cellLocks:    NewCellLockManager(),
+		pendingCells: NewPendingCellManager(),
+		rowLocks:     NewRowLockManager(),
+		history:      NewEventHistory(roomNames...),
+		shutdown:     make(chan struct{}),
+		sessions:     sessions,
+		store:        store,
+		config:       config,
+		parked:       make(map[string][]*parkedClient),
+		instanceID:   config.InstanceID,
+		backplane:    config.Backplane,
+		locks:        config.Locks,
+		outbox:       make(chan Envelope, backplaneOutboxSize),
+		tickets:      config.Tickets,
+	}
+	if h.instanceID == "" {
+		h.instanceID = "local"
+	}
+	if h.locks == nil {
+		h.locks = NewMemoryLockStore()
 	}
+	if h.tickets == nil {
+		h.tickets = NewMemoryTicketStore()
+	}
+	h.changeLog = NewChangeLogWatcher(h, store)
+	h.metrics = newHubMetrics(h)
+	return h
 }
 
 // ValidateSession checks if a session is valid and returns user info
 func (h *Hub) ValidateSession(sessionID string) (*UserInfo, error) {
-	query := `
-		SELECT
-			s.user_id,
-			u.username,
-			u.firstname,
-			u.lastname
-		FROM sessions s
-		JOIN users u ON s.user_id = u.id
-		WHERE s.session_id = ?
-		AND s.expires_at > NOW()
-	`
-
-	var userInfo UserInfo
-	err := h.db.QueryRow(query, sessionID).Scan(
-		&userInfo.UserID,
-		&userInfo.Username,
-		&userInfo.Firstname,
-		&userInfo.Lastname,
-	)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("invalid or expired session")
-		}
-		return nil, fmt.Errorf("database error: %v", err)
-	}
-
-	return &userInfo, nil
+	return h.sessions.ValidateSession(sessionID)
 }
 
-func (c *Client) handleClientState(payload interface{}) {
-	payloadMap, ok := payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-
-	var conflicts []map[string]interface{}
+func (c *Client) handleClientState(p *protocol.ClientState, room string) {
+	conflicts := []protocol.Conflict{}
 
 	// 1. Reconcile position
-	if posRaw, ok := payloadMap["position"]; ok && posRaw != nil {
-		if posMap, ok := posRaw.(map[string]interface{}); ok {
-			row, rowOk := posMap["row"].(float64)
-			col, colOk := posMap["col"].(float64)
-			if rowOk && colOk && row >= 0 && col >= 0 {
-				c.hub.presence.Set(c, int(row), int(col))
-
-				broadcastPayload := map[string]interface{}{
-					"row":       int(row),
-					"col":       int(col),
-					"clientId":  c.userID,
-					"userId":    c.userInfo.UserID,
-					"username":  c.userInfo.Username,
-					"firstname": c.userInfo.Firstname,
-					"lastname":  c.userInfo.Lastname,
-					"color":     c.userInfo.Color,
-				}
-				c.hub.BroadcastToRoom(c.room,"USER_POSITION_UPDATE", broadcastPayload, c)
-			}
-		}
+	if p.Position != nil {
+		row, col := p.Position.Row, p.Position.Col
+		prevAssetID := c.hub.presence.Set(c, row, col, p.Position.AssetID.String(), room)
+		c.hub.BroadcastInView(room, cursorAssets(p.Position.AssetID.String(), prevAssetID), protocol.TypeUserPositionUpdate, c.position(row, col, p.Position.AssetID), c)
 	}
 
 	// 2. Reconcile lock
-	if lockRaw, ok := payloadMap["lock"]; ok && lockRaw != nil {
-		if lockMap, ok := lockRaw.(map[string]interface{}); ok {
-			assetIdRaw, ok1 := lockMap["assetId"]
-			keyStr, ok2 := lockMap["key"].(string)
-			if ok1 && ok2 && keyStr != "" {
-				assetId := fmt.Sprintf("%v", assetIdRaw)
-				lockKey := assetId + ":" + keyStr
-
-				// Check pending by another user first
-				if blocked, blocker := c.hub.pendingCells.IsBlockedByOther(lockKey, c); blocked {
-					conflict := map[string]interface{}{
-						"type":      "lock",
-						"assetId":   assetId,
-						"key":       keyStr,
-						"heldBy":    blocker.Client.userID,
-						"firstname": blocker.Client.userInfo.Firstname,
-						"lastname":  blocker.Client.userInfo.Lastname,
-					}
-					conflicts = append(conflicts, conflict)
-				} else if locked := c.hub.cellLocks.Lock(lockKey, c, assetId, keyStr); locked {
-					broadcastPayload := map[string]interface{}{
-						"assetId":   assetIdRaw,
-						"key":       keyStr,
-						"userId":    c.userID,
-						"firstname": c.userInfo.Firstname,
-						"lastname":  c.userInfo.Lastname,
-						"color":     c.userInfo.Color,
-					}
-					c.hub.BroadcastToRoom(c.room,"CELL_LOCKED", broadcastPayload, c)
-				} else {
-					existing := c.hub.cellLocks.GetLock(lockKey)
-					conflict := map[string]interface{}{
-						"type":    "lock",
-						"assetId": assetId,
-						"key":     keyStr,
-					}
-					if existing != nil {
-						conflict["heldBy"] = existing.Client.userID
-						conflict["firstname"] = existing.Client.userInfo.Firstname
-						conflict["lastname"] = existing.Client.userInfo.Lastname
-					}
-					conflicts = append(conflicts, conflict)
-				}
+	if p.Lock != nil {
+		assetId := p.Lock.AssetID.String()
+		lockKey := protocol.CellKey(p.Lock.AssetID, p.Lock.Key)
+
+		// Check pending by another user first
+		if blocked, blocker := c.hub.pendingCells.IsBlockedByOther(lockKey, c); blocked {
+			conflicts = append(conflicts, protocol.Conflict{
+				Type:      "lock",
+				AssetID:   p.Lock.AssetID,
+				Key:       p.Lock.Key,
+				HeldBy:    blocker.Client.userID,
+				Firstname: blocker.Client.userInfo.Firstname,
+				Lastname:  blocker.Client.userInfo.Lastname,
+			})
+		} else if claim := c.hub.remoteClaim(LockPending, lockKey); claim != nil {
+			conflicts = append(conflicts, claimConflict("lock", claim, p.Lock.AssetID, p.Lock.Key))
+		} else if locked := c.hub.cellLocks.Lock(lockKey, c, assetId, p.Lock.Key, room); !locked {
+			conflict := protocol.Conflict{
+				Type:    "lock",
+				AssetID: p.Lock.AssetID,
+				Key:     p.Lock.Key,
 			}
+			if existing := c.hub.cellLocks.GetLock(lockKey); existing != nil {
+				conflict.HeldBy = existing.Client.userID
+				conflict.Firstname = existing.Client.userInfo.Firstname
+				conflict.Lastname = existing.Client.userInfo.Lastname
+			}
+			conflicts = append(conflicts, conflict)
+		} else if other := c.claim(LockCell, lockKey, "", room); other != nil {
+			// Locked meanwhile through another instance
+			c.hub.cellLocks.ForceUnlock(lockKey)
+			conflicts = append(conflicts, claimConflict("lock", other, p.Lock.AssetID, p.Lock.Key))
+		} else {
+			c.hub.BroadcastInView(room, []string{assetId}, protocol.TypeCellLocked, protocol.CellLocked{
+				AssetID: p.Lock.AssetID,
+				Key:     p.Lock.Key,
+				Holder:  c.holder(),
+			}, c)
 		}
 	}
 
 	// 3. Reconcile pending cells
-	if pendingRaw, ok := payloadMap["pending"]; ok && pendingRaw != nil {
-		if pendingArr, ok := pendingRaw.([]interface{}); ok {
-			var addedKeys []string
-			for _, item := range pendingArr {
-				cellMap, ok := item.(map[string]interface{})
-				if !ok {
-					continue
-				}
-				assetIdRaw, ok1 := cellMap["assetId"]
-				keyStr, ok2 := cellMap["key"].(string)
-				valueStr, _ := cellMap["value"].(string)
-				if !ok1 || !ok2 || keyStr == "" {
-					continue
-				}
-
-				assetId := fmt.Sprintf("%v", assetIdRaw)
-				cellKey := assetId + ":" + keyStr
-
-				if added := c.hub.pendingCells.Add(cellKey, c, assetId, keyStr, valueStr); added {
-					addedKeys = append(addedKeys, cellKey)
-					broadcastPayload := map[string]interface{}{
-						"assetId":   assetIdRaw,
-						"key":       keyStr,
-						"userId":    c.userID,
-						"firstname": c.userInfo.Firstname,
-						"lastname":  c.userInfo.Lastname,
-						"color":     c.userInfo.Color,
-					}
-					c.hub.BroadcastToRoom(c.room,"PENDING_BROADCAST", broadcastPayload, c)
-				} else {
-					// Blocked by another user
-					blocked, blocker := c.hub.pendingCells.IsBlockedByOther(cellKey, c)
-					if blocked {
-						conflict := map[string]interface{}{
-							"type":      "pending",
-							"assetId":   assetId,
-							"key":       keyStr,
-							"heldBy":    blocker.Client.userID,
-							"firstname": blocker.Client.userInfo.Firstname,
-							"lastname":  blocker.Client.userInfo.Lastname,
-						}
-						conflicts = append(conflicts, conflict)
-					}
-				}
-			}
-			if n := len(addedKeys); n > 0 {
-				preview := addedKeys
-				suffix := ""
-				if n > 5 {
-					preview = addedKeys[:5]
-					suffix = fmt.Sprintf(", ...+%d", n-5)
-				}
-				log.Printf("[Pending] %s (%s %s) pended %d cells: %s%s", c.userInfo.Username, c.userInfo.Firstname, c.userInfo.Lastname, n, strings.Join(preview, ", "), suffix)
+	var addedKeys []string
+	for _, cell := range p.Pending {
+		cellKey := protocol.CellKey(cell.AssetID, cell.Key)
+
+		if added := c.hub.pendingCells.Add(cellKey, c, cell.AssetID.String(), cell.Key, cell.Value, room); added {
+			if other := c.claim(LockPending, cellKey, cell.Value, room); other != nil {
+				c.hub.pendingCells.Remove(cellKey, c)
+				conflicts = append(conflicts, claimConflict("pending", other, cell.AssetID, cell.Key))
+				continue
 			}
+			addedKeys = append(addedKeys, cellKey)
+			c.hub.BroadcastInView(room, []string{cell.AssetID.String()}, protocol.TypePendingBroadcast, protocol.PendingCell{
+				AssetID: cell.AssetID,
+				Key:     cell.Key,
+				Holder:  c.holder(),
+			}, c)
+		} else if blocked, blocker := c.hub.pendingCells.IsBlockedByOther(cellKey, c); blocked {
+			// Blocked by another user
+			conflicts = append(conflicts, protocol.Conflict{
+				Type:      "pending",
+				AssetID:   cell.AssetID,
+				Key:       cell.Key,
+				HeldBy:    blocker.Client.userID,
+				Firstname: blocker.Client.userInfo.Firstname,
+				Lastname:  blocker.Client.userInfo.Lastname,
+			})
 		}
 	}
+	if n := len(addedKeys); n > 0 {
+		preview := addedKeys
+		suffix := ""
+		if n > 5 {
+			preview = addedKeys[:5]
+			suffix = fmt.Sprintf(", ...+%d", n-5)
+		}
+		log.Printf("[Pending] %s (%s %s) pended %d cells: %s%s", c.userInfo.Username, c.userInfo.Firstname, c.userInfo.Lastname, n, strings.Join(preview, ", "), suffix)
+	}
 
 	// 4. Reconcile row lock
-	if rowLockRaw, ok := payloadMap["rowLock"]; ok && rowLockRaw != nil {
-		if rowLockMap, ok := rowLockRaw.(map[string]interface{}); ok {
-			if assetIdRaw, ok := rowLockMap["assetId"]; ok {
-				assetId := fmt.Sprintf("%v", assetIdRaw)
-
-				if locked := c.hub.rowLocks.Lock(assetId, c); locked {
-					broadcastPayload := map[string]interface{}{
-						"assetId":   assetId,
-						"userId":    c.userID,
-						"firstname": c.userInfo.Firstname,
-						"lastname":  c.userInfo.Lastname,
-						"color":     c.userInfo.Color,
-					}
-					c.hub.BroadcastToRoom(c.room, "ROW_LOCKED", broadcastPayload, c)
-				} else {
-					existing := c.hub.rowLocks.GetAll()[assetId]
-					conflict := map[string]interface{}{
-						"type":    "rowLock",
-						"assetId": assetId,
-					}
-					if existing != nil {
-						conflict["heldBy"] = existing.Client.userID
-						conflict["firstname"] = existing.Client.userInfo.Firstname
-						conflict["lastname"] = existing.Client.userInfo.Lastname
-					}
-					conflicts = append(conflicts, conflict)
-				}
+	if p.RowLock != nil {
+		assetId := p.RowLock.AssetID.String()
+
+		if locked := c.hub.rowLocks.Lock(assetId, c, room); !locked {
+			conflict := protocol.Conflict{
+				Type:    "rowLock",
+				AssetID: p.RowLock.AssetID,
 			}
+			if existing := c.hub.rowLocks.GetAll()[assetId]; existing != nil {
+				conflict.HeldBy = existing.Client.userID
+				conflict.Firstname = existing.Client.userInfo.Firstname
+				conflict.Lastname = existing.Client.userInfo.Lastname
+			}
+			conflicts = append(conflicts, conflict)
+		} else if other := c.claim(LockRow, assetId, "", room); other != nil {
+			c.hub.rowLocks.Unlock(assetId, c)
+			conflicts = append(conflicts, claimConflict("rowLock", other, p.RowLock.AssetID, ""))
+		} else {
+			c.hub.BroadcastToAllRooms(protocol.TypeRowLocked, protocol.RowLocked{
+				AssetID: p.RowLock.AssetID,
+				Holder:  c.holder(),
+			}, c)
 		}
 	}
 
 	// 5. Send reconciliation result back to client
-	reconcileMsg := Message{
-		Type: "CLIENT_STATE_RECONCILED",
-		Payload: map[string]interface{}{
-			"conflicts": conflicts,
-		},
-	}
-	if jsonMsg, err := json.Marshal(reconcileMsg); err == nil {
-		select {
-		case c.send <- jsonMsg:
-		default:
-			log.Printf("Failed to send CLIENT_STATE_RECONCILED to %s (buffer full)", c.userInfo.Username)
-		}
-	}
+	c.sendMessage(protocol.TypeClientStateReconciled, protocol.ClientStateReconciled{
+		Conflicts: conflicts,
+	})
 
 	if len(conflicts) > 0 {
 		log.Printf("[Reconcile] %s had %d conflicts on CLIENT_STATE", c.userInfo.Username, len(conflicts))
 	}
 }
 
+// claimConflict reports a key held through another instance
+func claimConflict(conflictType string, claim *Claim, assetID protocol.ID, key string) protocol.Conflict {
+	return protocol.Conflict{
+		Type:      conflictType,
+		AssetID:   assetID,
+		Key:       key,
+		HeldBy:    claim.Holder.UserID,
+		Firstname: claim.Holder.Firstname,
+		Lastname:  claim.Holder.Lastname,
+	}
+}
+
 func (h *Hub) Run() {
 	healthTicker := time.NewTicker(healthCheckInterval)
 	defer healthTicker.Stop()
 
-	log.Println("Hub started - ready for WebSocket connections")
+	leaseTicker := time.NewTicker(cellLockSweepInterval)
+	defer leaseTicker.Stop()
+
+	if h.config.ChangeLogPoll > 0 {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			h.changeLog.Run(h.config.ChangeLogPoll, h.shutdown)
+		}()
+	}
+
+	if h.config.SessionRevalidate > 0 {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			h.runSessionRevalidation(h.config.SessionRevalidate)
+		}()
+	}
+
+	if h.config.RowFeed != nil {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			h.runRowFeed()
+		}()
+	}
+
+	if h.backplane != nil {
+		h.wg.Add(2)
+		go func() {
+			defer h.wg.Done()
+			h.runPublisher()
+		}()
+		go func() {
+			defer h.wg.Done()
+			h.backplane.Run(h.instanceID, h.shutdown, h.receive)
+		}()
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.runLockRenewal()
+	}()
+
+	log.Printf("Hub started as instance %s - ready for WebSocket connections", h.instanceID)
 
 	for {
 		select {
@@ -329,6 +383,10 @@ func (h *Hub) Run() {
 
 		case <-healthTicker.C:
 			h.checkStaleConnections()
+			h.pruneRooms()
+
+		case <-leaseTicker.C:
+			h.expireCellLocks(time.Now())
 
 		case <-h.shutdown:
 			log.Println("Hub shutting down...")
@@ -351,81 +409,132 @@ func (h *Hub) registerClient(client *Client) {
 	h.userClients[client.userID][client] = true
 
 	log.Printf("User %s connected (Sessions: %d)", client.userInfo.Username, len(h.userClients[client.userID]))
+
+	// Upgraded just as Shutdown began; send it away with the rest
+	if h.draining.Load() {
+		client.sendMessage(protocol.TypeServerShutdown, protocol.ServerShutdown{ReconnectAfterMs: shutdownReconnectHint.Milliseconds()})
+		client.startDrain()
+	}
 }
 
-func (h *Hub) sendExistingUsers(client *Client) {
-	existingPositions := h.presence.GetAllExcept(client)
-	allLocks := h.cellLocks.GetAll()
-	allPending := h.pendingCells.GetAll()
+// sendExistingUsers sends a room's snapshot: the cursors, locks and pending
+// cells members of room are shown, which are those acquired in it or in a
+// room below it. Row locks are shown everywhere. It runs on the room's
+// goroutine or while the room is paused, so the snapshot sits at a fixed
+// point of the room's stream.
+func (h *Hub) sendExistingUsers(client *Client, r *roomActor) {
+	room := r.name
+	users, locked, pending := h.cellState(client, func(from string) bool {
+		return roomReaches(from, room)
+	}, nil)
+
+	snapshot := protocol.ExistingUsers{
+		Room:         room,
+		Users:        users,
+		LockedCells:  locked,
+		PendingCells: pending,
+		RowLocks:     make(map[string]protocol.Holder),
+	}
+
+	// Row locks
+	for assetId, lockInfo := range h.rowLocks.GetAll() {
+		if !lockInfo.Client.left.Load() {
+			snapshot.RowLocks[assetId] = lockInfo.Client.holder()
+		}
+	}
+
+	// Row locks held by clients of other instances
+	for _, claim := range h.remoteClaims(LockRow) {
+		if _, ok := snapshot.RowLocks[claim.Key]; !ok {
+			snapshot.RowLocks[claim.Key] = claim.Holder
+		}
+	}
+
+	// The snapshot is as fresh as the room's last delivered broadcast;
+	// clients resume the room from there
+	msg := newOutbound(protocol.Message{
+		Type:    protocol.TypeExistingUsers,
+		Seq:     r.seq,
+		Rooms:   []string{room},
+		Payload: snapshot,
+	})
+	if !h.deliver(client, msg) {
+		log.Printf("Failed to send %s to %s (buffer full)", protocol.TypeExistingUsers, client.userInfo.Username)
+	}
+}
+
+// cellState collects the cursors, locked cells and pending cells acquired
+// in rooms that reach accepts, including those of other instances. Cells of
+// assets shown rejects are left out; a nil shown keeps them all.
+func (h *Hub) cellState(client *Client, reach func(room string) bool, shown func(assetID string) bool) (map[string]protocol.PresentUser, map[string]protocol.Holder, map[string]protocol.PendingCell) {
+	if shown == nil {
+		shown = func(string) bool { return true }
+	}
+	parked := h.parkedClients()
+
+	users := make(map[string]protocol.PresentUser)
+	locked := make(map[string]protocol.Holder)
+	pending := make(map[string]protocol.PendingCell)
 
 	// Enhanced user positions
-	enhancedUsers := make(map[string]interface{})
-	for c, pos := range existingPositions {
-		enhancedUsers[c.userID] = map[string]interface{}{
-			"row":       pos.Row,
-			"col":       pos.Col,
-			"userId":    c.userInfo.UserID,
-			"username":  c.userInfo.Username,
-			"firstname": c.userInfo.Firstname,
-			"lastname":  c.userInfo.Lastname,
-			"color":     c.userInfo.Color,
+	for c, pos := range h.presence.GetAllExcept(client) {
+		if !reach(pos.Room) || c.left.Load() {
+			continue
+		}
+		users[c.userID] = protocol.PresentUser{
+			Row:       pos.Row,
+			Col:       pos.Col,
+			AssetID:   protocol.ID(pos.AssetID),
+			UserID:    c.userInfo.UserID,
+			Username:  c.userInfo.Username,
+			Firstname: c.userInfo.Firstname,
+			Lastname:  c.userInfo.Lastname,
+			Color:     c.userInfo.Color,
+			Away:      parked[c],
 		}
 	}
 
 	// Current cell locks
-	lockedCellsPayload := make(map[string]interface{})
-	for lockKey, lockInfo := range allLocks {
-		lockedCellsPayload[lockKey] = map[string]interface{}{
-			"userId":    lockInfo.Client.userID,
-			"firstname": lockInfo.Client.userInfo.Firstname,
-			"lastname":  lockInfo.Client.userInfo.Lastname,
-			"color":     lockInfo.Client.userInfo.Color,
+	for lockKey, lockInfo := range h.cellLocks.GetAll() {
+		if reach(lockInfo.Room) && shown(lockInfo.AssetID) && !lockInfo.Client.left.Load() {
+			locked[lockKey] = lockInfo.Client.holder()
 		}
 	}
 
 	// Pending cells
-	pendingCellsPayload := make(map[string]interface{})
-	for cellKey, pendingInfo := range allPending {
-		pendingCellsPayload[cellKey] = map[string]interface{}{
-			"userId":    pendingInfo.Client.userID,
-			"assetId":   pendingInfo.AssetID,
-			"key":       pendingInfo.Key,
-			"firstname": pendingInfo.Client.userInfo.Firstname,
-			"lastname":  pendingInfo.Client.userInfo.Lastname,
-			"color":     pendingInfo.Client.userInfo.Color,
+	for cellKey, pendingInfo := range h.pendingCells.GetAll() {
+		if !reach(pendingInfo.Room) || !shown(pendingInfo.AssetID) || pendingInfo.Client.left.Load() {
+			continue
+		}
+		pending[cellKey] = protocol.PendingCell{
+			AssetID: protocol.ID(pendingInfo.AssetID),
+			Key:     pendingInfo.Key,
+			Holder:  pendingInfo.Client.holder(),
 		}
 	}
 
-	// Row locks
-	allRowLocks := h.rowLocks.GetAll()
-	rowLocksPayload := make(map[string]interface{})
-	for assetId, lockInfo := range allRowLocks {
-		rowLocksPayload[assetId] = map[string]interface{}{
-			"userId":    lockInfo.Client.userID,
-			"firstname": lockInfo.Client.userInfo.Firstname,
-			"lastname":  lockInfo.Client.userInfo.Lastname,
-			"color":     lockInfo.Client.userInfo.Color,
-		}
-	}
-
-	msg := Message{Type: "EXISTING_USERS", Payload: map[string]interface{}{
-		"users":        enhancedUsers,
-		"lockedCells":  lockedCellsPayload,
-		"pendingCells": pendingCellsPayload,
-		"rowLocks":     rowLocksPayload,
-	}}
-	jsonMsg, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("Failed to marshal existing users: %v", err)
-		return
+	// State held by clients of other instances
+	for _, claim := range h.remoteClaims(LockCell) {
+		if _, ok := locked[claim.Key]; ok || !reach(claim.Room) {
+			continue
+		}
+		if cell, ok := splitCellKey(claim.Key); ok && shown(cell.AssetID.String()) {
+			locked[claim.Key] = claim.Holder
+		}
 	}
-
-	select {
-	case client.send <- jsonMsg:
-		// sent
-	default:
-		log.Printf("Skipped sending existing state to %s (client unavailable)", client.userInfo.Username)
+	for _, claim := range h.remoteClaims(LockPending) {
+		if _, ok := pending[claim.Key]; ok || !reach(claim.Room) {
+			continue
+		}
+		if cell, ok := splitCellKey(claim.Key); ok && shown(cell.AssetID.String()) {
+			pending[claim.Key] = protocol.PendingCell{
+				AssetID: cell.AssetID,
+				Key:     cell.Key,
+				Holder:  claim.Holder,
+			}
+		}
 	}
+	return users, locked, pending
 }
 
 func (h *Hub) unregisterClient(client *Client) {
@@ -443,138 +552,254 @@ func (h *Hub) unregisterClient(client *Client) {
 			}
 		}
 
-		// 3. Remove from all rooms
-		for roomName, roomClients := range h.rooms {
-			if _, inRoom := roomClients[client]; inRoom {
-				delete(roomClients, client)
-				if len(roomClients) == 0 {
-					delete(h.rooms, roomName)
-				}
-				log.Printf("[Room] %s (%s %s) left room '%s' (disconnected)", client.userInfo.Username, client.userInfo.Firstname, client.userInfo.Lastname, roomName)
-			}
-		}
-
 		close(client.done)
-		room := client.room // capture while mutex still held
 		h.mutex.Unlock()
 
+		// 3. Remove from all rooms
+		rooms := client.roomList()
+		for _, r := range h.roomActors(rooms) {
+			r.leave(client)
+			log.Printf("[Room] %s (%s %s) left room '%s' (disconnected)", client.userInfo.Username, client.userInfo.Firstname, client.userInfo.Lastname, r.name)
+		}
+
 		log.Printf("User %s disconnected session", client.userInfo.Username)
 
+		// Nobody is coming back to this process once it drains, and an
+		// ended session cannot reconnect
+		if h.config.ReconnectGrace > 0 && !h.draining.Load() && !client.revoked.Load() {
+			h.parkClient(client, rooms)
+			return
+		}
+
 		h.wg.Add(1)
 		go func() {
 			defer h.wg.Done()
-			h.cleanupClient(client, room)
+			h.cleanupClient(client, rooms)
 		}()
 	} else {
 		h.mutex.Unlock()
 	}
 }
 
-func (h *Hub) cleanupClient(client *Client, room string) {
-	h.presence.Remove(client)
-	h.cellLocks.RemoveAllForClient(client)
-	h.pendingCells.RemoveAllForClient(client)
-
-	removedRowLocks := h.rowLocks.RemoveAllForClient(client)
-	for _, assetId := range removedRowLocks {
-		h.BroadcastToAllRooms("ROW_UNLOCKED", map[string]interface{}{
-			"assetId": assetId,
+// cleanupClient releases what a client held and tells its rooms it left.
+// USER_LEFT and ROW_UNLOCKED are sequenced before anything is released, so
+// nobody can take one of its locks and have that announced ahead of them,
+// and snapshots stop showing its state before they are: one taken meanwhile
+// is never older than what it leaves out.
+func (h *Hub) cleanupClient(client *Client, rooms []string) {
+	client.left.Store(true)
+
+	var rowLocks []string
+	for assetId, lockInfo := range h.rowLocks.GetAll() {
+		if lockInfo.Client == client {
+			rowLocks = append(rowLocks, assetId)
+		}
+	}
+	sort.Strings(rowLocks)
+	for _, assetId := range rowLocks {
+		h.BroadcastToAllRooms(protocol.TypeRowUnlocked, protocol.RowRef{
+			AssetID: protocol.ID(assetId),
 		}, nil)
 	}
+	h.BroadcastToRooms(rooms, protocol.TypeUserLeft, protocol.UserLeft{ClientID: client.userID}, nil)
 
-	payload := map[string]interface{}{"clientId": client.userID}
-	h.BroadcastToRoom(room, "USER_LEFT", payload, nil)
+	h.presence.Remove(client)
+	for _, removedLocks := range h.cellLocks.RemoveAllForClient(client) {
+		h.release(LockCell, client, removedLocks...)
+	}
+	for _, removedCells := range h.pendingCells.RemoveAllForClient(client) {
+		h.release(LockPending, client, removedCells...)
+	}
+	h.release(LockRow, client, h.rowLocks.RemoveAllForClient(client)...)
 }
 
 // BroadcastMessage queues a message for broadcast, excluding the sender if provided
 func (h *Hub) BroadcastMessage(msgType string, data interface{}, sender *Client) {
-	msg := Message{
+	msg := protocol.Message{
 		Type:    msgType,
 		Payload: data,
 	}
 
-	jsonMsg, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("JSON Marshal error: %v", err)
-		return
-	}
-
 	select {
-	case h.broadcast <- BroadcastData{Message: jsonMsg, Sender: sender}:
+	case h.broadcast <- BroadcastData{Message: msg, Sender: sender, Type: msgType, Queued: time.Now()}:
 	case <-time.After(100 * time.Millisecond):
 		log.Printf("Broadcast channel full, dropping message type: %s", msgType)
 	}
 }
 
-// BroadcastToRoom sends a message only to clients in the specified room, excluding the sender
+// BroadcastToRoom sends a message to the clients in room and in the rooms
+// above it, excluding the sender. The message is stamped with the next
+// sequence number and kept for replay in each of those rooms. Other
+// instances deliver it to the same rooms.
 func (h *Hub) BroadcastToRoom(room string, msgType string, data interface{}, sender *Client) {
-	msg := Message{
-		Type:    msgType,
-		Payload: data,
+	if room == "" {
+		return
 	}
+	h.BroadcastToRooms([]string{room}, msgType, data, sender)
+}
 
-	jsonMsg, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("JSON Marshal error: %v", err)
+// BroadcastToRooms is BroadcastToRoom for several rooms at once; clients in
+// more than one of them get the message once
+func (h *Hub) BroadcastToRooms(rooms []string, msgType string, data interface{}, sender *Client) {
+	if len(rooms) == 0 {
 		return
 	}
+	h.broadcastToRoomsLocal(rooms, nil, msgType, data, sender)
+	h.publish(msgType, data, rooms, nil)
+}
 
-	h.mutex.RLock()
-	defer h.mutex.RUnlock()
-
-	roomClients, ok := h.rooms[room]
-	if !ok {
+// BroadcastInView is BroadcastToRoom for events about particular assets,
+// such as cell locks and cursors. Clients whose VIEWPORT shows none of
+// assets are skipped.
+func (h *Hub) BroadcastInView(room string, assets []string, msgType string, data interface{}, sender *Client) {
+	if room == "" {
 		return
 	}
+	h.broadcastToRoomsLocal([]string{room}, assets, msgType, data, sender)
+	h.publish(msgType, data, []string{room}, assets)
+}
 
-	for client := range roomClients {
-		if sender != nil && client == sender {
-			continue
-		}
-		select {
-		case client.send <- jsonMsg:
-		default:
-			log.Printf("User %s send buffer full in room '%s', skipping message", client.userInfo.Username, room)
-		}
-	}
+// broadcastToRoomsLocal is BroadcastToRooms for this instance's clients
+// only; with assets it is BroadcastInView
+func (h *Hub) broadcastToRoomsLocal(rooms, assets []string, msgType string, data interface{}, sender *Client) {
+	start := time.Now()
+	targets := roomTargets(rooms)
+	h.sequence(targets, assets, msgType, data, sender, func() {
+		h.metrics.observeBroadcast(roomKind(rooms[0]), start)
+	})
 }
 
-// BroadcastToAllRooms sends a message to all clients that are in any room, excluding the sender
+// BroadcastToAllRooms sends a message to all clients that are in any room, excluding the sender.
+// It is recorded in every room's history, so it is replayed wherever a client resumes.
+// Other instances deliver it to their rooms too.
 func (h *Hub) BroadcastToAllRooms(msgType string, data interface{}, sender *Client) {
-	msg := Message{
-		Type:    msgType,
-		Payload: data,
+	h.broadcastToAllRoomsLocal(msgType, data, sender)
+	h.publish(msgType, data, nil, nil)
+}
+
+// broadcastToAllRoomsLocal is BroadcastToAllRooms for this instance's clients only
+func (h *Hub) broadcastToAllRoomsLocal(msgType string, data interface{}, sender *Client) {
+	start := time.Now()
+	h.sequence(nil, nil, msgType, data, sender, func() {
+		h.metrics.observeBroadcast(allRoomsLabel, start)
+	})
+}
+
+// sequence stamps a broadcast with the next seq, records it in the history
+// of rooms, or of every room when rooms is nil, and queues it on their actors.
+// Stamping and queueing happen together, so every room delivers its
+// broadcasts in seq order; nobody waits for the delivery. delivered runs
+// once every room has queued it to its clients.
+func (h *Hub) sequence(rooms, assets []string, msgType string, data interface{}, sender *Client, delivered func()) {
+	h.history.Stamp(rooms, func(seq uint64) *outbound {
+		msg := newBroadcast(protocol.Message{
+			Type:    msgType,
+			Seq:     seq,
+			Rooms:   rooms,
+			Payload: data,
+		})
+		// Looked up under the history lock, so a room starting meanwhile
+		// starts after this seq
+		h.fanOut(h.roomActors(rooms), assets, msg, sender, delivered)
+		return msg
+	})
+}
+
+// joinRooms adds a client to rooms and sends it each room's snapshot. When
+// resuming it first replays the events of each room the client missed
+// since its last seq there, or tells it to resync the rooms whose events
+// are gone. Each room does this on its own goroutine, so no live broadcast
+// slips in between the replay and the snapshot.
+func (h *Hub) joinRooms(client *Client, rooms []string, resume *resumePoint) {
+	// An event in a room and the room above it is recorded in both
+	replayed := make(map[uint64]bool)
+
+	for _, room := range rooms {
+		h.inRoom(room, func(r *roomActor, members map[*Client]bool) {
+			if !members[client] {
+				members[client] = true
+				r.size.Add(1)
+			}
+			if resume != nil {
+				h.replay(client, r, resume.from(room), replayed)
+			}
+			h.sendExistingUsers(client, r)
+		})
+	}
+}
+
+// replay sends a joining client the events of a room after seq, or
+// RESYNC_REQUIRED when some are gone. Events newer than the room has
+// delivered are still queued on it and reach the client live. It runs on
+// the room's goroutine.
+func (h *Hub) replay(client *Client, r *roomActor, seq uint64, replayed map[uint64]bool) {
+	entries, ok := h.history.Since(r.name, seq)
+	var missed []historyEntry
+	for _, entry := range entries {
+		if entry.Seq <= r.seq && !replayed[entry.Seq] {
+			missed = append(missed, entry)
+		}
 	}
 
-	jsonMsg, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("JSON Marshal error: %v", err)
+	// Replay only what fits in the send buffer; a partial replay is worse than none
+	if !ok || len(missed) > cap(client.send)-len(client.send)-1 {
+		log.Printf("[Resume] %s cannot resume room '%s' from seq %d, resync required", client.userInfo.Username, r.name, seq)
+		client.sendMessage(protocol.TypeResyncRequired, protocol.ResyncRequired{Room: r.name})
 		return
 	}
+	for _, entry := range missed {
+		replayed[entry.Seq] = true
+		// Other rooms can fill the buffer meanwhile; the slow client policy
+		// deals with that rather than blocking the room
+		h.deliver(client, entry.Message)
+	}
+	if len(missed) > 0 {
+		log.Printf("[Resume] Replayed %d events of room '%s' to %s after seq %d", len(missed), r.name, client.userInfo.Username, seq)
+	}
+}
 
-	h.mutex.RLock()
-	defer h.mutex.RUnlock()
+// leaveRoom takes a client out of a room. Callers update client.rooms.
+func (h *Hub) leaveRoom(client *Client, room string) {
+	for _, r := range h.roomActors([]string{room}) {
+		r.leave(client)
+	}
+	log.Printf("[Room] %s (%s %s) left room '%s'", client.userInfo.Username, client.userInfo.Firstname, client.userInfo.Lastname, room)
+}
 
-	sent := make(map[*Client]bool)
-	for _, roomClients := range h.rooms {
-		for client := range roomClients {
-			if sender != nil && client == sender {
-				continue
-			}
-			if sent[client] {
-				continue
-			}
-			sent[client] = true
-			select {
-			case client.send <- jsonMsg:
-			default:
-				log.Printf("User %s send buffer full in BroadcastToAllRooms, skipping message", client.userInfo.Username)
+// pruneRooms stops the actors of rooms nobody is in and forgets the events
+// of rooms nobody is in or parked in, so rooms that come and go do not keep
+// a goroutine or their history forever. The top-level rooms keep theirs.
+func (h *Hub) pruneRooms() {
+	h.retireEmptyRooms()
+
+	n := h.history.Retain(func() map[string]bool {
+		h.mutex.RLock()
+		defer h.mutex.RUnlock()
+
+		keep := make(map[string]bool, len(roomNames)+len(h.rooms))
+		for _, room := range roomNames {
+			keep[room] = true
+		}
+		for room := range h.rooms {
+			keep[room] = true
+		}
+		for _, queue := range h.parked {
+			for _, p := range queue {
+				for _, room := range p.rooms {
+					keep[room] = true
+				}
 			}
 		}
+		return keep
+	})
+	if n > 0 {
+		log.Printf("[Resume] Forgot the history of %d empty rooms", n)
 	}
 }
 
 func (h *Hub) sendToClients(data BroadcastData) {
+	defer h.metrics.observeBroadcast(allRoomsLabel, data.Queued)
+	msg := newBroadcast(data.Message)
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 
@@ -586,14 +811,30 @@ func (h *Hub) sendToClients(data BroadcastData) {
 			continue
 		}
 
-		select {
-		case client.send <- data.Message:
-		default:
+		if !h.deliver(client, msg) {
 			log.Printf("User %s send buffer full, skipping message", client.userInfo.Username)
 		}
 	}
 }
 
+// deliver queues a message on a client's send buffer without blocking and
+// counts the outcome. A full buffer is left to the slow client policy; it
+// returns false when the message was dropped.
+func (h *Hub) deliver(client *Client, msg *outbound) bool {
+	select {
+	case client.send <- msg:
+		h.metrics.messagesOut.WithLabelValues(msg.msg.Type).Inc()
+		return true
+	default:
+		label, _ := client.roomLabel.Load().(string)
+		if label == "" {
+			label = "none"
+		}
+		h.metrics.sendBufferFull.WithLabelValues(label).Inc()
+		return h.sendBufferFull(client, msg)
+	}
+}
+
 func (h *Hub) checkStaleConnections() {
 	now := time.Now()
 	staleThreshold := pongWait + (10 * time.Second)
@@ -619,11 +860,40 @@ func (h *Hub) checkStaleConnections() {
 	}
 }
 
+// expireCellLocks releases cell locks whose lease ran out before now.
+// The room sees a normal CELL_UNLOCKED; the owner is told its lock expired.
+func (h *Hub) expireCellLocks(now time.Time) {
+	expired := h.cellLocks.ExpireStale(now)
+	for _, info := range expired {
+		owner := info.Client
+		h.release(LockCell, owner, protocol.CellKey(protocol.ID(info.AssetID), info.Key))
+
+		log.Printf("[CellLock] Lease expired for %s on cell %s:%s", owner.userInfo.Username, info.AssetID, info.Key)
+
+		cell := protocol.CellRef{AssetID: protocol.ID(info.AssetID), Key: info.Key}
+		h.BroadcastInView(info.Room, []string{info.AssetID}, protocol.TypeCellUnlocked, cell, owner)
+		owner.sendMessage(protocol.TypeCellLockExpired, cell)
+	}
+}
+
 func (h *Hub) ServeWs(w http.ResponseWriter, r *http.Request) {
-	sessionID := r.URL.Query().Get("session_id")
-	if sessionID == "" {
-		log.Println("WebSocket connection rejected: missing session_id")
-		http.Error(w, "Missing session_id", http.StatusUnauthorized)
+	if h.draining.Load() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(shutdownReconnectHint.Seconds())))
+		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Refused before upgradeSession, which spends a ticket
+	if status, err := h.checkHandshake(r); err != nil {
+		log.Printf("WebSocket connection rejected: %v", err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	sessionID, err := h.upgradeSession(r)
+	if err != nil {
+		log.Printf("WebSocket connection rejected: %v", err)
+		http.Error(w, "Missing or invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
@@ -644,66 +914,189 @@ func (h *Hub) ServeWs(w http.ResponseWriter, r *http.Request) {
 	// Create upgrader with dynamic origin checking
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
-			origin := r.Header.Get("Origin")
-			for _, allowed := range h.allowedOrigins {
-				if origin == allowed {
-					return true
-				}
-			}
-			log.Printf("WebSocket origin rejected: %s (allowed: %v)", origin, h.allowedOrigins)
-			return false
+			return h.originAllowed(r.Header.Get("Origin"))
 		},
+		EnableCompression: h.config.CompressionLevel > 0,
+		Subprotocols:      []string{protocol.MsgpackSubprotocol},
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	stats := &wireStats{}
+	conn, err := upgrader.Upgrade(countingWriter{ResponseWriter: w, stats: stats}, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
 		return
 	}
+	// Only count the messages, not the handshake
+	stats.wire.Store(0)
+	compressed := upgrader.EnableCompression && offersDeflate(r)
+	if compressed {
+		conn.SetCompressionLevel(h.config.CompressionLevel)
+	}
 
 	clientID := strconv.FormatInt(userInfo.UserID, 10)
 
+	// resume_from is where the client left each room before it reconnected
+	var resume *resumePoint
+	if raw := r.URL.Query().Get("resume_from"); raw != "" {
+		if resume, err = parseResumePoint(raw); err != nil {
+			log.Printf("Ignoring resume_from from %s: %v", userInfo.Username, err)
+		}
+	}
+	// Seqs are per instance. Landing on another one means a resync; seq 0
+	// predates every history, so the first join asks for it.
+	if resume != nil && r.URL.Query().Get("resume_instance") != h.instanceID {
+		resume = &resumePoint{}
+	}
+
 	client := &Client{
-		hub:      h,
-		conn:     conn,
-		send:     make(chan []byte, clientSendBuffer),
-		done:     make(chan struct{}),
-		userID:   clientID,
-		userInfo: userInfo,
-		lastPong: time.Now(),
-		limiter:  rate.NewLimiter(200, 50),
+		hub:        h,
+		conn:       conn,
+		send:       make(chan *outbound, clientSendBuffer),
+		done:       make(chan struct{}),
+		drain:      make(chan struct{}),
+		backlog:    make(chan struct{}, 1),
+		userID:     clientID,
+		sessionID:  sessionID,
+		userInfo:   userInfo,
+		lastPong:   time.Now(),
+		limiter:    rate.NewLimiter(200, 50),
+		compressed: compressed,
+		stats:      stats,
+		binary:     conn.Subprotocol() == protocol.MsgpackSubprotocol,
+		resume:     resume,
 	}
 
 	h.register <- client
 
+	// Take over locks and pending cells left by a dropped connection of this session
+	h.adoptParked(client)
+
 	// Send welcome message immediately
-	welcomeMsg := Message{
-		Type: "WELCOME",
-		Payload: map[string]interface{}{
-			"clientId":  client.userID, // FIXED: was 'client.id'
-			"userId":    userInfo.UserID,
-			"username":  userInfo.Username,
-			"firstname": userInfo.Firstname,
-			"lastname":  userInfo.Lastname,
-			"color":     userInfo.Color,
+	welcomeMsg := protocol.Message{
+		Type: protocol.TypeWelcome,
+		Payload: protocol.Welcome{
+			ClientID:  client.userID,
+			UserID:    userInfo.UserID,
+			Username:  userInfo.Username,
+			Firstname: userInfo.Firstname,
+			Lastname:  userInfo.Lastname,
+			Role:      userInfo.Role,
+			Color:     userInfo.Color,
+			Instance:  h.instanceID,
 		},
 	}
 
-	if jsonMsg, err := json.Marshal(welcomeMsg); err == nil {
-		client.conn.SetWriteDeadline(time.Now().Add(writeWait))
-		if err := client.conn.WriteMessage(websocket.TextMessage, jsonMsg); err != nil {
-			log.Printf("Failed to send welcome to %s: %v", userInfo.Username, err)
-		} else {
-			log.Printf("User %s (%s %s) connected via WebSocket",
-				userInfo.Username, userInfo.Firstname, userInfo.Lastname)
-		}
+	client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := client.write(newOutbound(welcomeMsg)); err != nil {
+		log.Printf("Failed to send welcome to %s: %v", userInfo.Username, err)
+	} else {
+		log.Printf("User %s (%s %s) connected via WebSocket",
+			userInfo.Username, userInfo.Firstname, userInfo.Lastname)
 	}
 
 	go client.writePump()
 	go client.readPump()
 }
 
-func (h *Hub) Shutdown() {
-	close(h.shutdown)
-	h.wg.Wait()
+// originAllowed reports whether origin is one of AllowedOrigins
+// checkHandshake refuses the requests upgrader.Upgrade would, with the
+// status to answer them with
+func (h *Hub) checkHandshake(r *http.Request) (int, error) {
+	if r.Method != http.MethodGet {
+		return http.StatusMethodNotAllowed, fmt.Errorf("%s is not a websocket handshake", r.Method)
+	}
+	if !websocket.IsWebSocketUpgrade(r) || r.Header.Get("Sec-Websocket-Key") == "" {
+		return http.StatusBadRequest, fmt.Errorf("not a websocket handshake: Upgrade %q", r.Header.Get("Upgrade"))
+	}
+	if v := r.Header.Get("Sec-Websocket-Version"); v != "13" {
+		return http.StatusBadRequest, fmt.Errorf("unsupported websocket version %q", v)
+	}
+	if origin := r.Header.Get("Origin"); !h.originAllowed(origin) {
+		return http.StatusForbidden, fmt.Errorf("origin %s not allowed (allowed: %v)", origin, h.config.AllowedOrigins)
+	}
+	return 0, nil
+}
+
+func (h *Hub) originAllowed(origin string) bool {
+	for _, allowed := range h.config.AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Shutdown drains the hub: it refuses new connections, tells every client
+// the server is going away, flushes their queued messages and closes them
+// with a close frame, then stops the hub's goroutines. It returns ctx's
+// error if clients or goroutines are still running at the deadline.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.shutdownOnce.Do(func() {
+		h.draining.Store(true)
+
+		h.mutex.RLock()
+		clients := make([]*Client, 0, len(h.clients))
+		for client := range h.clients {
+			clients = append(clients, client)
+		}
+		h.mutex.RUnlock()
+
+		log.Printf("Hub draining %d clients", len(clients))
+		notice := protocol.ServerShutdown{ReconnectAfterMs: shutdownReconnectHint.Milliseconds()}
+		for _, client := range clients {
+			client.sendMessage(protocol.TypeServerShutdown, notice)
+			client.startDrain()
+		}
+	})
+
+	// readPumps unregister their clients as the close frames land
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for h.clientCount() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Printf("Hub shutdown deadline reached with %d clients still connected", h.clientCount())
+			return ctx.Err()
+		}
+	}
+
+	h.mutex.Lock()
+	for key, queue := range h.parked {
+		for _, p := range queue {
+			p.timer.Stop()
+		}
+		delete(h.parked, key)
+	}
+	h.mutex.Unlock()
+
+	// Parked clients never cleaned up; free their keys for the other instances
+	if err := h.locks.ReleaseInstance(h.instanceID); err != nil {
+		log.Printf("[LockStore] Failed to release claims of %s: %v", h.instanceID, err)
+	}
+
+	select {
+	case <-h.shutdown:
+	default:
+		close(h.shutdown)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		log.Println("Hub stopped")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *Hub) clientCount() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return len(h.clients)
 }
@@ -0,0 +1,1969 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"asset-ws/internal/protocol"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	testOrigin = "http://grid.test"
+	// testTimeout bounds every wait for a message
+	testTimeout = 2 * time.Second
+)
+
+// testHub is a hub serving real websocket connections from an httptest server
+type testHub struct {
+	hub      *Hub
+	server   *httptest.Server
+	sessions *MemorySessionValidator
+	store    *MemoryAssetStore
+}
+
+// newTestHub starts a hub that is shut down when the test ends
+func newTestHub(t testing.TB, config HubConfig) *testHub {
+	t.Helper()
+
+	sessions := NewMemorySessionValidator()
+	store := NewMemoryAssetStore()
+	config.AllowedOrigins = []string{testOrigin}
+	hub := NewHub(sessions, store, config)
+	go hub.Run()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/ws", hub.ServeWs)
+	mux.HandleFunc("/api/ws/ticket", hub.ServeTicket)
+	server := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := hub.Shutdown(ctx); err != nil {
+			t.Errorf("hub shutdown: %v", err)
+		}
+		server.Close()
+	})
+	return &testHub{hub: hub, server: server, sessions: sessions, store: store}
+}
+
+// testMessage is an outbound message as the client reads it
+type testMessage struct {
+	Type    string          `json:"type"`
+	Seq     uint64          `json:"seq"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+func (m testMessage) decode(t *testing.T, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(m.Payload, v); err != nil {
+		t.Fatalf("decode %s payload %s: %v", m.Type, m.Payload, err)
+	}
+}
+
+// testClient is one browser tab. Messages are read in the background and
+// kept until a test asks for them, so waiting for one type never loses
+// another.
+type testClient struct {
+	t       *testing.T
+	conn    *websocket.Conn
+	user    UserInfo
+	session string
+	welcome protocol.Welcome
+
+	incoming chan testMessage
+	buffered []testMessage
+	closed   chan struct{}
+	// Why the connection ended; read after closed
+	readErr error
+
+	nextID    int
+	closeOnce sync.Once
+}
+
+// connect registers a session for the user and opens a connection with it
+func (th *testHub) connect(t *testing.T, userID int64, role int) *testClient {
+	t.Helper()
+	user := UserInfo{
+		UserID:    userID,
+		Username:  fmt.Sprintf("user%d", userID),
+		Firstname: "First" + strconv.FormatInt(userID, 10),
+		Lastname:  "Last" + strconv.FormatInt(userID, 10),
+		Role:      role,
+	}
+	session := fmt.Sprintf("session-%d", userID)
+	th.sessions.Add(session, user)
+	return th.dial(t, user, session)
+}
+
+// reconnect opens a new connection on c's session, like a reloaded tab
+func (th *testHub) reconnect(t *testing.T, c *testClient) *testClient {
+	t.Helper()
+	return th.dial(t, c.user, c.session)
+}
+
+// resume reconnects c's session on its instance with ?resume_from
+func (th *testHub) resume(t *testing.T, c *testClient, resumeFrom string) *testClient {
+	t.Helper()
+	query := url.Values{"resume_from": {resumeFrom}, "resume_instance": {c.welcome.Instance}}
+	return th.dialQuery(t, c.user, c.session, "?"+query.Encode())
+}
+
+// dial connects with the session cookie, as a browser on the same site does
+func (th *testHub) dial(t *testing.T, user UserInfo, session string) *testClient {
+	t.Helper()
+	return th.dialQuery(t, user, session, "")
+}
+
+// dialQuery is dial with a query string
+func (th *testHub) dialQuery(t *testing.T, user UserInfo, session, query string) *testClient {
+	t.Helper()
+
+	header := http.Header{
+		"Origin": []string{testOrigin},
+		"Cookie": []string{sessionCookie + "=" + session},
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(th.wsURL(query), header)
+	if err != nil {
+		t.Fatalf("dial: %v (%v)", err, resp)
+	}
+	return newTestClient(t, conn, user, session)
+}
+
+// wsURL is the websocket endpoint with an optional query string
+func (th *testHub) wsURL(query string) string {
+	return "ws" + strings.TrimPrefix(th.server.URL, "http") + "/api/ws" + query
+}
+
+// newTestClient starts reading an upgraded connection and waits for WELCOME
+func newTestClient(t *testing.T, conn *websocket.Conn, user UserInfo, session string) *testClient {
+	t.Helper()
+
+	c := &testClient{
+		t:        t,
+		conn:     conn,
+		user:     user,
+		session:  session,
+		incoming: make(chan testMessage, 256),
+		closed:   make(chan struct{}),
+	}
+	go c.readLoop()
+	t.Cleanup(c.close)
+
+	c.expect(protocol.TypeWelcome).decode(t, &c.welcome)
+	return c
+}
+
+func (c *testClient) readLoop() {
+	defer close(c.closed)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		// A write may batch several messages, one per line
+		for _, line := range strings.Split(string(data), "\n") {
+			var msg testMessage
+			if err := json.Unmarshal([]byte(line), &msg); err != nil {
+				continue
+			}
+			c.incoming <- msg
+		}
+	}
+}
+
+// close drops the connection without a close handshake, like a lost network
+func (c *testClient) close() {
+	c.closeOnce.Do(func() {
+		c.conn.Close()
+		<-c.closed
+	})
+}
+
+// expectClose waits for the hub to close the connection with code
+func (c *testClient) expectClose(code int) {
+	c.t.Helper()
+	select {
+	case <-c.closed:
+	case <-time.After(testTimeout):
+		c.t.Fatalf("%s: timed out waiting for close %d", c.user.Username, code)
+	}
+	if !websocket.IsCloseError(c.readErr, code) {
+		c.t.Fatalf("%s: want close %d, got %v", c.user.Username, code, c.readErr)
+	}
+}
+
+// send writes a message with a fresh requestId and returns the id
+func (c *testClient) send(msgType string, payload interface{}) string {
+	c.t.Helper()
+	return c.sendIn("", msgType, payload)
+}
+
+// sendIn is send for a message acting in room
+func (c *testClient) sendIn(room, msgType string, payload interface{}) string {
+	c.t.Helper()
+	c.nextID++
+	requestID := "req-" + strconv.Itoa(c.nextID)
+	msg := map[string]interface{}{"type": msgType, "requestId": requestID, "payload": payload}
+	if room != "" {
+		msg["room"] = room
+	}
+	if err := c.conn.WriteJSON(msg); err != nil {
+		c.t.Fatalf("send %s: %v", msgType, err)
+	}
+	return requestID
+}
+
+// request sends a message and waits for its ACK or ERROR
+func (c *testClient) request(msgType string, payload interface{}) testMessage {
+	c.t.Helper()
+	return c.requestIn("", msgType, payload)
+}
+
+// requestIn is request for a message acting in room
+func (c *testClient) requestIn(room, msgType string, payload interface{}) testMessage {
+	c.t.Helper()
+	requestID := c.sendIn(room, msgType, payload)
+	return c.next(fmt.Sprintf("reply to %s", requestID), func(msg testMessage) bool {
+		if msg.Type != protocol.TypeAck && msg.Type != protocol.TypeError {
+			return false
+		}
+		var reply struct {
+			RequestID string `json:"requestId"`
+		}
+		json.Unmarshal(msg.Payload, &reply)
+		return reply.RequestID == requestID
+	})
+}
+
+// mustAck sends a message and fails unless the hub accepted it
+func (c *testClient) mustAck(msgType string, payload interface{}) {
+	c.t.Helper()
+	c.mustAckIn("", msgType, payload)
+}
+
+// mustAckIn is mustAck for a message acting in room
+func (c *testClient) mustAckIn(room, msgType string, payload interface{}) {
+	c.t.Helper()
+	if reply := c.requestIn(room, msgType, payload); reply.Type != protocol.TypeAck {
+		c.t.Fatalf("%s: want ACK, got %s %s", msgType, reply.Type, reply.Payload)
+	}
+}
+
+// mustReject sends a message and fails unless the hub refused it with code
+func (c *testClient) mustReject(msgType string, payload interface{}, code string) {
+	c.t.Helper()
+	c.mustRejectIn("", msgType, payload, code)
+}
+
+// mustRejectIn is mustReject for a message acting in room
+func (c *testClient) mustRejectIn(room, msgType string, payload interface{}, code string) {
+	c.t.Helper()
+	reply := c.requestIn(room, msgType, payload)
+	if reply.Type != protocol.TypeError {
+		c.t.Fatalf("%s: want ERROR %s, got %s", msgType, code, reply.Type)
+	}
+	var errReply protocol.ErrorReply
+	reply.decode(c.t, &errReply)
+	if errReply.Code != code {
+		c.t.Fatalf("%s: want code %s, got %s (%s)", msgType, code, errReply.Code, errReply.Message)
+	}
+}
+
+// subscribe joins a room and returns the snapshot the hub sent
+func (c *testClient) subscribe(room string) protocol.ExistingUsers {
+	c.t.Helper()
+	c.mustAck(protocol.TypeSubscribe, protocol.Subscribe{Room: room})
+	var snapshot protocol.ExistingUsers
+	c.expect(protocol.TypeExistingUsers).decode(c.t, &snapshot)
+	return snapshot
+}
+
+// subscribeRooms joins several rooms and returns their snapshots by room
+func (c *testClient) subscribeRooms(rooms ...string) map[string]protocol.ExistingUsers {
+	c.t.Helper()
+	c.mustAck(protocol.TypeSubscribe, protocol.Subscribe{Rooms: rooms})
+	snapshots := make(map[string]protocol.ExistingUsers, len(rooms))
+	for range rooms {
+		var snapshot protocol.ExistingUsers
+		c.expect(protocol.TypeExistingUsers).decode(c.t, &snapshot)
+		snapshots[snapshot.Room] = snapshot
+	}
+	return snapshots
+}
+
+// expectNone fails if a message of a type arrived before the hub answered
+// a PING, which it does after everything queued for c so far
+func (c *testClient) expectNone(msgType string) {
+	c.t.Helper()
+	c.mustAck(protocol.TypePing, protocol.Empty{})
+	for _, msg := range c.buffered {
+		if msg.Type == msgType {
+			c.t.Fatalf("%s: unexpected %s %s", c.user.Username, msgType, msg.Payload)
+		}
+	}
+}
+
+// expect waits for the next message of a type
+func (c *testClient) expect(msgType string) testMessage {
+	c.t.Helper()
+	return c.next(msgType, func(msg testMessage) bool { return msg.Type == msgType })
+}
+
+// next returns the first message, buffered or new, that match accepts
+func (c *testClient) next(what string, match func(testMessage) bool) testMessage {
+	c.t.Helper()
+	for i, msg := range c.buffered {
+		if match(msg) {
+			c.buffered = append(c.buffered[:i], c.buffered[i+1:]...)
+			return msg
+		}
+	}
+
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case msg := <-c.incoming:
+			if match(msg) {
+				return msg
+			}
+			c.buffered = append(c.buffered, msg)
+		case <-deadline:
+			c.t.Fatalf("%s: timed out waiting for %s", c.user.Username, what)
+			return testMessage{}
+		}
+	}
+}
+
+func TestSubscribeSendsRoomSnapshot(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+
+	alice := th.connect(t, 1, RoleUser)
+	if alice.welcome.UserID != 1 || alice.welcome.Instance == "" {
+		t.Fatalf("unexpected welcome %+v", alice.welcome)
+	}
+	snapshot := alice.subscribe("grid")
+	if len(snapshot.LockedCells) != 0 || len(snapshot.RowLocks) != 0 || len(snapshot.PendingCells) != 0 {
+		t.Fatalf("empty hub sent state: %+v", snapshot)
+	}
+
+	alice.mustAck(protocol.TypeCellEditStart, protocol.CellRef{AssetID: "5", Key: "model"})
+	alice.mustAck(protocol.TypeRowLock, protocol.RowRef{AssetID: "7"})
+	alice.mustAck(protocol.TypeCellPending, protocol.CellValue{AssetID: "9", Key: "node", Value: "n1"})
+
+	bob := th.connect(t, 2, RoleUser)
+	snapshot = bob.subscribe("grid")
+	if holder, ok := snapshot.LockedCells["5:model"]; !ok || holder.UserID != "1" {
+		t.Errorf("locked cells = %+v, want 5:model held by 1", snapshot.LockedCells)
+	}
+	if holder, ok := snapshot.RowLocks["7"]; !ok || holder.UserID != "1" {
+		t.Errorf("row locks = %+v, want 7 held by 1", snapshot.RowLocks)
+	}
+	if _, ok := snapshot.PendingCells["9:node"]; !ok {
+		t.Errorf("pending cells = %+v, want 9:node", snapshot.PendingCells)
+	}
+}
+
+func TestSubscribeUnknownRoom(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+
+	alice := th.connect(t, 1, RoleUser)
+	alice.mustReject(protocol.TypeSubscribe, protocol.Subscribe{Room: "nowhere"}, protocol.CodeUnknownRoom)
+}
+
+func TestScopedRoomsMustExist(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	th.store.AddRow("asset_locations", "3")
+	th.store.AddAsset("7", nil)
+
+	alice := th.connect(t, 1, RoleUser)
+	for _, room := range []string{"grid:location:4", "grid:location:03", "grid:location:x", "asset:8", "audit:cycle:1", "asset", "grid:3"} {
+		alice.mustReject(protocol.TypeSubscribe, protocol.Subscribe{Room: room}, protocol.CodeUnknownRoom)
+	}
+
+	snapshots := alice.subscribeRooms("grid:location:3", "asset:7")
+	if _, ok := snapshots["grid:location:3"]; !ok {
+		t.Errorf("no snapshot for grid:location:3 in %+v", snapshots)
+	}
+	if _, ok := snapshots["asset:7"]; !ok {
+		t.Errorf("no snapshot for asset:7 in %+v", snapshots)
+	}
+	alice.mustRejectIn("audit", protocol.TypeCellEditStart, protocol.CellRef{AssetID: "7", Key: "model"}, protocol.CodeNotSubscribed)
+	alice.mustReject(protocol.TypeUnsubscribe, protocol.Unsubscribe{Room: "grid"}, protocol.CodeNotSubscribed)
+}
+
+func TestLocksAreScopedToTheirRoom(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	th.store.AddRow("asset_locations", "3")
+	th.store.AddRow("asset_locations", "4")
+
+	alice := th.connect(t, 1, RoleUser)
+	alice.subscribeRooms("grid", "grid:location:3")
+	bob := th.connect(t, 2, RoleUser)
+	bob.subscribe("grid")
+	carol := th.connect(t, 3, RoleUser)
+	carol.subscribe("grid:location:4")
+
+	// The grid sees what happens in its locations, other locations do not
+	alice.mustAckIn("grid:location:3", protocol.TypeCellEditStart, protocol.CellRef{AssetID: "5", Key: "model"})
+	bob.expect(protocol.TypeCellLocked)
+	carol.expectNone(protocol.TypeCellLocked)
+
+	dave := th.connect(t, 4, RoleUser)
+	if snapshot := dave.subscribe("grid:location:4"); len(snapshot.LockedCells) != 0 {
+		t.Errorf("grid:location:4 snapshot has locks from location 3: %+v", snapshot.LockedCells)
+	}
+	if snapshot := dave.subscribe("grid"); snapshot.LockedCells["5:model"].UserID != "1" {
+		t.Errorf("grid snapshot locked cells = %+v, want 5:model held by 1", snapshot.LockedCells)
+	}
+
+	// Leaving the location releases only what was acquired there
+	alice.mustAck(protocol.TypeCellPending, protocol.CellValue{AssetID: "9", Key: "node", Value: "n1"})
+	bob.expect(protocol.TypePendingBroadcast)
+	alice.subscribe("grid")
+	var unlocked protocol.CellRef
+	bob.expect(protocol.TypeCellUnlocked).decode(t, &unlocked)
+	if unlocked.AssetID != "5" || unlocked.Key != "model" {
+		t.Errorf("unlocked %+v, want 5:model", unlocked)
+	}
+	if _, ok := th.hub.pendingCells.GetAll()["9:node"]; !ok {
+		t.Error("pending cell made in the grid was released when leaving the location")
+	}
+}
+
+func TestRoomActorsDeliverOnceAndRetire(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	th.store.AddRow("asset_locations", "3")
+
+	alice := th.connect(t, 1, RoleUser)
+	alice.subscribeRooms("grid", "grid:location:3")
+	bob := th.connect(t, 2, RoleUser)
+	bob.subscribe("grid:location:3")
+
+	// Alice is in the location and the grid above it, but hears it once
+	bob.mustAck(protocol.TypeCellEditStart, protocol.CellRef{AssetID: "5", Key: "model"})
+	alice.expect(protocol.TypeCellLocked)
+	alice.expectNone(protocol.TypeCellLocked)
+
+	alice.subscribe("grid")
+	bob.mustAck(protocol.TypeUnsubscribe, protocol.Unsubscribe{})
+	alice.expect(protocol.TypeCellUnlocked)
+	th.hub.pruneRooms()
+	if actors := th.hub.roomActors([]string{"grid:location:3"}); len(actors) != 0 {
+		t.Fatalf("grid:location:3 still has an actor after everyone left")
+	}
+
+	// The room starts again for the next member
+	bob.subscribe("grid:location:3")
+	bob.mustAck(protocol.TypeUserPositionUpdate, protocol.PositionUpdate{Row: 1, Col: 1, AssetID: "5"})
+	alice.expect(protocol.TypeUserPositionUpdate)
+}
+
+func TestClientStateBeforeSubscribeBelongsToFirstRoom(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	th.store.AddRow("asset_locations", "3")
+	th.store.AddRow("asset_locations", "4")
+
+	bob := th.connect(t, 2, RoleUser)
+	bob.subscribe("grid")
+
+	// A reconnecting tab restores its lock before it rejoins its room
+	alice := th.connect(t, 1, RoleUser)
+	alice.mustAck(protocol.TypeClientState, protocol.ClientState{Lock: &protocol.CellRef{AssetID: "5", Key: "model"}})
+	alice.expect(protocol.TypeClientStateReconciled)
+	alice.subscribe("grid:location:3")
+
+	carol := th.connect(t, 3, RoleUser)
+	if snapshot := carol.subscribe("grid:location:4"); len(snapshot.LockedCells) != 0 {
+		t.Errorf("grid:location:4 snapshot has locks from location 3: %+v", snapshot.LockedCells)
+	}
+
+	alice.mustAck(protocol.TypeCellEditEnd, protocol.Empty{})
+	bob.expect(protocol.TypeCellUnlocked)
+}
+
+func TestCanSend(t *testing.T) {
+	// Roles 0 and 4 are outside the hierarchy and get nothing privileged
+	roles := []int{RoleAuditAdmin, RoleAdmin, RoleUser, 0, 4}
+	tests := []struct {
+		msgType string
+		allowed []bool // By roles
+	}{
+		{protocol.TypeAuditStart, []bool{true, false, false, false, false}},
+		{protocol.TypeAuditClose, []bool{true, false, false, false, false}},
+		{protocol.TypeAdminForceUnlockCell, []bool{true, true, false, false, false}},
+		{protocol.TypeAdminForceUnlockRow, []bool{true, true, false, false, false}},
+		{protocol.TypeAdminClearPendingForUser, []bool{true, true, false, false, false}},
+		{protocol.TypeCellEditStart, []bool{true, true, true, true, true}},
+	}
+
+	covered := 0
+	for _, tt := range tests {
+		if _, ok := messageRoles[tt.msgType]; ok {
+			covered++
+		}
+		for i, role := range roles {
+			if got := canSend(role, tt.msgType); got != tt.allowed[i] {
+				t.Errorf("canSend(%d, %s) = %v, want %v", role, tt.msgType, got, tt.allowed[i])
+			}
+		}
+	}
+	if covered != len(messageRoles) {
+		t.Errorf("table covers %d of %d messageRoles entries", covered, len(messageRoles))
+	}
+}
+
+func TestRejectsUnknownSession(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+
+	header := http.Header{"Origin": []string{testOrigin}, "Cookie": []string{sessionCookie + "=missing"}}
+	_, resp, err := websocket.DefaultDialer.Dial(th.wsURL(""), header)
+	if err == nil {
+		t.Fatal("dial with an unknown session succeeded")
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("want 401, got %v", resp)
+	}
+}
+
+func TestQuerySessionNeedsCompatibilityFlag(t *testing.T) {
+	header := http.Header{"Origin": []string{testOrigin}}
+	user := UserInfo{UserID: 1, Username: "user1", Role: RoleUser}
+
+	th := newTestHub(t, HubConfig{})
+	th.sessions.Add("session-1", user)
+	_, resp, err := websocket.DefaultDialer.Dial(th.wsURL("?session_id=session-1"), header)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("query session accepted without the flag: %v", resp)
+	}
+
+	legacy := newTestHub(t, HubConfig{AllowQuerySession: true})
+	legacy.sessions.Add("session-1", user)
+	conn, _, err := websocket.DefaultDialer.Dial(legacy.wsURL("?session_id=session-1"), header)
+	if err != nil {
+		t.Fatalf("query session refused with the flag: %v", err)
+	}
+	newTestClient(t, conn, user, "session-1")
+}
+
+// issueTicket asks the hub for a ticket the way the browser does
+func (th *testHub) issueTicket(t *testing.T, session, origin string) (string, int) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, th.server.URL+"/api/ws/ticket", nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Authorization", "Bearer "+session)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("ticket request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Ticket string `json:"ticket"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	return body.Ticket, resp.StatusCode
+}
+
+func TestTicketOpensOneConnection(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	user := UserInfo{UserID: 1, Username: "user1", Role: RoleUser}
+	th.sessions.Add("session-1", user)
+	header := http.Header{"Origin": []string{testOrigin}}
+
+	if _, status := th.issueTicket(t, "missing", testOrigin); status != http.StatusUnauthorized {
+		t.Fatalf("ticket for an unknown session: status %d", status)
+	}
+	if _, status := th.issueTicket(t, "session-1", "http://evil.test"); status != http.StatusForbidden {
+		t.Fatalf("ticket for a foreign origin: status %d", status)
+	}
+
+	ticket, status := th.issueTicket(t, "session-1", testOrigin)
+	if status != http.StatusOK || ticket == "" {
+		t.Fatalf("ticket request: status %d", status)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(th.wsURL("?ticket="+ticket), header)
+	if err != nil {
+		t.Fatalf("dial with ticket: %v", err)
+	}
+	c := newTestClient(t, conn, user, "session-1")
+	if c.welcome.UserID != 1 {
+		t.Fatalf("ticket opened the wrong session: %+v", c.welcome)
+	}
+
+	// Spent
+	if _, resp, err := websocket.DefaultDialer.Dial(th.wsURL("?ticket="+ticket), header); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("ticket was accepted twice: %v", resp)
+	}
+}
+
+func TestRejectedHandshakeKeepsTheTicket(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	user := UserInfo{UserID: 1, Username: "user1", Role: RoleUser}
+	th.sessions.Add("session-1", user)
+	ticket, status := th.issueTicket(t, "session-1", testOrigin)
+	if status != http.StatusOK {
+		t.Fatalf("ticket request: status %d", status)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(th.wsURL("?ticket="+ticket), http.Header{"Origin": []string{"http://evil.test"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("foreign origin: want 403, got %v", resp)
+	}
+	resp, err = http.Get(th.server.URL + "/api/ws?ticket=" + ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("plain GET: want 400, got %d", resp.StatusCode)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(th.wsURL("?ticket="+ticket), http.Header{"Origin": []string{testOrigin}})
+	if err != nil {
+		t.Fatalf("ticket spent by a rejected handshake: %v", err)
+	}
+	newTestClient(t, conn, user, "session-1")
+}
+
+func TestCellLockConflict(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+
+	cell := protocol.CellRef{AssetID: "5", Key: "model"}
+	alice.mustAck(protocol.TypeCellEditStart, cell)
+
+	var locked protocol.CellLocked
+	bob.expect(protocol.TypeCellLocked).decode(t, &locked)
+	if locked.AssetID != "5" || locked.Key != "model" || locked.UserID != "1" {
+		t.Fatalf("bob saw lock %+v", locked)
+	}
+	bob.mustReject(protocol.TypeCellEditStart, cell, protocol.CodeCellLocked)
+
+	alice.mustAck(protocol.TypeCellEditEnd, protocol.Empty{})
+	bob.expect(protocol.TypeCellUnlocked)
+	bob.mustAck(protocol.TypeCellEditStart, cell)
+}
+
+func TestCellLockLeaseNeedsHeartbeats(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	carol := th.connect(t, 3, RoleUser)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+	carol.subscribe("grid")
+
+	aliceCell := protocol.CellRef{AssetID: "5", Key: "model"}
+	bobCell := protocol.CellRef{AssetID: "6", Key: "model"}
+	alice.mustAck(protocol.TypeCellEditStart, aliceCell)
+	bob.mustAck(protocol.TypeCellEditStart, bobCell)
+	// Neither lease outlives this without a heartbeat
+	leaseEnd := time.Now().Add(cellLockLease)
+
+	time.Sleep(10 * time.Millisecond)
+	bob.mustAck(protocol.TypeCellLockHeartbeat, protocol.Empty{})
+
+	th.hub.expireCellLocks(leaseEnd)
+	var expired protocol.CellRef
+	alice.expect(protocol.TypeCellLockExpired).decode(t, &expired)
+	if expired != aliceCell {
+		t.Fatalf("alice's expired lock is %+v, want %+v", expired, aliceCell)
+	}
+	var unlocked protocol.CellRef
+	carol.expect(protocol.TypeCellUnlocked).decode(t, &unlocked)
+	if unlocked != aliceCell {
+		t.Fatalf("carol saw %+v unlocked, want %+v", unlocked, aliceCell)
+	}
+	bob.expectNone(protocol.TypeCellLockExpired)
+	carol.mustReject(protocol.TypeCellEditStart, bobCell, protocol.CodeCellLocked)
+
+	// The heartbeat only bought one more lease
+	th.hub.expireCellLocks(time.Now().Add(cellLockLease))
+	bob.expect(protocol.TypeCellLockExpired)
+	carol.expect(protocol.TypeCellUnlocked).decode(t, &unlocked)
+	if unlocked != bobCell {
+		t.Fatalf("carol saw %+v unlocked, want %+v", unlocked, bobCell)
+	}
+	carol.mustAck(protocol.TypeCellEditStart, bobCell)
+}
+
+func TestPendingCellBlocksOthers(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+
+	cell := protocol.CellRef{AssetID: "5", Key: "model"}
+	alice.mustAck(protocol.TypeCellPending, protocol.CellValue{AssetID: "5", Key: "model", Value: "X1"})
+
+	var pending protocol.PendingCell
+	bob.expect(protocol.TypePendingBroadcast).decode(t, &pending)
+	if pending.AssetID != "5" || pending.Key != "model" || pending.UserID != "1" {
+		t.Fatalf("bob saw pending %+v", pending)
+	}
+	bob.mustReject(protocol.TypeCellEditStart, cell, protocol.CodeCellPending)
+	bob.mustReject(protocol.TypeCellPending, protocol.CellValue{AssetID: "5", Key: "model", Value: "X2"}, protocol.CodeCellPending)
+
+	alice.mustAck(protocol.TypeCellPendingClear, cell)
+	bob.expect(protocol.TypePendingClearBroadcast)
+	bob.mustAck(protocol.TypeCellEditStart, cell)
+}
+
+func TestRowLock(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+
+	row := protocol.RowRef{AssetID: "7"}
+	alice.mustAck(protocol.TypeRowLock, row)
+	bob.expect(protocol.TypeRowLocked)
+
+	bob.mustReject(protocol.TypeCellEditStart, protocol.CellRef{AssetID: "7", Key: "model"}, protocol.CodeRowLocked)
+	bob.mustReject(protocol.TypeRowLock, row, protocol.CodeRowLocked)
+	bob.mustReject(protocol.TypeRowUnlock, row, protocol.CodeNotHeld)
+
+	alice.mustAck(protocol.TypeRowUnlock, row)
+	bob.expect(protocol.TypeRowUnlocked)
+	bob.mustAck(protocol.TypeCellEditStart, protocol.CellRef{AssetID: "7", Key: "model"})
+
+	// A cell being edited keeps the row from being locked
+	alice.mustReject(protocol.TypeRowLock, row, protocol.CodeRowBeingEdited)
+}
+
+func TestAdminForceUnlockCell(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	admin := th.connect(t, 9, RoleAdmin)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+	admin.subscribe("grid")
+
+	cell := protocol.CellRef{AssetID: "5", Key: "model"}
+	alice.mustAck(protocol.TypeCellEditStart, cell)
+	bob.expect(protocol.TypeCellLocked)
+
+	admin.mustAck(protocol.TypeAdminForceUnlockCell, cell)
+
+	var revoked protocol.CellLockRevoked
+	alice.expect(protocol.TypeCellLockRevoked).decode(t, &revoked)
+	if revoked.AssetID != "5" || revoked.Key != "model" || revoked.By.UserID != "9" || revoked.By.Firstname != "First9" {
+		t.Fatalf("alice was told %+v", revoked)
+	}
+	var unlocked protocol.CellRef
+	bob.expect(protocol.TypeCellUnlocked).decode(t, &unlocked)
+	if unlocked != cell {
+		t.Fatalf("bob saw %+v unlocked, want %+v", unlocked, cell)
+	}
+	bob.mustAck(protocol.TypeCellEditStart, cell)
+
+	admin.mustReject(protocol.TypeAdminForceUnlockCell, protocol.CellRef{AssetID: "6", Key: "model"}, protocol.CodeNotFound)
+}
+
+func TestAdminForceUnlockRow(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	admin := th.connect(t, 9, RoleAdmin)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+	admin.subscribe("grid")
+
+	row := protocol.RowRef{AssetID: "7"}
+	alice.mustAck(protocol.TypeRowLock, row)
+	bob.expect(protocol.TypeRowLocked)
+
+	admin.mustAck(protocol.TypeAdminForceUnlockRow, row)
+
+	var revoked protocol.RowLockRevoked
+	alice.expect(protocol.TypeRowLockRevoked).decode(t, &revoked)
+	if revoked.AssetID != "7" || revoked.By.UserID != "9" {
+		t.Fatalf("alice was told %+v", revoked)
+	}
+	bob.expect(protocol.TypeRowUnlocked)
+	bob.mustAck(protocol.TypeRowLock, row)
+
+	admin.mustReject(protocol.TypeAdminForceUnlockRow, protocol.RowRef{AssetID: "8"}, protocol.CodeNotFound)
+}
+
+func TestAdminClearPendingForUser(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	admin := th.connect(t, 9, RoleAdmin)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+	admin.subscribe("grid")
+
+	alice.mustAck(protocol.TypeCellPending, protocol.CellValue{AssetID: "5", Key: "model", Value: "X1"})
+	alice.mustAck(protocol.TypeCellPending, protocol.CellValue{AssetID: "6", Key: "node", Value: "n1"})
+	bob.mustAck(protocol.TypeCellPending, protocol.CellValue{AssetID: "7", Key: "model", Value: "X2"})
+
+	admin.mustAck(protocol.TypeAdminClearPendingForUser, protocol.UserRef{UserID: "1"})
+
+	var revoked protocol.PendingRevoked
+	alice.expect(protocol.TypePendingRevoked).decode(t, &revoked)
+	if len(revoked.Cells) != 2 || revoked.By.UserID != "9" {
+		t.Fatalf("alice was told %+v", revoked)
+	}
+	var cleared protocol.PendingClear
+	bob.next("alice's pending cleared", func(msg testMessage) bool {
+		if msg.Type != protocol.TypePendingClearBroadcast {
+			return false
+		}
+		msg.decode(t, &cleared)
+		return cleared.UserID == "1"
+	})
+	if len(cleared.Cells) != 2 {
+		t.Fatalf("bob saw %+v cleared", cleared)
+	}
+	bob.expectNone(protocol.TypePendingRevoked)
+	bob.mustAck(protocol.TypeCellPending, protocol.CellValue{AssetID: "5", Key: "model", Value: "X3"})
+
+	admin.mustReject(protocol.TypeAdminClearPendingForUser, protocol.UserRef{UserID: "1"}, protocol.CodeNotFound)
+}
+
+// adminGet calls the admin API with a Bearer session, or none if empty
+func (th *testHub) adminGet(t *testing.T, session, path string, v interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if session != "" {
+		req.Header.Set("Authorization", "Bearer "+session)
+	}
+	rec := httptest.NewRecorder()
+	th.hub.AdminHandler().ServeHTTP(rec, req)
+	if rec.Code == http.StatusOK && v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAdminAPINeedsAdminSession(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	th.connect(t, 1, RoleUser)
+	th.connect(t, 2, RoleAuditAdmin)
+
+	if code := th.adminGet(t, "", "/api/ws/admin/locks", nil); code != http.StatusUnauthorized {
+		t.Errorf("without a session: status %d, want 401", code)
+	}
+	if code := th.adminGet(t, "session-unknown", "/api/ws/admin/locks", nil); code != http.StatusUnauthorized {
+		t.Errorf("unknown session: status %d, want 401", code)
+	}
+	if code := th.adminGet(t, "session-1", "/api/ws/admin/locks", nil); code != http.StatusForbidden {
+		t.Errorf("user role: status %d, want 403", code)
+	}
+	if code := th.adminGet(t, "session-2", "/api/ws/admin/locks", nil); code != http.StatusOK {
+		t.Errorf("audit admin: status %d, want 200", code)
+	}
+}
+
+func TestAdminAPIListsLocksAndPending(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	th.connect(t, 3, RoleAdmin)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+
+	alice.mustAck(protocol.TypeCellEditStart, protocol.CellRef{AssetID: "5", Key: "model"})
+	bob.mustAck(protocol.TypeCellPending, protocol.CellValue{AssetID: "6", Key: "serial", Value: "SN-1"})
+
+	var locks []adminCellLock
+	if code := th.adminGet(t, "session-3", "/api/ws/admin/locks", &locks); code != http.StatusOK {
+		t.Fatalf("locks: status %d", code)
+	}
+	if len(locks) != 1 || locks[0].AssetID != "5" || locks[0].Key != "model" ||
+		locks[0].Holder.UserID != "1" || locks[0].Holder.Room != "grid" {
+		t.Errorf("locks %+v", locks)
+	}
+
+	var pending []adminPendingCell
+	if code := th.adminGet(t, "session-3", "/api/ws/admin/pending", &pending); code != http.StatusOK {
+		t.Fatalf("pending: status %d", code)
+	}
+	if len(pending) != 1 || pending[0].AssetID != "6" || pending[0].Key != "serial" ||
+		pending[0].Value != "SN-1" || pending[0].Holder.Username != "user2" {
+		t.Errorf("pending %+v", pending)
+	}
+
+	// Released state drops out of the listings
+	alice.mustAck(protocol.TypeCellEditEnd, protocol.Empty{})
+	th.adminGet(t, "session-3", "/api/ws/admin/locks", &locks)
+	if len(locks) != 0 {
+		t.Errorf("released lock still listed: %+v", locks)
+	}
+}
+
+func TestDisconnectReleasesState(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+
+	alice.mustAck(protocol.TypeCellEditStart, protocol.CellRef{AssetID: "5", Key: "model"})
+	alice.mustAck(protocol.TypeCellPending, protocol.CellValue{AssetID: "6", Key: "node", Value: "n1"})
+	alice.mustAck(protocol.TypeRowLock, protocol.RowRef{AssetID: "7"})
+	bob.expect(protocol.TypeRowLocked)
+
+	alice.close()
+
+	bob.expect(protocol.TypeRowUnlocked)
+	var left protocol.UserLeft
+	bob.expect(protocol.TypeUserLeft).decode(t, &left)
+	if left.ClientID != "1" {
+		t.Fatalf("USER_LEFT for %q, want 1", left.ClientID)
+	}
+
+	bob.mustAck(protocol.TypeCellEditStart, protocol.CellRef{AssetID: "5", Key: "model"})
+	bob.mustAck(protocol.TypeCellPending, protocol.CellValue{AssetID: "6", Key: "node", Value: "n2"})
+	bob.mustAck(protocol.TypeCellEditEnd, protocol.Empty{})
+	bob.mustAck(protocol.TypeRowLock, protocol.RowRef{AssetID: "7"})
+}
+
+func TestUserLeftPrecedesNextHolder(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	carol := th.connect(t, 3, RoleUser)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+	carol.subscribe("grid")
+
+	cell := protocol.CellRef{AssetID: "5", Key: "model"}
+	alice.mustAck(protocol.TypeCellEditStart, cell)
+	carol.expect(protocol.TypeCellLocked)
+
+	// Hold the room so nothing is delivered while bob races for the lock
+	release := make(chan struct{})
+	th.hub.room("grid").send(func(map[*Client]bool) { <-release }, nil)
+
+	alice.close()
+	for {
+		reply := bob.request(protocol.TypeCellEditStart, cell)
+		if reply.Type == protocol.TypeAck {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	// Whatever order the room runs in, alice is gone before bob holds the cell
+	first := carol.next("USER_LEFT or CELL_LOCKED", func(msg testMessage) bool {
+		return msg.Type == protocol.TypeUserLeft || msg.Type == protocol.TypeCellLocked
+	})
+	if first.Type != protocol.TypeUserLeft {
+		t.Fatalf("carol saw %s %s before alice left", first.Type, first.Payload)
+	}
+	locked := carol.expect(protocol.TypeCellLocked)
+	if locked.Seq <= first.Seq {
+		t.Fatalf("CELL_LOCKED seq %d not after USER_LEFT seq %d", locked.Seq, first.Seq)
+	}
+
+	// A snapshot taken since has bob's lock and no trace of alice
+	dave := th.connect(t, 4, RoleUser)
+	snapshot := dave.subscribe("grid")
+	if holder := snapshot.LockedCells["5:model"]; holder.UserID != "2" {
+		t.Fatalf("snapshot lock held by %+v, want bob", holder)
+	}
+	if _, ok := snapshot.Users["1"]; ok {
+		t.Fatalf("snapshot still shows alice: %+v", snapshot.Users)
+	}
+}
+
+func TestReconnectWithinGraceKeepsLocks(t *testing.T) {
+	th := newTestHub(t, HubConfig{ReconnectGrace: 5 * time.Second})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+
+	cell := protocol.CellRef{AssetID: "5", Key: "model"}
+	alice.mustAck(protocol.TypeCellEditStart, cell)
+	bob.expect(protocol.TypeCellLocked)
+
+	alice.close()
+	bob.expect(protocol.TypeUserAway)
+	bob.mustReject(protocol.TypeCellEditStart, cell, protocol.CodeCellLocked)
+
+	alice = th.reconnect(t, alice)
+	snapshot := alice.subscribe("grid")
+	if _, ok := snapshot.LockedCells["5:model"]; !ok {
+		t.Fatalf("lock lost across reconnect: %+v", snapshot.LockedCells)
+	}
+	bob.expect(protocol.TypeUserReturned)
+	bob.mustReject(protocol.TypeCellEditStart, cell, protocol.CodeCellLocked)
+}
+
+// subscribeSeq joins room and returns the seq of its snapshot
+func (c *testClient) subscribeSeq(room string) uint64 {
+	c.t.Helper()
+	c.mustAck(protocol.TypeSubscribe, protocol.Subscribe{Room: room})
+	return c.expect(protocol.TypeExistingUsers).Seq
+}
+
+func TestResumeReplaysMissedEvents(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	seq := alice.subscribeSeq("grid")
+	bob.subscribe("grid")
+
+	alice.close()
+	bob.expect(protocol.TypeUserLeft)
+	bob.mustAck(protocol.TypeCellEditStart, protocol.CellRef{AssetID: "5", Key: "model"})
+	bob.mustAck(protocol.TypeCellEditEnd, protocol.Empty{})
+	bob.mustAck(protocol.TypeRowLock, protocol.RowRef{AssetID: "7"})
+
+	alice = th.resume(t, alice, fmt.Sprintf("grid:%d", seq))
+	snapshot := alice.subscribeSeq("grid")
+	for _, msgType := range []string{protocol.TypeCellLocked, protocol.TypeCellUnlocked, protocol.TypeRowLocked} {
+		msg := alice.expect(msgType)
+		if msg.Seq <= seq || msg.Seq > snapshot {
+			t.Fatalf("replayed %s with seq %d, want after %d and up to the snapshot's %d", msgType, msg.Seq, seq, snapshot)
+		}
+		seq = msg.Seq
+	}
+	alice.expectNone(protocol.TypeResyncRequired)
+}
+
+func TestResumeBelowHistoryFloorResyncs(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	alice := th.connect(t, 1, RoleUser)
+	seq := alice.subscribeSeq("grid")
+	alice.close()
+
+	// More than the room keeps
+	for i := 0; i <= roomHistorySize; i++ {
+		th.hub.BroadcastToRoom("grid", protocol.TypeRowUnlocked, protocol.RowRef{AssetID: "7"}, nil)
+	}
+
+	alice = th.resume(t, alice, fmt.Sprintf("grid:%d", seq))
+	alice.subscribe("grid")
+	var resync protocol.ResyncRequired
+	alice.expect(protocol.TypeResyncRequired).decode(t, &resync)
+	if resync.Room != "grid" {
+		t.Fatalf("resync for room %q, want grid", resync.Room)
+	}
+	alice.expectNone(protocol.TypeRowUnlocked)
+}
+
+func TestResumeUnknownSeqResyncs(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	alice := th.connect(t, 1, RoleUser)
+	seq := alice.subscribeSeq("grid")
+	alice.close()
+
+	// Never issued by this hub, as after a restart of a hub whose clock went back
+	alice = th.resume(t, alice, strconv.FormatUint(seq+1000, 10))
+	alice.subscribe("grid")
+	alice.expect(protocol.TypeResyncRequired)
+}
+
+func TestOtherSessionDoesNotAdoptParkedState(t *testing.T) {
+	th := newTestHub(t, HubConfig{ReconnectGrace: 5 * time.Second})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+
+	cell := protocol.CellRef{AssetID: "5", Key: "model"}
+	alice.mustAck(protocol.TypeCellEditStart, cell)
+	alice.close()
+	bob.expect(protocol.TypeUserAway)
+
+	// Alice signs in on another browser: same user, new session
+	th.sessions.Add("session-1-other", alice.user)
+	other := th.dial(t, alice.user, "session-1-other")
+	other.subscribe("grid")
+	other.mustReject(protocol.TypeCellEditStart, cell, protocol.CodeCellLocked)
+	bob.expectNone(protocol.TypeUserReturned)
+
+	// The parked state still waits for the session it belongs to
+	alice = th.reconnect(t, alice)
+	alice.subscribe("grid")
+	bob.expect(protocol.TypeUserReturned)
+	alice.mustAck(protocol.TypeCellEditEnd, protocol.Empty{})
+	bob.expect(protocol.TypeCellUnlocked)
+}
+
+func TestCommitWritesAndBroadcasts(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	th.store.AddAsset("5", map[string]string{"model": "X1"})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+
+	base := th.store.Modified("5")
+	value := "X2"
+	alice.mustAck(protocol.TypeCellPending, protocol.CellValue{AssetID: "5", Key: "model", Value: value})
+	alice.mustAck(protocol.TypeCommit, protocol.Commit{Changes: []protocol.CommitChange{
+		{AssetID: "5", Key: "model", Value: &value, BaseModified: base},
+	}})
+
+	var committed protocol.CommittedChanges
+	bob.expect(protocol.TypeCommitBroadcast).decode(t, &committed)
+	if committed.UserID != "1" || len(committed.Changes) != 1 || *committed.Changes[0].Value != value {
+		t.Fatalf("bob saw commit %+v", committed)
+	}
+	if got := th.store.Value("5", "model"); got == nil || *got != value {
+		t.Fatalf("store has %v, want %s", got, value)
+	}
+	// Committing released the pending cell
+	bob.mustAck(protocol.TypeCellEditStart, protocol.CellRef{AssetID: "5", Key: "model"})
+
+	stale := "X3"
+	alice.mustReject(protocol.TypeCommit, protocol.Commit{Changes: []protocol.CommitChange{
+		{AssetID: "5", Key: "model", Value: &stale, BaseModified: "2000-01-01 00:00:00"},
+	}}, protocol.CodeCommitConflict)
+	var conflict protocol.CommitConflict
+	alice.expect(protocol.TypeCommitConflict).decode(t, &conflict)
+	if len(conflict.Conflicts) != 1 || *conflict.Conflicts[0].Value != value {
+		t.Fatalf("conflict %+v", conflict)
+	}
+
+	alice.mustReject(protocol.TypeCommit, protocol.Commit{Changes: []protocol.CommitChange{
+		{AssetID: "5", Key: "password", Value: &stale, BaseModified: th.store.Modified("5")},
+	}}, protocol.CodeInvalidMessage)
+}
+
+func TestCommitConflict(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	th.store.AddAsset("5", map[string]string{"model": "X1"})
+	th.store.AddAsset("6", map[string]string{"model": "Y1"})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+
+	// Both loaded the rows at the same time; bob saves first
+	base5, base6 := th.store.Modified("5"), th.store.Modified("6")
+	bobs := "X2"
+	bob.mustAck(protocol.TypeCommit, protocol.Commit{Changes: []protocol.CommitChange{
+		{AssetID: "5", Key: "model", Value: &bobs, BaseModified: base5},
+	}})
+
+	// Alice's commit touches bob's row and one nobody changed: none of it is written
+	alices := "X3"
+	alice.mustReject(protocol.TypeCommit, protocol.Commit{Changes: []protocol.CommitChange{
+		{AssetID: "6", Key: "model", Value: &alices, BaseModified: base6},
+		{AssetID: "5", Key: "model", Value: &alices, BaseModified: base5},
+	}}, protocol.CodeCommitConflict)
+	var conflict protocol.CommitConflict
+	alice.expect(protocol.TypeCommitConflict).decode(t, &conflict)
+	if len(conflict.Conflicts) != 1 {
+		t.Fatalf("conflicts %+v, want only asset 5", conflict.Conflicts)
+	}
+	got := conflict.Conflicts[0]
+	if got.AssetID != "5" || got.Key != "model" || got.Value == nil || *got.Value != bobs ||
+		got.ModifiedBy != "Last2, First2" || got.ChangedKey != "model" {
+		t.Fatalf("conflict %+v, want bob's X2 on 5:model", got)
+	}
+	if v := th.store.Value("6", "model"); v == nil || *v != "Y1" {
+		t.Fatalf("asset 6 was written: %v", v)
+	}
+
+	// Without a base there is nothing to check the row against
+	alice.mustReject(protocol.TypeCommit, protocol.Commit{Changes: []protocol.CommitChange{
+		{AssetID: "6", Key: "model", Value: &alices},
+	}}, protocol.CodeInvalidMessage)
+	if v := th.store.Value("6", "model"); v == nil || *v != "Y1" {
+		t.Fatalf("asset 6 was written without a base: %v", v)
+	}
+}
+
+func TestCommitConflictWithinTheSameSecond(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+
+	// Start early in a second so both commits land in it
+	time.Sleep(time.Second - time.Duration(time.Now().Nanosecond()))
+	th.store.AddAsset("5", map[string]string{"model": "X1", "comment": "old"})
+	base := th.store.Modified("5")
+
+	comment := "checked"
+	bob.mustAck(protocol.TypeCommit, protocol.Commit{Changes: []protocol.CommitChange{
+		{AssetID: "5", Key: "comment", Value: &comment, BaseModified: base},
+	}})
+	model := "X2"
+	alice.mustReject(protocol.TypeCommit, protocol.Commit{Changes: []protocol.CommitChange{
+		{AssetID: "5", Key: "model", Value: &model, BaseModified: base},
+	}}, protocol.CodeCommitConflict)
+	if baseSecond(th.store.Modified("5")) != baseSecond(base) {
+		t.Fatalf("commits spanned seconds %s and %s", base, th.store.Modified("5"))
+	}
+
+	// Bob changed another cell of the row; the conflict says which
+	var conflict protocol.CommitConflict
+	alice.expect(protocol.TypeCommitConflict).decode(t, &conflict)
+	if len(conflict.Conflicts) != 1 {
+		t.Fatalf("conflicts %+v, want one", conflict.Conflicts)
+	}
+	got := conflict.Conflicts[0]
+	if got.Key != "model" || got.Value == nil || *got.Value != "X1" || got.ChangedKey != "comment" || got.Modified == base {
+		t.Fatalf("conflict %+v, want model unchanged and comment changed", got)
+	}
+}
+
+func TestChangeLogWatcherBroadcastsExternalWrites(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	th.store.AddAsset("5", map[string]string{"model": "X1"})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+
+	value := "X2"
+	alice.mustAck(protocol.TypeCommit, protocol.Commit{Changes: []protocol.CommitChange{
+		{AssetID: "5", Key: "model", Value: &value, BaseModified: th.store.Modified("5")},
+	}})
+	alice.expect(protocol.TypeCommitBroadcast)
+	bob.expect(protocol.TypeCommitBroadcast)
+
+	// Saved through the API meanwhile
+	external := "X3"
+	th.store.LogChange("5", "model", &external, "Doe, Jane")
+
+	n, err := th.hub.changeLog.poll()
+	if err != nil || n != 2 {
+		t.Fatalf("poll read %d rows (%v), want both", n, err)
+	}
+	for _, c := range []*testClient{alice, bob} {
+		var committed protocol.CommittedChanges
+		c.expect(protocol.TypeCommitBroadcast).decode(t, &committed)
+		if committed.ModifiedBy != "Doe, Jane" || len(committed.Changes) != 1 || *committed.Changes[0].Value != external {
+			t.Fatalf("%s saw %+v, want only the API write", c.user.Username, committed)
+		}
+		c.expectNone(protocol.TypeCommitBroadcast)
+	}
+}
+
+func TestChangeLogWatcherPicksUpIdsThatCommitLate(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	th.store.AddAsset("5", map[string]string{"model": "X1"})
+	th.store.AddAsset("6", map[string]string{"model": "Y1"})
+	alice := th.connect(t, 1, RoleUser)
+	alice.subscribe("grid")
+
+	// The first write takes id 1 but commits after the second, id 2
+	slow, fast := "X2", "Y2"
+	commitSlow := th.store.StartChange("5", "model", &slow, "Doe, Jane")
+	th.store.LogChange("6", "model", &fast, "Roe, Rick")
+
+	expectOnly := func(assetID, value string) {
+		t.Helper()
+		var committed protocol.CommittedChanges
+		alice.expect(protocol.TypeCommitBroadcast).decode(t, &committed)
+		if len(committed.Changes) != 1 || committed.Changes[0].AssetID != protocol.ID(assetID) || *committed.Changes[0].Value != value {
+			t.Fatalf("saw %+v, want %s set to %s", committed, assetID, value)
+		}
+	}
+	if n, err := th.hub.changeLog.poll(); err != nil || n != 1 {
+		t.Fatalf("first poll read %d rows (%v), want id 2", n, err)
+	}
+	expectOnly("6", fast)
+
+	commitSlow()
+	if n, err := th.hub.changeLog.poll(); err != nil || n != 1 {
+		t.Fatalf("second poll read %d rows (%v), want the late id 1", n, err)
+	}
+	expectOnly("5", slow)
+	if len(th.hub.changeLog.gaps) != 0 {
+		t.Errorf("still waiting for %v", th.hub.changeLog.gaps)
+	}
+
+	if n, err := th.hub.changeLog.poll(); err != nil || n != 0 {
+		t.Fatalf("third poll read %d rows (%v), want none", n, err)
+	}
+	alice.expectNone(protocol.TypeCommitBroadcast)
+}
+
+func TestChangeLogWatcherSkipsRowsOfAnyHub(t *testing.T) {
+	value := "X2"
+	batch := []ChangeLogRow{
+		{ID: 1, Column: "model", NewValue: &value, Action: "update", Origin: "local"},
+		{ID: 2, Column: "model", NewValue: &value, Action: "update"},
+		{ID: 3, Column: "model", NewValue: &value, Action: "update", Origin: "ws-2"},
+	}
+	external := (&ChangeLogWatcher{}).external(batch)
+	if len(external) != 1 || external[0].ID != 2 {
+		t.Fatalf("external kept %+v, want row 2", external)
+	}
+}
+
+func TestViewportFiltersCellEvents(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	th.store.AddAsset("5", map[string]string{"model": "X1"})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+	bob.mustAck(protocol.TypeViewport, protocol.Viewport{AssetIDs: []protocol.ID{"1", "2"}})
+
+	// Locks, pending cells and cursors elsewhere are not sent to bob
+	alice.mustAck(protocol.TypeCellEditStart, protocol.CellRef{AssetID: "5", Key: "model"})
+	alice.mustAck(protocol.TypeUserPositionUpdate, protocol.PositionUpdate{Row: 40, Col: 1, AssetID: "5"})
+	bob.expectNone(protocol.TypeCellLocked)
+	bob.expectNone(protocol.TypeUserPositionUpdate)
+
+	// Commits still are
+	value := "X2"
+	alice.mustAck(protocol.TypeCellEditEnd, protocol.Empty{})
+	alice.mustAck(protocol.TypeCellPending, protocol.CellValue{AssetID: "5", Key: "model", Value: value})
+	alice.mustAck(protocol.TypeCommit, protocol.Commit{Changes: []protocol.CommitChange{
+		{AssetID: "5", Key: "model", Value: &value, BaseModified: th.store.Modified("5")},
+	}})
+	bob.expect(protocol.TypeCommitBroadcast)
+	bob.expectNone(protocol.TypePendingBroadcast)
+
+	// Scrolling asset 5 into view catches bob up on it
+	alice.mustAck(protocol.TypeCellEditStart, protocol.CellRef{AssetID: "5", Key: "model"})
+	bob.mustAck(protocol.TypeViewport, protocol.Viewport{AssetIDs: []protocol.ID{"2", "5"}})
+	var state protocol.ViewportState
+	bob.expect(protocol.TypeViewportState).decode(t, &state)
+	if len(state.AssetIDs) != 1 || state.AssetIDs[0] != "5" {
+		t.Errorf("viewport state for %v, want only the asset that came into view", state.AssetIDs)
+	}
+	if state.LockedCells["5:model"].UserID != "1" {
+		t.Errorf("viewport state locked cells = %+v, want 5:model held by 1", state.LockedCells)
+	}
+	if user := state.Users["1"]; user.AssetID != "5" {
+		t.Errorf("viewport state users = %+v, want alice's cursor on 5", state.Users)
+	}
+
+	// A cursor leaving the viewport is sent so it does not linger
+	alice.mustAck(protocol.TypeUserPositionUpdate, protocol.PositionUpdate{Row: 90, Col: 1, AssetID: "9"})
+	bob.expect(protocol.TypeUserPositionUpdate)
+	alice.mustAck(protocol.TypeUserPositionUpdate, protocol.PositionUpdate{Row: 91, Col: 1, AssetID: "10"})
+	bob.expectNone(protocol.TypeUserPositionUpdate)
+}
+
+func TestSlowClientPolicies(t *testing.T) {
+	// A client without a connection whose small send buffer is already full
+	slowClient := func(h *Hub) *Client {
+		c := &Client{
+			hub:      h,
+			send:     make(chan *outbound, 4),
+			done:     make(chan struct{}),
+			drain:    make(chan struct{}),
+			backlog:  make(chan struct{}, 1),
+			userInfo: &UserInfo{Username: "slow"},
+		}
+		for len(c.send) < cap(c.send) {
+			c.send <- newOutbound(protocol.Message{Type: protocol.TypeAck})
+		}
+		return c
+	}
+	position := func(clientID string, row int) *outbound {
+		return newBroadcast(protocol.Message{Type: protocol.TypeUserPositionUpdate, Payload: protocol.UserPosition{Row: row, ClientID: clientID}})
+	}
+
+	th := newTestHub(t, HubConfig{})
+	th.connect(t, 1, 1).subscribe("grid")
+	c := slowClient(th.hub)
+	for _, msg := range []*outbound{position("2", 1), position("2", 5), position("3", 1)} {
+		if !th.hub.deliver(c, msg) {
+			t.Fatal("cursor update was dropped instead of coalesced")
+		}
+	}
+	if len(c.coalesced) != 2 || c.coalesced["2"].msg.Payload.(protocol.UserPosition).Row != 5 {
+		t.Errorf("coalesced %d cursors, want the latest of users 2 and 3", len(c.coalesced))
+	}
+	if c.resync.Load() {
+		t.Error("coalescing cursors marked the client for resync")
+	}
+	if th.hub.deliver(c, newBroadcast(protocol.Message{Type: protocol.TypeCellLocked, Payload: protocol.CellLocked{}})) || !c.resync.Load() {
+		t.Error("a dropped CELL_LOCKED did not mark the client for resync")
+	}
+
+	// Once it caught up it is told to resync and sent its room again
+	for len(c.send) > 0 {
+		<-c.send
+	}
+	c.setRooms([]string{"grid"})
+	th.hub.resyncClient(c)
+	for _, want := range []string{protocol.TypeResyncRequired, protocol.TypeExistingUsers} {
+		if msg := <-c.send; msg.msg.Type != want {
+			t.Fatalf("got %s, want %s", msg.msg.Type, want)
+		}
+	}
+
+	th.hub.config.SlowClients = SlowClientDisconnect
+	c = slowClient(th.hub)
+	if th.hub.deliver(c, position("2", 1)) {
+		t.Error("message to a full buffer was delivered")
+	}
+	select {
+	case <-c.drain:
+	default:
+		t.Error("slow client was not disconnected")
+	}
+}
+
+func TestResyncRunsOnWritePumpOnceCaughtUp(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	alice := th.connect(t, 1, RoleUser)
+	alice.subscribeRooms("grid", "audit")
+
+	// As if a broadcast had been dropped on the full buffer
+	client := th.serverClient(t, alice)
+	client.resync.Store(true)
+	client.wake()
+
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		var resync protocol.ResyncRequired
+		alice.expect(protocol.TypeResyncRequired).decode(t, &resync)
+		var snapshot protocol.ExistingUsers
+		alice.expect(protocol.TypeExistingUsers).decode(t, &snapshot)
+		if snapshot.Room != resync.Room {
+			t.Errorf("resync of %s followed by the snapshot of %s", resync.Room, snapshot.Room)
+		}
+		got[resync.Room] = true
+	}
+	if !got["grid"] || !got["audit"] {
+		t.Errorf("resynced %v, want grid and audit", got)
+	}
+	if client.resync.Load() {
+		t.Error("client still marked for resync")
+	}
+}
+
+// scrapeMetrics waits until the metrics page has every line in want, and
+// returns it
+func (th *testHub) scrapeMetrics(t *testing.T, want ...string) string {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		rec := httptest.NewRecorder()
+		th.hub.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("scrape: status %d", rec.Code)
+		}
+		page := rec.Body.String()
+		missing := ""
+		for _, line := range want {
+			if !strings.Contains(page, "\n"+line+"\n") {
+				missing = line
+				break
+			}
+		}
+		if missing == "" {
+			return page
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("metrics have no %q:\n%s", missing, page)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMetricsCountMessagesAndDrops(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+
+	alice.mustAck(protocol.TypeCellEditStart, protocol.CellRef{AssetID: "5", Key: "model"})
+	bob.expect(protocol.TypeCellLocked)
+	alice.send("NOT_A_TYPE", protocol.Empty{})
+	alice.expect(protocol.TypeError)
+
+	// A client whose send buffer is full drops what it is sent
+	slow := &Client{
+		hub:      th.hub,
+		send:     make(chan *outbound),
+		done:     make(chan struct{}),
+		drain:    make(chan struct{}),
+		backlog:  make(chan struct{}, 1),
+		userInfo: &UserInfo{Username: "slow"},
+	}
+	slow.roomLabel.Store("grid")
+	th.hub.deliver(slow, newBroadcast(protocol.Message{Type: protocol.TypeCellLocked, Payload: protocol.CellLocked{}}))
+
+	th.scrapeMetrics(t,
+		`asset_ws_messages_received_total{type="SUBSCRIBE"} 2`,
+		`asset_ws_messages_received_total{type="CELL_EDIT_START"} 1`,
+		`asset_ws_messages_received_total{type="INVALID"} 1`,
+		`asset_ws_messages_sent_total{type="EXISTING_USERS"} 2`,
+		`asset_ws_messages_sent_total{type="CELL_LOCKED"} 1`,
+		`asset_ws_messages_sent_total{type="ERROR"} 1`,
+		`asset_ws_send_buffer_full_total{room="grid"} 1`,
+		`asset_ws_slow_client_actions_total{action="resync"} 1`,
+		`asset_ws_connected_clients 2`,
+		`asset_ws_cell_locks 1`,
+	)
+}
+
+func TestBroadcastLatencyWaitsForTheRooms(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	alice := th.connect(t, 1, RoleUser)
+	alice.subscribe("grid")
+
+	// Sequenced while the room is held, but not yet queued to alice
+	_, resume := th.hub.pauseRooms([]string{"grid"})
+	th.hub.BroadcastToRoom("grid", protocol.TypeCommitBroadcast, protocol.CommittedChanges{}, nil)
+	page := th.scrapeMetrics(t)
+	if strings.Contains(page, `asset_ws_broadcast_duration_seconds_count{room="grid"}`) {
+		resume()
+		t.Fatalf("broadcast observed before its room delivered it:\n%s", page)
+	}
+
+	resume()
+	alice.expect(protocol.TypeCommitBroadcast)
+	th.scrapeMetrics(t, `asset_ws_broadcast_duration_seconds_count{room="grid"} 1`)
+}
+
+func TestCompressesLargeMessages(t *testing.T) {
+	th := newTestHub(t, HubConfig{CompressionLevel: 1, CompressionMinSize: 1024})
+
+	user := UserInfo{UserID: 1, Username: "user1", Role: RoleUser}
+	th.sessions.Add("session-1", user)
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, _, err := dialer.Dial(th.wsURL(""), http.Header{
+		"Origin": []string{testOrigin},
+		"Cookie": []string{sessionCookie + "=session-1"},
+	})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	mobile := newTestClient(t, conn, user, "session-1")
+	desktop := th.connect(t, 2, RoleUser)
+	mobile.subscribe("grid")
+	desktop.subscribe("grid")
+
+	// stats waits for the ACK of a PING, written after everything before it
+	stats := func(c *testClient) adminClient {
+		t.Helper()
+		c.mustAck(protocol.TypePing, protocol.Empty{})
+		for _, view := range th.hub.adminViews() {
+			if view.Username == c.user.Username {
+				return view
+			}
+		}
+		t.Fatalf("%s is not connected", c.user.Username)
+		return adminClient{}
+	}
+	commit := func(size int) {
+		value := strings.Repeat("a", size)
+		th.hub.BroadcastToRoom("grid", protocol.TypeCommitBroadcast, protocol.CommittedChanges{
+			Changes: []protocol.CommitChange{{AssetID: "5", Key: "notes", Value: &value}},
+		}, nil)
+		for _, c := range []*testClient{mobile, desktop} {
+			var changes protocol.CommittedChanges
+			c.expect(protocol.TypeCommitBroadcast).decode(t, &changes)
+			if len(*changes.Changes[0].Value) != size {
+				t.Fatalf("%s got a %d byte value, want %d", c.user.Username, len(*changes.Changes[0].Value), size)
+			}
+		}
+	}
+
+	// Below the threshold nothing is compressed
+	commit(500)
+	if view := stats(mobile); !view.Compressed || view.BytesSaved != 0 {
+		t.Errorf("mobile after a small message: compressed %v, saved %d bytes; want compression on and nothing saved", view.Compressed, view.BytesSaved)
+	}
+
+	commit(20000)
+	if view := stats(mobile); view.BytesSaved < 15000 || view.BytesWire >= view.BytesSent {
+		t.Errorf("mobile sent %d bytes as %d on the wire, want most of the large message saved", view.BytesSent, view.BytesWire)
+	}
+	if view := stats(desktop); view.Compressed || view.BytesSaved != 0 {
+		t.Errorf("desktop did not offer compression but got compressed %v, saved %d bytes", view.Compressed, view.BytesSaved)
+	}
+}
+
+func TestMsgpackClientsShareRoomsWithJSONClients(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	th.store.AddAsset("5", map[string]string{"model": "X1", "serial": "S1"})
+	alice := th.connect(t, 1, RoleUser)
+	alice.subscribe("grid")
+
+	th.sessions.Add("session-2", UserInfo{UserID: 2, Username: "user2", Firstname: "First2", Role: RoleUser})
+	dialer := websocket.Dialer{Subprotocols: []string{protocol.MsgpackSubprotocol}}
+	conn, _, err := dialer.Dial(th.wsURL(""), http.Header{
+		"Origin": []string{testOrigin},
+		"Cookie": []string{sessionCookie + "=session-2"},
+	})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != protocol.MsgpackSubprotocol {
+		t.Fatalf("negotiated %q, want %s", conn.Subprotocol(), protocol.MsgpackSubprotocol)
+	}
+
+	send := func(msgType string, payload interface{}) {
+		t.Helper()
+		data, err := msgpack.Marshal(map[string]interface{}{"type": msgType, "requestId": "req-" + msgType, "payload": payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			t.Fatalf("send %s: %v", msgType, err)
+		}
+	}
+	// next reads binary frames until one of msgType and decodes its payload
+	next := func(msgType string, payload interface{}) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(testTimeout))
+		for {
+			frameType, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("waiting for %s: %v", msgType, err)
+			}
+			if frameType != websocket.BinaryMessage {
+				t.Fatalf("got a text frame: %s", data)
+			}
+			var msg struct {
+				Type    string             `msgpack:"type"`
+				Payload msgpack.RawMessage `msgpack:"payload"`
+			}
+			if err := msgpack.Unmarshal(data, &msg); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if msg.Type != msgType {
+				continue
+			}
+			dec := msgpack.NewDecoder(bytes.NewReader(msg.Payload))
+			dec.SetCustomStructTag("json")
+			if err := dec.Decode(payload); err != nil {
+				t.Fatalf("decode %s payload: %v", msgType, err)
+			}
+			return
+		}
+	}
+
+	var welcome protocol.Welcome
+	next(protocol.TypeWelcome, &welcome)
+	if welcome.Username != "user2" {
+		t.Errorf("welcome for %q, want user2", welcome.Username)
+	}
+	send(protocol.TypeSubscribe, map[string]interface{}{"room": "grid"})
+	var snapshot protocol.ExistingUsers
+	next(protocol.TypeExistingUsers, &snapshot)
+
+	// A JSON client's lock reaches the MessagePack client
+	alice.mustAck(protocol.TypeCellEditStart, protocol.CellRef{AssetID: "5", Key: "model"})
+	var locked protocol.CellLocked
+	next(protocol.TypeCellLocked, &locked)
+	if locked.AssetID != "5" || locked.Key != "model" || locked.UserID != "1" {
+		t.Errorf("got lock %+v, want 5:model held by 1", locked)
+	}
+
+	// and the other way round
+	send(protocol.TypeCellEditStart, map[string]interface{}{"assetId": 5, "key": "serial"})
+	var ack protocol.Ack
+	next(protocol.TypeAck, &ack)
+	alice.expect(protocol.TypeCellLocked).decode(t, &locked)
+	if locked.AssetID != "5" || locked.Key != "serial" || locked.Firstname != "First2" {
+		t.Errorf("alice got lock %+v, want 5:serial held by user2", locked)
+	}
+
+	// Bad payloads are rejected like JSON ones
+	send(protocol.TypeCellEditStart, map[string]interface{}{"assetId": 5})
+	var reply protocol.ErrorReply
+	next(protocol.TypeError, &reply)
+	if reply.Code != protocol.CodeInvalidMessage || reply.Field != "key" {
+		t.Errorf("got error %+v, want %s on key", reply, protocol.CodeInvalidMessage)
+	}
+}
+
+func TestClusterSharesLocksAndBroadcasts(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	locks := NewMemoryLockStore()
+	east := newTestHub(t, HubConfig{InstanceID: "east", Backplane: backplane, Locks: locks})
+	west := newTestHub(t, HubConfig{InstanceID: "west", Backplane: backplane, Locks: locks})
+
+	alice := east.connect(t, 1, RoleUser)
+	west.sessions.Add("session-2", UserInfo{UserID: 2, Username: "user2", Role: RoleUser})
+	bob := west.dial(t, UserInfo{UserID: 2, Username: "user2"}, "session-2")
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+
+	cell := protocol.CellRef{AssetID: "5", Key: "model"}
+	alice.mustAck(protocol.TypeCellEditStart, cell)
+
+	var locked protocol.CellLocked
+	bob.expect(protocol.TypeCellLocked).decode(t, &locked)
+	if locked.UserID != "1" {
+		t.Fatalf("bob saw lock %+v", locked)
+	}
+	bob.mustReject(protocol.TypeCellEditStart, cell, protocol.CodeCellLocked)
+
+	alice.mustAck(protocol.TypeCellEditEnd, protocol.Empty{})
+	bob.expect(protocol.TypeCellUnlocked)
+	bob.mustAck(protocol.TypeCellEditStart, cell)
+}
+
+// serverClient is the hub's side of a test client's connection
+func (th *testHub) serverClient(t *testing.T, c *testClient) *Client {
+	t.Helper()
+	th.hub.mutex.RLock()
+	defer th.hub.mutex.RUnlock()
+	for client := range th.hub.userClients[strconv.FormatInt(c.user.UserID, 10)] {
+		return client
+	}
+	t.Fatalf("%s is not connected", c.user.Username)
+	return nil
+}
+
+func TestShutdownFlushesQueuedSendsBeforeClosing(t *testing.T) {
+	th := newTestHub(t, HubConfig{ReconnectGrace: time.Minute})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+
+	// Queued just before the drain starts, behind whatever is in flight
+	const queued = 100
+	client := th.serverClient(t, alice)
+	for i := 0; i < queued; i++ {
+		msg := newOutbound(protocol.Message{Type: protocol.TypeCellUnlocked, Payload: protocol.CellRef{AssetID: "5", Key: strconv.Itoa(i)}})
+		if !th.hub.deliver(client, msg) {
+			t.Fatalf("message %d did not fit the send buffer", i)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := th.hub.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	for i := 0; i < queued; i++ {
+		var cell protocol.CellRef
+		alice.expect(protocol.TypeCellUnlocked).decode(t, &cell)
+		if cell.Key != strconv.Itoa(i) {
+			t.Fatalf("queued message %d arrived as %s", i, cell.Key)
+		}
+	}
+	for _, c := range []*testClient{alice, bob} {
+		var notice protocol.ServerShutdown
+		c.expect(protocol.TypeServerShutdown).decode(t, &notice)
+		if notice.ReconnectAfterMs != shutdownReconnectHint.Milliseconds() {
+			t.Errorf("%s told to reconnect after %dms", c.user.Username, notice.ReconnectAfterMs)
+		}
+		c.expectClose(websocket.CloseServiceRestart)
+	}
+
+	// Drained clients are not parked for a reconnect to this instance
+	if n := th.hub.clientCount(); n != 0 {
+		t.Errorf("%d clients still registered", n)
+	}
+	if parked := th.hub.parkedClients(); len(parked) != 0 {
+		t.Errorf("%d clients parked during shutdown", len(parked))
+	}
+}
+
+func TestShutdownRefusesUpgradesAndHonorsDeadline(t *testing.T) {
+	th := newTestHub(t, HubConfig{})
+	th.sessions.Add("session-1", UserInfo{UserID: 1, Username: "user1", Role: RoleUser})
+
+	// A client that never closes: nothing reads its send buffer or
+	// unregisters it
+	stuck := &Client{
+		hub:      th.hub,
+		userID:   "9",
+		send:     make(chan *outbound, clientSendBuffer),
+		done:     make(chan struct{}),
+		drain:    make(chan struct{}),
+		backlog:  make(chan struct{}, 1),
+		userInfo: &UserInfo{UserID: 9, Username: "stuck"},
+	}
+	th.hub.registerClient(stuck)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- th.hub.Shutdown(ctx) }()
+
+	// Refused while it drains
+	deadline := time.After(testTimeout)
+	for !th.hub.draining.Load() {
+		select {
+		case <-deadline:
+			t.Fatal("hub did not start draining")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	header := http.Header{"Origin": []string{testOrigin}, "Cookie": []string{sessionCookie + "=session-1"}}
+	_, resp, err := websocket.DefaultDialer.Dial(th.wsURL(""), header)
+	if err == nil {
+		t.Fatal("upgrade during shutdown succeeded")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("want 503 with Retry-After, got %v", resp)
+	}
+
+	select {
+	case err := <-shutdownErr:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("shutdown returned %v, want the deadline", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("shutdown ran past its deadline")
+	}
+	if msg := <-stuck.send; msg.msg.Type != protocol.TypeServerShutdown {
+		t.Errorf("stuck client was sent %s, want SERVER_SHUTDOWN", msg.msg.Type)
+	}
+	select {
+	case <-stuck.drain:
+	default:
+		t.Error("stuck client was not told to close")
+	}
+
+	// Let the cleanup's Shutdown finish
+	th.hub.mutex.Lock()
+	delete(th.hub.clients, stuck)
+	delete(th.hub.userClients, stuck.userID)
+	th.hub.mutex.Unlock()
+}
+
+func TestRevalidateEndsInvalidSessions(t *testing.T) {
+	th := newTestHub(t, HubConfig{ReconnectGrace: 5 * time.Second})
+	alice := th.connect(t, 1, RoleUser)
+	bob := th.connect(t, 2, RoleUser)
+	carol := th.connect(t, 3, RoleUser)
+	alice.subscribe("grid")
+	bob.subscribe("grid")
+	carol.subscribe("grid")
+
+	alice.mustAck(protocol.TypeCellEditStart, protocol.CellRef{AssetID: "5", Key: "model"})
+	carol.mustAck(protocol.TypeRowLock, protocol.RowRef{AssetID: "7"})
+	bob.expect(protocol.TypeRowLocked)
+
+	// Carol's tab dropped and is waiting out the grace window
+	carol.close()
+	bob.expect(protocol.TypeUserAway)
+
+	if ended := th.hub.RevalidateSessions(); ended != 0 {
+		t.Fatalf("ended %d clients with every session valid", ended)
+	}
+
+	th.sessions.Remove(alice.session)
+	th.sessions.Remove(carol.session)
+	if ended := th.hub.RevalidateSessions(); ended != 2 {
+		t.Fatalf("ended %d clients, want 2", ended)
+	}
+
+	alice.expect(protocol.TypeSessionExpired)
+	alice.expectClose(websocket.ClosePolicyViolation)
+	bob.expect(protocol.TypeRowUnlocked)
+
+	// Released at once rather than parked
+	bob.mustAck(protocol.TypeCellEditStart, protocol.CellRef{AssetID: "5", Key: "model"})
+	bob.mustAck(protocol.TypeCellEditEnd, protocol.Empty{})
+	bob.mustAck(protocol.TypeRowLock, protocol.RowRef{AssetID: "7"})
+}
+
+// BenchmarkBroadcast measures a COMMIT_BROADCAST reaching every client of a
+// room over real connections, for sizing the server:
+//
+//	go test -run ^$ -bench Broadcast ./internal
+func BenchmarkBroadcast(b *testing.B) {
+	for _, clients := range []int{50, 500, 5000} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			benchmarkBroadcast(b, clients)
+		})
+	}
+}
+
+func benchmarkBroadcast(b *testing.B, clients int) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+	th := newTestHub(b, HubConfig{})
+
+	var received sync.WaitGroup
+	for i := 1; i <= clients; i++ {
+		conn := th.benchSubscriber(b, int64(i), "grid")
+		go func() {
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if bytes.Contains(data, []byte(protocol.TypeCommitBroadcast)) {
+					received.Done()
+				}
+			}
+		}()
+	}
+
+	value := "Updated"
+	changes := protocol.CommittedChanges{
+		UserID:     "1",
+		ModifiedBy: "user1",
+		Modified:   "2026-01-01 00:00:00",
+		Changes:    []protocol.CommitChange{{AssetID: "1", Key: "name", Value: &value}},
+	}
+	for b.Loop() {
+		received.Add(clients)
+		th.hub.BroadcastToRoom("grid", protocol.TypeCommitBroadcast, changes, nil)
+		received.Wait()
+	}
+	b.ReportMetric(float64(clients*b.N)/b.Elapsed().Seconds(), "deliveries/s")
+}
+
+// benchSubscriber connects a user and joins room without the buffering of
+// testClient, so a benchmark can read as fast as the hub writes
+func (th *testHub) benchSubscriber(b *testing.B, userID int64, room string) *websocket.Conn {
+	b.Helper()
+	session := fmt.Sprintf("session-%d", userID)
+	th.sessions.Add(session, UserInfo{UserID: userID, Username: fmt.Sprintf("user%d", userID)})
+
+	header := http.Header{
+		"Origin": []string{testOrigin},
+		"Cookie": []string{sessionCookie + "=" + session},
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(th.wsURL(""), header)
+	if err != nil {
+		b.Fatalf("dial: %v", err)
+	}
+	b.Cleanup(func() { conn.Close() })
+
+	subscribe := map[string]interface{}{"type": protocol.TypeSubscribe, "requestId": "req-1", "payload": protocol.Subscribe{Room: room}}
+	if err := conn.WriteJSON(subscribe); err != nil {
+		b.Fatalf("subscribe: %v", err)
+	}
+	for {
+		var msg testMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			b.Fatalf("waiting for %s: %v", protocol.TypeExistingUsers, err)
+		}
+		if msg.Type == protocol.TypeExistingUsers {
+			return conn
+		}
+	}
+}
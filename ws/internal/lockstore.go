@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"asset-ws/internal/protocol"
+)
+
+const (
+	// lockClaimTTL is how long a claim outlives its instance's last renewal,
+	// so a crashed instance's locks free up on their own
+	lockClaimTTL = 45 * time.Second
+	// lockRenewInterval is how often an instance renews all of its claims
+	lockRenewInterval = 10 * time.Second
+)
+
+// LockKind names the kind of state a claim guards
+type LockKind string
+
+const (
+	LockCell    LockKind = "cell"
+	LockRow     LockKind = "row"
+	LockPending LockKind = "pending"
+)
+
+// Claim is one instance's hold on a cell lock, row lock or pending cell.
+// The lock managers keep the per-connection detail; the store only decides
+// which instance and session a key belongs to.
+type Claim struct {
+	Kind LockKind
+	// "assetId:key" for cells and pending cells, the asset id for rows
+	Key string
+	// Instance and session holding the key; see Hub.claimOwner
+	Owner    string
+	Instance string
+	Holder   protocol.Holder
+	Value    string
+	// Room the key was taken in, which decides who sees it in snapshots
+	Room      string
+	ExpiresAt time.Time
+}
+
+// LockStore arbitrates cell, row and pending state between hub instances.
+// Every instance claims a key in the store before it grants it locally.
+type LockStore interface {
+	// Acquire claims claim.Key for claim.Owner, taking over an expired
+	// claim. It returns the other owner's claim when the key is taken.
+	Acquire(claim Claim) (*Claim, error)
+	// Release drops keys held by owner
+	Release(kind LockKind, owner string, keys ...string) error
+	// Get returns the live claim on a key, or nil
+	Get(kind LockKind, key string) (*Claim, error)
+	// List returns every live claim of a kind
+	List(kind LockKind) ([]Claim, error)
+	// Renew pushes back the expiry of every claim an instance holds
+	Renew(instance string) error
+	// ReleaseInstance drops every claim an instance holds
+	ReleaseInstance(instance string) error
+}
+
+// MemoryLockStore keeps claims in process. It is the default for a single
+// instance, and hubs sharing one in tests behave like a cluster.
+type MemoryLockStore struct {
+	claims map[LockKind]map[string]*Claim
+	ttl    time.Duration
+	mutex  sync.Mutex
+}
+
+func NewMemoryLockStore() *MemoryLockStore {
+	return &MemoryLockStore{
+		claims: make(map[LockKind]map[string]*Claim),
+		ttl:    lockClaimTTL,
+	}
+}
+
+func (s *MemoryLockStore) Acquire(claim Claim) (*Claim, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if existing, ok := s.claims[claim.Kind][claim.Key]; ok && existing.Owner != claim.Owner && now.Before(existing.ExpiresAt) {
+		other := *existing
+		return &other, nil
+	}
+
+	if s.claims[claim.Kind] == nil {
+		s.claims[claim.Kind] = make(map[string]*Claim)
+	}
+	claim.ExpiresAt = now.Add(s.ttl)
+	s.claims[claim.Kind][claim.Key] = &claim
+	return nil, nil
+}
+
+func (s *MemoryLockStore) Release(kind LockKind, owner string, keys ...string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, key := range keys {
+		if existing, ok := s.claims[kind][key]; ok && existing.Owner == owner {
+			delete(s.claims[kind], key)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryLockStore) Get(kind LockKind, key string) (*Claim, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if existing, ok := s.claims[kind][key]; ok && time.Now().Before(existing.ExpiresAt) {
+		claim := *existing
+		return &claim, nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryLockStore) List(kind LockKind) ([]Claim, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	claims := make([]Claim, 0, len(s.claims[kind]))
+	for _, existing := range s.claims[kind] {
+		if now.Before(existing.ExpiresAt) {
+			claims = append(claims, *existing)
+		}
+	}
+	return claims, nil
+}
+
+func (s *MemoryLockStore) Renew(instance string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	expiresAt := now.Add(s.ttl)
+	for _, claims := range s.claims {
+		for key, claim := range claims {
+			if claim.Instance == instance {
+				claim.ExpiresAt = expiresAt
+			} else if !now.Before(claim.ExpiresAt) {
+				delete(claims, key)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *MemoryLockStore) ReleaseInstance(instance string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, claims := range s.claims {
+		for key, claim := range claims {
+			if claim.Instance == instance {
+				delete(claims, key)
+			}
+		}
+	}
+	return nil
+}
+
+// claimOwner identifies a client's session on this instance. Tabs sharing a
+// session share an owner, like they share parked state. The session id is
+// hashed so it never lands in a shared table.
+func (h *Hub) claimOwner(c *Client) string {
+	session := sha256.Sum256([]byte(c.sessionID))
+	return h.instanceID + "/" + c.userID + ":" + hex.EncodeToString(session[:8])
+}
+
+// ownsClaim reports whether owner belongs to this instance
+func (h *Hub) ownsClaim(owner string) bool {
+	return strings.HasPrefix(owner, h.instanceID+"/")
+}
+
+// claim takes key in the lock store for c. It returns the claim of a client
+// on another instance holding the key, or nil once c holds it. A store that
+// cannot be reached is logged and treated as free, so a database hiccup
+// degrades to per-instance locking instead of blocking every edit.
+func (c *Client) claim(kind LockKind, key, value, room string) *Claim {
+	other, err := c.hub.locks.Acquire(Claim{
+		Kind:     kind,
+		Key:      key,
+		Owner:    c.hub.claimOwner(c),
+		Instance: c.hub.instanceID,
+		Holder:   c.holder(),
+		Value:    value,
+		Room:     room,
+	})
+	if err != nil {
+		log.Printf("[LockStore] Failed to claim %s %s for %s: %v", kind, key, c.userInfo.Username, err)
+		return nil
+	}
+	return other
+}
+
+// release drops client's claims on keys
+func (h *Hub) release(kind LockKind, client *Client, keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	if err := h.locks.Release(kind, h.claimOwner(client), keys...); err != nil {
+		log.Printf("[LockStore] Failed to release %d %s claims of %s: %v", len(keys), kind, client.userInfo.Username, err)
+	}
+}
+
+// remoteClaim returns the claim on key when another instance holds it. Keys
+// held here are answered by the lock managers, which know the connection.
+func (h *Hub) remoteClaim(kind LockKind, key string) *Claim {
+	claim, err := h.locks.Get(kind, key)
+	if err != nil {
+		log.Printf("[LockStore] Failed to read %s %s: %v", kind, key, err)
+		return nil
+	}
+	if claim == nil || claim.Instance == h.instanceID {
+		return nil
+	}
+	return claim
+}
+
+// remoteClaims returns every claim of a kind held by other instances
+func (h *Hub) remoteClaims(kind LockKind) []Claim {
+	claims, err := h.locks.List(kind)
+	if err != nil {
+		log.Printf("[LockStore] Failed to list %s claims: %v", kind, err)
+		return nil
+	}
+	remote := claims[:0]
+	for _, claim := range claims {
+		if claim.Instance != h.instanceID {
+			remote = append(remote, claim)
+		}
+	}
+	return remote
+}
+
+// runLockRenewal keeps this instance's claims alive until shutdown
+func (h *Hub) runLockRenewal() {
+	ticker := time.NewTicker(lockRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := h.locks.Renew(h.instanceID); err != nil {
+				log.Printf("[LockStore] Failed to renew claims: %v", err)
+			}
+		case <-h.shutdown:
+			return
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"asset-ws/internal/protocol"
+)
+
+// MySQLLockStore keeps claims in the ws_locks table so every instance
+// pointed at the database sees the same locks. Expiry uses the database
+// clock, so instances do not need synchronised clocks.
+type MySQLLockStore struct {
+	db  *sql.DB
+	ttl time.Duration
+}
+
+// NewMySQLLockStore creates the ws_locks table if it is missing
+func NewMySQLLockStore(db *sql.DB) (*MySQLLockStore, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS ws_locks (
+			kind VARCHAR(16) NOT NULL,
+			lock_key VARCHAR(191) NOT NULL,
+			owner VARCHAR(191) NOT NULL,
+			instance VARCHAR(64) NOT NULL,
+			holder TEXT NOT NULL,
+			value TEXT NOT NULL,
+			room VARCHAR(191) NOT NULL DEFAULT '',
+			expires_at DATETIME(6) NOT NULL,
+			PRIMARY KEY (kind, lock_key),
+			KEY idx_ws_locks_instance (instance)
+		)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("create ws_locks: %w", err)
+	}
+	return &MySQLLockStore{db: db, ttl: lockClaimTTL}, nil
+}
+
+// Acquire upserts the claim, keeping the existing row unless it is ours or
+// expired. The upsert is atomic per key, so two instances racing for a key
+// cannot both win. owner is assigned after the columns that test it and
+// before expires_at, which the test also reads.
+func (s *MySQLLockStore) Acquire(claim Claim) (*Claim, error) {
+	holder, err := json.Marshal(claim.Holder)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO ws_locks (kind, lock_key, owner, instance, holder, value, room, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, NOW(6) + INTERVAL ? MICROSECOND)
+		ON DUPLICATE KEY UPDATE
+			instance = IF(owner = VALUES(owner) OR expires_at <= NOW(6), VALUES(instance), instance),
+			holder = IF(owner = VALUES(owner) OR expires_at <= NOW(6), VALUES(holder), holder),
+			value = IF(owner = VALUES(owner) OR expires_at <= NOW(6), VALUES(value), value),
+			room = IF(owner = VALUES(owner) OR expires_at <= NOW(6), VALUES(room), room),
+			owner = IF(owner = VALUES(owner) OR expires_at <= NOW(6), VALUES(owner), owner),
+			expires_at = IF(owner = VALUES(owner), VALUES(expires_at), expires_at)
+	`, claim.Kind, claim.Key, claim.Owner, claim.Instance, holder, claim.Value, claim.Room, s.ttl.Microseconds())
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := s.Get(claim.Kind, claim.Key)
+	if err != nil || current == nil || current.Owner == claim.Owner {
+		return nil, err
+	}
+	return current, nil
+}
+
+func (s *MySQLLockStore) Release(kind LockKind, owner string, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := []interface{}{kind, owner}
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(keys)), ",")
+	_, err := s.db.Exec("DELETE FROM ws_locks WHERE kind = ? AND owner = ? AND lock_key IN ("+placeholders+")", args...)
+	return err
+}
+
+func (s *MySQLLockStore) Get(kind LockKind, key string) (*Claim, error) {
+	rows, err := s.db.Query(`
+		SELECT kind, lock_key, owner, instance, holder, value, room, expires_at
+		FROM ws_locks
+		WHERE kind = ? AND lock_key = ? AND expires_at > NOW(6)
+	`, kind, key)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := scanClaims(rows)
+	if err != nil || len(claims) == 0 {
+		return nil, err
+	}
+	return &claims[0], nil
+}
+
+func (s *MySQLLockStore) List(kind LockKind) ([]Claim, error) {
+	rows, err := s.db.Query(`
+		SELECT kind, lock_key, owner, instance, holder, value, room, expires_at
+		FROM ws_locks
+		WHERE kind = ? AND expires_at > NOW(6)
+	`, kind)
+	if err != nil {
+		return nil, err
+	}
+	return scanClaims(rows)
+}
+
+// Renew also clears out claims left by instances that stopped renewing
+func (s *MySQLLockStore) Renew(instance string) error {
+	if _, err := s.db.Exec("UPDATE ws_locks SET expires_at = NOW(6) + INTERVAL ? MICROSECOND WHERE instance = ?", s.ttl.Microseconds(), instance); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM ws_locks WHERE expires_at <= NOW(6)")
+	return err
+}
+
+func (s *MySQLLockStore) ReleaseInstance(instance string) error {
+	_, err := s.db.Exec("DELETE FROM ws_locks WHERE instance = ?", instance)
+	return err
+}
+
+func scanClaims(rows *sql.Rows) ([]Claim, error) {
+	defer rows.Close()
+
+	var claims []Claim
+	for rows.Next() {
+		var claim Claim
+		var holder string
+		if err := rows.Scan(&claim.Kind, &claim.Key, &claim.Owner, &claim.Instance, &holder, &claim.Value, &claim.Room, &claim.ExpiresAt); err != nil {
+			return nil, err
+		}
+		var h protocol.Holder
+		if err := json.Unmarshal([]byte(holder), &h); err == nil {
+			claim.Holder = h
+		}
+		claims = append(claims, claim)
+	}
+	return claims, rows.Err()
+}
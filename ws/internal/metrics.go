@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace prefixes every metric the hub exports
+const metricsNamespace = "asset_ws"
+
+// invalidMessageType labels inbound messages that failed to decode, so junk
+// types cannot grow the label set
+const invalidMessageType = "INVALID"
+
+// allRoomsLabel is the room label of broadcasts sent to every room
+const allRoomsLabel = "all"
+
+// hubMetrics holds the hub's counters and histograms. Gauges are read from
+// the hub and managers at scrape time by hubCollector.
+type hubMetrics struct {
+	registry *prometheus.Registry
+
+	messagesIn       *prometheus.CounterVec
+	messagesOut      *prometheus.CounterVec
+	rateLimited      prometheus.Counter
+	sendBufferFull   *prometheus.CounterVec
+	outOfView        *prometheus.CounterVec
+	slowClients      *prometheus.CounterVec
+	broadcastLatency *prometheus.HistogramVec
+	sessionsEnded    prometheus.Counter
+	messageBytes     prometheus.Counter
+	wireBytes        prometheus.Counter
+}
+
+func newHubMetrics(h *Hub) *hubMetrics {
+	m := &hubMetrics{
+		registry: prometheus.NewRegistry(),
+		messagesIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_received_total",
+			Help:      "Messages received from clients, by type.",
+		}, []string{"type"}),
+		messagesOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_sent_total",
+			Help:      "Messages queued to clients, by type. A broadcast counts once per recipient.",
+		}, []string{"type"}),
+		rateLimited: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rate_limited_total",
+			Help:      "Client messages dropped by the per-client rate limit.",
+		}),
+		sendBufferFull: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "send_buffer_full_total",
+			Help:      "Messages dropped because a client's send buffer was full, by the kind of the client's first room.",
+		}, []string{"room"}),
+		outOfView: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_out_of_view_total",
+			Help:      "Broadcasts not sent to a client because its viewport showed none of their assets, by type.",
+		}, []string{"type"}),
+		slowClients: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "slow_client_actions_total",
+			Help:      "What the slow client policy did about full send buffers: coalesced a cursor, marked a client for resync, or disconnected it.",
+		}, []string{"action"}),
+		broadcastLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "broadcast_duration_seconds",
+			Help:      "Time from a broadcast call until its rooms have queued it to every recipient, by kind of room.",
+			Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+		}, []string{"room"}),
+		sessionsEnded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "sessions_ended_total",
+			Help:      "Clients disconnected because their session was logged out, expired or deleted.",
+		}),
+		messageBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "message_bytes_total",
+			Help:      "Bytes of the messages written to clients, before compression.",
+		}),
+		wireBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "wire_bytes_total",
+			Help:      "Bytes written to client sockets for those messages, after compression and framing.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.messagesIn,
+		m.messagesOut,
+		m.rateLimited,
+		m.sendBufferFull,
+		m.outOfView,
+		m.slowClients,
+		m.broadcastLatency,
+		m.sessionsEnded,
+		m.messageBytes,
+		m.wireBytes,
+		&hubCollector{hub: h},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// observeBroadcast records how long a broadcast to room took since start
+func (m *hubMetrics) observeBroadcast(room string, start time.Time) {
+	m.broadcastLatency.WithLabelValues(room).Observe(time.Since(start).Seconds())
+}
+
+// MetricsHandler serves the hub's metrics in the Prometheus text format
+func (h *Hub) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(h.metrics.registry, promhttp.HandlerOpts{})
+}
+
+var (
+	connectedClientsDesc = prometheus.NewDesc(metricsNamespace+"_connected_clients",
+		"Open WebSocket connections.", nil, nil)
+	roomClientsDesc = prometheus.NewDesc(metricsNamespace+"_room_clients",
+		"Room subscriptions by kind of room (grid, audit, asset).", []string{"room"}, nil)
+	parkedClientsDesc = prometheus.NewDesc(metricsNamespace+"_parked_clients",
+		"Dropped connections inside their reconnect grace window.", nil, nil)
+	cellLocksDesc = prometheus.NewDesc(metricsNamespace+"_cell_locks",
+		"Cells currently locked for editing.", nil, nil)
+	rowLocksDesc = prometheus.NewDesc(metricsNamespace+"_row_locks",
+		"Rows currently locked.", nil, nil)
+	pendingCellsDesc = prometheus.NewDesc(metricsNamespace+"_pending_cells",
+		"Uncommitted cell edits.", nil, nil)
+)
+
+// hubCollector reports the hub's live state as gauges on every scrape
+type hubCollector struct {
+	hub *Hub
+}
+
+func (hc *hubCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connectedClientsDesc
+	ch <- roomClientsDesc
+	ch <- parkedClientsDesc
+	ch <- cellLocksDesc
+	ch <- rowLocksDesc
+	ch <- pendingCellsDesc
+}
+
+func (hc *hubCollector) Collect(ch chan<- prometheus.Metric) {
+	h := hc.hub
+
+	h.mutex.RLock()
+	clients := len(h.clients)
+	rooms := make(map[string]int, len(roomNames)+len(scopedRooms))
+	for _, room := range roomNames {
+		rooms[room] = 0
+	}
+	for room, r := range h.rooms {
+		rooms[roomKind(room)] += int(r.size.Load())
+	}
+	parked := 0
+	for _, queue := range h.parked {
+		parked += len(queue)
+	}
+	h.mutex.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(connectedClientsDesc, prometheus.GaugeValue, float64(clients))
+	for room, n := range rooms {
+		ch <- prometheus.MustNewConstMetric(roomClientsDesc, prometheus.GaugeValue, float64(n), room)
+	}
+	ch <- prometheus.MustNewConstMetric(parkedClientsDesc, prometheus.GaugeValue, float64(parked))
+	ch <- prometheus.MustNewConstMetric(cellLocksDesc, prometheus.GaugeValue, float64(h.cellLocks.Count()))
+	ch <- prometheus.MustNewConstMetric(rowLocksDesc, prometheus.GaugeValue, float64(h.rowLocks.Count()))
+	ch <- prometheus.MustNewConstMetric(pendingCellsDesc, prometheus.GaugeValue, float64(h.pendingCells.Count()))
+}
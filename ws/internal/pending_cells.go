@@ -1,10 +1,10 @@
 package internal
 
 import (
-	"fmt"
 	"log"
-	"strings"
 	"sync"
+
+	"asset-ws/internal/protocol"
 )
 
 type PendingCellInfo struct {
@@ -12,6 +12,7 @@ type PendingCellInfo struct {
 	AssetID string
 	Key     string
 	Value   string
+	Room    string // Room the edit was made in
 }
 
 type PendingCellManager struct {
@@ -29,7 +30,7 @@ func NewPendingCellManager() *PendingCellManager {
 	}
 }
 
-func (pcm *PendingCellManager) Add(cellKey string, client *Client, assetID, key, value string) bool {
+func (pcm *PendingCellManager) Add(cellKey string, client *Client, assetID, key, value, room string) bool {
 	pcm.mutex.Lock()
 	defer pcm.mutex.Unlock()
 
@@ -43,6 +44,7 @@ func (pcm *PendingCellManager) Add(cellKey string, client *Client, assetID, key,
 		AssetID: assetID,
 		Key:     key,
 		Value:   value,
+		Room:    room,
 	}
 
 	if _, ok := pcm.userCells[client]; !ok {
@@ -53,13 +55,40 @@ func (pcm *PendingCellManager) Add(cellKey string, client *Client, assetID, key,
 	return true
 }
 
-func (pcm *PendingCellManager) Remove(cellKey string, client *Client) bool {
+// Transfer hands every pending cell of one client to another
+func (pcm *PendingCellManager) Transfer(from, to *Client) int {
+	pcm.mutex.Lock()
+	defer pcm.mutex.Unlock()
+
+	cellKeys, ok := pcm.userCells[from]
+	if !ok {
+		return 0
+	}
+
+	for cellKey := range cellKeys {
+		if info, ok := pcm.cells[cellKey]; ok {
+			info.Client = to
+		}
+	}
+	delete(pcm.userCells, from)
+	if pcm.userCells[to] == nil {
+		pcm.userCells[to] = make(map[string]bool)
+	}
+	for cellKey := range cellKeys {
+		pcm.userCells[to][cellKey] = true
+	}
+	return len(cellKeys)
+}
+
+// Remove drops a client's pending cell and returns it, or nil when the
+// client has no pending edit there
+func (pcm *PendingCellManager) Remove(cellKey string, client *Client) *PendingCellInfo {
 	pcm.mutex.Lock()
 	defer pcm.mutex.Unlock()
 
 	existing, ok := pcm.cells[cellKey]
 	if !ok || existing.Client != client {
-		return false
+		return nil
 	}
 
 	delete(pcm.cells, cellKey)
@@ -69,10 +98,12 @@ func (pcm *PendingCellManager) Remove(cellKey string, client *Client) bool {
 			delete(pcm.userCells, client)
 		}
 	}
-	return true
+	return existing
 }
 
-func (pcm *PendingCellManager) RemoveAllForClient(client *Client) []string {
+// RemoveAllForClient removes every pending cell of a client and returns
+// their keys grouped by the room they were made in
+func (pcm *PendingCellManager) RemoveAllForClient(client *Client) map[string][]string {
 	pcm.mutex.Lock()
 	defer pcm.mutex.Unlock()
 
@@ -81,15 +112,78 @@ func (pcm *PendingCellManager) RemoveAllForClient(client *Client) []string {
 		return nil
 	}
 
-	removed := make([]string, 0, len(cellKeys))
+	removed := make(map[string][]string)
 	for cellKey := range cellKeys {
+		if info, ok := pcm.cells[cellKey]; ok {
+			removed[info.Room] = append(removed[info.Room], cellKey)
+		}
 		delete(pcm.cells, cellKey)
-		removed = append(removed, cellKey)
 	}
 	delete(pcm.userCells, client)
 	return removed
 }
 
+// RemoveRoomForClient removes the pending cells a client made in one room
+// and returns their keys
+func (pcm *PendingCellManager) RemoveRoomForClient(client *Client, room string) []string {
+	pcm.mutex.Lock()
+	defer pcm.mutex.Unlock()
+
+	var removed []string
+	for cellKey := range pcm.userCells[client] {
+		if info, ok := pcm.cells[cellKey]; ok && info.Room == room {
+			delete(pcm.cells, cellKey)
+			delete(pcm.userCells[client], cellKey)
+			removed = append(removed, cellKey)
+		}
+	}
+	if len(pcm.userCells[client]) == 0 {
+		delete(pcm.userCells, client)
+	}
+	return removed
+}
+
+// AssignRoom moves the pending cells a client made outside any room into room
+func (pcm *PendingCellManager) AssignRoom(client *Client, room string) {
+	pcm.mutex.Lock()
+	defer pcm.mutex.Unlock()
+
+	for cellKey := range pcm.userCells[client] {
+		if info, ok := pcm.cells[cellKey]; ok && info.Room == "" {
+			info.Room = room
+		}
+	}
+}
+
+// RemoveAllForUser removes pending cells held by any connection of a user and
+// returns them grouped by the connection that held them
+func (pcm *PendingCellManager) RemoveAllForUser(userID string) map[*Client][]*PendingCellInfo {
+	pcm.mutex.Lock()
+	defer pcm.mutex.Unlock()
+
+	removed := make(map[*Client][]*PendingCellInfo)
+	for client, cellKeys := range pcm.userCells {
+		if client.userID != userID {
+			continue
+		}
+		for cellKey := range cellKeys {
+			if info, ok := pcm.cells[cellKey]; ok {
+				removed[client] = append(removed[client], info)
+			}
+			delete(pcm.cells, cellKey)
+		}
+		delete(pcm.userCells, client)
+	}
+	return removed
+}
+
+// Count returns how many cells are pending
+func (pcm *PendingCellManager) Count() int {
+	pcm.mutex.RLock()
+	defer pcm.mutex.RUnlock()
+	return len(pcm.cells)
+}
+
 func (pcm *PendingCellManager) GetAll() map[string]*PendingCellInfo {
 	pcm.mutex.RLock()
 	defer pcm.mutex.RUnlock()
@@ -101,6 +195,7 @@ func (pcm *PendingCellManager) GetAll() map[string]*PendingCellInfo {
 			AssetID: v.AssetID,
 			Key:     v.Key,
 			Value:   v.Value,
+			Room:    v.Room,
 		}
 	}
 	return snapshot
@@ -116,108 +211,68 @@ func (pcm *PendingCellManager) IsBlockedByOther(cellKey string, client *Client)
 			AssetID: info.AssetID,
 			Key:     info.Key,
 			Value:   info.Value,
+			Room:    info.Room,
 		}
 	}
 	return false, nil
 }
 
-func (c *Client) handleCellPending(payload interface{}) {
-	payloadMap, ok := payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-
-	assetIdRaw, ok1 := payloadMap["assetId"]
-	keyStr, ok2 := payloadMap["key"].(string)
-	valueStr, _ := payloadMap["value"].(string)
-	if !ok1 || !ok2 || keyStr == "" {
-		return
-	}
-
-	assetId := fmt.Sprintf("%v", assetIdRaw)
-	cellKey := assetId + ":" + keyStr
+func (c *Client) handleCellPending(p *protocol.CellValue, room string) error {
+	cellKey := protocol.CellKey(p.AssetID, p.Key)
 
-	added := c.hub.pendingCells.Add(cellKey, c, assetId, keyStr, valueStr)
-
-	if added {
-		log.Printf("[Pending] %s (%s %s) pended cell %s", c.userInfo.Username, c.userInfo.Firstname, c.userInfo.Lastname, cellKey)
-		broadcastPayload := map[string]interface{}{
-			"assetId":   assetIdRaw,
-			"key":       keyStr,
-			"userId":    c.userID,
-			"firstname": c.userInfo.Firstname,
-			"lastname":  c.userInfo.Lastname,
-			"color":     c.userInfo.Color,
+	added := c.hub.pendingCells.Add(cellKey, c, p.AssetID.String(), p.Key, p.Value, room)
+	if !added {
+		if blocked, blocker := c.hub.pendingCells.IsBlockedByOther(cellKey, c); blocked {
+			log.Printf("[Pending] %s rejected for cell %s (pending by %s %s)", c.userInfo.Username, cellKey, blocker.Client.userInfo.Firstname, blocker.Client.userInfo.Lastname)
+			return protocol.Rejectf(protocol.CodeCellPending, "Cell has unsaved changes by %s %s", blocker.Client.userInfo.Firstname, blocker.Client.userInfo.Lastname)
 		}
-		c.hub.BroadcastToRoom(c.room,"PENDING_BROADCAST", broadcastPayload, c)
+		return protocol.Rejectf(protocol.CodeCellPending, "Cell has unsaved changes by another user")
 	}
-}
-
-func (c *Client) handleCellPendingClear(payload interface{}) {
-	payloadMap, ok := payload.(map[string]interface{})
-	if !ok {
-		return
+	if other := c.claim(LockPending, cellKey, p.Value, room); other != nil {
+		c.hub.pendingCells.Remove(cellKey, c)
+		log.Printf("[Pending] %s rejected for cell %s (pending by %s %s on %s)", c.userInfo.Username, cellKey, other.Holder.Firstname, other.Holder.Lastname, other.Instance)
+		return protocol.Rejectf(protocol.CodeCellPending, "Cell has unsaved changes by %s %s", other.Holder.Firstname, other.Holder.Lastname)
 	}
 
-	assetIdRaw, ok1 := payloadMap["assetId"]
-	keyStr, ok2 := payloadMap["key"].(string)
-	if !ok1 || !ok2 || keyStr == "" {
-		return
-	}
+	log.Printf("[Pending] %s (%s %s) pended cell %s", c.userInfo.Username, c.userInfo.Firstname, c.userInfo.Lastname, cellKey)
+	c.hub.BroadcastInView(room, []string{p.AssetID.String()}, protocol.TypePendingBroadcast, protocol.PendingCell{
+		AssetID: p.AssetID,
+		Key:     p.Key,
+		Holder:  c.holder(),
+	}, c)
+	return nil
+}
 
-	assetId := fmt.Sprintf("%v", assetIdRaw)
-	cellKey := assetId + ":" + keyStr
+func (c *Client) handleCellPendingClear(p *protocol.CellRef) error {
+	cellKey := protocol.CellKey(p.AssetID, p.Key)
 
 	removed := c.hub.pendingCells.Remove(cellKey, c)
-	if removed {
-		log.Printf("[Pending] %s cleared cell %s", c.userInfo.Username, cellKey)
-		broadcastPayload := map[string]interface{}{
-			"assetId": assetIdRaw,
-			"key":     keyStr,
-			"userId":  c.userID,
-		}
-		c.hub.BroadcastToRoom(c.room,"PENDING_CLEAR_BROADCAST", broadcastPayload, c)
+	if removed == nil {
+		return protocol.Rejectf(protocol.CodeNotHeld, "Cell %s is not pending for you", cellKey)
 	}
+	c.hub.release(LockPending, c, cellKey)
+
+	log.Printf("[Pending] %s cleared cell %s", c.userInfo.Username, cellKey)
+	c.hub.BroadcastInView(removed.Room, []string{removed.AssetID}, protocol.TypePendingClearBroadcast, protocol.PendingClear{
+		AssetID: p.AssetID,
+		Key:     p.Key,
+		UserID:  c.userID,
+	}, c)
+	return nil
 }
 
 func (c *Client) handlePendingClearAll() {
-	removedCells := c.hub.pendingCells.RemoveAllForClient(c)
-	if len(removedCells) > 0 {
-		cells := make([]map[string]interface{}, 0, len(removedCells))
-		for _, cellKey := range removedCells {
-			parts := strings.SplitN(cellKey, ":", 2)
-			if len(parts) == 2 {
-				cells = append(cells, map[string]interface{}{
-					"assetId": parts[0],
-					"key":     parts[1],
-				})
-			}
-		}
-		broadcastPayload := map[string]interface{}{
-			"userId": c.userID,
-			"cells":  cells,
-		}
-		c.hub.BroadcastToRoom(c.room,"PENDING_CLEAR_BROADCAST", broadcastPayload, c)
-		log.Printf("[Pending] %s cleared all (%d cells)", c.userInfo.Username, len(removedCells))
-	}
-}
-
-func (c *Client) handleCommitBroadcast(payload interface{}) {
-	payloadMap, ok := payload.(map[string]interface{})
-	if !ok {
-		return
+	cleared := 0
+	for room, removedCells := range c.hub.pendingCells.RemoveAllForClient(c) {
+		c.hub.release(LockPending, c, removedCells...)
+		cells := splitCellKeys(removedCells)
+		c.hub.BroadcastInView(room, cellAssets(cells), protocol.TypePendingClearBroadcast, protocol.PendingClear{
+			UserID: c.userID,
+			Cells:  cells,
+		}, c)
+		cleared += len(removedCells)
 	}
-
-	// Clear all pending cells for the committing user
-	c.hub.pendingCells.RemoveAllForClient(c)
-
-	// Forward changes to all other clients
-	changes, _ := payloadMap["changes"].([]interface{})
-	broadcastPayload := map[string]interface{}{
-		"userId":  c.userID,
-		"changes": changes,
+	if cleared > 0 {
+		log.Printf("[Pending] %s cleared all (%d cells)", c.userInfo.Username, cleared)
 	}
-	c.hub.BroadcastToAllRooms("COMMIT_BROADCAST", broadcastPayload, c)
-
-	log.Printf("[Commit] %s broadcast %d changes", c.userInfo.Username, len(changes))
 }
@@ -3,11 +3,15 @@ package internal
 import (
 	"log"
 	"sync"
+
+	"asset-ws/internal/protocol"
 )
 
 type UserPosition struct {
-	Row int `json:"row"`
-	Col int `json:"col"`
+	Row     int    `json:"row"`
+	Col     int    `json:"col"`
+	AssetID string `json:"assetId"`
+	Room    string `json:"room"` // Room the cursor is shown in
 }
 
 type UserPresence struct {
@@ -21,18 +25,56 @@ func NewUserPresence() *UserPresence {
 	}
 }
 
-func (up *UserPresence) Set(client *Client, row, col int) {
+// Set moves a client's cursor and returns the asset it was on before
+func (up *UserPresence) Set(client *Client, row, col int, assetID, room string) (prevAssetID string) {
 	up.mutex.Lock()
 	defer up.mutex.Unlock()
-	up.positions[client] = &UserPosition{Row: row, Col: col}
+	if prev, ok := up.positions[client]; ok {
+		prevAssetID = prev.AssetID
+	}
+	up.positions[client] = &UserPosition{Row: row, Col: col, AssetID: assetID, Room: room}
+	return prevAssetID
 }
 
-func (up *UserPresence) Remove(client *Client) bool {
+// Remove drops a client's cursor and returns it, or nil when it had none
+func (up *UserPresence) Remove(client *Client) *UserPosition {
 	up.mutex.Lock()
 	defer up.mutex.Unlock()
-	_, existed := up.positions[client]
+	pos := up.positions[client]
 	delete(up.positions, client)
-	return existed
+	return pos
+}
+
+// RemoveInRoom drops a client's cursor if it is shown in room. It reports
+// whether the client has no cursor left anywhere.
+func (up *UserPresence) RemoveInRoom(client *Client, room string) bool {
+	up.mutex.Lock()
+	defer up.mutex.Unlock()
+	pos, ok := up.positions[client]
+	if ok && pos.Room == room {
+		delete(up.positions, client)
+		return true
+	}
+	return !ok
+}
+
+// AssignRoom moves a cursor set outside any room into room
+func (up *UserPresence) AssignRoom(client *Client, room string) {
+	up.mutex.Lock()
+	defer up.mutex.Unlock()
+	if pos, ok := up.positions[client]; ok && pos.Room == "" {
+		pos.Room = room
+	}
+}
+
+// Transfer moves a client's position to another client
+func (up *UserPresence) Transfer(from, to *Client) {
+	up.mutex.Lock()
+	defer up.mutex.Unlock()
+	if pos, ok := up.positions[from]; ok {
+		up.positions[to] = pos
+		delete(up.positions, from)
+	}
 }
 
 func (up *UserPresence) GetAllExcept(exclude *Client) map[*Client]*UserPosition {
@@ -41,47 +83,43 @@ func (up *UserPresence) GetAllExcept(exclude *Client) map[*Client]*UserPosition
 	snapshot := make(map[*Client]*UserPosition)
 	for c, pos := range up.positions {
 		if c != exclude {
-			snapshot[c] = &UserPosition{Row: pos.Row, Col: pos.Col}
+			snapshot[c] = &UserPosition{Row: pos.Row, Col: pos.Col, AssetID: pos.AssetID, Room: pos.Room}
 		}
 	}
 	return snapshot
 }
 
-func (c *Client) handlePositionUpdate(payload interface{}) {
-	payloadMap, ok := payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-
-	row, rowOk := payloadMap["row"].(float64)
-	col, colOk := payloadMap["col"].(float64)
-
-	if !rowOk || !colOk || row < 0 || col < 0 {
-		return
-	}
+func (c *Client) handlePositionUpdate(p *protocol.PositionUpdate, room string) {
+	row, col := p.Row, p.Col
 
 	// Update presence for the USER (shared across tabs)
-	c.hub.presence.Set(c, int(row), int(col))
+	prevAssetID := c.hub.presence.Set(c, row, col, p.AssetID.String(), room)
 
 	// log.Printf("[DEBUG] User %s updated position", c.userInfo.Username)
 
-	payloadMap["clientId"] = c.userID // Use UserID as the identifier for other clients
-	payloadMap["userId"] = c.userInfo.UserID
-	payloadMap["username"] = c.userInfo.Username
-	payloadMap["firstname"] = c.userInfo.Firstname
-	payloadMap["lastname"] = c.userInfo.Lastname
-	payloadMap["color"] = c.userInfo.Color
+	// Send to everyone, but exclude THIS specific connection. Clients that
+	// had the old cell in view are told too, so the cursor leaves it.
+	c.hub.BroadcastInView(room, cursorAssets(p.AssetID.String(), prevAssetID), protocol.TypeUserPositionUpdate, c.position(row, col, p.AssetID), c)
+}
 
-	// Send to everyone, but exclude THIS specific connection
-	c.hub.BroadcastToRoom(c.room,"USER_POSITION_UPDATE", payloadMap, c)
+// position builds this client's cursor broadcast
+func (c *Client) position(row, col int, assetID protocol.ID) protocol.UserPosition {
+	return protocol.UserPosition{
+		Row:       row,
+		Col:       col,
+		AssetID:   assetID,
+		ClientID:  c.userID, // Use UserID as the identifier for other clients
+		UserID:    c.userInfo.UserID,
+		Username:  c.userInfo.Username,
+		Firstname: c.userInfo.Firstname,
+		Lastname:  c.userInfo.Lastname,
+		Color:     c.userInfo.Color,
+	}
 }
 
 func (c *Client) handleDeselect() {
-	hadPosition := c.hub.presence.Remove(c)
-
-	if hadPosition {
-		payload := map[string]interface{}{"clientId": c.userID}
-		c.hub.BroadcastToRoom(c.room,"USER_LEFT", payload, c)
+	if pos := c.hub.presence.Remove(c); pos != nil {
+		c.hub.BroadcastToRoom(pos.Room, protocol.TypeUserLeft, protocol.UserLeft{ClientID: c.userID}, c)
 		log.Printf("User %s deselected", c.userInfo.Username)
 	}
 }
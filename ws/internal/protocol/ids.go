@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+)
+
+// ID is an asset or user id. Clients send ids as JSON numbers while the hub
+// keys its maps by string, so ID accepts either form and stores a string.
+// Numeric ids are written back out as numbers.
+type ID string
+
+var idType = reflect.TypeOf(ID(""))
+
+func (id *ID) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*id = ID(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return &json.UnmarshalTypeError{Value: string(data), Type: idType}
+	}
+	*id = ID(n.String())
+	return nil
+}
+
+func (id ID) MarshalJSON() ([]byte, error) {
+	if _, err := strconv.ParseInt(string(id), 10, 64); err == nil {
+		return []byte(id), nil
+	}
+	return json.Marshal(string(id))
+}
+
+// String returns the id as the hub uses it in map keys
+func (id ID) String() string {
+	return string(id)
+}
+
+// CellKey is the "assetId:key" form used to key cell locks and pending cells
+func CellKey(assetID ID, key string) string {
+	return string(assetID) + ":" + key
+}
@@ -0,0 +1,311 @@
+package protocol
+
+import "fmt"
+
+// Inbound message types (client → hub)
+const (
+	TypeUserPositionUpdate       = "USER_POSITION_UPDATE"
+	TypeUserDeselected           = "USER_DESELECTED"
+	TypeCellEditStart            = "CELL_EDIT_START"
+	TypeCellEditEnd              = "CELL_EDIT_END"
+	TypeCellLockHeartbeat        = "CELL_LOCK_HEARTBEAT"
+	TypeCellPending              = "CELL_PENDING"
+	TypeCellPendingClear         = "CELL_PENDING_CLEAR"
+	TypePendingClearAll          = "PENDING_CLEAR_ALL"
+	TypeCommit                   = "COMMIT"
+	TypeClientState              = "CLIENT_STATE"
+	TypeSubscribe                = "SUBSCRIBE"
+	TypeUnsubscribe              = "UNSUBSCRIBE"
+	TypeViewport                 = "VIEWPORT"
+	TypeAuditAssign              = "AUDIT_ASSIGN"
+	TypeAuditComplete            = "AUDIT_COMPLETE"
+	TypeAuditStart               = "AUDIT_START"
+	TypeAuditClose               = "AUDIT_CLOSE"
+	TypeRowLock                  = "ROW_LOCK"
+	TypeRowUnlock                = "ROW_UNLOCK"
+	TypeAdminForceUnlockCell     = "ADMIN_FORCE_UNLOCK_CELL"
+	TypeAdminForceUnlockRow      = "ADMIN_FORCE_UNLOCK_ROW"
+	TypeAdminClearPendingForUser = "ADMIN_CLEAR_PENDING_FOR_USER"
+	TypePing                     = "PING"
+)
+
+// Inbound maps each inbound message type to a constructor for its payload
+var Inbound = map[string]func() Payload{
+	TypeUserPositionUpdate:       func() Payload { return &PositionUpdate{} },
+	TypeUserDeselected:           func() Payload { return &Empty{} },
+	TypeCellEditStart:            func() Payload { return &CellRef{} },
+	TypeCellEditEnd:              func() Payload { return &Empty{} },
+	TypeCellLockHeartbeat:        func() Payload { return &Empty{} },
+	TypeCellPending:              func() Payload { return &CellValue{} },
+	TypeCellPendingClear:         func() Payload { return &CellRef{} },
+	TypePendingClearAll:          func() Payload { return &Empty{} },
+	TypeCommit:                   func() Payload { return &Commit{} },
+	TypeClientState:              func() Payload { return &ClientState{} },
+	TypeSubscribe:                func() Payload { return &Subscribe{} },
+	TypeUnsubscribe:              func() Payload { return &Unsubscribe{} },
+	TypeViewport:                 func() Payload { return &Viewport{} },
+	TypeAuditAssign:              func() Payload { return &AuditAssign{} },
+	TypeAuditComplete:            func() Payload { return &AuditComplete{} },
+	TypeAuditStart:               func() Payload { return &Empty{} },
+	TypeAuditClose:               func() Payload { return &Empty{} },
+	TypeRowLock:                  func() Payload { return &RowRef{} },
+	TypeRowUnlock:                func() Payload { return &RowRef{} },
+	TypeAdminForceUnlockCell:     func() Payload { return &CellRef{} },
+	TypeAdminForceUnlockRow:      func() Payload { return &RowRef{} },
+	TypeAdminClearPendingForUser: func() Payload { return &UserRef{} },
+	TypePing:                     func() Payload { return &Empty{} },
+}
+
+// Empty is the payload of messages that carry no data
+type Empty struct{}
+
+func (p *Empty) Validate() error { return nil }
+
+// PositionUpdate is a user's selected cell. Col is the column index.
+type PositionUpdate struct {
+	Row     int `json:"row"`
+	Col     int `json:"col"`
+	AssetID ID  `json:"assetId,omitempty"`
+}
+
+func (p *PositionUpdate) Validate() error {
+	if p.Row < 0 {
+		return fieldError("row", "must be a non-negative number")
+	}
+	if p.Col < 0 {
+		return fieldError("col", "must be a non-negative number")
+	}
+	return nil
+}
+
+// CellRef identifies a single cell
+type CellRef struct {
+	AssetID ID     `json:"assetId"`
+	Key     string `json:"key"`
+}
+
+func (p *CellRef) Validate() error {
+	if p.AssetID == "" {
+		return fieldError("assetId", "is required")
+	}
+	if p.Key == "" {
+		return fieldError("key", "is required")
+	}
+	return nil
+}
+
+// CellValue is a cell together with the value the user typed into it
+type CellValue struct {
+	AssetID ID     `json:"assetId"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+}
+
+func (p *CellValue) Validate() error {
+	return (&CellRef{AssetID: p.AssetID, Key: p.Key}).Validate()
+}
+
+// RowRef identifies a whole asset row
+type RowRef struct {
+	AssetID ID `json:"assetId"`
+}
+
+func (p *RowRef) Validate() error {
+	if p.AssetID == "" {
+		return fieldError("assetId", "is required")
+	}
+	return nil
+}
+
+// UserRef identifies a user
+type UserRef struct {
+	UserID ID `json:"userId"`
+}
+
+func (p *UserRef) Validate() error {
+	if p.UserID == "" {
+		return fieldError("userId", "is required")
+	}
+	return nil
+}
+
+// CommitChange is one saved cell in a commit. BaseModified is the asset's
+// modified time, to the microsecond, as the client last saw it; the commit
+// is refused if the row has changed since. Every change in a COMMIT needs
+// it; it is left out of the COMMIT_BROADCAST.
+type CommitChange struct {
+	AssetID      ID      `json:"assetId"`
+	Key          string  `json:"key"`
+	Value        *string `json:"value"`
+	BaseModified string  `json:"baseModified,omitempty"`
+}
+
+// maxCommitChanges caps one COMMIT so a single transaction stays short
+const maxCommitChanges = 1000
+
+// Commit asks the hub to save changes to the database
+type Commit struct {
+	Changes []CommitChange `json:"changes"`
+}
+
+func (p *Commit) Validate() error {
+	if len(p.Changes) == 0 {
+		return fieldError("changes", "must not be empty")
+	}
+	if len(p.Changes) > maxCommitChanges {
+		return fieldError("changes", fmt.Sprintf("must not have more than %d entries", maxCommitChanges))
+	}
+	for _, change := range p.Changes {
+		if change.AssetID == "" {
+			return fieldError("changes.assetId", "is required")
+		}
+		if change.Key == "" {
+			return fieldError("changes.key", "is required")
+		}
+		if change.BaseModified == "" {
+			return fieldError("changes.baseModified", "is required")
+		}
+	}
+	return nil
+}
+
+// ClientState is what a reconnecting client still holds locally
+type ClientState struct {
+	Position *PositionUpdate `json:"position,omitempty"`
+	Lock     *CellRef        `json:"lock,omitempty"`
+	Pending  []CellValue     `json:"pending,omitempty"`
+	RowLock  *RowRef         `json:"rowLock,omitempty"`
+}
+
+func (p *ClientState) Validate() error {
+	if p.Position != nil {
+		if err := p.Position.Validate(); err != nil {
+			return prefixField("position", err)
+		}
+	}
+	if p.Lock != nil {
+		if err := p.Lock.Validate(); err != nil {
+			return prefixField("lock", err)
+		}
+	}
+	for i := range p.Pending {
+		if err := p.Pending[i].Validate(); err != nil {
+			return prefixField("pending", err)
+		}
+	}
+	if p.RowLock != nil {
+		if err := p.RowLock.Validate(); err != nil {
+			return prefixField("rowLock", err)
+		}
+	}
+	return nil
+}
+
+// maxSubscribeRooms is how many rooms a client can be in at once
+const maxSubscribeRooms = 16
+
+// Subscribe sets the rooms a client is in: Room for a single one, Rooms for
+// several. Rooms the client was in but are not listed are left. The first
+// room is where messages that name no room act.
+type Subscribe struct {
+	Room  string   `json:"room,omitempty"`
+	Rooms []string `json:"rooms,omitempty"`
+}
+
+func (p *Subscribe) Validate() error {
+	if p.Room != "" && len(p.Rooms) > 0 {
+		return fieldError("rooms", "cannot be combined with room")
+	}
+	if p.Room == "" && len(p.Rooms) == 0 {
+		return fieldError("room", "is required")
+	}
+	if len(p.Rooms) > maxSubscribeRooms {
+		return fieldError("rooms", fmt.Sprintf("must not have more than %d entries", maxSubscribeRooms))
+	}
+	for _, room := range p.Rooms {
+		if room == "" {
+			return fieldError("rooms", "must not contain empty names")
+		}
+	}
+	return nil
+}
+
+// RoomList returns the requested rooms in order, without duplicates
+func (p *Subscribe) RoomList() []string {
+	if p.Room != "" {
+		return []string{p.Room}
+	}
+	rooms := make([]string, 0, len(p.Rooms))
+	seen := make(map[string]bool, len(p.Rooms))
+	for _, room := range p.Rooms {
+		if !seen[room] {
+			seen[room] = true
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
+
+// Unsubscribe leaves one room, or every room when Room is empty
+type Unsubscribe struct {
+	Room string `json:"room,omitempty"`
+}
+
+func (p *Unsubscribe) Validate() error { return nil }
+
+// maxViewportAssets bounds one VIEWPORT; grids render far fewer rows
+const maxViewportAssets = 1000
+
+// Viewport declares the assets a client has rendered. The hub then only
+// sends it cell lock, pending and cursor events about those assets. Without
+// AssetIDs the client gets every event again. Assets are named by id rather
+// than row because each client sorts and filters the grid its own way.
+type Viewport struct {
+	AssetIDs []ID `json:"assetIds,omitempty"`
+}
+
+func (p *Viewport) Validate() error {
+	if len(p.AssetIDs) > maxViewportAssets {
+		return fieldError("assetIds", fmt.Sprintf("must not have more than %d entries", maxViewportAssets))
+	}
+	for _, id := range p.AssetIDs {
+		if id == "" {
+			return fieldError("assetIds", "must not contain empty ids")
+		}
+	}
+	return nil
+}
+
+// AuditAssign assigns assets to an auditor
+type AuditAssign struct {
+	AssetIDs    []int64 `json:"assetIds"`
+	UserID      int64   `json:"userId"`
+	AuditorName string  `json:"auditorName"`
+}
+
+func (p *AuditAssign) Validate() error {
+	if len(p.AssetIDs) == 0 {
+		return fieldError("assetIds", "must not be empty")
+	}
+	return nil
+}
+
+// AuditComplete marks one audited asset as done
+type AuditComplete struct {
+	AssetID        int64 `json:"assetId"`
+	CompletedCount int   `json:"completedCount"`
+}
+
+func (p *AuditComplete) Validate() error {
+	if p.AssetID <= 0 {
+		return fieldError("assetId", "must be a positive number")
+	}
+	return nil
+}
+
+func prefixField(prefix string, err error) error {
+	if verr, ok := err.(*ValidationError); ok {
+		return &ValidationError{Field: prefix + "." + verr.Field, Reason: verr.Reason}
+	}
+	return err
+}
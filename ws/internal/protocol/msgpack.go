@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgpackSubprotocol is the Sec-WebSocket-Protocol a client asks for to
+// exchange MessagePack in binary frames instead of JSON. Messages keep the
+// shape and key names of their JSON form.
+const MsgpackSubprotocol = "asset-ws.msgpack.v1"
+
+// MarshalMsgpack encodes an outbound Message. A payload relayed from another
+// instance as json.RawMessage is decoded to its registered type first.
+func MarshalMsgpack(msg Message) ([]byte, error) {
+	if raw, ok := msg.Payload.(json.RawMessage); ok {
+		payload, err := decodeRelayed(msg.Type, raw)
+		if err != nil {
+			return nil, err
+		}
+		msg.Payload = payload
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(enc)
+	enc.Reset(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeRelayed turns a JSON payload into the payload type of msgType, or
+// into plain maps and slices for a type missing from Outbound
+func decodeRelayed(msgType string, raw json.RawMessage) (interface{}, error) {
+	if example, ok := Outbound[msgType]; ok {
+		payload := reflect.New(reflect.TypeOf(example))
+		if err := json.Unmarshal(raw, payload.Interface()); err != nil {
+			return nil, err
+		}
+		return payload.Elem().Interface(), nil
+	}
+	var payload interface{}
+	err := json.Unmarshal(raw, &payload)
+	return payload, err
+}
+
+// msgpackEnvelope is envelope for binary frames
+type msgpackEnvelope struct {
+	Type      string             `msgpack:"type"`
+	RequestID string             `msgpack:"requestId"`
+	Room      string             `msgpack:"room"`
+	Payload   msgpack.RawMessage `msgpack:"payload"`
+}
+
+// DecodeMsgpack is Decode for a message sent in a binary frame
+func DecodeMsgpack(data []byte) (Request, error) {
+	var env msgpackEnvelope
+	if err := msgpack.Unmarshal(data, &env); err != nil {
+		return Request{}, &ValidationError{Reason: "message is not valid MessagePack"}
+	}
+	return decodeRequest(Request{Type: env.Type, RequestID: env.RequestID, Room: env.Room}, func(payload Payload) *ValidationError {
+		// Absent or nil
+		if len(env.Payload) == 0 || bytes.Equal(env.Payload, []byte{0xc0}) {
+			return nil
+		}
+		dec := msgpack.GetDecoder()
+		defer msgpack.PutDecoder(dec)
+		dec.Reset(bytes.NewReader(env.Payload))
+		dec.SetCustomStructTag("json")
+		if err := dec.Decode(payload); err != nil {
+			return &ValidationError{Type: env.Type, Field: "payload", Reason: "is malformed"}
+		}
+		return nil
+	})
+}
+
+// EncodeMsgpack writes numeric ids as integers, like MarshalJSON
+func (id ID) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if n, err := strconv.ParseInt(string(id), 10, 64); err == nil {
+		return enc.EncodeInt(n)
+	}
+	return enc.EncodeString(string(id))
+}
+
+// DecodeMsgpack accepts an integer, float or string id. Encoders may send
+// whole numbers as floats; those are read back as integers.
+func (id *ID) DecodeMsgpack(dec *msgpack.Decoder) error {
+	v, err := dec.DecodeInterfaceLoose()
+	if err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case nil:
+	case string:
+		*id = ID(v)
+	case int64:
+		*id = ID(strconv.FormatInt(v, 10))
+	case uint64:
+		*id = ID(strconv.FormatUint(v, 10))
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			*id = ID(strconv.FormatInt(int64(v), 10))
+		} else {
+			*id = ID(strconv.FormatFloat(v, 'f', -1, 64))
+		}
+	default:
+		return fmt.Errorf("id must be a number or string, got %T", v)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// packed encodes v as a msgpack test input
+func packed(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := msgpack.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestIDMsgpackRoundTrip(t *testing.T) {
+	type holder struct {
+		ID ID `msgpack:"id"`
+	}
+	tests := []struct {
+		id ID
+		// What the id is written as
+		wire interface{}
+	}{
+		{"5", int8(5)},
+		{"-3", int8(-3)},
+		{"1099511627776", uint64(1099511627776)},
+		{"A-7", "A-7"},
+		{"1.5", "1.5"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		data := packed(t, holder{ID: tt.id})
+
+		var raw map[string]interface{}
+		if err := msgpack.Unmarshal(data, &raw); err != nil {
+			t.Fatal(err)
+		}
+		if raw["id"] != tt.wire {
+			t.Errorf("%q written as %#v, want %#v", tt.id, raw["id"], tt.wire)
+		}
+
+		var back holder
+		if err := msgpack.Unmarshal(data, &back); err != nil || back.ID != tt.id {
+			t.Errorf("%q read back as %q (%v)", tt.id, back.ID, err)
+		}
+	}
+}
+
+func TestIDMsgpackDecode(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  ID
+	}{
+		{int64(42), "42"},
+		{uint64(1 << 63), "9223372036854775808"},
+		{float64(5), "5"},
+		{float32(7), "7"},
+		{float64(-12), "-12"},
+		{float64(1.5), "1.5"},
+		{"42", "42"},
+		{[]byte("A-7"), "A-7"},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		var got struct {
+			ID ID `msgpack:"id"`
+		}
+		err := msgpack.Unmarshal(packed(t, map[string]interface{}{"id": tt.value}), &got)
+		if err != nil || got.ID != tt.want {
+			t.Errorf("%#v: got %q (%v), want %q", tt.value, got.ID, err, tt.want)
+		}
+	}
+
+	for _, bad := range []interface{}{true, []int{5}, map[string]int{"id": 5}} {
+		var got struct {
+			ID ID `msgpack:"id"`
+		}
+		if err := msgpack.Unmarshal(packed(t, map[string]interface{}{"id": bad}), &got); err == nil {
+			t.Errorf("%#v decoded as id %q", bad, got.ID)
+		}
+	}
+}
+
+func TestDecodeMsgpack(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  map[string]interface{}
+		want Request
+	}{
+		{
+			"integer id",
+			map[string]interface{}{"type": TypeCellEditStart, "requestId": "r1", "room": "grid", "payload": map[string]interface{}{"assetId": 5, "key": "model"}},
+			Request{Type: TypeCellEditStart, RequestID: "r1", Room: "grid", Payload: &CellRef{AssetID: "5", Key: "model"}},
+		},
+		{
+			"float id",
+			map[string]interface{}{"type": TypeRowLock, "payload": map[string]interface{}{"assetId": 5.0}},
+			Request{Type: TypeRowLock, Payload: &RowRef{AssetID: "5"}},
+		},
+		{
+			"string id",
+			map[string]interface{}{"type": TypeRowLock, "payload": map[string]interface{}{"assetId": "A-7"}},
+			Request{Type: TypeRowLock, Payload: &RowRef{AssetID: "A-7"}},
+		},
+		{
+			"nil payload",
+			map[string]interface{}{"type": TypePing, "payload": nil},
+			Request{Type: TypePing, Payload: &Empty{}},
+		},
+		{
+			"no payload",
+			map[string]interface{}{"type": TypeCellEditEnd},
+			Request{Type: TypeCellEditEnd, Payload: &Empty{}},
+		},
+		{
+			"nested payloads",
+			map[string]interface{}{"type": TypeCommit, "payload": map[string]interface{}{"changes": []interface{}{
+				map[string]interface{}{"assetId": 5, "key": "model", "value": nil, "baseModified": "2026-01-01 00:00:00.000000"},
+			}}},
+			Request{Type: TypeCommit, Payload: &Commit{Changes: []CommitChange{
+				{AssetID: "5", Key: "model", BaseModified: "2026-01-01 00:00:00.000000"},
+			}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeMsgpack(packed(t, tt.msg))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeMsgpackErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want ValidationError
+	}{
+		{"not msgpack", []byte{0xc1, 0x00}, ValidationError{Reason: "message is not valid MessagePack"}},
+		{"truncated", packed(t, map[string]interface{}{"type": TypePing})[:4], ValidationError{Reason: "message is not valid MessagePack"}},
+		{"not a map", packed(t, []string{TypePing}), ValidationError{Reason: "message is not valid MessagePack"}},
+		{"no type", packed(t, map[string]interface{}{"payload": nil}), ValidationError{Field: "type", Reason: "is required"}},
+		{"unknown type", packed(t, map[string]interface{}{"type": "NOPE"}), ValidationError{Type: "NOPE", Field: "type", Reason: "unknown message type"}},
+		{"id of the wrong type",
+			packed(t, map[string]interface{}{"type": TypeRowLock, "payload": map[string]interface{}{"assetId": true}}),
+			ValidationError{Type: TypeRowLock, Field: "payload", Reason: "is malformed"}},
+		{"payload not a map",
+			packed(t, map[string]interface{}{"type": TypeRowLock, "payload": "5"}),
+			ValidationError{Type: TypeRowLock, Field: "payload", Reason: "is malformed"}},
+		{"nil payload that needs fields",
+			packed(t, map[string]interface{}{"type": TypeCellEditStart, "payload": nil}),
+			ValidationError{Type: TypeCellEditStart, Field: "assetId", Reason: "is required"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeMsgpack(tt.data)
+			var verr *ValidationError
+			if !errors.As(err, &verr) || *verr != tt.want {
+				t.Fatalf("got %v, want %v", err, &tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalMsgpack(t *testing.T) {
+	locked := CellLocked{AssetID: "5", Key: "model", Holder: Holder{UserID: "1", Firstname: "Ann"}}
+	relayed, err := json.Marshal(locked)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A local payload and the same one relayed as JSON encode alike
+	var frames [][]byte
+	for _, payload := range []interface{}{locked, json.RawMessage(relayed)} {
+		data, err := MarshalMsgpack(Message{Type: TypeCellLocked, Seq: 9, Rooms: []string{"grid"}, Payload: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, data)
+	}
+	if !reflect.DeepEqual(frames[0], frames[1]) {
+		t.Error("relayed payload encoded differently")
+	}
+
+	var msg map[string]interface{}
+	if err := msgpack.Unmarshal(frames[0], &msg); err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := msg["payload"].(map[string]interface{})
+	if msg["type"] != TypeCellLocked || msg["seq"] != int8(9) || payload["assetId"] != int8(5) || payload["key"] != "model" {
+		t.Errorf("decoded %#v", msg)
+	}
+
+	// Types missing from Outbound still relay, as plain maps
+	data, err := MarshalMsgpack(Message{Type: "SOMETHING_NEW", Payload: json.RawMessage(`{"a":[1,"b"]}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msgpack.Unmarshal(data, &msg); err != nil || !reflect.DeepEqual(msg["payload"], map[string]interface{}{"a": []interface{}{1.0, "b"}}) {
+		t.Errorf("unregistered type decoded as %#v (%v)", msg, err)
+	}
+
+	if _, err := MarshalMsgpack(Message{Type: TypeCellLocked, Payload: json.RawMessage(`{"assetId":`)}); err == nil {
+		t.Error("malformed relayed payload encoded")
+	}
+}
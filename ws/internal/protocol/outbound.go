@@ -0,0 +1,341 @@
+package protocol
+
+import "errors"
+
+// Outbound message types (hub → client)
+const (
+	TypeWelcome                = "WELCOME"
+	TypeExistingUsers          = "EXISTING_USERS"
+	TypeViewportState          = "VIEWPORT_STATE"
+	TypeUserLeft               = "USER_LEFT"
+	TypeUserAway               = "USER_AWAY"
+	TypeUserReturned           = "USER_RETURNED"
+	TypeCellLocked             = "CELL_LOCKED"
+	TypeCellUnlocked           = "CELL_UNLOCKED"
+	TypeCellLockExpired        = "CELL_LOCK_EXPIRED"
+	TypeCellLockRevoked        = "CELL_LOCK_REVOKED"
+	TypePendingBroadcast       = "PENDING_BROADCAST"
+	TypePendingClearBroadcast  = "PENDING_CLEAR_BROADCAST"
+	TypePendingRevoked         = "PENDING_REVOKED"
+	TypeCommitBroadcast        = "COMMIT_BROADCAST"
+	TypeCommitConflict         = "COMMIT_CONFLICT"
+	TypeRowsChanged            = "ROWS_CHANGED"
+	TypeClientStateReconciled  = "CLIENT_STATE_RECONCILED"
+	TypeAuditAssignBroadcast   = "AUDIT_ASSIGN_BROADCAST"
+	TypeAuditCompleteBroadcast = "AUDIT_COMPLETE_BROADCAST"
+	TypeAuditStartBroadcast    = "AUDIT_START_BROADCAST"
+	TypeAuditCloseBroadcast    = "AUDIT_CLOSE_BROADCAST"
+	TypeRowLocked              = "ROW_LOCKED"
+	TypeRowUnlocked            = "ROW_UNLOCKED"
+	TypeRowLockRejected        = "ROW_LOCK_REJECTED"
+	TypeRowLockRevoked         = "ROW_LOCK_REVOKED"
+	TypeResyncRequired         = "RESYNC_REQUIRED"
+	TypeServerShutdown         = "SERVER_SHUTDOWN"
+	TypeSessionExpired         = "SESSION_EXPIRED"
+	TypeAck                    = "ACK"
+	TypeError                  = "ERROR"
+)
+
+// USER_POSITION_UPDATE shares its type name with the inbound message it
+// answers; see TypeUserPositionUpdate.
+
+// Outbound maps each outbound message type to its payload type. It is read
+// by the TypeScript generator, and by MarshalMsgpack to type the payloads
+// relayed by other instances.
+var Outbound = map[string]interface{}{
+	TypeWelcome:                Welcome{},
+	TypeExistingUsers:          ExistingUsers{},
+	TypeViewportState:          ViewportState{},
+	TypeUserPositionUpdate:     UserPosition{},
+	TypeUserLeft:               UserLeft{},
+	TypeUserAway:               UserAway{},
+	TypeUserReturned:           UserAway{},
+	TypeCellLocked:             CellLocked{},
+	TypeCellUnlocked:           CellRef{},
+	TypeCellLockExpired:        CellRef{},
+	TypeCellLockRevoked:        CellLockRevoked{},
+	TypePendingBroadcast:       PendingCell{},
+	TypePendingClearBroadcast:  PendingClear{},
+	TypePendingRevoked:         PendingRevoked{},
+	TypeCommitBroadcast:        CommittedChanges{},
+	TypeCommitConflict:         CommitConflict{},
+	TypeRowsChanged:            RowsChanged{},
+	TypeClientStateReconciled:  ClientStateReconciled{},
+	TypeAuditAssignBroadcast:   AuditAssign{},
+	TypeAuditCompleteBroadcast: AuditComplete{},
+	TypeAuditStartBroadcast:    Empty{},
+	TypeAuditCloseBroadcast:    Empty{},
+	TypeRowLocked:              RowLocked{},
+	TypeRowUnlocked:            RowRef{},
+	TypeRowLockRejected:        RowLockRejected{},
+	TypeRowLockRevoked:         RowLockRevoked{},
+	TypeResyncRequired:         ResyncRequired{},
+	TypeServerShutdown:         ServerShutdown{},
+	TypeSessionExpired:         Empty{},
+	TypeAck:                    Ack{},
+	TypeError:                  ErrorReply{},
+}
+
+// Holder is the user holding a lock or pending cell
+type Holder struct {
+	UserID    string `json:"userId"`
+	Firstname string `json:"firstname"`
+	Lastname  string `json:"lastname"`
+	Color     string `json:"color"`
+}
+
+// Actor is the admin behind a forced release
+type Actor struct {
+	UserID    string `json:"userId"`
+	Firstname string `json:"firstname"`
+	Lastname  string `json:"lastname"`
+}
+
+// Welcome is sent once, right after the upgrade
+type Welcome struct {
+	ClientID  string `json:"clientId"`
+	UserID    int64  `json:"userId"`
+	Username  string `json:"username"`
+	Firstname string `json:"firstname"`
+	Lastname  string `json:"lastname"`
+	Role      int    `json:"role"`
+	Color     string `json:"color"`
+	// Hub instance serving the connection; sent back as resume_instance
+	Instance string `json:"instance"`
+}
+
+// PresentUser is another user's cursor in an EXISTING_USERS snapshot
+type PresentUser struct {
+	Row       int    `json:"row"`
+	Col       int    `json:"col"`
+	AssetID   ID     `json:"assetId,omitempty"`
+	UserID    int64  `json:"userId"`
+	Username  string `json:"username"`
+	Firstname string `json:"firstname"`
+	Lastname  string `json:"lastname"`
+	Color     string `json:"color"`
+	Away      bool   `json:"away,omitempty"`
+}
+
+// ExistingUsers is the room snapshot sent after SUBSCRIBE, one per room
+type ExistingUsers struct {
+	Room         string                 `json:"room"`
+	Users        map[string]PresentUser `json:"users"`
+	LockedCells  map[string]Holder      `json:"lockedCells"`
+	PendingCells map[string]PendingCell `json:"pendingCells"`
+	RowLocks     map[string]Holder      `json:"rowLocks"`
+}
+
+// ViewportState catches a client up on the assets a VIEWPORT brought into
+// view. Its locked and pending cells replace what the client knew about
+// AssetIDs; Users is where every cursor is now.
+type ViewportState struct {
+	AssetIDs     []ID                   `json:"assetIds"`
+	Users        map[string]PresentUser `json:"users"`
+	LockedCells  map[string]Holder      `json:"lockedCells"`
+	PendingCells map[string]PendingCell `json:"pendingCells"`
+}
+
+// UserPosition is a user's cursor broadcast to the room
+type UserPosition struct {
+	Row       int    `json:"row"`
+	Col       int    `json:"col"`
+	AssetID   ID     `json:"assetId,omitempty"`
+	ClientID  string `json:"clientId"`
+	UserID    int64  `json:"userId"`
+	Username  string `json:"username"`
+	Firstname string `json:"firstname"`
+	Lastname  string `json:"lastname"`
+	Color     string `json:"color"`
+}
+
+// UserLeft tells the room a user's cursor is gone
+type UserLeft struct {
+	ClientID string `json:"clientId"`
+}
+
+// UserAway marks a user whose connection dropped but whose locks are held for
+// a reconnect (USER_AWAY), or who came back in time (USER_RETURNED)
+type UserAway struct {
+	ClientID string `json:"clientId"`
+}
+
+// CellLocked is a granted lock, or the lock that blocked an edit
+type CellLocked struct {
+	AssetID ID     `json:"assetId"`
+	Key     string `json:"key"`
+	Holder
+}
+
+// CellLockRevoked tells the owner an admin released its cell lock
+type CellLockRevoked struct {
+	AssetID ID     `json:"assetId"`
+	Key     string `json:"key"`
+	By      Actor  `json:"by"`
+}
+
+// PendingCell is a cell with an unsaved edit
+type PendingCell struct {
+	AssetID ID     `json:"assetId"`
+	Key     string `json:"key"`
+	Holder
+}
+
+// PendingClear releases one pending cell (AssetID/Key) or several (Cells)
+type PendingClear struct {
+	AssetID ID        `json:"assetId,omitempty"`
+	Key     string    `json:"key,omitempty"`
+	UserID  string    `json:"userId,omitempty"`
+	Cells   []CellRef `json:"cells,omitempty"`
+}
+
+// PendingRevoked tells the owner an admin released its pending cells
+type PendingRevoked struct {
+	Cells []CellRef `json:"cells"`
+	By    Actor     `json:"by"`
+}
+
+// CommittedChanges is a commit the hub wrote to the database, sent to every room
+type CommittedChanges struct {
+	UserID     string         `json:"userId"`
+	ModifiedBy string         `json:"modifiedBy"`
+	Modified   string         `json:"modified"`
+	Changes    []CommitChange `json:"changes"`
+}
+
+// RowChange is a row of an asset table changed in the database by any
+// writer, as read from the binlog. Values holds grid keys for updates (only
+// the columns that changed) and inserts; it is empty for deletes.
+type RowChange struct {
+	Table   string             `json:"table"`
+	Action  string             `json:"action"`
+	AssetID ID                 `json:"assetId"`
+	Values  map[string]*string `json:"values,omitempty"`
+}
+
+// RowsChanged carries the watched rows of one database transaction
+type RowsChanged struct {
+	Changes []RowChange `json:"changes"`
+}
+
+// CellConflict is a committed cell whose row changed after the client loaded
+// it: the value now in the database and the row's modified and modified_by.
+// ChangedKey is Key if that cell itself changed since, otherwise another
+// cell of the row that did; it is empty if change_log does not say.
+type CellConflict struct {
+	AssetID    ID      `json:"assetId"`
+	Key        string  `json:"key"`
+	Value      *string `json:"value"`
+	Modified   string  `json:"modified"`
+	ModifiedBy string  `json:"modifiedBy"`
+	ChangedKey string  `json:"changedKey,omitempty"`
+}
+
+// CommitConflict rejects a whole COMMIT because some of its rows are stale
+type CommitConflict struct {
+	RequestID string         `json:"requestId,omitempty"`
+	Conflicts []CellConflict `json:"conflicts"`
+}
+
+// Conflict is a piece of client state the hub could not restore
+type Conflict struct {
+	Type      string `json:"type"` // "lock", "pending" or "rowLock"
+	AssetID   ID     `json:"assetId"`
+	Key       string `json:"key,omitempty"`
+	HeldBy    string `json:"heldBy,omitempty"`
+	Firstname string `json:"firstname,omitempty"`
+	Lastname  string `json:"lastname,omitempty"`
+}
+
+// ClientStateReconciled answers CLIENT_STATE
+type ClientStateReconciled struct {
+	Conflicts []Conflict `json:"conflicts"`
+}
+
+// RowLocked is a granted row lock
+type RowLocked struct {
+	AssetID ID `json:"assetId"`
+	Holder
+}
+
+// RowLockRejected explains why a ROW_LOCK was refused
+type RowLockRejected struct {
+	AssetID   ID     `json:"assetId"`
+	Reason    string `json:"reason"` // "row_locked" or "row_being_edited"
+	Firstname string `json:"firstname"`
+	Lastname  string `json:"lastname"`
+}
+
+// RowLockRevoked tells the owner an admin released its row lock
+type RowLockRevoked struct {
+	AssetID ID    `json:"assetId"`
+	By      Actor `json:"by"`
+}
+
+// ResyncRequired tells a resuming client its missed events are gone and it
+// must reload the room's data
+type ResyncRequired struct {
+	Room string `json:"room"`
+}
+
+// ServerShutdown warns that the hub is going away. Clients should wait
+// about ReconnectAfterMs (plus some jitter) before reconnecting.
+type ServerShutdown struct {
+	ReconnectAfterMs int64 `json:"reconnectAfterMs"`
+}
+
+// Ack confirms that a message sent with a requestId was applied
+type Ack struct {
+	RequestID string `json:"requestId"`
+	Type      string `json:"type"`
+}
+
+// ErrorReply reports a rejected inbound message to its sender
+type ErrorReply struct {
+	RequestID string `json:"requestId,omitempty"`
+	Type      string `json:"type"`
+	Code      string `json:"code"`
+	Field     string `json:"field,omitempty"`
+	Message   string `json:"message"`
+}
+
+// Error codes are stable identifiers the client can branch on; the message
+// next to them is for humans and may change.
+const (
+	CodeInvalidMessage = "INVALID_MESSAGE"  // payload failed validation
+	CodeForbidden      = "FORBIDDEN"        // role too low for this message
+	CodeRateLimited    = "RATE_LIMITED"     // message dropped by the rate limiter
+	CodeUnknownRoom    = "UNKNOWN_ROOM"     // SUBSCRIBE to a room that does not exist
+	CodeNotSubscribed  = "NOT_SUBSCRIBED"   // message names a room the client is not in
+	CodeCellLocked     = "CELL_LOCKED"      // another user is editing the cell
+	CodeCellPending    = "CELL_PENDING"     // another user has an unsaved edit in the cell
+	CodeRowLocked      = "ROW_LOCKED"       // another user holds the row lock
+	CodeRowBeingEdited = "ROW_BEING_EDITED" // a cell in the row is being edited
+	CodeNotHeld        = "NOT_HELD"         // releasing something the client does not hold
+	CodeNotFound       = "NOT_FOUND"        // target asset, lock or user does not exist
+	CodeInvalidValue   = "INVALID_VALUE"    // the database would not accept a committed value
+	CodeDuplicate      = "DUPLICATE"        // a committed value must be unique and is taken
+	CodeCommitConflict = "COMMIT_CONFLICT"  // a committed row changed since the client loaded it
+	CodeInternal       = "INTERNAL"         // server-side failure
+)
+
+// NewErrorReply builds the ERROR payload for a request that failed with err
+func NewErrorReply(req Request, err error) ErrorReply {
+	reply := ErrorReply{RequestID: req.RequestID, Type: req.Type}
+
+	var verr *ValidationError
+	var reject *Reject
+	switch {
+	case errors.As(err, &verr):
+		reply.Code = CodeInvalidMessage
+		reply.Field = verr.Field
+		reply.Message = verr.Error()
+	case errors.As(err, &reject):
+		reply.Code = reject.Code
+		reply.Message = reject.Message
+	default:
+		reply.Code = CodeInternal
+		reply.Message = "Something went wrong on the server"
+	}
+	return reply
+}
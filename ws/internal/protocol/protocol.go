@@ -0,0 +1,204 @@
+// Package protocol defines every message exchanged over /api/ws as a Go type.
+//
+// Inbound messages (client → hub) are decoded with Decode, which picks the
+// payload type from the envelope's "type" field and validates it. Outbound
+// messages (hub → client) are plain structs wrapped in a Message. Clients
+// that negotiate MsgpackSubprotocol use DecodeMsgpack and MarshalMsgpack
+// for the same messages.
+//
+// The TypeScript definitions used by the Svelte realtimeManager are generated
+// from the registries in this package:
+//
+//go:generate go run ../../cmd/protogen -out ../../../frontend/src/lib/utils/realtimeProtocol.ts
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Message is the envelope written to clients. Room broadcasts carry a Seq
+// and the Rooms whose streams it belongs to, every room when there are
+// none. The client passes the last seq of each room back as ?resume_from
+// after reconnecting.
+type Message struct {
+	Type    string      `json:"type"`
+	Seq     uint64      `json:"seq,omitempty"`
+	Rooms   []string    `json:"rooms,omitempty"`
+	Payload interface{} `json:"payload"`
+}
+
+// envelope is the raw shape of an inbound message before its payload is typed
+type envelope struct {
+	Type      string          `json:"type"`
+	RequestID string          `json:"requestId,omitempty"`
+	Room      string          `json:"room,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// Request is a decoded inbound message. RequestID is optional; when the
+// client sets it, the hub answers with an ACK or ERROR carrying the same id.
+// Room names which of the client's rooms the message acts in; empty means
+// the first room it subscribed to.
+type Request struct {
+	Type      string
+	RequestID string
+	Room      string
+	Payload   Payload
+}
+
+// Payload is implemented by every inbound payload type
+type Payload interface {
+	Validate() error
+}
+
+// Decode parses an inbound message, picks its payload type from the "type"
+// field and validates it. Failures are returned as *ValidationError together
+// with whatever of the envelope could be read, so the error can still be
+// correlated with the client's requestId.
+func Decode(data []byte) (Request, error) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return Request{}, &ValidationError{Reason: "message is not valid JSON"}
+	}
+	return decodeRequest(Request{Type: env.Type, RequestID: env.RequestID, Room: env.Room}, func(payload Payload) *ValidationError {
+		if len(env.Payload) == 0 || bytes.Equal(env.Payload, []byte("null")) {
+			return nil
+		}
+		if err := json.Unmarshal(env.Payload, payload); err != nil {
+			verr := decodeError(env.Type, err)
+			if verr.Field == "" {
+				verr.Field = locateIDField(payload, env.Payload)
+			}
+			return verr
+		}
+		return nil
+	})
+}
+
+// decodeRequest types and validates the payload of an envelope read into
+// req, whatever its encoding
+func decodeRequest(req Request, unmarshal func(Payload) *ValidationError) (Request, error) {
+	if req.Type == "" {
+		return req, &ValidationError{Field: "type", Reason: "is required"}
+	}
+
+	newPayload, ok := Inbound[req.Type]
+	if !ok {
+		return req, &ValidationError{Type: req.Type, Field: "type", Reason: "unknown message type"}
+	}
+
+	payload := newPayload()
+	if verr := unmarshal(payload); verr != nil {
+		return req, verr
+	}
+
+	if err := payload.Validate(); err != nil {
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			verr.Type = req.Type
+			return req, verr
+		}
+		return req, &ValidationError{Type: req.Type, Reason: err.Error()}
+	}
+
+	req.Payload = payload
+	return req, nil
+}
+
+// decodeError turns a json.Unmarshal failure into a field-level ValidationError
+func decodeError(msgType string, err error) *ValidationError {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		reason := fmt.Sprintf("must be %s", jsonKind(typeErr.Type.Kind().String()))
+		if typeErr.Type == idType {
+			reason = "must be a number or string"
+		}
+		return &ValidationError{Type: msgType, Field: typeErr.Field, Reason: reason}
+	}
+	return &ValidationError{Type: msgType, Field: "payload", Reason: "is malformed"}
+}
+
+// locateIDField finds which top-level id field failed to decode, since
+// encoding/json attaches no field context to errors from custom unmarshalers
+func locateIDField(payload Payload, raw json.RawMessage) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return ""
+	}
+
+	t := reflect.TypeOf(payload).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Type != idType {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		var id ID
+		if value, ok := fields[name]; ok && json.Unmarshal(value, &id) != nil {
+			return name
+		}
+	}
+	return ""
+}
+
+func jsonKind(goKind string) string {
+	switch goKind {
+	case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64", "float32", "float64":
+		return "a number"
+	case "string":
+		return "a string"
+	case "bool":
+		return "a boolean"
+	case "slice", "array":
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// ValidationError describes why an inbound message was rejected. It is sent
+// back to the client as an ERROR message.
+type ValidationError struct {
+	Type   string
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	switch {
+	case e.Field != "" && e.Type != "":
+		return fmt.Sprintf("%s: %s %s", e.Type, e.Field, e.Reason)
+	case e.Field != "":
+		return fmt.Sprintf("%s %s", e.Field, e.Reason)
+	case e.Type != "":
+		return fmt.Sprintf("%s: %s", e.Type, e.Reason)
+	default:
+		return e.Reason
+	}
+}
+
+// fieldError is a shorthand for Validate implementations
+func fieldError(field, reason string) error {
+	return &ValidationError{Field: field, Reason: reason}
+}
+
+// Reject is a handler's refusal to carry out a valid message. It reaches the
+// client as an ERROR message with a stable code.
+type Reject struct {
+	Code    string
+	Message string
+}
+
+func (r *Reject) Error() string {
+	return r.Code + ": " + r.Message
+}
+
+// Rejectf builds a Reject with a formatted human-readable message
+func Rejectf(code, format string, args ...interface{}) *Reject {
+	return &Reject{Code: code, Message: fmt.Sprintf(format, args...)}
+}
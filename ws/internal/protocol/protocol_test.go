@@ -0,0 +1,244 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want Request
+	}{
+		{
+			"numeric id",
+			`{"type":"CELL_EDIT_START","requestId":"r1","room":"grid","payload":{"assetId":5,"key":"model"}}`,
+			Request{Type: TypeCellEditStart, RequestID: "r1", Room: "grid", Payload: &CellRef{AssetID: "5", Key: "model"}},
+		},
+		{
+			"string id",
+			`{"type":"ROW_LOCK","payload":{"assetId":"A-7"}}`,
+			Request{Type: TypeRowLock, Payload: &RowRef{AssetID: "A-7"}},
+		},
+		{
+			"no payload",
+			`{"type":"PING"}`,
+			Request{Type: TypePing, Payload: &Empty{}},
+		},
+		{
+			"null payload",
+			`{"type":"CELL_EDIT_END","payload":null}`,
+			Request{Type: TypeCellEditEnd, Payload: &Empty{}},
+		},
+		{
+			"nested payloads",
+			`{"type":"CLIENT_STATE","payload":{"lock":{"assetId":5,"key":"model"},"pending":[{"assetId":6,"key":"serial_number","value":"SN"}]}}`,
+			Request{Type: TypeClientState, Payload: &ClientState{
+				Lock:    &CellRef{AssetID: "5", Key: "model"},
+				Pending: []CellValue{{AssetID: "6", Key: "serial_number", Value: "SN"}},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		want      ValidationError
+		requestID string
+	}{
+		{"not JSON", `{"type":`, ValidationError{Reason: "message is not valid JSON"}, ""},
+		{"no type", `{"payload":{}}`, ValidationError{Field: "type", Reason: "is required"}, ""},
+		{"unknown type", `{"type":"NOPE","requestId":"r2"}`, ValidationError{Type: "NOPE", Field: "type", Reason: "unknown message type"}, "r2"},
+		{"wrong field type", `{"type":"USER_POSITION_UPDATE","requestId":"r3","payload":{"row":"3","col":1}}`,
+			ValidationError{Type: TypeUserPositionUpdate, Field: "row", Reason: "must be a number"}, "r3"},
+		{"id of the wrong type", `{"type":"CELL_EDIT_START","payload":{"assetId":true,"key":"model"}}`,
+			ValidationError{Type: TypeCellEditStart, Field: "assetId", Reason: "must be a number or string"}, ""},
+		{"payload not an object", `{"type":"CELL_EDIT_START","payload":"5:model"}`,
+			ValidationError{Type: TypeCellEditStart, Reason: "must be an object"}, ""},
+		{"array instead of string", `{"type":"SUBSCRIBE","payload":{"room":["grid"]}}`,
+			ValidationError{Type: TypeSubscribe, Field: "room", Reason: "must be a string"}, ""},
+		{"invalid after decoding", `{"type":"ROW_LOCK","requestId":"r4","payload":{}}`,
+			ValidationError{Type: TypeRowLock, Field: "assetId", Reason: "is required"}, "r4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := Decode([]byte(tt.data))
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("got %v, want a ValidationError", err)
+			}
+			if *verr != tt.want {
+				t.Errorf("got %+v, want %+v", *verr, tt.want)
+			}
+			if req.RequestID != tt.requestID {
+				t.Errorf("requestId %q, want %q", req.RequestID, tt.requestID)
+			}
+			if req.Payload != nil {
+				t.Errorf("rejected message has payload %+v", req.Payload)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	changes := func(n int) string {
+		change := `{"assetId":5,"key":"model","value":"X","baseModified":"2026-01-01 00:00:00.000000"}`
+		return `{"changes":[` + strings.TrimSuffix(strings.Repeat(change+",", n), ",") + `]}`
+	}
+	tests := []struct {
+		msgType string
+		payload string
+		field   string
+		reason  string
+	}{
+		{TypeUserPositionUpdate, `{"row":-1,"col":0}`, "row", "must be a non-negative number"},
+		{TypeUserPositionUpdate, `{"row":0,"col":-1}`, "col", "must be a non-negative number"},
+		{TypeUserPositionUpdate, `{"row":3,"col":1,"assetId":5}`, "", ""},
+		{TypeCellEditStart, `{"key":"model"}`, "assetId", "is required"},
+		{TypeCellEditStart, `{"assetId":5}`, "key", "is required"},
+		{TypeCellPending, `{"assetId":5,"value":"X"}`, "key", "is required"},
+		{TypeRowUnlock, `{"assetId":""}`, "assetId", "is required"},
+		{TypeAdminClearPendingForUser, `{}`, "userId", "is required"},
+		{TypeAdminClearPendingForUser, `{"userId":7}`, "", ""},
+		{TypeCommit, `{"changes":[]}`, "changes", "must not be empty"},
+		{TypeCommit, changes(maxCommitChanges + 1), "changes", "must not have more than 1000 entries"},
+		{TypeCommit, changes(2), "", ""},
+		{TypeCommit, `{"changes":[{"key":"model","baseModified":"x"}]}`, "changes.assetId", "is required"},
+		{TypeCommit, `{"changes":[{"assetId":5,"baseModified":"x"}]}`, "changes.key", "is required"},
+		{TypeCommit, `{"changes":[{"assetId":5,"key":"model","value":null}]}`, "changes.baseModified", "is required"},
+		{TypeClientState, `{"position":{"row":-1,"col":0}}`, "position.row", "must be a non-negative number"},
+		{TypeClientState, `{"lock":{"assetId":5}}`, "lock.key", "is required"},
+		{TypeClientState, `{"pending":[{"assetId":5,"key":"model"},{"key":"model"}]}`, "pending.assetId", "is required"},
+		{TypeClientState, `{"rowLock":{}}`, "rowLock.assetId", "is required"},
+		{TypeClientState, `{}`, "", ""},
+		{TypeSubscribe, `{}`, "room", "is required"},
+		{TypeSubscribe, `{"room":"grid","rooms":["audit"]}`, "rooms", "cannot be combined with room"},
+		{TypeSubscribe, `{"rooms":["grid",""]}`, "rooms", "must not contain empty names"},
+		{TypeSubscribe, `{"rooms":["1","2","3","4","5","6","7","8","9","10","11","12","13","14","15","16","17"]}`, "rooms", "must not have more than 16 entries"},
+		{TypeUnsubscribe, `{}`, "", ""},
+		{TypeViewport, `{"assetIds":[1,""]}`, "assetIds", "must not contain empty ids"},
+		{TypeViewport, `{}`, "", ""},
+		{TypeAuditAssign, `{"assetIds":[],"userId":3}`, "assetIds", "must not be empty"},
+		{TypeAuditComplete, `{"assetId":0}`, "assetId", "must be a positive number"},
+		{TypeAuditComplete, `{"assetId":4,"completedCount":2}`, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msgType+" "+tt.payload[:min(len(tt.payload), 40)], func(t *testing.T) {
+			_, err := Decode([]byte(`{"type":"` + tt.msgType + `","payload":` + tt.payload + `}`))
+			if tt.field == "" {
+				if err != nil {
+					t.Fatalf("rejected: %v", err)
+				}
+				return
+			}
+			want := ValidationError{Type: tt.msgType, Field: tt.field, Reason: tt.reason}
+			var verr *ValidationError
+			if !errors.As(err, &verr) || *verr != want {
+				t.Fatalf("got %v, want %v", err, &want)
+			}
+		})
+	}
+}
+
+func TestLocateIDField(t *testing.T) {
+	tests := []struct {
+		payload Payload
+		raw     string
+		want    string
+	}{
+		{&CellRef{}, `{"assetId":{"id":5},"key":"model"}`, "assetId"},
+		{&PositionUpdate{}, `{"row":1,"col":2,"assetId":[5]}`, "assetId"},
+		{&UserRef{}, `{"userId":false}`, "userId"},
+		// The ids decode; the error was somewhere else
+		{&CellRef{}, `{"assetId":5,"key":7}`, ""},
+		{&CellRef{}, `{"assetId":null}`, ""},
+		// Not an object, or no id fields to blame
+		{&CellRef{}, `[1,2]`, ""},
+		{&Commit{}, `{"changes":[{"assetId":true}]}`, ""},
+	}
+	for _, tt := range tests {
+		if got := locateIDField(tt.payload, json.RawMessage(tt.raw)); got != tt.want {
+			t.Errorf("locateIDField(%T, %s) = %q, want %q", tt.payload, tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixField(t *testing.T) {
+	err := prefixField("lock", &ValidationError{Type: TypeClientState, Field: "key", Reason: "is required"})
+	var verr *ValidationError
+	if !errors.As(err, &verr) || verr.Field != "lock.key" || verr.Reason != "is required" {
+		t.Errorf("got %v, want lock.key is required", err)
+	}
+	// decodeRequest sets the message type once, on the outermost error
+	if verr.Type != "" {
+		t.Errorf("prefixed error kept type %q", verr.Type)
+	}
+
+	other := errors.New("not a validation error")
+	if got := prefixField("lock", other); got != other {
+		t.Errorf("got %v, want the error unchanged", got)
+	}
+}
+
+func TestValidationErrorMessage(t *testing.T) {
+	tests := []struct {
+		err  ValidationError
+		want string
+	}{
+		{ValidationError{Type: TypeCommit, Field: "changes", Reason: "must not be empty"}, "COMMIT: changes must not be empty"},
+		{ValidationError{Field: "type", Reason: "is required"}, "type is required"},
+		{ValidationError{Type: TypeCommit, Reason: "must be an object"}, "COMMIT: must be an object"},
+		{ValidationError{Reason: "message is not valid JSON"}, "message is not valid JSON"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestIDJSON(t *testing.T) {
+	for id, want := range map[ID]string{"5": `5`, "-3": `-3`, "A-7": `"A-7"`, "": `""`} {
+		data, err := json.Marshal(id)
+		if err != nil || string(data) != want {
+			t.Errorf("marshal %q: got %s (%v), want %s", id, data, err, want)
+		}
+	}
+	for data, want := range map[string]ID{`5`: "5", `"5"`: "5", `1.5`: "1.5", `"A-7"`: "A-7", `null`: ""} {
+		var id ID
+		if err := json.Unmarshal([]byte(data), &id); err != nil || id != want {
+			t.Errorf("unmarshal %s: got %q (%v), want %q", data, id, err, want)
+		}
+	}
+	var id ID
+	if err := json.Unmarshal([]byte(`{}`), &id); err == nil {
+		t.Error("object decoded as an id")
+	}
+}
+
+func TestSubscribeRoomList(t *testing.T) {
+	if got := (&Subscribe{Room: "grid"}).RoomList(); !reflect.DeepEqual(got, []string{"grid"}) {
+		t.Errorf("single room: %v", got)
+	}
+	got := (&Subscribe{Rooms: []string{"grid", "audit", "grid", "grid:location:3"}}).RoomList()
+	if !reflect.DeepEqual(got, []string{"grid", "audit", "grid:location:3"}) {
+		t.Errorf("rooms: %v", got)
+	}
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"log"
+	"time"
+
+	"asset-ws/internal/protocol"
+)
+
+// parkedClient is a disconnected client whose locks, pending cells and
+// presence are held for ReconnectGrace in case the same session comes back.
+type parkedClient struct {
+	client *Client
+	rooms  []string
+	timer  *time.Timer
+}
+
+// parkKey groups parked clients by user and session. Tabs of one browser
+// share a session, so a key can hold several parked clients.
+func parkKey(c *Client) string {
+	return c.userID + ":" + c.sessionID
+}
+
+// parkClient keeps a dropped client's state alive for the grace window and
+// shows it as away to its rooms. cleanupClient runs if nobody adopts it.
+func (h *Hub) parkClient(client *Client, rooms []string) {
+	key := parkKey(client)
+	p := &parkedClient{client: client, rooms: rooms}
+
+	h.mutex.Lock()
+	h.parked[key] = append(h.parked[key], p)
+	p.timer = time.AfterFunc(h.config.ReconnectGrace, func() {
+		h.expireParked(key, p)
+	})
+	h.mutex.Unlock()
+
+	log.Printf("[Reconnect] Parked %s for %s", client.userInfo.Username, h.config.ReconnectGrace)
+
+	h.BroadcastToRooms(rooms, protocol.TypeUserAway, protocol.UserAway{ClientID: client.userID}, nil)
+}
+
+// expireParked releases a parked client's state once its grace window ends
+func (h *Hub) expireParked(key string, p *parkedClient) {
+	h.mutex.Lock()
+	found := h.removeParked(key, p)
+	h.mutex.Unlock()
+
+	// Adopted by a reconnect in the meantime
+	if !found {
+		return
+	}
+
+	log.Printf("[Reconnect] Grace period ended for %s, releasing state", p.client.userInfo.Username)
+	h.cleanupClient(p.client, p.rooms)
+}
+
+// releaseParked cleans up every client parked under key without waiting for
+// the grace window. It returns how many it released.
+func (h *Hub) releaseParked(key string) int {
+	h.mutex.Lock()
+	queue := h.parked[key]
+	delete(h.parked, key)
+	for _, p := range queue {
+		p.timer.Stop()
+	}
+	h.mutex.Unlock()
+
+	for _, p := range queue {
+		h.cleanupClient(p.client, p.rooms)
+	}
+	return len(queue)
+}
+
+// adoptParked moves a parked client's state onto a reconnecting client with
+// the same session. It must run before the new client's readPump starts so
+// CLIENT_STATE reconciliation sees the adopted locks as its own.
+func (h *Hub) adoptParked(client *Client) bool {
+	key := parkKey(client)
+
+	h.mutex.Lock()
+	var p *parkedClient
+	if queue := h.parked[key]; len(queue) > 0 {
+		p = queue[0]
+		h.removeParked(key, p)
+	}
+	h.mutex.Unlock()
+
+	if p == nil {
+		return false
+	}
+	p.timer.Stop()
+
+	old := p.client
+	h.presence.Transfer(old, client)
+	locks := h.cellLocks.Transfer(old, client)
+	pending := h.pendingCells.Transfer(old, client)
+	rowLocks := h.rowLocks.Transfer(old, client)
+
+	log.Printf("[Reconnect] %s resumed session (%d locks, %d pending, %d row locks)", client.userInfo.Username, locks, pending, rowLocks)
+
+	h.BroadcastToRooms(p.rooms, protocol.TypeUserReturned, protocol.UserAway{ClientID: client.userID}, nil)
+	return true
+}
+
+// removeParked drops p from the parked list. Callers must hold h.mutex.
+func (h *Hub) removeParked(key string, p *parkedClient) bool {
+	queue := h.parked[key]
+	for i, candidate := range queue {
+		if candidate == p {
+			queue = append(queue[:i], queue[i+1:]...)
+			if len(queue) == 0 {
+				delete(h.parked, key)
+			} else {
+				h.parked[key] = queue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// parkedClients returns the clients currently inside their grace window
+func (h *Hub) parkedClients() map[*Client]bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	parked := make(map[*Client]bool)
+	for _, queue := range h.parked {
+		for _, p := range queue {
+			parked[p.client] = true
+		}
+	}
+	return parked
+}
@@ -0,0 +1,30 @@
+package internal
+
+import "asset-ws/internal/protocol"
+
+// Role model mirrors the frontend (src/lib/utils/roles.ts): strict hierarchy,
+// lower number = more privileged. Checks use `role <= N`.
+const (
+	RoleAuditAdmin = 1
+	RoleAdmin      = 2
+	RoleUser       = 3
+)
+
+// messageRoles is the least privileged role allowed to send each message type.
+// Types not listed here are open to every authenticated user.
+var messageRoles = map[string]int{
+	protocol.TypeAuditStart:               RoleAuditAdmin,
+	protocol.TypeAuditClose:               RoleAuditAdmin,
+	protocol.TypeAdminForceUnlockCell:     RoleAdmin,
+	protocol.TypeAdminForceUnlockRow:      RoleAdmin,
+	protocol.TypeAdminClearPendingForUser: RoleAdmin,
+}
+
+// canSend reports whether a user with the given role may send a message type
+func canSend(role int, msgType string) bool {
+	required, ok := messageRoles[msgType]
+	if !ok {
+		return true
+	}
+	return role >= RoleAuditAdmin && role <= required
+}
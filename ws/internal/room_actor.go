@@ -0,0 +1,329 @@
+package internal
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// roomActor is the goroutine that owns one room's membership and delivers
+// its broadcasts. Joins, leaves and deliveries run on it one at a time, in
+// the order they were queued, so a room needs no lock shared with the
+// others and fans out in parallel with them. Broadcasts are queued in seq
+// order (see Hub.sequence) and nobody waits for them to be delivered.
+//
+// Locks, pending cells and cursors stay in the managers: a cell locked from
+// grid:location:3 must read as locked from grid too, so that state cannot
+// belong to either room. Snapshots of it are taken on the room goroutine or
+// while the room is paused (see pauseRooms), so each matches the seq it
+// carries.
+type roomActor struct {
+	name string
+
+	mu sync.Mutex
+	// Ops waiting to run, oldest first
+	queue []roomOp
+	// Set once the room is retired or the hub shut down; nothing more runs
+	stopped  bool
+	wake     chan struct{}
+	shutdown <-chan struct{}
+
+	size atomic.Int32 // Number of members, readable from any goroutine
+	// Seq of the last broadcast delivered. Only read on the room goroutine
+	// or while the room is paused.
+	seq uint64
+}
+
+// roomOp is one queued op. done, if set, receives whether it ran.
+type roomOp struct {
+	run  func(members map[*Client]bool)
+	done chan bool
+}
+
+// newRoomActor starts a room whose stream is at seq
+func newRoomActor(name string, seq uint64, shutdown <-chan struct{}) *roomActor {
+	r := &roomActor{
+		name:     name,
+		wake:     make(chan struct{}, 1),
+		shutdown: shutdown,
+		seq:      seq,
+	}
+	go r.run()
+	return r
+}
+
+func (r *roomActor) run() {
+	members := make(map[*Client]bool)
+	for {
+		select {
+		case <-r.wake:
+		case <-r.shutdown:
+			r.stop()
+			return
+		}
+		for {
+			r.mu.Lock()
+			if r.stopped || len(r.queue) == 0 {
+				stopped := r.stopped
+				r.mu.Unlock()
+				if stopped {
+					return
+				}
+				break
+			}
+			op := r.queue[0]
+			r.queue[0] = roomOp{}
+			r.queue = r.queue[1:]
+			r.mu.Unlock()
+
+			op.run(members)
+			if op.done != nil {
+				op.done <- true
+			}
+		}
+	}
+}
+
+// send queues op without waiting for it. done, if not nil, must have room
+// for one value and receives whether op ran; it does not if the room stops
+// first.
+func (r *roomActor) send(op func(members map[*Client]bool), done chan bool) {
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		if done != nil {
+			done <- false
+		}
+		return
+	}
+	r.queue = append(r.queue, roomOp{run: op, done: done})
+	r.mu.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// do runs op on the room goroutine, waits for it and reports whether it ran
+func (r *roomActor) do(op func(members map[*Client]bool)) bool {
+	done := make(chan bool, 1)
+	r.send(op, done)
+	return <-done
+}
+
+// stop ends the room: queued ops are dropped and later ones refused
+func (r *roomActor) stop() {
+	r.mu.Lock()
+	r.stopped = true
+	dropped := r.queue
+	r.queue = nil
+	r.mu.Unlock()
+
+	for _, op := range dropped {
+		if op.done != nil {
+			op.done <- false
+		}
+	}
+}
+
+// leave takes client out of the room without waiting: ops queued after it
+// no longer see the client
+func (r *roomActor) leave(client *Client) {
+	r.send(func(members map[*Client]bool) {
+		if members[client] {
+			delete(members, client)
+			r.size.Add(-1)
+		}
+	}, nil)
+}
+
+func (r *roomActor) clients() []*Client {
+	var clients []*Client
+	r.do(func(members map[*Client]bool) {
+		clients = make([]*Client, 0, len(members))
+		for client := range members {
+			clients = append(clients, client)
+		}
+	})
+	return clients
+}
+
+// room returns the actor of a room, starting it if needed
+func (h *Hub) room(name string) *roomActor {
+	h.mutex.RLock()
+	r, ok := h.rooms[name]
+	h.mutex.RUnlock()
+	if ok {
+		return r
+	}
+
+	h.history.Start(name, func(seq uint64) {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		if r, ok = h.rooms[name]; !ok {
+			r = newRoomActor(name, seq, h.shutdown)
+			h.rooms[name] = r
+		}
+	})
+	return r
+}
+
+// inRoom runs op on the goroutine of a room, starting the room if it is not
+// running or was retired meanwhile. It returns false once the hub shuts down.
+func (h *Hub) inRoom(name string, op func(r *roomActor, members map[*Client]bool)) bool {
+	for {
+		r := h.room(name)
+		if r.do(func(members map[*Client]bool) { op(r, members) }) {
+			return true
+		}
+		select {
+		case <-h.shutdown:
+			return false
+		default:
+		}
+	}
+}
+
+// roomActors returns the actors of the rooms in names that are running; nil
+// names returns every one
+func (h *Hub) roomActors(names []string) []*roomActor {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if names == nil {
+		actors := make([]*roomActor, 0, len(h.rooms))
+		for _, r := range h.rooms {
+			actors = append(actors, r)
+		}
+		return actors
+	}
+	actors := make([]*roomActor, 0, len(names))
+	for _, name := range names {
+		if r, ok := h.rooms[name]; ok {
+			actors = append(actors, r)
+		}
+	}
+	return actors
+}
+
+// roomSize is how many clients are in a room
+func (h *Hub) roomSize(name string) int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if r, ok := h.rooms[name]; ok {
+		return int(r.size.Load())
+	}
+	return 0
+}
+
+// retireEmptyRooms stops the actors of rooms nobody is in and waits for
+// them. Each room checks on its own goroutine, so a join queued before the
+// check keeps it running; one queued after it starts the room again (see
+// inRoom).
+func (h *Hub) retireEmptyRooms() {
+	actors := h.roomActors(nil)
+	done := make([]chan bool, len(actors))
+	for i, r := range actors {
+		done[i] = make(chan bool, 1)
+		r.send(func(members map[*Client]bool) {
+			if len(members) > 0 {
+				return
+			}
+			h.mutex.Lock()
+			if h.rooms[r.name] == r {
+				delete(h.rooms, r.name)
+			}
+			h.mutex.Unlock()
+			r.stop()
+		}, done[i])
+	}
+	for _, d := range done {
+		<-d
+	}
+}
+
+// pauseRooms holds the running actors of rooms between two ops until resume
+// is called, and returns them. Broadcasts can still be
+// sequenced for them meanwhile; they are delivered once the rooms resume.
+// Rooms are taken in name order, so two callers never wait on each other.
+// Callers must not be room goroutines.
+func (h *Hub) pauseRooms(rooms []string) (paused []*roomActor, resume func()) {
+	if len(rooms) == 0 {
+		return nil, func() {}
+	}
+	actors := h.roomActors(rooms)
+	sort.Slice(actors, func(i, j int) bool { return actors[i].name < actors[j].name })
+
+	release := make(chan struct{})
+	for _, r := range actors {
+		holding := make(chan struct{})
+		done := make(chan bool, 1)
+		r.send(func(map[*Client]bool) {
+			close(holding)
+			<-release
+		}, done)
+		select {
+		case <-holding:
+			paused = append(paused, r)
+		case <-done:
+			// Stopped before it got there
+		}
+	}
+	return paused, func() { close(release) }
+}
+
+// fanOut queues a sequenced message on the goroutines of rooms and returns
+// without waiting for them. A client in several of the rooms gets it once,
+// before any later message of those rooms. Clients whose viewport shows
+// none of assets are skipped; see BroadcastInView. The message is encoded
+// and framed once per wire format for all of them. delivered, if not nil,
+// runs on the last room to finish; not at all if a room stops first.
+func (h *Hub) fanOut(rooms []*roomActor, assets []string, msg *outbound, sender *Client, delivered func()) {
+	if len(rooms) == 0 {
+		if delivered != nil {
+			delivered()
+		}
+		return
+	}
+	var mu sync.Mutex
+	sent := make(map[*Client]bool)
+	var remaining atomic.Int32
+	remaining.Store(int32(len(rooms)))
+	for _, r := range rooms {
+		r.send(func(members map[*Client]bool) {
+			r.seq = msg.msg.Seq
+			for client := range members {
+				if client == sender {
+					continue
+				}
+				if len(rooms) == 1 {
+					h.deliverInView(r, client, assets, msg)
+					continue
+				}
+				// Delivered while holding mu, so the room that skips a
+				// client finds the message already queued for it
+				mu.Lock()
+				if !sent[client] {
+					sent[client] = true
+					h.deliverInView(r, client, assets, msg)
+				}
+				mu.Unlock()
+			}
+			if remaining.Add(-1) == 0 && delivered != nil {
+				delivered()
+			}
+		}, nil)
+	}
+}
+
+// deliverInView is deliver for a room broadcast about assets
+func (h *Hub) deliverInView(r *roomActor, client *Client, assets []string, msg *outbound) {
+	if !client.inView(assets) {
+		h.metrics.outOfView.WithLabelValues(msg.msg.Type).Inc()
+		return
+	}
+	if !h.deliver(client, msg) {
+		log.Printf("User %s send buffer full in room '%s', skipping message", client.userInfo.Username, r.name)
+	}
+}
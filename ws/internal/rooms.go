@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"asset-ws/internal/protocol"
+)
+
+// Rooms are named by a path of colon-separated segments. The top-level
+// rooms always exist; the scoped ones name a database row and exist while
+// that row does:
+//
+//	grid                   the whole asset grid
+//	grid:location:<id>     the grid filtered to one asset_locations row
+//	audit                  every audit cycle
+//	audit:cycle:<id>       one asset_audit_cycles row
+//	asset:<id>             one asset_inventory row
+//
+// A broadcast to a room also reaches the rooms above it, so grid members
+// see what happens in every location, but not the other way round.
+
+// roomNames are the top-level rooms
+var roomNames = []string{"grid", "audit"}
+
+// roomScope describes a family of scoped rooms: the table their id must
+// exist in and the room above them, if any
+type roomScope struct {
+	table  string
+	parent string
+}
+
+// scopedRooms maps a scoped room's prefix (the name without ":<id>") to its scope
+var scopedRooms = map[string]roomScope{
+	"grid:location": {table: "asset_locations", parent: "grid"},
+	"audit:cycle":   {table: "asset_audit_cycles", parent: "audit"},
+	"asset":         {table: "asset_inventory"},
+}
+
+// parseRoom splits a scoped room name into its scope and row id. ok is
+// false for top-level rooms and for names that are not rooms at all.
+func parseRoom(room string) (scope roomScope, id string, ok bool) {
+	i := strings.LastIndexByte(room, ':')
+	if i < 0 {
+		return roomScope{}, "", false
+	}
+	scope, ok = scopedRooms[room[:i]]
+	id = room[i+1:]
+	if !ok {
+		return roomScope{}, "", false
+	}
+	if n, err := strconv.ParseInt(id, 10, 64); err != nil || n <= 0 || strconv.FormatInt(n, 10) != id {
+		return roomScope{}, "", false
+	}
+	return scope, id, true
+}
+
+// isRootRoom reports whether room is one of roomNames
+func isRootRoom(room string) bool {
+	for _, name := range roomNames {
+		if room == name {
+			return true
+		}
+	}
+	return false
+}
+
+// roomLineage returns room followed by the rooms above it, nearest first
+func roomLineage(room string) []string {
+	lineage := []string{room}
+	for {
+		scope, _, ok := parseRoom(room)
+		if !ok || scope.parent == "" {
+			return lineage
+		}
+		room = scope.parent
+		lineage = append(lineage, room)
+	}
+}
+
+// roomTargets returns rooms and the rooms above them, each once: where a
+// broadcast to rooms is delivered
+func roomTargets(rooms []string) []string {
+	var targets []string
+	seen := make(map[string]bool)
+	for _, room := range rooms {
+		for _, target := range roomLineage(room) {
+			if !seen[target] {
+				seen[target] = true
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets
+}
+
+// roomReaches reports whether a broadcast to from is delivered to members
+// of to. State taken outside any room, such as a claim from an instance
+// that has not assigned it yet, is shown everywhere.
+func roomReaches(from, to string) bool {
+	if from == "" {
+		return true
+	}
+	for _, room := range roomLineage(from) {
+		if room == to {
+			return true
+		}
+	}
+	return false
+}
+
+// roomKind is a room's first segment. Metrics are labelled with it so the
+// number of series stays bounded however many rooms exist.
+func roomKind(room string) string {
+	kind, _, _ := strings.Cut(room, ":")
+	return kind
+}
+
+// checkRoom rejects a SUBSCRIBE to a room that is malformed or whose row
+// does not exist. Rooms somebody is already in are known to exist.
+func (h *Hub) checkRoom(room string) error {
+	if isRootRoom(room) {
+		return nil
+	}
+	scope, id, ok := parseRoom(room)
+	if !ok {
+		return protocol.Rejectf(protocol.CodeUnknownRoom, "Unknown room '%s'", room)
+	}
+
+	if h.roomSize(room) > 0 {
+		return nil
+	}
+
+	exists, err := h.store.RowExists(scope.table, id)
+	if err != nil {
+		log.Printf("[Room] Failed to look up room '%s': %v", room, err)
+		return err
+	}
+	if !exists {
+		return protocol.Rejectf(protocol.CodeUnknownRoom, "Room '%s' does not exist", room)
+	}
+	return nil
+}
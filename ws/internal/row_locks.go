@@ -1,16 +1,17 @@
 package internal
 
 import (
-	"encoding/json"
-	"fmt"
 	"log"
 	"strings"
 	"sync"
+
+	"asset-ws/internal/protocol"
 )
 
 type RowLockInfo struct {
 	Client  *Client
 	AssetID string
+	Room    string // Room the lock was taken in
 }
 
 type RowLockManager struct {
@@ -28,7 +29,7 @@ func NewRowLockManager() *RowLockManager {
 	}
 }
 
-func (rlm *RowLockManager) Lock(assetId string, client *Client) bool {
+func (rlm *RowLockManager) Lock(assetId string, client *Client, room string) bool {
 	rlm.mutex.Lock()
 	defer rlm.mutex.Unlock()
 
@@ -40,6 +41,7 @@ func (rlm *RowLockManager) Lock(assetId string, client *Client) bool {
 	rlm.locks[assetId] = &RowLockInfo{
 		Client:  client,
 		AssetID: assetId,
+		Room:    room,
 	}
 
 	if _, ok := rlm.userLocks[client]; !ok {
@@ -50,6 +52,31 @@ func (rlm *RowLockManager) Lock(assetId string, client *Client) bool {
 	return true
 }
 
+// Transfer hands every row lock of one client to another
+func (rlm *RowLockManager) Transfer(from, to *Client) int {
+	rlm.mutex.Lock()
+	defer rlm.mutex.Unlock()
+
+	assetIds, ok := rlm.userLocks[from]
+	if !ok {
+		return 0
+	}
+
+	for assetId := range assetIds {
+		if info, ok := rlm.locks[assetId]; ok {
+			info.Client = to
+		}
+	}
+	delete(rlm.userLocks, from)
+	if rlm.userLocks[to] == nil {
+		rlm.userLocks[to] = make(map[string]bool)
+	}
+	for assetId := range assetIds {
+		rlm.userLocks[to][assetId] = true
+	}
+	return len(assetIds)
+}
+
 func (rlm *RowLockManager) Unlock(assetId string, client *Client) bool {
 	rlm.mutex.Lock()
 	defer rlm.mutex.Unlock()
@@ -69,6 +96,26 @@ func (rlm *RowLockManager) Unlock(assetId string, client *Client) bool {
 	return true
 }
 
+// ForceUnlock removes a row lock regardless of its owner and returns the removed lock, or nil
+func (rlm *RowLockManager) ForceUnlock(assetId string) *RowLockInfo {
+	rlm.mutex.Lock()
+	defer rlm.mutex.Unlock()
+
+	info, ok := rlm.locks[assetId]
+	if !ok {
+		return nil
+	}
+
+	delete(rlm.locks, assetId)
+	if userSet, ok := rlm.userLocks[info.Client]; ok {
+		delete(userSet, assetId)
+		if len(userSet) == 0 {
+			delete(rlm.userLocks, info.Client)
+		}
+	}
+	return info
+}
+
 // RemoveAllForClient removes all row locks for a client and returns the assetIds that were removed
 func (rlm *RowLockManager) RemoveAllForClient(client *Client) []string {
 	rlm.mutex.Lock()
@@ -88,6 +135,45 @@ func (rlm *RowLockManager) RemoveAllForClient(client *Client) []string {
 	return removed
 }
 
+// RemoveRoomForClient removes the row locks a client took in one room and
+// returns their assetIds
+func (rlm *RowLockManager) RemoveRoomForClient(client *Client, room string) []string {
+	rlm.mutex.Lock()
+	defer rlm.mutex.Unlock()
+
+	var removed []string
+	for assetId := range rlm.userLocks[client] {
+		if info, ok := rlm.locks[assetId]; ok && info.Room == room {
+			delete(rlm.locks, assetId)
+			delete(rlm.userLocks[client], assetId)
+			removed = append(removed, assetId)
+		}
+	}
+	if len(rlm.userLocks[client]) == 0 {
+		delete(rlm.userLocks, client)
+	}
+	return removed
+}
+
+// AssignRoom moves the row locks a client took outside any room into room
+func (rlm *RowLockManager) AssignRoom(client *Client, room string) {
+	rlm.mutex.Lock()
+	defer rlm.mutex.Unlock()
+
+	for assetId := range rlm.userLocks[client] {
+		if info, ok := rlm.locks[assetId]; ok && info.Room == "" {
+			info.Room = room
+		}
+	}
+}
+
+// Count returns how many rows are locked
+func (rlm *RowLockManager) Count() int {
+	rlm.mutex.RLock()
+	defer rlm.mutex.RUnlock()
+	return len(rlm.locks)
+}
+
 func (rlm *RowLockManager) GetAll() map[string]*RowLockInfo {
 	rlm.mutex.RLock()
 	defer rlm.mutex.RUnlock()
@@ -97,6 +183,7 @@ func (rlm *RowLockManager) GetAll() map[string]*RowLockInfo {
 		snapshot[k] = &RowLockInfo{
 			Client:  v.Client,
 			AssetID: v.AssetID,
+			Room:    v.Room,
 		}
 	}
 	return snapshot
@@ -110,32 +197,24 @@ func (rlm *RowLockManager) IsRowLocked(assetId string, client *Client) (bool, *R
 		return true, &RowLockInfo{
 			Client:  info.Client,
 			AssetID: info.AssetID,
+			Room:    info.Room,
 		}
 	}
 	return false, nil
 }
 
-func (c *Client) handleRowLock(payload interface{}) {
-	payloadMap, ok := payload.(map[string]interface{})
-	if !ok {
-		return
-	}
-
-	assetIdRaw, ok := payloadMap["assetId"]
-	if !ok {
-		return
-	}
-
-	assetId := fmt.Sprintf("%v", assetIdRaw)
+func (c *Client) handleRowLock(p *protocol.RowRef, room string) error {
+	assetId := p.AssetID.String()
 
 	// Release any existing row lock for this client first (one row lock per client)
 	existingLocks := c.hub.rowLocks.GetAll()
 	for existingAssetId, lockInfo := range existingLocks {
 		if lockInfo.Client == c && existingAssetId != assetId {
 			if c.hub.rowLocks.Unlock(existingAssetId, c) {
+				c.hub.release(LockRow, c, existingAssetId)
 				log.Printf("[RowLock] %s released previous row lock %s", c.userInfo.Username, existingAssetId)
-				c.hub.BroadcastToAllRooms("ROW_UNLOCKED", map[string]interface{}{
-					"assetId": existingAssetId,
+				c.hub.BroadcastToAllRooms(protocol.TypeRowUnlocked, protocol.RowRef{
+					AssetID: protocol.ID(existingAssetId),
 				}, nil)
 			}
 		}
@@ -146,74 +225,76 @@ func (c *Client) handleRowLock(payload interface{}) {
 	for lockKey, lockInfo := range allCellLocks {
 		if strings.HasPrefix(lockKey, assetId+":") && lockInfo.Client != c {
 			log.Printf("[RowLock] %s rejected for row %s (cell %s being edited by %s %s)", c.userInfo.Username, assetId, lockKey, lockInfo.Client.userInfo.Firstname, lockInfo.Client.userInfo.Lastname)
-			msg := Message{Type: "ROW_LOCK_REJECTED", Payload: map[string]interface{}{
-				"assetId":   assetId,
-				"reason":    "row_being_edited",
-				"firstname": lockInfo.Client.userInfo.Firstname,
-				"lastname":  lockInfo.Client.userInfo.Lastname,
-			}}
-			jsonMsg, err := json.Marshal(msg)
-			if err == nil {
-				select {
-				case c.send <- jsonMsg:
-				default:
-				}
-			}
-			return
+			c.sendMessage(protocol.TypeRowLockRejected, protocol.RowLockRejected{
+				AssetID:   p.AssetID,
+				Reason:    "row_being_edited",
+				Firstname: lockInfo.Client.userInfo.Firstname,
+				Lastname:  lockInfo.Client.userInfo.Lastname,
+			})
+			return protocol.Rejectf(protocol.CodeRowBeingEdited, "Row is being edited by %s %s", lockInfo.Client.userInfo.Firstname, lockInfo.Client.userInfo.Lastname)
+		}
+	}
+	for _, claim := range c.hub.remoteClaims(LockCell) {
+		if strings.HasPrefix(claim.Key, assetId+":") {
+			log.Printf("[RowLock] %s rejected for row %s (cell %s being edited by %s %s on %s)", c.userInfo.Username, assetId, claim.Key, claim.Holder.Firstname, claim.Holder.Lastname, claim.Instance)
+			c.sendMessage(protocol.TypeRowLockRejected, protocol.RowLockRejected{
+				AssetID:   p.AssetID,
+				Reason:    "row_being_edited",
+				Firstname: claim.Holder.Firstname,
+				Lastname:  claim.Holder.Lastname,
+			})
+			return protocol.Rejectf(protocol.CodeRowBeingEdited, "Row is being edited by %s %s", claim.Holder.Firstname, claim.Holder.Lastname)
 		}
 	}
 
 	// Grant row lock
-	locked := c.hub.rowLocks.Lock(assetId, c)
+	locked := c.hub.rowLocks.Lock(assetId, c, room)
 
 	if locked {
-		log.Printf("[RowLock] %s (%s %s) locked row %s", c.userInfo.Username, c.userInfo.Firstname, c.userInfo.Lastname, assetId)
-		broadcastPayload := map[string]interface{}{
-			"assetId":   assetId,
-			"userId":    c.userID,
-			"firstname": c.userInfo.Firstname,
-			"lastname":  c.userInfo.Lastname,
-			"color":     c.userInfo.Color,
+		if other := c.claim(LockRow, assetId, "", room); other != nil {
+			c.hub.rowLocks.Unlock(assetId, c)
+			log.Printf("[RowLock] %s rejected for row %s (held by %s %s on %s)", c.userInfo.Username, assetId, other.Holder.Firstname, other.Holder.Lastname, other.Instance)
+			c.sendMessage(protocol.TypeRowLockRejected, protocol.RowLockRejected{
+				AssetID:   p.AssetID,
+				Reason:    "row_locked",
+				Firstname: other.Holder.Firstname,
+				Lastname:  other.Holder.Lastname,
+			})
+			return protocol.Rejectf(protocol.CodeRowLocked, "Row is locked by %s %s", other.Holder.Firstname, other.Holder.Lastname)
 		}
-		c.hub.BroadcastToAllRooms("ROW_LOCKED", broadcastPayload, c)
-	} else {
-		existing := c.hub.rowLocks.GetAll()[assetId]
-		if existing != nil {
-			log.Printf("[RowLock] %s rejected for row %s (held by %s %s)", c.userInfo.Username, assetId, existing.Client.userInfo.Firstname, existing.Client.userInfo.Lastname)
-			msg := Message{Type: "ROW_LOCK_REJECTED", Payload: map[string]interface{}{
-				"assetId":   assetId,
-				"reason":    "row_locked",
-				"firstname": existing.Client.userInfo.Firstname,
-				"lastname":  existing.Client.userInfo.Lastname,
-			}}
-			jsonMsg, err := json.Marshal(msg)
-			if err == nil {
-				select {
-				case c.send <- jsonMsg:
-				default:
-				}
-			}
-		}
-	}
-}
-
-func (c *Client) handleRowUnlock(payload interface{}) {
-	payloadMap, ok := payload.(map[string]interface{})
-	if !ok {
-		return
+		log.Printf("[RowLock] %s (%s %s) locked row %s", c.userInfo.Username, c.userInfo.Firstname, c.userInfo.Lastname, assetId)
+		c.hub.BroadcastToAllRooms(protocol.TypeRowLocked, protocol.RowLocked{
+			AssetID: p.AssetID,
+			Holder:  c.holder(),
+		}, c)
+		return nil
 	}
 
-	assetIdRaw, ok := payloadMap["assetId"]
-	if !ok {
-		return
+	existing := c.hub.rowLocks.GetAll()[assetId]
+	if existing == nil {
+		return protocol.Rejectf(protocol.CodeRowLocked, "Row is locked by another user")
 	}
+	log.Printf("[RowLock] %s rejected for row %s (held by %s %s)", c.userInfo.Username, assetId, existing.Client.userInfo.Firstname, existing.Client.userInfo.Lastname)
+	c.sendMessage(protocol.TypeRowLockRejected, protocol.RowLockRejected{
+		AssetID:   p.AssetID,
+		Reason:    "row_locked",
+		Firstname: existing.Client.userInfo.Firstname,
+		Lastname:  existing.Client.userInfo.Lastname,
+	})
+	return protocol.Rejectf(protocol.CodeRowLocked, "Row is locked by %s %s", existing.Client.userInfo.Firstname, existing.Client.userInfo.Lastname)
+}
 
-	assetId := fmt.Sprintf("%v", assetIdRaw)
+func (c *Client) handleRowUnlock(p *protocol.RowRef) error {
+	assetId := p.AssetID.String()
 
-	if c.hub.rowLocks.Unlock(assetId, c) {
-		log.Printf("[RowLock] %s (%s %s) unlocked row %s", c.userInfo.Username, c.userInfo.Firstname, c.userInfo.Lastname, assetId)
-		c.hub.BroadcastToAllRooms("ROW_UNLOCKED", map[string]interface{}{
-			"assetId": assetId,
-		}, c)
+	if !c.hub.rowLocks.Unlock(assetId, c) {
+		return protocol.Rejectf(protocol.CodeNotHeld, "You do not hold the lock on row %s", assetId)
 	}
+	c.hub.release(LockRow, c, assetId)
+
+	log.Printf("[RowLock] %s (%s %s) unlocked row %s", c.userInfo.Username, c.userInfo.Firstname, c.userInfo.Lastname, assetId)
+	c.hub.BroadcastToAllRooms(protocol.TypeRowUnlocked, protocol.RowRef{
+		AssetID: p.AssetID,
+	}, c)
+	return nil
 }
@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"asset-ws/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrInvalidSession is returned for a session that is unknown, expired or
+// whose user is gone. Any other error means the check itself failed.
+var ErrInvalidSession = errors.New("invalid or expired session")
+
+// UserSettings mirrors the JSON stored in users.user_settings
+type UserSettings struct {
+	RowHeight      int      `json:"row_height,omitempty"`
+	HiddenStatuses []string `json:"hidden_statuses,omitempty"`
+	Theme          string   `json:"theme,omitempty"`
+}
+
+// UserInfo holds authenticated user data
+type UserInfo struct {
+	UserID    int64
+	Username  string
+	Firstname string
+	Lastname  string
+	Role      int
+	Settings  UserSettings
+	Color     string
+}
+
+// SessionValidator resolves the session id a client connects with to the
+// user behind it
+type SessionValidator interface {
+	ValidateSession(sessionID string) (*UserInfo, error)
+}
+
+// SQLSessionValidator checks sessions against the sessions and users tables
+// the SvelteKit app writes
+type SQLSessionValidator struct {
+	db *sql.DB
+}
+
+func NewSQLSessionValidator(db *sql.DB) *SQLSessionValidator {
+	return &SQLSessionValidator{db: db}
+}
+
+func (v *SQLSessionValidator) ValidateSession(sessionID string) (*UserInfo, error) {
+	query := `
+		SELECT
+			s.user_id,
+			u.username,
+			u.firstname,
+			u.lastname,
+			u.role,
+			u.user_settings
+		FROM sessions s
+		JOIN users u ON s.user_id = u.id
+		WHERE s.session_id = ?
+		AND s.expires_at > NOW()
+	`
+
+	var userInfo UserInfo
+	var settings sql.NullString
+	err := v.db.QueryRow(query, sessionID).Scan(
+		&userInfo.UserID,
+		&userInfo.Username,
+		&userInfo.Firstname,
+		&userInfo.Lastname,
+		&userInfo.Role,
+		&settings,
+	)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidSession
+		}
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+
+	// Same fallback as the SvelteKit hook: bad JSON means default settings
+	if settings.Valid && settings.String != "" {
+		if err := json.Unmarshal([]byte(settings.String), &userInfo.Settings); err != nil {
+			log.Printf("Failed to parse user_settings for %s, using defaults: %v", userInfo.Username, err)
+		}
+	}
+
+	return &userInfo, nil
+}
+
+// MemorySessionValidator accepts the sessions added to it. Tests use it to
+// connect users without a database.
+type MemorySessionValidator struct {
+	sessions map[string]UserInfo
+	mutex    sync.RWMutex
+}
+
+func NewMemorySessionValidator() *MemorySessionValidator {
+	return &MemorySessionValidator{sessions: make(map[string]UserInfo)}
+}
+
+// Add registers a session for a user
+func (v *MemorySessionValidator) Add(sessionID string, user UserInfo) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.sessions[sessionID] = user
+}
+
+// Remove ends a session
+func (v *MemorySessionValidator) Remove(sessionID string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	delete(v.sessions, sessionID)
+}
+
+func (v *MemorySessionValidator) ValidateSession(sessionID string) (*UserInfo, error) {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	user, ok := v.sessions[sessionID]
+	if !ok {
+		return nil, ErrInvalidSession
+	}
+	return &user, nil
+}
+
+// RevalidateSessions checks the session of every connected and parked
+// client again and ends those that were logged out, expired or lost their
+// user. It returns how many clients it ended. Sessions that cannot be
+// checked, say because the database is down, are left alone.
+func (h *Hub) RevalidateSessions() int {
+	connected := make(map[string][]*Client)
+	parked := make(map[string][]string)
+
+	h.mutex.RLock()
+	for client := range h.clients {
+		connected[client.sessionID] = append(connected[client.sessionID], client)
+	}
+	for key, queue := range h.parked {
+		if len(queue) > 0 {
+			sessionID := queue[0].client.sessionID
+			parked[sessionID] = append(parked[sessionID], key)
+		}
+	}
+	h.mutex.RUnlock()
+
+	checked := make(map[string]bool, len(connected)+len(parked))
+	ended, failed := 0, 0
+	var lastErr error
+	check := func(sessionID string) {
+		if checked[sessionID] {
+			return
+		}
+		checked[sessionID] = true
+
+		_, err := h.sessions.ValidateSession(sessionID)
+		if err == nil {
+			return
+		}
+		if !errors.Is(err, ErrInvalidSession) {
+			failed++
+			lastErr = err
+			return
+		}
+		for _, client := range connected[sessionID] {
+			h.endSession(client)
+			ended++
+		}
+		for _, key := range parked[sessionID] {
+			ended += h.releaseParked(key)
+		}
+	}
+	for sessionID := range connected {
+		check(sessionID)
+	}
+	for sessionID := range parked {
+		check(sessionID)
+	}
+
+	if failed > 0 {
+		log.Printf("[Session] Could not recheck %d sessions: %v", failed, lastErr)
+	}
+	if ended > 0 {
+		h.metrics.sessionsEnded.Add(float64(ended))
+		log.Printf("[Session] Ended %d clients whose session is no longer valid", ended)
+	}
+	return ended
+}
+
+// endSession tells a client its session is over and closes the connection.
+// Its locks and pending cells are released at once rather than parked.
+func (h *Hub) endSession(client *Client) {
+	log.Printf("[Session] Session of %s is no longer valid, disconnecting", client.userInfo.Username)
+	client.revoked.Store(true)
+	client.sendMessage(protocol.TypeSessionExpired, protocol.Empty{})
+	client.closeWith(websocket.ClosePolicyViolation, "Session expired")
+}
+
+// runSessionRevalidation rechecks every session each interval until shutdown
+func (h *Hub) runSessionRevalidation(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.RevalidateSessions()
+		case <-h.shutdown:
+			return
+		}
+	}
+}
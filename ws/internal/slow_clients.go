@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"asset-ws/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// SlowClientPolicy is what the hub does when a client's send buffer is full
+type SlowClientPolicy string
+
+const (
+	// SlowClientCoalesce keeps only the latest cursor of each user while the
+	// client catches up. Any other message it misses earns it RESYNC_REQUIRED
+	// and fresh room snapshots once it has.
+	SlowClientCoalesce SlowClientPolicy = "coalesce"
+	// SlowClientDisconnect closes the connection. The client reconnects and
+	// resumes, or resyncs if too much went by.
+	SlowClientDisconnect SlowClientPolicy = "disconnect"
+)
+
+// sendBufferFull applies the slow client policy to a message that did not
+// fit in client.send. It reports whether the message will still be sent.
+func (h *Hub) sendBufferFull(client *Client, msg *outbound) bool {
+	if h.config.SlowClients == SlowClientDisconnect {
+		if client.closeWith(websocket.CloseTryAgainLater, "Too slow, resync") {
+			log.Printf("[Slow] Disconnecting %s, send buffer full", client.userInfo.Username)
+			h.metrics.slowClients.WithLabelValues("disconnected").Inc()
+		}
+		return false
+	}
+
+	if owner := cursorOwner(msg); owner != "" {
+		client.mu.Lock()
+		if client.coalesced == nil {
+			client.coalesced = make(map[string]*outbound)
+		}
+		client.coalesced[owner] = msg
+		client.mu.Unlock()
+		client.wake()
+		h.metrics.slowClients.WithLabelValues("coalesced").Inc()
+		return true
+	}
+
+	if client.resync.CompareAndSwap(false, true) {
+		log.Printf("[Slow] %s missed %s, resync once caught up", client.userInfo.Username, msg.msg.Type)
+		h.metrics.slowClients.WithLabelValues("resync").Inc()
+	}
+	client.wake()
+	return false
+}
+
+// cursorOwner is the user a USER_POSITION_UPDATE is about, or empty for
+// any other message
+func cursorOwner(msg *outbound) string {
+	if msg.msg.Type != protocol.TypeUserPositionUpdate {
+		return ""
+	}
+	switch payload := msg.msg.Payload.(type) {
+	case protocol.UserPosition:
+		return payload.ClientID
+	case json.RawMessage:
+		// Relayed by another instance
+		var position protocol.UserPosition
+		json.Unmarshal(payload, &position)
+		return position.ClientID
+	}
+	return ""
+}
+
+// wake tells writePump there is a backlog to write once send drains
+func (c *Client) wake() {
+	select {
+	case c.backlog <- struct{}{}:
+	default:
+	}
+}
+
+// catchUp runs on writePump whenever send is empty. It writes the cursors
+// coalesced meanwhile and, if messages were dropped, queues the resync so
+// it is the next thing the client reads. It returns false when the
+// connection failed.
+func (c *Client) catchUp() bool {
+	c.mu.Lock()
+	coalesced := c.coalesced
+	c.coalesced = nil
+	c.mu.Unlock()
+
+	for _, message := range coalesced {
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := c.write(message); err != nil {
+			return false
+		}
+		c.hub.metrics.messagesOut.WithLabelValues(protocol.TypeUserPositionUpdate).Inc()
+	}
+
+	if c.resync.CompareAndSwap(true, false) {
+		c.hub.resyncClient(c)
+	}
+	return true
+}
+
+// resyncClient tells a client that dropped messages to reload each of its
+// rooms and sends their snapshots again. The rooms are paused meanwhile, so
+// each snapshot is as fresh as the seq it carries. Safe to call on the
+// client's writePump: rooms only queue to send without waiting on it.
+func (h *Hub) resyncClient(client *Client) {
+	paused, resume := h.pauseRooms(client.roomList())
+	defer resume()
+
+	select {
+	case <-client.done:
+		return
+	default:
+	}
+	for _, r := range paused {
+		log.Printf("[Slow] %s caught up, resync required for room '%s'", client.userInfo.Username, r.name)
+		client.sendMessage(protocol.TypeResyncRequired, protocol.ResyncRequired{Room: r.name})
+		h.sendExistingUsers(client, r)
+	}
+}
@@ -0,0 +1,383 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"asset-ws/internal/binlog"
+	"asset-ws/internal/protocol"
+)
+
+// AssetStore is the hub's view of the asset database: the commits it writes
+// and the change_log it follows
+type AssetStore interface {
+	// CommitAssetChanges writes changes in one transaction and logs each to
+	// change_log with origin, the hub instance writing them
+	CommitAssetChanges(changes []protocol.CommitChange, modifiedBy, origin string) (*CommitResult, error)
+	// ChangeLogHead returns the newest change_log id
+	ChangeLogHead() (int64, error)
+	// ChangeLogAfter returns up to limit change_log rows after id, plus those
+	// of the earlier ids in also that exist by now, oldest first
+	ChangeLogAfter(id int64, also []int64, limit int) ([]ChangeLogRow, error)
+	// LookupName returns the name column of a lookup table row, or nil
+	LookupName(table, column, id string) (*string, error)
+	// RowExists reports whether table has a row with this id
+	RowExists(table, id string) (bool, error)
+}
+
+// RowFeed reports committed row changes as they happen; *binlog.Stream is
+// the production feed
+type RowFeed interface {
+	Run(shutdown <-chan struct{}, handle func([]binlog.RowChange))
+}
+
+// ChangeLogRow is one change_log entry. ModifiedAt is the asset's own
+// modified time, which clients base their next commit on.
+type ChangeLogRow struct {
+	ID         int64
+	AssetID    int64
+	Column     string
+	NewValue   *string
+	Action     string
+	ModifiedBy string
+	ModifiedAt string
+	// Hub instance that wrote the row; empty for every other writer
+	Origin string
+}
+
+// SQLAssetStore reads and writes the asset tables in MariaDB
+type SQLAssetStore struct {
+	db *sql.DB
+}
+
+// NewSQLAssetStore checks that the schema has the changes in migrations/
+func NewSQLAssetStore(db *sql.DB) (*SQLAssetStore, error) {
+	var origin, precision int
+	err := db.QueryRow(`
+		SELECT
+			COUNT(CASE WHEN TABLE_NAME = 'change_log' AND COLUMN_NAME = 'origin' THEN 1 END),
+			COALESCE(MAX(CASE WHEN TABLE_NAME = 'asset_inventory' AND COLUMN_NAME = 'modified' THEN DATETIME_PRECISION END), 0)
+		FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE()
+	`).Scan(&origin, &precision)
+	if err != nil {
+		return nil, fmt.Errorf("check schema: %w", err)
+	}
+	if origin == 0 {
+		return nil, fmt.Errorf("change_log.origin is missing; apply migrations/001_change_log_origin.sql")
+	}
+	if precision < 6 {
+		return nil, fmt.Errorf("asset_inventory.modified has no microseconds; apply migrations/002_asset_modified_microseconds.sql")
+	}
+	return &SQLAssetStore{db: db}, nil
+}
+
+func (s *SQLAssetStore) ChangeLogHead() (int64, error) {
+	var id int64
+	err := s.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM change_log").Scan(&id)
+	return id, err
+}
+
+func (s *SQLAssetStore) ChangeLogAfter(id int64, also []int64, limit int) ([]ChangeLogRow, error) {
+	where := "cl.id > ?"
+	args := []interface{}{id}
+	if len(also) > 0 {
+		placeholders := make([]string, 0, len(also))
+		for _, id := range also {
+			placeholders = append(placeholders, "?")
+			args = append(args, id)
+		}
+		where += " OR cl.id IN (" + strings.Join(placeholders, ",") + ")"
+	}
+	args = append(args, limit)
+
+	rows, err := s.db.Query(`
+		SELECT cl.id, cl.asset_id, cl.column_name, cl.new_value, cl.action, cl.modified_by,
+			COALESCE(DATE_FORMAT(ai.modified, '%Y-%m-%d %H:%i:%s.%f'), ''), COALESCE(cl.origin, '')
+		FROM change_log cl
+		LEFT JOIN asset_inventory ai ON ai.id = cl.asset_id
+		WHERE `+where+`
+		ORDER BY cl.id
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []ChangeLogRow
+	for rows.Next() {
+		var row ChangeLogRow
+		var newValue, modifiedBy sql.NullString
+		if err := rows.Scan(&row.ID, &row.AssetID, &row.Column, &newValue, &row.Action, &modifiedBy, &row.ModifiedAt, &row.Origin); err != nil {
+			return nil, err
+		}
+		if newValue.Valid {
+			row.NewValue = &newValue.String
+		}
+		row.ModifiedBy = modifiedBy.String
+		batch = append(batch, row)
+	}
+	return batch, rows.Err()
+}
+
+func (s *SQLAssetStore) LookupName(table, column, id string) (*string, error) {
+	var name sql.NullString
+	err := s.db.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", column, table), id).Scan(&name)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if !name.Valid {
+		return nil, nil
+	}
+	return &name.String, nil
+}
+
+func (s *SQLAssetStore) RowExists(table, id string) (bool, error) {
+	var found int
+	err := s.db.QueryRow(fmt.Sprintf("SELECT 1 FROM %s WHERE id = ?", table), id).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// MemoryAssetStore keeps assets and their change_log in memory. It is the
+// store the tests run the hub against; it has no lookup tables, only the
+// bare ids added with AddRow.
+type MemoryAssetStore struct {
+	assets map[string]*memoryAsset
+	rows   map[string]bool
+	// Committed change_log rows by id; ids are taken in order but may
+	// commit out of it (see StartChange)
+	changeLog []ChangeLogRow
+	lastID    int64
+	mutex     sync.Mutex
+}
+
+type memoryAsset struct {
+	values     map[string]*string
+	modified   string
+	modifiedBy string
+}
+
+func NewMemoryAssetStore() *MemoryAssetStore {
+	return &MemoryAssetStore{assets: make(map[string]*memoryAsset), rows: make(map[string]bool)}
+}
+
+// AddRow makes RowExists find id in table; assets are found in
+// asset_inventory without it
+func (s *MemoryAssetStore) AddRow(table, id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rows[table+":"+id] = true
+}
+
+// AddAsset creates or replaces an asset with the given grid values
+func (s *MemoryAssetStore) AddAsset(assetID string, values map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	asset := &memoryAsset{values: make(map[string]*string), modified: memoryNow()}
+	for key, value := range values {
+		value := value
+		asset.values[key] = &value
+	}
+	s.assets[assetID] = asset
+}
+
+// Value returns an asset's current grid value, nil for NULL or unknown
+func (s *MemoryAssetStore) Value(assetID, key string) *string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if asset, ok := s.assets[assetID]; ok {
+		return asset.values[key]
+	}
+	return nil
+}
+
+// LogChange writes a cell the way the other writers do: the asset and a
+// change_log row without an origin
+func (s *MemoryAssetStore) LogChange(assetID, key string, value *string, modifiedBy string) {
+	s.StartChange(assetID, key, value, modifiedBy)()
+}
+
+// StartChange is LogChange in a transaction that takes its change_log id
+// now and commits when the returned func is called, like an auto-increment
+// insert that commits after a later one
+func (s *MemoryAssetStore) StartChange(assetID, key string, value *string, modifiedBy string) (commit func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastID++
+	logID := s.lastID
+
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		asset := s.assets[assetID]
+		asset.values[key] = value
+		asset.modified = memoryNow()
+		asset.modifiedBy = modifiedBy
+
+		id, _ := strconv.ParseInt(assetID, 10, 64)
+		s.insertChangeLog(ChangeLogRow{
+			ID:         logID,
+			AssetID:    id,
+			Column:     key,
+			NewValue:   value,
+			Action:     "update",
+			ModifiedBy: modifiedBy,
+			ModifiedAt: asset.modified,
+		})
+	}
+}
+
+// insertChangeLog adds a committed row in id order
+func (s *MemoryAssetStore) insertChangeLog(row ChangeLogRow) {
+	i := sort.Search(len(s.changeLog), func(i int) bool { return s.changeLog[i].ID > row.ID })
+	s.changeLog = append(s.changeLog, ChangeLogRow{})
+	copy(s.changeLog[i+1:], s.changeLog[i:])
+	s.changeLog[i] = row
+}
+
+// Modified returns an asset's modified time, what a commit is based on
+func (s *MemoryAssetStore) Modified(assetID string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if asset, ok := s.assets[assetID]; ok {
+		return asset.modified
+	}
+	return ""
+}
+
+func (s *MemoryAssetStore) CommitAssetChanges(changes []protocol.CommitChange, modifiedBy, origin string) (*CommitResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var conflicts []protocol.CellConflict
+	for _, change := range changes {
+		asset, ok := s.assets[change.AssetID.String()]
+		if !ok {
+			return nil, protocol.Rejectf(protocol.CodeNotFound, "Asset %s does not exist", change.AssetID)
+		}
+		if change.BaseModified != asset.modified {
+			conflicts = append(conflicts, protocol.CellConflict{
+				AssetID:    change.AssetID,
+				Key:        change.Key,
+				Value:      asset.values[change.Key],
+				Modified:   asset.modified,
+				ModifiedBy: asset.modifiedBy,
+				ChangedKey: s.changedKey(change),
+			})
+		}
+	}
+	if len(conflicts) > 0 {
+		return nil, &CommitConflictError{Conflicts: conflicts}
+	}
+
+	modified := memoryNow()
+	result := &CommitResult{Changes: make([]CommittedChange, 0, len(changes)), Modified: modified}
+	for _, change := range changes {
+		assetID := change.AssetID.String()
+		asset := s.assets[assetID]
+		oldValue := asset.values[change.Key]
+		asset.values[change.Key] = change.Value
+		asset.modified = modified
+		asset.modifiedBy = modifiedBy
+
+		id, _ := strconv.ParseInt(assetID, 10, 64)
+		s.lastID++
+		row := ChangeLogRow{
+			ID:         s.lastID,
+			AssetID:    id,
+			Column:     change.Key,
+			NewValue:   change.Value,
+			Action:     "update",
+			ModifiedBy: modifiedBy,
+			ModifiedAt: modified,
+			Origin:     origin,
+		}
+		s.insertChangeLog(row)
+
+		change.BaseModified = ""
+		result.Changes = append(result.Changes, CommittedChange{CommitChange: change, OldValue: oldValue})
+	}
+	return result, nil
+}
+
+// changedKey picks the change_log row that moved a conflicting change's
+// asset on, the way findCommitConflicts does: the cell's own if it changed
+// since the base, else the newest
+func (s *MemoryAssetStore) changedKey(change protocol.CommitChange) string {
+	id, _ := strconv.ParseInt(change.AssetID.String(), 10, 64)
+	changed := ""
+	for i := len(s.changeLog) - 1; i >= 0; i-- {
+		row := s.changeLog[i]
+		if row.AssetID != id || row.ModifiedAt <= change.BaseModified {
+			continue
+		}
+		if row.Column == change.Key {
+			return row.Column
+		}
+		if changed == "" {
+			changed = row.Column
+		}
+	}
+	return changed
+}
+
+func (s *MemoryAssetStore) ChangeLogHead() (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.changeLog) == 0 {
+		return 0, nil
+	}
+	return s.changeLog[len(s.changeLog)-1].ID, nil
+}
+
+func (s *MemoryAssetStore) ChangeLogAfter(id int64, also []int64, limit int) ([]ChangeLogRow, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	wanted := make(map[int64]bool, len(also))
+	for _, id := range also {
+		wanted[id] = true
+	}
+	var batch []ChangeLogRow
+	for _, row := range s.changeLog {
+		if len(batch) == limit {
+			break
+		}
+		if row.ID > id || wanted[row.ID] {
+			batch = append(batch, row)
+		}
+	}
+	return batch, nil
+}
+
+func (s *MemoryAssetStore) LookupName(table, column, id string) (*string, error) {
+	return nil, nil
+}
+
+func (s *MemoryAssetStore) RowExists(table, id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if table == "asset_inventory" && s.assets[id] != nil {
+		return true, nil
+	}
+	return s.rows[table+":"+id], nil
+}
+
+// memoryNow formats the current time like the grid's modified column
+func memoryNow() string {
+	return time.Now().Format("2006-01-02 15:04:05.000000")
+}
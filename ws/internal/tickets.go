@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ticketTTL is how long a ticket can open a connection after it is issued
+const ticketTTL = 30 * time.Second
+
+// sessionCookie is the SvelteKit session cookie
+const sessionCookie = "sessionId"
+
+// Ticket lets one websocket upgrade authenticate as a session without the
+// session id appearing in the URL
+type Ticket struct {
+	SessionID string
+	// Origin the ticket was issued to; the upgrade must come from it too
+	Origin    string
+	ExpiresAt time.Time
+}
+
+// TicketStore keeps issued tickets until they are redeemed or expire.
+// Tickets are stored under the hash of their id, so the store never holds
+// anything that opens a connection by itself.
+type TicketStore interface {
+	// Issue stores a ticket for ticketTTL
+	Issue(hash string, ticket Ticket) error
+	// Redeem removes and returns a live ticket, or nil when it is unknown,
+	// expired or already redeemed
+	Redeem(hash string) (*Ticket, error)
+}
+
+// MemoryTicketStore keeps tickets in process. It is the default for a
+// single instance.
+type MemoryTicketStore struct {
+	tickets map[string]Ticket
+	mutex   sync.Mutex
+}
+
+func NewMemoryTicketStore() *MemoryTicketStore {
+	return &MemoryTicketStore{tickets: make(map[string]Ticket)}
+}
+
+func (s *MemoryTicketStore) Issue(hash string, ticket Ticket) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for key, existing := range s.tickets {
+		if !now.Before(existing.ExpiresAt) {
+			delete(s.tickets, key)
+		}
+	}
+	ticket.ExpiresAt = now.Add(ticketTTL)
+	s.tickets[hash] = ticket
+	return nil
+}
+
+func (s *MemoryTicketStore) Redeem(hash string) (*Ticket, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ticket, ok := s.tickets[hash]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.tickets, hash)
+	if !time.Now().Before(ticket.ExpiresAt) {
+		return nil, nil
+	}
+	return &ticket, nil
+}
+
+// hashTicket is the key a ticket id is stored under
+func hashTicket(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// ServeTicket issues a single-use ticket for opening the websocket. Callers
+// authenticate like the admin API, with their session as a Bearer token or
+// the session cookie, from an allowed origin. The ticket only opens a
+// connection from that same origin, within ticketTTL.
+func (h *Hub) ServeTicket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, "Use POST")
+		return
+	}
+
+	origin := r.Header.Get("Origin")
+	if !h.originAllowed(origin) {
+		log.Printf("[Ticket] Origin rejected: %s", origin)
+		writeJSONError(w, http.StatusForbidden, "Origin not allowed")
+		return
+	}
+
+	sessionID := requestSessionID(r)
+	if sessionID == "" {
+		writeJSONError(w, http.StatusUnauthorized, "Missing session")
+		return
+	}
+	userInfo, err := h.ValidateSession(sessionID)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidSession) {
+			log.Printf("[Ticket] Session check failed: %v", err)
+		}
+		writeJSONError(w, http.StatusUnauthorized, "Invalid session")
+		return
+	}
+
+	id, err := newTicketID()
+	if err == nil {
+		err = h.tickets.Issue(hashTicket(id), Ticket{SessionID: sessionID, Origin: origin})
+	}
+	if err != nil {
+		log.Printf("[Ticket] Failed to issue ticket for %s: %v", userInfo.Username, err)
+		writeJSONError(w, http.StatusInternalServerError, "Could not issue ticket")
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"ticket":      id,
+		"expiresInMs": ticketTTL.Milliseconds(),
+	})
+}
+
+func newTicketID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// upgradeSession finds the session a websocket upgrade authenticates with:
+// a ticket from ServeTicket, the session cookie, or, only when
+// AllowQuerySession is set, the session_id query parameter
+func (h *Hub) upgradeSession(r *http.Request) (string, error) {
+	query := r.URL.Query()
+
+	if id := query.Get("ticket"); id != "" {
+		ticket, err := h.tickets.Redeem(hashTicket(id))
+		if err != nil {
+			return "", fmt.Errorf("redeem ticket: %w", err)
+		}
+		if ticket == nil {
+			return "", errors.New("unknown, expired or used ticket")
+		}
+		if origin := r.Header.Get("Origin"); origin != ticket.Origin {
+			return "", fmt.Errorf("ticket issued to %s used from %s", ticket.Origin, origin)
+		}
+		return ticket.SessionID, nil
+	}
+
+	if cookie, err := r.Cookie(sessionCookie); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+
+	if sessionID := query.Get("session_id"); sessionID != "" {
+		if !h.config.AllowQuerySession {
+			return "", errors.New("session_id in the URL is disabled")
+		}
+		return sessionID, nil
+	}
+	return "", errors.New("missing session")
+}
+
+// requestSessionID reads the session from the Authorization header or cookie
+func requestSessionID(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
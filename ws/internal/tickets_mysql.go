@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// MySQLTicketStore keeps tickets in the ws_tickets table, so a ticket
+// issued by one instance opens a connection on any other
+type MySQLTicketStore struct {
+	db *sql.DB
+}
+
+// NewMySQLTicketStore creates the ws_tickets table if it is missing
+func NewMySQLTicketStore(db *sql.DB) (*MySQLTicketStore, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS ws_tickets (
+			hash CHAR(64) NOT NULL PRIMARY KEY,
+			session_id VARCHAR(255) NOT NULL,
+			origin VARCHAR(255) NOT NULL,
+			expires_at DATETIME(6) NOT NULL,
+			KEY idx_ws_tickets_expires (expires_at)
+		)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("create ws_tickets: %w", err)
+	}
+	return &MySQLTicketStore{db: db}, nil
+}
+
+// Issue also clears out tickets nobody redeemed
+func (s *MySQLTicketStore) Issue(hash string, ticket Ticket) error {
+	if _, err := s.db.Exec("DELETE FROM ws_tickets WHERE expires_at <= NOW(6)"); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO ws_tickets (hash, session_id, origin, expires_at)
+		VALUES (?, ?, ?, NOW(6) + INTERVAL ? MICROSECOND)
+	`, hash, ticket.SessionID, ticket.Origin, ticketTTL.Microseconds())
+	return err
+}
+
+// Redeem only succeeds for the caller whose DELETE removes the row, so two
+// instances racing for one ticket cannot both use it
+func (s *MySQLTicketStore) Redeem(hash string) (*Ticket, error) {
+	var ticket Ticket
+	err := s.db.QueryRow(`
+		SELECT session_id, origin, expires_at
+		FROM ws_tickets
+		WHERE hash = ? AND expires_at > NOW(6)
+	`, hash).Scan(&ticket.SessionID, &ticket.Origin, &ticket.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.db.Exec("DELETE FROM ws_tickets WHERE hash = ?", hash)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return nil, err
+	}
+	return &ticket, nil
+}
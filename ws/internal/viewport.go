@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"log"
+	"sort"
+
+	"asset-ws/internal/protocol"
+)
+
+// A client that sends VIEWPORT only gets the cell lock, pending and cursor
+// events of the assets it has rendered; BroadcastInView skips it for the
+// rest. Commits, row locks and everything else still reach it. What it
+// missed about an asset is sent when the asset comes back into view.
+
+// inView reports whether the client has one of assets in its viewport.
+// Events about no asset in particular are always in view.
+func (c *Client) inView(assets []string) bool {
+	view := c.viewport.Load()
+	if view == nil || len(assets) == 0 {
+		return true
+	}
+	for _, assetID := range assets {
+		if (*view)[assetID] {
+			return true
+		}
+	}
+	return false
+}
+
+// handleViewport replaces the client's viewport and sends the state of the
+// assets that came into view
+func (c *Client) handleViewport(p *protocol.Viewport) {
+	var next *map[string]bool
+	if len(p.AssetIDs) > 0 {
+		view := make(map[string]bool, len(p.AssetIDs))
+		for _, assetID := range p.AssetIDs {
+			view[assetID.String()] = true
+		}
+		next = &view
+	}
+
+	// No broadcast may reach the client between the swap and the state
+	// sent below
+	rooms := c.roomList()
+	paused, resume := c.hub.pauseRooms(rooms)
+	defer resume()
+
+	prev := c.viewport.Swap(next)
+	if prev == nil {
+		// Nothing was filtered out so far
+		return
+	}
+
+	if next == nil {
+		// Every asset comes into view
+		for _, r := range paused {
+			c.hub.sendExistingUsers(c, r)
+		}
+		return
+	}
+
+	var shown []string
+	for assetID := range *next {
+		if !(*prev)[assetID] {
+			shown = append(shown, assetID)
+		}
+	}
+	if len(shown) > 0 && len(rooms) > 0 {
+		sort.Strings(shown)
+		c.hub.sendViewportState(c, rooms, shown)
+	}
+}
+
+// sendViewportState sends the locked and pending cells of shown, as seen
+// from rooms, along with every cursor. Callers pause rooms.
+func (h *Hub) sendViewportState(client *Client, rooms []string, shown []string) {
+	inView := make(map[string]bool, len(shown))
+	for _, assetID := range shown {
+		inView[assetID] = true
+	}
+	users, locked, pending := h.cellState(client, func(from string) bool {
+		for _, room := range rooms {
+			if roomReaches(from, room) {
+				return true
+			}
+		}
+		return false
+	}, func(assetID string) bool {
+		return inView[assetID]
+	})
+
+	state := protocol.ViewportState{
+		AssetIDs:     make([]protocol.ID, len(shown)),
+		Users:        users,
+		LockedCells:  locked,
+		PendingCells: pending,
+	}
+	for i, assetID := range shown {
+		state.AssetIDs[i] = protocol.ID(assetID)
+	}
+
+	if !h.deliver(client, newOutbound(protocol.Message{Type: protocol.TypeViewportState, Payload: state})) {
+		log.Printf("Failed to send %s to %s (buffer full)", protocol.TypeViewportState, client.userInfo.Username)
+	}
+}
+
+// cursorAssets is what a cursor move is about: the asset it moved to and
+// the one it left. A cursor on no asset is shown to everyone.
+func cursorAssets(assetID, prevAssetID string) []string {
+	if assetID == "" {
+		return nil
+	}
+	if prevAssetID == "" || prevAssetID == assetID {
+		return []string{assetID}
+	}
+	return []string{assetID, prevAssetID}
+}
+
+// cellAssets returns the distinct assets of cells
+func cellAssets(cells []protocol.CellRef) []string {
+	seen := make(map[string]bool, len(cells))
+	var assets []string
+	for _, cell := range cells {
+		if assetID := cell.AssetID.String(); !seen[assetID] {
+			seen[assetID] = true
+			assets = append(assets, assetID)
+		}
+	}
+	return assets
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"asset-ws/internal"
+	"asset-ws/internal/binlog"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/joho/godotenv"
@@ -70,9 +76,180 @@ func main() {
 		allowedOrigins[i] = strings.TrimSpace(allowedOrigins[i])
 	}
 
+	// How long a dropped client's locks survive for it to reconnect
+	reconnectGrace := 20 * time.Second
+	if v := os.Getenv("WS_RECONNECT_GRACE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("❌ Invalid WS_RECONNECT_GRACE %q: want a duration like 20s, or 0 to disable", v)
+		}
+		reconnectGrace = d
+	}
+
+	// How often to look for changes written outside the hub
+	changeLogPoll := 2 * time.Second
+	if v := os.Getenv("WS_CHANGELOG_POLL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("❌ Invalid WS_CHANGELOG_POLL %q: want a duration like 2s, or 0 to disable", v)
+		}
+		changeLogPoll = d
+	}
+
+	// How often to disconnect clients whose session was logged out or expired
+	sessionRevalidate := time.Minute
+	if v := os.Getenv("WS_SESSION_REVALIDATE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("❌ Invalid WS_SESSION_REVALIDATE %q: want a duration like 1m, or 0 to disable", v)
+		}
+		sessionRevalidate = d
+	}
+
+	// Optional binlog change-data-capture feed. It sees every write, so it
+	// replaces the change_log watcher when enabled.
+	var rowFeed internal.RowFeed
+	if os.Getenv("WS_BINLOG_ENABLED") == "true" {
+		serverID := uint64(4242)
+		if v := os.Getenv("WS_BINLOG_SERVER_ID"); v != "" {
+			id, err := strconv.ParseUint(v, 10, 32)
+			if err != nil || id == 0 {
+				log.Fatalf("❌ Invalid WS_BINLOG_SERVER_ID %q: want a positive id unused by any replica", v)
+			}
+			serverID = id
+		}
+		binlogUser := os.Getenv("WS_BINLOG_USER")
+		binlogPassword := os.Getenv("WS_BINLOG_PASSWORD")
+		if binlogUser == "" {
+			binlogUser, binlogPassword = dbUser, dbPassword
+		}
+
+		rowFeed = binlog.NewStream(binlog.Config{
+			Addr:     net.JoinHostPort(dbHost, dbPort),
+			User:     binlogUser,
+			Password: binlogPassword,
+			ServerID: uint32(serverID),
+			Schema:   dbName,
+			Tables:   internal.BinlogTables(),
+		}, db)
+
+		changeLogPoll = 0
+		log.Printf("📡 Binlog feed enabled as replica server id %d", serverID)
+	}
+
+	// How long a SIGTERM waits for clients to drain before exiting
+	shutdownTimeout := 15 * time.Second
+	if v := os.Getenv("WS_SHUTDOWN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("❌ Invalid WS_SHUTDOWN_TIMEOUT %q: want a duration like 15s", v)
+		}
+		shutdownTimeout = d
+	}
+
+	// Metrics are served on their own listener, outside CORS and the public
+	// port. The default sits next to the public port (9090 is Prometheus's
+	// own) and only accepts local scrapes; set WS_METRICS_ADDR to an
+	// interface Prometheus can reach, or "off" to disable.
+	metricsAddr := os.Getenv("WS_METRICS_ADDR")
+	if metricsAddr == "" {
+		metricsAddr = "127.0.0.1:8081"
+	}
+
+	// Old clients connect with ?session_id=, which leaks the session into
+	// proxy logs. Only accept it while they are being rolled out.
+	allowQuerySession := os.Getenv("WS_ALLOW_QUERY_SESSION") == "true"
+	if allowQuerySession {
+		log.Println("⚠️  Accepting session_id in the WebSocket URL (WS_ALLOW_QUERY_SESSION)")
+	}
+
+	// What to do with a client that cannot keep up with its messages
+	slowClients := internal.SlowClientCoalesce
+	switch v := internal.SlowClientPolicy(os.Getenv("WS_SLOW_CLIENTS")); v {
+	case "", internal.SlowClientCoalesce:
+	case internal.SlowClientDisconnect:
+		slowClients = v
+	default:
+		log.Fatalf("❌ Invalid WS_SLOW_CLIENTS %q: want coalesce or disconnect", v)
+	}
+
+	// permessage-deflate for clients that offer it, for messages of at least
+	// WS_COMPRESSION_MIN_SIZE bytes. Level 0 turns it off.
+	compressionLevel := 1
+	if v := os.Getenv("WS_COMPRESSION_LEVEL"); v != "" {
+		level, err := strconv.Atoi(v)
+		if err != nil || level < 0 || level > 9 {
+			log.Fatalf("❌ Invalid WS_COMPRESSION_LEVEL %q: want 1 (fastest) to 9 (smallest), or 0 to disable", v)
+		}
+		compressionLevel = level
+	}
+	compressionMinSize := 1024
+	if v := os.Getenv("WS_COMPRESSION_MIN_SIZE"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 0 {
+			log.Fatalf("❌ Invalid WS_COMPRESSION_MIN_SIZE %q: want a size in bytes like 1024", v)
+		}
+		compressionMinSize = size
+	}
+
+	// Several instances behind one load balancer share state through the
+	// database. Each needs its own WS_INSTANCE_ID (and WS_BINLOG_SERVER_ID
+	// when the binlog feed is on).
+	instanceID := os.Getenv("WS_INSTANCE_ID")
+	if instanceID == "" {
+		hostname, _ := os.Hostname()
+		instanceID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	if len(instanceID) > 64 {
+		log.Fatalf("❌ Invalid WS_INSTANCE_ID %q: at most 64 characters", instanceID)
+	}
+
+	var backplane internal.Backplane
+	var locks internal.LockStore
+	var tickets internal.TicketStore
+	switch v := os.Getenv("WS_BACKPLANE"); v {
+	case "", "memory":
+		log.Println("🧍 Running as a single instance")
+	case "mysql":
+		mysqlBackplane, err := internal.NewMySQLBackplane(db)
+		if err != nil {
+			log.Fatalf("❌ Failed to set up the MySQL backplane: %v", err)
+		}
+		mysqlLocks, err := internal.NewMySQLLockStore(db)
+		if err != nil {
+			log.Fatalf("❌ Failed to set up the MySQL lock store: %v", err)
+		}
+		mysqlTickets, err := internal.NewMySQLTicketStore(db)
+		if err != nil {
+			log.Fatalf("❌ Failed to set up the MySQL ticket store: %v", err)
+		}
+		backplane, locks, tickets = mysqlBackplane, mysqlLocks, mysqlTickets
+		log.Printf("🔗 Clustered through MySQL as instance %s", instanceID)
+	default:
+		log.Fatalf("❌ Invalid WS_BACKPLANE %q: want memory or mysql", v)
+	}
+
 	// Realtime WebSocket Hub with database connection
 	log.Println("🔌 Initializing WebSocket hub...")
-	hub := internal.NewHub(db, allowedOrigins)
+	assets, err := internal.NewSQLAssetStore(db)
+	if err != nil {
+		log.Fatalf("❌ Failed to set up the asset store: %v", err)
+	}
+	hub := internal.NewHub(internal.NewSQLSessionValidator(db), assets, internal.HubConfig{
+		AllowedOrigins:     allowedOrigins,
+		ReconnectGrace:     reconnectGrace,
+		ChangeLogPoll:      changeLogPoll,
+		RowFeed:            rowFeed,
+		InstanceID:         instanceID,
+		Backplane:          backplane,
+		Locks:              locks,
+		SessionRevalidate:  sessionRevalidate,
+		Tickets:            tickets,
+		AllowQuerySession:  allowQuerySession,
+		SlowClients:        slowClients,
+		CompressionLevel:   compressionLevel,
+		CompressionMinSize: compressionMinSize,
+	})
 	go hub.Run()
 	log.Println("✅ WebSocket hub running")
 
@@ -84,6 +261,12 @@ func main() {
 		hub.ServeWs(w, r)
 	})
 
+	// Single-use tickets that open /api/ws without a session in the URL
+	r.HandleFunc("/api/ws/ticket", hub.ServeTicket)
+
+	// Hub state and session recheck for admins
+	r.Handle("/api/ws/admin/", hub.AdminHandler())
+
 	log.Println("✅ Routes configured")
 
 	// CORS setup
@@ -110,9 +293,59 @@ func main() {
 	log.Println("✅ Server ready!")
 	log.Println("📍 Listening on: http://localhost:8080")
 	log.Println("🔌 WebSocket endpoint: ws://localhost:8080/api/ws")
+	if metricsAddr != "off" {
+		log.Printf("📊 Metrics endpoint: http://%s/metrics", metricsAddr)
+	}
 	log.Println("========================================")
 
-	if err := srv.ListenAndServe(); err != nil {
+	serverErr := make(chan error, 2)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	var metricsSrv *http.Server
+	if metricsAddr != "off" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", hub.MetricsHandler())
+		metricsSrv = &http.Server{
+			Addr:         metricsAddr,
+			Handler:      metricsMux,
+			ReadTimeout:  15 * time.Second,
+			WriteTimeout: 15 * time.Second,
+		}
+		go func() {
+			serverErr <- metricsSrv.ListenAndServe()
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+
+	select {
+	case err := <-serverErr:
 		log.Fatalf("❌ Server failed: %v", err)
+	case sig := <-stop:
+		log.Printf("🛑 Received %s, shutting down (timeout %s)...", sig, shutdownTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Drain the hub first: hijacked WebSocket connections are not tracked
+	// by http.Server, and new upgrades are refused while it drains
+	if err := hub.Shutdown(ctx); err != nil {
+		log.Printf("⚠️  Hub did not drain cleanly: %v", err)
+	} else {
+		log.Println("✅ WebSocket clients drained")
+	}
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("⚠️  HTTP server shutdown: %v", err)
+	}
+	if metricsSrv != nil {
+		if err := metricsSrv.Shutdown(ctx); err != nil {
+			log.Printf("⚠️  Metrics server shutdown: %v", err)
+		}
 	}
+	log.Println("👋 Server stopped")
 }
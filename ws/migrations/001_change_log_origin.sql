@@ -0,0 +1,4 @@
+-- Hub instance that wrote a change_log row. The ChangeLogWatcher skips rows
+-- with an origin, since the hub that wrote them already broadcast the
+-- change. Every other writer leaves it NULL.
+ALTER TABLE change_log ADD COLUMN IF NOT EXISTS origin VARCHAR(64) NULL;
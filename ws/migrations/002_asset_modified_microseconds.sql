@@ -0,0 +1,5 @@
+-- Commits are refused when the asset changed after the client loaded it,
+-- by comparing modified. With whole seconds two commits in the same second
+-- look alike and the second silently overwrites the first.
+ALTER TABLE asset_inventory
+    MODIFY modified DATETIME(6) NOT NULL DEFAULT current_timestamp(6) ON UPDATE current_timestamp(6);